@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"nats-limiter-proxy/internal/creds"
+)
+
+func main() {
+	dir := flag.String("dir", "local/nsc/nkeys/creds/root/app", "Directory to write <user>.creds files to")
+	resolver := flag.String("resolver", "local/nats/resolver.conf", "Path of the nats-server resolver config to write")
+	account := flag.String("account", "app", "Name of the account users are created in")
+	users := flag.String("users", "admin,alice,bob", "Comma-separated list of users to create")
+	flag.Parse()
+
+	env, err := creds.NewEnvironment("root", *account)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create operator and accounts")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(*resolver), 0o755); err != nil {
+		log.Fatal().Err(err).Msg("Failed to create resolver config directory")
+	}
+	if err := os.WriteFile(*resolver, []byte(env.ResolverConfig()), 0o644); err != nil {
+		log.Fatal().Err(err).Msg("Failed to write resolver config")
+	}
+	log.Info().Str("path", *resolver).Msg("Wrote resolver config")
+
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		log.Fatal().Err(err).Msg("Failed to create creds directory")
+	}
+	for _, user := range strings.Split(*users, ",") {
+		user = strings.TrimSpace(user)
+		if user == "" {
+			continue
+		}
+		content, err := env.UserCreds(user)
+		if err != nil {
+			log.Fatal().Err(err).Str("user", user).Msg("Failed to create user")
+		}
+		path := filepath.Join(*dir, user+".creds")
+		if err := os.WriteFile(path, content, 0o600); err != nil {
+			log.Fatal().Err(err).Str("path", path).Msg("Failed to write creds")
+		}
+		log.Info().Str("user", user).Str("path", path).Msg("Wrote creds")
+	}
+}
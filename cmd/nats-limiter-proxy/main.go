@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -11,9 +16,19 @@ import (
 
 const (
 	localPort = 4223
+	// shutdownTimeout is how long open connections may drain on shutdown.
+	shutdownTimeout = 10 * time.Second
 )
 
 func main() {
+	showVersion := flag.Bool("version", false, "Print version information and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(server.VersionString())
+		return
+	}
+
 	// Configure zerolog
 	logLevel, err := zerolog.ParseLevel(os.Getenv("LOG_LEVEL"))
 	if err != nil {
@@ -37,12 +52,38 @@ func main() {
 		log.Fatal().Str("port", portStr).Msg("Invalid UPSTREAM_PORT value")
 	}
 
+	log.Info().Str("version", server.Version).Str("commit", server.Commit).Msg("Starting nats-limiter-proxy")
+
 	proxy, err := server.NewProxy(upstreamHost, upstreamPort, "config.yaml")
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create proxy")
 	}
 
-	if err := proxy.Start(localPort); err != nil {
+	listeners, err := server.SystemdListeners()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to use systemd sockets")
+	}
+	var srv *server.Server
+	if len(listeners) > 0 {
+		if len(listeners) > 1 {
+			log.Warn().Int("sockets", len(listeners)).Msg("Serving only the first systemd socket")
+			for _, l := range listeners[1:] {
+				l.Close()
+			}
+		}
+		srv = server.NewServerWithListener(proxy, listeners[0])
+	} else if srv, err = server.NewServer(proxy, fmt.Sprintf(":%d", localPort)); err != nil {
+		log.Fatal().Err(err).Msg("Failed to start proxy")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := srv.Run(ctx); err != nil {
 		log.Fatal().Err(err).Msg("Proxy failed")
 	}
+
+	log.Info().Dur("timeout", shutdownTimeout).Msg("Shutting down")
+	if err := srv.Stop(shutdownTimeout); err != nil {
+		log.Warn().Err(err).Msg("Connections didn't drain before shutdown")
+	}
 }
@@ -0,0 +1,219 @@
+// Command throughput-tester publishes through the proxy and verifies the
+// achieved throughput matches the configured limit.
+//
+// With --scenario, it instead runs the mixed workload described in a
+// scenario file and grades each user's outcome (see scenario.go). With
+// --transparency, it verifies protocol features behave identically through the
+// proxy and, given --direct, directly against the upstream (see transparency.go).
+//
+// Example, checking alice's 5MB/s limit holds across 4 TLS connections:
+//
+//	throughput-tester --server nats://localhost:4223 --creds local/nsc/nkeys/creds/root/app/alice.creds \
+//	    --conns 4 --expected 5242880 --tls --tlsca local/ca.pem
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type options struct {
+	server    string
+	creds     string
+	subject   string
+	size      int
+	msgs      int
+	conns     int
+	expected  float64
+	tolerance float64
+
+	tls      bool
+	tlsFirst bool
+	tlsCA    string
+	tlsCert  string
+	tlsKey   string
+}
+
+func main() {
+	var o options
+	flag.StringVar(&o.server, "server", "nats://localhost:4223", "Proxy URL")
+	flag.StringVar(&o.creds, "creds", "", "User creds file")
+	flag.StringVar(&o.subject, "subject", "throughput.test", "Subject to publish to")
+	flag.IntVar(&o.size, "size", 1024, "Message payload size in bytes")
+	flag.IntVar(&o.msgs, "msgs", 10000, "Number of messages to publish per connection")
+	flag.IntVar(&o.conns, "conns", 1, "Number of concurrent connections of the user")
+	flag.Float64Var(&o.expected, "expected", 0, "Expected aggregate bytes/second, 0 only reports the result")
+	flag.Float64Var(&o.tolerance, "tolerance", 0.2, "Allowed relative deviation from --expected")
+	flag.BoolVar(&o.tls, "tls", false, "Connect using TLS")
+	flag.BoolVar(&o.tlsFirst, "tlsfirst", false, "Perform the TLS handshake before the server's INFO")
+	flag.StringVar(&o.tlsCA, "tlsca", "", "CA certificate to verify the proxy with")
+	flag.StringVar(&o.tlsCert, "tlscert", "", "Client certificate for mutual TLS")
+	flag.StringVar(&o.tlsKey, "tlskey", "", "Client key for mutual TLS")
+	scenarioFile := flag.String("scenario", "", "Scenario file to run instead of a single publish run")
+	transparency := flag.Bool("transparency", false, "Verify protocol transparency instead of throughput")
+	direct := flag.String("direct", "", "Upstream URL to compare against in --transparency mode")
+	metricsURL := flag.String("metrics", "", "Proxy metrics URL to report proxy-observed results from, e.g. http://localhost:8223/metrics")
+	flag.Parse()
+
+	if *transparency {
+		passed, err := runTransparency(&o, *direct)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if !passed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *scenarioFile != "" {
+		scenario, err := LoadScenario(*scenarioFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		report := startProxyReport(*metricsURL)
+		passed, err := runScenario(&o, scenario)
+		report()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if !passed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	report := startProxyReport(*metricsURL)
+	result, err := runPublish(&o)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(result)
+	report()
+
+	if !withinTolerance(result.rate(), o.expected, o.tolerance) {
+		fmt.Fprintf(os.Stderr, "FAIL: %.0f bytes/s is not within %.0f%% of expected %.0f bytes/s\n",
+			result.rate(), o.tolerance*100, o.expected)
+		os.Exit(1)
+	}
+}
+
+// startProxyReport scrapes the proxy's metrics before a run and returns a
+// function printing what the proxy observed since. It is a no-op without url.
+func startProxyReport(url string) func() {
+	if url == "" {
+		return func() {}
+	}
+	before, err := scrapeMetrics(url)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to scrape proxy metrics: %v\n", err)
+		return func() {}
+	}
+	return func() {
+		after, err := scrapeMetrics(url)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to scrape proxy metrics: %v\n", err)
+			return
+		}
+		printProxyReport(before, after)
+	}
+}
+
+// connect opens a connection to the proxy with the configured auth and TLS options.
+func (o *options) connect(name string) (*nats.Conn, error) {
+	opts := []nats.Option{nats.Name(name)}
+	if o.creds != "" {
+		opts = append(opts, nats.UserCredentials(o.creds))
+	}
+	if o.tls {
+		opts = append(opts, nats.Secure())
+		if o.tlsFirst {
+			opts = append(opts, nats.TLSHandshakeFirst())
+		}
+		if o.tlsCA != "" {
+			opts = append(opts, nats.RootCAs(o.tlsCA))
+		}
+		if o.tlsCert != "" {
+			opts = append(opts, nats.ClientCert(o.tlsCert, o.tlsKey))
+		}
+	}
+	return nats.Connect(o.server, opts...)
+}
+
+// publishResult is the outcome of a publish run.
+type publishResult struct {
+	bytes   int64
+	elapsed time.Duration
+	tls     bool
+}
+
+func (r publishResult) rate() float64 {
+	return float64(r.bytes) / r.elapsed.Seconds()
+}
+
+func (r publishResult) String() string {
+	return fmt.Sprintf("Published %d bytes in %s: %.0f bytes/s (tls=%t)",
+		r.bytes, r.elapsed.Round(time.Millisecond), r.rate(), r.tls)
+}
+
+// runPublish publishes from o.conns connections concurrently and measures the
+// aggregate rate until every connection has flushed.
+func runPublish(o *options) (publishResult, error) {
+	conns := make([]*nats.Conn, o.conns)
+	for i := range conns {
+		nc, err := o.connect(fmt.Sprintf("throughput-tester-%d", i))
+		if err != nil {
+			return publishResult{}, fmt.Errorf("failed to connect: %w", err)
+		}
+		defer nc.Close()
+		if o.tls {
+			// Make sure the limit is verified over TLS, not a plaintext fallback
+			if _, err := nc.TLSConnectionState(); err != nil {
+				return publishResult{}, fmt.Errorf("connection is not using TLS: %w", err)
+			}
+		}
+		conns[i] = nc
+	}
+
+	payload := make([]byte, o.size)
+	errs := make(chan error, len(conns))
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	for _, nc := range conns {
+		wg.Add(1)
+		go func(nc *nats.Conn) {
+			defer wg.Done()
+			for i := 0; i < o.msgs; i++ {
+				if err := nc.Publish(o.subject, payload); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nc.FlushTimeout(time.Hour)
+		}(nc)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return publishResult{}, fmt.Errorf("publish failed: %w", err)
+		}
+	}
+	return publishResult{
+		bytes:   int64(o.size) * int64(o.msgs) * int64(len(conns)),
+		elapsed: elapsed,
+		tls:     o.tls,
+	}, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for 127.0.0.1 and its key,
+// returning their paths. The certificate is its own CA.
+func writeCert(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey failed: %v", err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+// startTLSServer starts a minimal NATS server requiring TLS, handshaking
+// before or after its INFO, and returns its URL.
+func startTLSServer(t *testing.T, certFile, keyFile string, handshakeFirst bool) string {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair failed: %v", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	info := "INFO {\"server_id\":\"test\",\"proto\":1,\"max_payload\":1048576,\"tls_required\":true}\r\n"
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if !handshakeFirst {
+					conn.Write([]byte(info))
+				}
+				tlsConn := tls.Server(conn, config)
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				if handshakeFirst {
+					tlsConn.Write([]byte(info))
+				}
+				r := bufio.NewReader(tlsConn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch fields := strings.Fields(line); {
+					case len(fields) == 0:
+					case fields[0] == "PING":
+						tlsConn.Write([]byte("PONG\r\n"))
+					case fields[0] == "PUB":
+						size, _ := strconv.Atoi(fields[len(fields)-1])
+						io.CopyN(io.Discard, r, int64(size)+2)
+					}
+				}
+			}()
+		}
+	}()
+	return "nats://" + ln.Addr().String()
+}
+
+func TestRunPublish_TLS(t *testing.T) {
+	certFile, keyFile := writeCert(t)
+	for _, first := range []bool{false, true} {
+		o := &options{
+			server:   startTLSServer(t, certFile, keyFile, first),
+			subject:  "throughput.test",
+			size:     128,
+			msgs:     10,
+			conns:    2,
+			tls:      true,
+			tlsFirst: first,
+			tlsCA:    certFile,
+		}
+		result, err := runPublish(o)
+		if err != nil {
+			t.Fatalf("runPublish failed (tlsfirst=%t): %v", first, err)
+		}
+		if !result.tls || result.bytes != 2*10*128 {
+			t.Errorf("Expected 2560 bytes published over TLS (tlsfirst=%t), got %s", first, result)
+		}
+	}
+
+	// Without the CA the server isn't trusted
+	o := &options{server: startTLSServer(t, certFile, keyFile, false), subject: "x", size: 1, msgs: 1, conns: 1, tls: true}
+	if _, err := runPublish(o); err == nil {
+		t.Error("Expected an untrusted server refused")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Proxy metrics reconciled against client-side results.
+const (
+	metricClientBytes  = "nats_limiter_proxy_client_bytes_total"
+	metricThrottleWait = "nats_limiter_proxy_throttle_wait_seconds_total"
+)
+
+// metricsSnapshot holds per-user values of the proxy's metrics at one point in
+// time, keyed by metric name and then user.
+type metricsSnapshot struct {
+	at     time.Time
+	values map[string]map[string]float64
+}
+
+// scrapeMetrics fetches the proxy's metrics endpoint.
+func scrapeMetrics(url string) (*metricsSnapshot, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return parseMetrics(resp.Body, time.Now())
+}
+
+// parseMetrics parses the user-labelled samples of the Prometheus text format.
+func parseMetrics(r io.Reader, at time.Time) (*metricsSnapshot, error) {
+	snap := &metricsSnapshot{at: at, values: make(map[string]map[string]float64)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.LastIndexByte(line, ' ')
+		if sep < 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[sep+1:], 64)
+		if err != nil {
+			continue
+		}
+		name, labels, _ := strings.Cut(line[:sep], "{")
+		user, ok := userLabel(strings.TrimSuffix(labels, "}"))
+		if !ok {
+			continue
+		}
+		if snap.values[name] == nil {
+			snap.values[name] = make(map[string]float64)
+		}
+		snap.values[name][user] = value
+	}
+	return snap, scanner.Err()
+}
+
+// userLabel extracts the value of the user label from a label set.
+func userLabel(labels string) (string, bool) {
+	i := strings.Index(labels, `user="`)
+	if i < 0 {
+		return "", false
+	}
+	var b strings.Builder
+	rest := labels[i+len(`user="`):]
+	for j := 0; j < len(rest); j++ {
+		switch rest[j] {
+		case '\\':
+			j++
+			if j < len(rest) {
+				if rest[j] == 'n' {
+					b.WriteByte('\n')
+				} else {
+					b.WriteByte(rest[j])
+				}
+			}
+		case '"':
+			return b.String(), true
+		default:
+			b.WriteByte(rest[j])
+		}
+	}
+	return "", false
+}
+
+// delta returns the increase of a metric per user between two snapshots.
+func (s *metricsSnapshot) delta(before *metricsSnapshot, name string) map[string]float64 {
+	d := make(map[string]float64)
+	for user, v := range s.values[name] {
+		if inc := v - before.values[name][user]; inc > 0 {
+			d[user] = inc
+		}
+	}
+	return d
+}
+
+// printProxyReport prints the proxy-observed throughput and throttle wait time
+// of every user active between the two snapshots.
+func printProxyReport(before, after *metricsSnapshot) {
+	elapsed := after.at.Sub(before.at).Seconds()
+	bytes := after.delta(before, metricClientBytes)
+	wait := after.delta(before, metricThrottleWait)
+
+	users := make([]string, 0, len(bytes))
+	for user := range bytes {
+		users = append(users, user)
+	}
+	for user := range wait {
+		if _, ok := bytes[user]; !ok {
+			users = append(users, user)
+		}
+	}
+	sort.Strings(users)
+
+	fmt.Println()
+	fmt.Println("Proxy-observed:")
+	fmt.Printf("%-16s %14s %14s\n", "USER", "PROXY B/s", "THROTTLED s")
+	for _, user := range users {
+		fmt.Printf("%-16s %14.0f %14.2f\n", user, bytes[user]/elapsed, wait[user])
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMetrics(t *testing.T) {
+	input := `# HELP nats_limiter_proxy_client_bytes_total Bytes received from clients.
+# TYPE nats_limiter_proxy_client_bytes_total counter
+nats_limiter_proxy_client_bytes_total{user="alice"} 1000
+nats_limiter_proxy_client_bytes_total{user="we\"ird"} 5
+nats_limiter_proxy_throttle_wait_seconds_total{user="alice"} 1.5
+nats_limiter_proxy_other 7
+`
+	before, err := parseMetrics(strings.NewReader(input), time.Unix(0, 0))
+	if err != nil {
+		t.Fatalf("parseMetrics failed: %v", err)
+	}
+	after, _ := parseMetrics(strings.NewReader(strings.Replace(input, "} 1000", "} 3000", 1)), time.Unix(2, 0))
+
+	if got := before.values[metricClientBytes][`we"ird`]; got != 5 {
+		t.Errorf("Expected escaped user label parsed, got %v", got)
+	}
+	if got := before.values[metricThrottleWait]["alice"]; got != 1.5 {
+		t.Errorf("Expected throttle wait 1.5, got %v", got)
+	}
+	delta := after.delta(before, metricClientBytes)
+	if len(delta) != 1 || delta["alice"] != 2000 {
+		t.Errorf("Expected only alice's bytes to increase by 2000, got %v", delta)
+	}
+}
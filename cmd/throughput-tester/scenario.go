@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario describes a mixed workload of concurrent users and the outcome
+// expected from the proxy.
+type Scenario struct {
+	// Server defaults to --server.
+	Server string `yaml:"server"`
+	// Duration each publisher runs for. Defaults to 10s.
+	Duration time.Duration  `yaml:"duration"`
+	Users    []ScenarioUser `yaml:"users"`
+}
+
+// ScenarioUser is one user's workload within a scenario.
+type ScenarioUser struct {
+	Name  string `yaml:"name"`
+	Creds string `yaml:"creds"`
+	// Conns is the number of connections of the user. Defaults to 1.
+	Conns     int              `yaml:"conns"`
+	Publish   *ScenarioPublish `yaml:"publish"`
+	Subscribe []string         `yaml:"subscribe"`
+	Expect    ScenarioExpect   `yaml:"expect"`
+}
+
+// ScenarioPublish is the publishing workload of each of a user's connections.
+type ScenarioPublish struct {
+	Subject string `yaml:"subject"`
+	Size    int    `yaml:"size"`
+	// Rate in messages per second per connection, 0 publishes as fast as possible.
+	Rate int `yaml:"rate"`
+}
+
+// ScenarioExpect is the expected outcome for a user, in aggregate bytes per
+// second across its connections. Zero values aren't checked.
+type ScenarioExpect struct {
+	PublishRate float64 `yaml:"publish_rate"`
+	ReceiveRate float64 `yaml:"receive_rate"`
+	// Tolerance is the allowed relative deviation. Defaults to 0.2.
+	Tolerance float64 `yaml:"tolerance"`
+}
+
+// userResult is the measured outcome of a user's workload.
+type userResult struct {
+	published atomic.Int64
+	received  atomic.Int64
+	err       error
+}
+
+// LoadScenario reads a scenario file.
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Scenario
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario: %w", err)
+	}
+	if s.Duration <= 0 {
+		s.Duration = 10 * time.Second
+	}
+	for i := range s.Users {
+		u := &s.Users[i]
+		if u.Conns <= 0 {
+			u.Conns = 1
+		}
+		if u.Expect.Tolerance <= 0 {
+			u.Expect.Tolerance = 0.2
+		}
+		if u.Publish != nil && (u.Publish.Subject == "" || u.Publish.Size < 0) {
+			return nil, fmt.Errorf("user %q: publish requires a subject and a non-negative size", u.Name)
+		}
+	}
+	return &s, nil
+}
+
+// runScenario executes all users' workloads concurrently and grades the
+// results, returning whether every expectation held.
+func runScenario(o *options, s *Scenario) (bool, error) {
+	if s.Server != "" {
+		o.server = s.Server
+	}
+
+	results := make([]*userResult, len(s.Users))
+	conns := make([][]*nats.Conn, len(s.Users))
+	defer func() {
+		for _, userConns := range conns {
+			for _, nc := range userConns {
+				nc.Close()
+			}
+		}
+	}()
+
+	// Connect and subscribe everyone before any publisher starts
+	for i, u := range s.Users {
+		results[i] = &userResult{}
+		uo := *o
+		if u.Creds != "" {
+			uo.creds = u.Creds
+		}
+		for c := 0; c < u.Conns; c++ {
+			nc, err := uo.connect(fmt.Sprintf("%s-%d", u.Name, c))
+			if err != nil {
+				return false, fmt.Errorf("user %q: failed to connect: %w", u.Name, err)
+			}
+			conns[i] = append(conns[i], nc)
+			for _, subject := range u.Subscribe {
+				result := results[i]
+				if _, err := nc.Subscribe(subject, func(m *nats.Msg) {
+					result.received.Add(int64(len(m.Data)))
+				}); err != nil {
+					return false, fmt.Errorf("user %q: failed to subscribe: %w", u.Name, err)
+				}
+			}
+			if err := nc.Flush(); err != nil {
+				return false, fmt.Errorf("user %q: %w", u.Name, err)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(s.Duration)
+	for i, u := range s.Users {
+		if u.Publish == nil {
+			continue
+		}
+		for _, nc := range conns[i] {
+			wg.Add(1)
+			go func(nc *nats.Conn, p ScenarioPublish, result *userResult) {
+				defer wg.Done()
+				if err := publishUntil(nc, p, deadline, result); err != nil {
+					result.err = err
+				}
+			}(nc, *u.Publish, results[i])
+		}
+	}
+	wg.Wait()
+	// Give in-flight messages a moment to reach subscribers
+	time.Sleep(500 * time.Millisecond)
+	elapsed := time.Since(start).Seconds()
+
+	passed := true
+	fmt.Printf("%-16s %14s %14s  %s\n", "USER", "PUB B/s", "RECV B/s", "RESULT")
+	for i, u := range s.Users {
+		r := results[i]
+		pubRate := float64(r.published.Load()) / elapsed
+		recvRate := float64(r.received.Load()) / elapsed
+
+		verdict := "PASS"
+		switch {
+		case r.err != nil:
+			verdict = "ERROR: " + r.err.Error()
+		case !withinTolerance(pubRate, u.Expect.PublishRate, u.Expect.Tolerance):
+			verdict = fmt.Sprintf("FAIL: expected publish %.0f B/s", u.Expect.PublishRate)
+		case !withinTolerance(recvRate, u.Expect.ReceiveRate, u.Expect.Tolerance):
+			verdict = fmt.Sprintf("FAIL: expected receive %.0f B/s", u.Expect.ReceiveRate)
+		}
+		if verdict != "PASS" {
+			passed = false
+		}
+		fmt.Printf("%-16s %14.0f %14.0f  %s\n", u.Name, pubRate, recvRate, verdict)
+	}
+	return passed, nil
+}
+
+// publishUntil publishes p's messages on nc until deadline, paced to p.Rate
+// if set, then flushes.
+func publishUntil(nc *nats.Conn, p ScenarioPublish, deadline time.Time, result *userResult) error {
+	payload := make([]byte, p.Size)
+	var tick <-chan time.Time
+	if p.Rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(p.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for time.Now().Before(deadline) {
+		if tick != nil {
+			<-tick
+		}
+		if err := nc.Publish(p.Subject, payload); err != nil {
+			return err
+		}
+		result.published.Add(int64(p.Size))
+	}
+	return nc.FlushTimeout(time.Minute)
+}
+
+// withinTolerance reports whether rate is within tolerance of expected. An
+// expected rate of zero isn't checked.
+func withinTolerance(rate, expected, tolerance float64) bool {
+	if expected <= 0 {
+		return true
+	}
+	return rate >= expected*(1-tolerance) && rate <= expected*(1+tolerance)
+}
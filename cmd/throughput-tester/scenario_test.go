@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadScenario(t *testing.T) {
+	s, err := LoadScenario("../../local/scenarios/mixed.yaml")
+	if err != nil {
+		t.Fatalf("LoadScenario failed: %v", err)
+	}
+	if s.Duration != 10*time.Second {
+		t.Errorf("Expected duration 10s, got %s", s.Duration)
+	}
+	if len(s.Users) != 3 {
+		t.Fatalf("Expected 3 users, got %d", len(s.Users))
+	}
+
+	alice, bob := s.Users[0], s.Users[1]
+	if alice.Conns != 2 || alice.Publish.Size != 4096 || alice.Expect.Tolerance != 0.2 {
+		t.Errorf("Unexpected alice workload: %+v", alice)
+	}
+	if bob.Conns != 1 || len(bob.Subscribe) != 1 || bob.Expect.ReceiveRate != 5242880 {
+		t.Errorf("Unexpected bob workload: %+v", bob)
+	}
+}
+
+func TestWithinTolerance(t *testing.T) {
+	tests := []struct {
+		rate, expected float64
+		want           bool
+	}{
+		{100, 0, true},
+		{100, 100, true},
+		{85, 100, true},
+		{75, 100, false},
+		{125, 100, false},
+	}
+	for _, tt := range tests {
+		if got := withinTolerance(tt.rate, tt.expected, 0.2); got != tt.want {
+			t.Errorf("withinTolerance(%v, %v) = %v, want %v", tt.rate, tt.expected, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// transparencyCheck verifies one aspect of the protocol is passed through
+// unchanged.
+type transparencyCheck struct {
+	name string
+	run  func(nc *nats.Conn) error
+}
+
+var transparencyChecks = []transparencyCheck{
+	{"request/reply", checkRequestReply},
+	{"queue groups", checkQueueGroups},
+	{"headers", checkHeaders},
+	{"ordering and integrity", checkOrdering},
+	{"large JetStream publish", checkJetStreamPublish},
+}
+
+// runTransparency runs every check through the proxy and, if direct is set,
+// directly against the upstream, returning whether both behave identically
+// and correctly.
+func runTransparency(o *options, direct string) (bool, error) {
+	targets := []struct{ name, url string }{{"proxy", o.server}}
+	if direct != "" {
+		targets = append(targets, struct{ name, url string }{"direct", direct})
+	}
+
+	results := make(map[string][]error)
+	for _, target := range targets {
+		to := *o
+		to.server = target.url
+		nc, err := to.connect("throughput-tester-transparency")
+		if err != nil {
+			return false, fmt.Errorf("%s: failed to connect: %w", target.name, err)
+		}
+		for _, check := range transparencyChecks {
+			results[target.name] = append(results[target.name], check.run(nc))
+		}
+		nc.Close()
+	}
+
+	passed := true
+	fmt.Printf("%-26s %-10s %s\n", "CHECK", "TARGET", "RESULT")
+	for i, check := range transparencyChecks {
+		for _, target := range targets {
+			verdict := "PASS"
+			if err := results[target.name][i]; err != nil {
+				verdict = "FAIL: " + err.Error()
+				passed = false
+			}
+			fmt.Printf("%-26s %-10s %s\n", check.name, target.name, verdict)
+		}
+	}
+	return passed, nil
+}
+
+// testPayload returns a deterministic binary payload for message i, seeded
+// with CRLF and protocol-like content to exercise the proxy's framing.
+func testPayload(i, size int) []byte {
+	payload := make([]byte, size)
+	rand.New(rand.NewSource(int64(i))).Read(payload)
+	copy(payload, "\r\nPING\r\nPUB x 1\r\n")
+	if size >= 8 {
+		binary.BigEndian.PutUint64(payload[size-8:], uint64(i))
+	}
+	return payload
+}
+
+func checkRequestReply(nc *nats.Conn) error {
+	subject := nats.NewInbox()
+	sub, err := nc.Subscribe(subject, func(m *nats.Msg) {
+		reply := append([]byte("re:"), m.Data...)
+		m.Respond(reply)
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	for i := 0; i < 100; i++ {
+		payload := testPayload(i, 1+i*37)
+		resp, err := nc.Request(subject, payload, 5*time.Second)
+		if err != nil {
+			return fmt.Errorf("request %d: %w", i, err)
+		}
+		if !bytes.Equal(resp.Data, append([]byte("re:"), payload...)) {
+			return fmt.Errorf("request %d: reply payload mismatch", i)
+		}
+	}
+	return nil
+}
+
+func checkQueueGroups(nc *nats.Conn) error {
+	const msgs = 200
+	subject := nats.NewInbox()
+
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	members := make(map[int]int)
+	done := make(chan struct{})
+	for member := 0; member < 3; member++ {
+		member := member
+		sub, err := nc.QueueSubscribe(subject, "workers", func(m *nats.Msg) {
+			mu.Lock()
+			defer mu.Unlock()
+			seen[string(m.Data)]++
+			members[member]++
+			if len(seen) == msgs {
+				close(done)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		defer sub.Unsubscribe()
+	}
+	if err := nc.Flush(); err != nil {
+		return err
+	}
+
+	for i := 0; i < msgs; i++ {
+		if err := nc.Publish(subject, testPayload(i, 64)); err != nil {
+			return err
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		mu.Lock()
+		defer mu.Unlock()
+		return fmt.Errorf("received %d of %d messages", len(seen), msgs)
+	}
+	// Wait briefly for duplicate deliveries
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, n := range seen {
+		if n != 1 {
+			return fmt.Errorf("message delivered %d times within the queue group", n)
+		}
+	}
+	if len(members) < 2 {
+		return fmt.Errorf("messages weren't distributed across queue members")
+	}
+	return nil
+}
+
+func checkHeaders(nc *nats.Conn) error {
+	subject := nats.NewInbox()
+	sub, err := nc.SubscribeSync(subject)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	msg := nats.NewMsg(subject)
+	msg.Header.Set("X-Test", "a: b\tc")
+	msg.Header.Add("X-Multi", "1")
+	msg.Header.Add("X-Multi", "2")
+	msg.Data = testPayload(1, 4096)
+	if err := nc.PublishMsg(msg); err != nil {
+		return err
+	}
+
+	got, err := sub.NextMsg(5 * time.Second)
+	if err != nil {
+		return err
+	}
+	if got.Header.Get("X-Test") != "a: b\tc" || len(got.Header.Values("X-Multi")) != 2 {
+		return fmt.Errorf("headers changed: %v", got.Header)
+	}
+	if !bytes.Equal(got.Data, msg.Data) {
+		return fmt.Errorf("payload mismatch")
+	}
+	return nil
+}
+
+func checkOrdering(nc *nats.Conn) error {
+	const msgs = 1000
+	subject := nats.NewInbox()
+	sub, err := nc.SubscribeSync(subject)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	if err := sub.SetPendingLimits(-1, -1); err != nil {
+		return err
+	}
+
+	for i := 0; i < msgs; i++ {
+		// Vary sizes so messages straddle the proxy's buffer boundaries
+		if err := nc.Publish(subject, testPayload(i, 8+(i*131)%9000)); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < msgs; i++ {
+		m, err := sub.NextMsg(5 * time.Second)
+		if err != nil {
+			return fmt.Errorf("message %d: %w", i, err)
+		}
+		if !bytes.Equal(m.Data, testPayload(i, 8+(i*131)%9000)) {
+			seq := binary.BigEndian.Uint64(m.Data[len(m.Data)-8:])
+			return fmt.Errorf("message %d: got message %d or corrupted payload", i, seq)
+		}
+	}
+	return nil
+}
+
+func checkJetStreamPublish(nc *nats.Conn) error {
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+	stream := "TRANSPARENCY_" + nats.NewInbox()[len("_INBOX."):]
+	subject := "transparency." + stream
+	if _, err := js.AddStream(&nats.StreamConfig{
+		Name:     stream,
+		Subjects: []string{subject},
+		Storage:  nats.MemoryStorage,
+	}); err != nil {
+		return fmt.Errorf("failed to create stream: %w", err)
+	}
+	defer js.DeleteStream(stream)
+
+	// As large as the server allows, leaving room for the JetStream headers
+	payload := testPayload(42, int(nc.MaxPayload())-1024)
+	ack, err := js.Publish(subject, payload)
+	if err != nil {
+		return err
+	}
+	stored, err := js.GetMsg(stream, ack.Sequence)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(stored.Data, payload) {
+		return fmt.Errorf("stored payload mismatch")
+	}
+	return nil
+}
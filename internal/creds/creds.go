@@ -0,0 +1,123 @@
+// Package creds generates NATS operator, account and user JWTs and creds
+// files, so tests and local setups don't depend on pre-generated credentials.
+package creds
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+// Environment is a self-contained operator with a system account and one
+// application account users are created in.
+type Environment struct {
+	Operator    nkeys.KeyPair
+	OperatorJWT string
+	System      nkeys.KeyPair
+	SystemJWT   string
+	Account     nkeys.KeyPair
+	AccountJWT  string
+}
+
+// NewEnvironment creates an operator, a system account and an account named
+// account.
+func NewEnvironment(operator, account string) (*Environment, error) {
+	env := &Environment{}
+	var err error
+	if env.Operator, err = nkeys.CreateOperator(); err != nil {
+		return nil, fmt.Errorf("failed to create operator key: %w", err)
+	}
+	if env.System, err = nkeys.CreateAccount(); err != nil {
+		return nil, fmt.Errorf("failed to create system account key: %w", err)
+	}
+	if env.Account, err = nkeys.CreateAccount(); err != nil {
+		return nil, fmt.Errorf("failed to create account key: %w", err)
+	}
+
+	oc := jwt.NewOperatorClaims(publicKey(env.Operator))
+	oc.Name = operator
+	oc.SystemAccount = publicKey(env.System)
+	if env.OperatorJWT, err = oc.Encode(env.Operator); err != nil {
+		return nil, err
+	}
+	if env.SystemJWT, err = accountJWT(env.Operator, "SYS", env.System); err != nil {
+		return nil, err
+	}
+	if env.AccountJWT, err = accountJWT(env.Operator, account, env.Account); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// accountJWT creates an account without limits, JetStream included, signed
+// by the operator.
+func accountJWT(operator nkeys.KeyPair, name string, account nkeys.KeyPair) (string, error) {
+	ac := jwt.NewAccountClaims(publicKey(account))
+	ac.Name = name
+	ac.Limits.JetStreamLimits.MemoryStorage = jwt.NoLimit
+	ac.Limits.JetStreamLimits.DiskStorage = jwt.NoLimit
+	return ac.Encode(operator)
+}
+
+// UserJWT creates a user without permission restrictions in the account,
+// returning its JWT and key pair.
+func (env *Environment) UserJWT(name string) (string, nkeys.KeyPair, error) {
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create user key: %w", err)
+	}
+	uc := jwt.NewUserClaims(publicKey(user))
+	uc.Name = name
+	token, err := uc.Encode(env.Account)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, user, nil
+}
+
+// UserCreds creates a user in the account and returns its creds file content.
+func (env *Environment) UserCreds(name string) ([]byte, error) {
+	token, user, err := env.UserJWT(name)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := user.Seed()
+	if err != nil {
+		return nil, err
+	}
+	return jwt.FormatUserConfig(token, seed)
+}
+
+// ResolverConfig returns a nats-server config snippet trusting the operator
+// and preloading its accounts into a memory resolver.
+func (env *Environment) ResolverConfig() string {
+	preload := map[string]string{
+		publicKey(env.System):  env.SystemJWT,
+		publicKey(env.Account): env.AccountJWT,
+	}
+	keys := make([]string, 0, len(preload))
+	for k := range preload {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "operator: %s\n", env.OperatorJWT)
+	fmt.Fprintf(&b, "system_account: %s\n", publicKey(env.System))
+	b.WriteString("resolver: MEMORY\nresolver_preload: {\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "  %s: %s\n", k, preload[k])
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// publicKey returns the public key of a key pair created with a seed, which
+// can't fail.
+func publicKey(kp nkeys.KeyPair) string {
+	pub, _ := kp.PublicKey()
+	return pub
+}
@@ -0,0 +1,58 @@
+package creds
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+func TestEnvironment_UserJWT(t *testing.T) {
+	env, err := NewEnvironment("root", "app")
+	if err != nil {
+		t.Fatalf("NewEnvironment failed: %v", err)
+	}
+	token, user, err := env.UserJWT("alice")
+	if err != nil {
+		t.Fatalf("UserJWT failed: %v", err)
+	}
+
+	// Decoding verifies the signature against the issuer
+	uc, err := jwt.DecodeUserClaims(token)
+	if err != nil {
+		t.Fatalf("DecodeUserClaims failed: %v", err)
+	}
+	if uc.Name != "alice" || uc.Subject != publicKey(user) || uc.Issuer != publicKey(env.Account) {
+		t.Errorf("Unexpected claims: %+v", uc)
+	}
+	ac, err := jwt.DecodeAccountClaims(env.AccountJWT)
+	if err != nil {
+		t.Fatalf("DecodeAccountClaims failed: %v", err)
+	}
+	if ac.Name != "app" || ac.Issuer != publicKey(env.Operator) {
+		t.Errorf("Unexpected account claims: %+v", ac)
+	}
+}
+
+func TestEnvironment_UserCreds(t *testing.T) {
+	env, err := NewEnvironment("root", "app")
+	if err != nil {
+		t.Fatalf("NewEnvironment failed: %v", err)
+	}
+	data, err := env.UserCreds("bob")
+	if err != nil {
+		t.Fatalf("UserCreds failed: %v", err)
+	}
+	token, err := jwt.ParseDecoratedJWT(data)
+	if err != nil {
+		t.Fatalf("ParseDecoratedJWT failed: %v", err)
+	}
+	kp, err := jwt.ParseDecoratedUserNKey(data)
+	if err != nil {
+		t.Fatalf("ParseDecoratedUserNKey failed: %v", err)
+	}
+	uc, _ := jwt.DecodeUserClaims(token)
+	if pub, _ := kp.PublicKey(); uc == nil || uc.Subject != pub || !strings.HasPrefix(pub, "U") {
+		t.Errorf("Expected the seed of the JWT's user, got %s for %+v", pub, uc)
+	}
+}
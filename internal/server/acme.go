@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACME challenge solvers.
+const (
+	challengeTLSALPN = "tls-alpn-01" // answered on the client port
+	challengeHTTP    = "http-01"     // answered on the ACME HTTP address
+)
+
+// newACMEManager returns the manager obtaining and renewing certificates of
+// the configured hosts. Renewed certificates are served to new connections
+// as soon as they're issued; established connections are unaffected.
+func newACMEManager(cfg *ACMEConfig) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		HostPolicy:  autocert.HostWhitelist(cfg.Hosts...),
+		Cache:       autocert.DirCache(cfg.CacheDir),
+		Email:       cfg.Email,
+		RenewBefore: cfg.RenewBefore,
+	}
+	if cfg.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	}
+	return m
+}
+
+// acmeCertificate returns a GetCertificate serving the ACME certificates of
+// the configured hosts and the TLS-ALPN challenges, and deferring to the
+// static certificates for other names.
+func acmeCertificate(m *autocert.Manager, hosts []string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+		if slices.Contains(hello.SupportedProtos, acme.ALPNProto) || slices.Contains(hosts, name) {
+			return m.GetCertificate(hello)
+		}
+		return nil, nil
+	}
+}
+
+// runACMEHTTP answers http-01 challenges until ctx is cancelled, redirecting
+// other requests to HTTPS.
+func (p *Proxy) runACMEHTTP(ctx context.Context) {
+	srv := &http.Server{Addr: p.currentConfig().TLS.ACME.HTTPAddr, Handler: p.acme.HTTPHandler(nil)}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	log.Info().Str("addr", srv.Addr).Msg("ACME challenge endpoint listening")
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error().Err(err).Msg("ACME challenge endpoint stopped")
+	}
+}
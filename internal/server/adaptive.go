@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// AdaptiveConfig configures the experimental AIMD mode, which grows a user's
+// effective rate additively while the upstream is healthy and cuts it
+// multiplicatively when the user's connections show congestion.
+type AdaptiveConfig struct {
+	// ConnzURL is the upstream's /connz monitoring endpoint including auth
+	// and closed connections, e.g. "http://nats:8222/connz?auth=true&state=any".
+	ConnzURL string `yaml:"connz_url"`
+	// Interval between adjustments. Defaults to 5s.
+	Interval time.Duration `yaml:"interval"`
+	// Increase is the additive step, as a fraction of the configured rate,
+	// applied per interval while healthy. Defaults to 0.05.
+	Increase float64 `yaml:"increase"`
+	// Decrease is the multiplicative factor applied on congestion. Defaults to 0.5.
+	Decrease float64 `yaml:"decrease"`
+	// MinFactor and MaxFactor bound the effective rate as a fraction of the
+	// configured rate. Default to 0.1 and 1.
+	MinFactor float64 `yaml:"min_factor"`
+	MaxFactor float64 `yaml:"max_factor"`
+	// MaxPendingBytes is the per-user sum of upstream pending bytes above
+	// which the user is considered congested. Defaults to 1MB.
+	MaxPendingBytes int64 `yaml:"max_pending_bytes"`
+}
+
+// upstreamConnz holds the fields of the upstream's /connz response used to
+// detect per-user congestion.
+type upstreamConnz struct {
+	Connections []struct {
+		CID            uint64 `json:"cid"`
+		PendingBytes   int64  `json:"pending_bytes"`
+		AuthorizedUser string `json:"authorized_user"`
+		NameTag        string `json:"name_tag"`
+		Reason         string `json:"reason"`
+	} `json:"connections"`
+}
+
+// AdaptiveLimiter adjusts per-user rate factors using AIMD.
+type AdaptiveLimiter struct {
+	cfg    AdaptiveConfig
+	rlm    *RateLimiterManager
+	client *http.Client
+
+	factors       map[string]float64
+	lastClosedCID uint64
+}
+
+// NewAdaptiveLimiter creates an AIMD controller adjusting rlm's per-user scales.
+func NewAdaptiveLimiter(cfg AdaptiveConfig, rlm *RateLimiterManager) *AdaptiveLimiter {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Second
+	}
+	if cfg.Increase <= 0 {
+		cfg.Increase = 0.05
+	}
+	if cfg.Decrease <= 0 || cfg.Decrease >= 1 {
+		cfg.Decrease = 0.5
+	}
+	if cfg.MinFactor <= 0 {
+		cfg.MinFactor = 0.1
+	}
+	if cfg.MaxFactor <= 0 {
+		cfg.MaxFactor = 1
+	}
+	if cfg.MaxPendingBytes <= 0 {
+		cfg.MaxPendingBytes = 1024 * 1024
+	}
+	return &AdaptiveLimiter{
+		cfg:     cfg,
+		rlm:     rlm,
+		client:  &http.Client{Timeout: cfg.Interval},
+		factors: make(map[string]float64),
+	}
+}
+
+// Run adjusts rates until ctx is cancelled.
+func (a *AdaptiveLimiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := a.adjust(ctx); err != nil {
+			log.Warn().Err(err).Str("url", a.cfg.ConnzURL).Msg("Failed to poll upstream connections")
+		}
+	}
+}
+
+// adjust polls the upstream's /connz once and updates every active user's factor.
+func (a *AdaptiveLimiter) adjust(ctx context.Context) error {
+	congested, err := a.congestedUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	healthy := a.rlm.GlobalScale() >= 1
+	for _, user := range a.rlm.ActiveUsers() {
+		factor, ok := a.factors[user]
+		if !ok {
+			factor = 1
+		}
+		switch {
+		case congested[user]:
+			factor = max(a.cfg.MinFactor, factor*a.cfg.Decrease)
+			log.Debug().Str("user", user).Float64("factor", factor).Msg("User congested, decreasing rate")
+		case healthy:
+			factor = min(a.cfg.MaxFactor, factor+a.cfg.Increase)
+		}
+		a.factors[user] = factor
+		a.rlm.SetUserScale(user, factor)
+	}
+	return nil
+}
+
+// congestedUsers returns the users with too many pending bytes upstream or
+// with a connection closed as a slow consumer since the last poll.
+func (a *AdaptiveLimiter) congestedUsers(ctx context.Context) (map[string]bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.cfg.ConnzURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var connz upstreamConnz
+	if err := json.NewDecoder(resp.Body).Decode(&connz); err != nil {
+		return nil, fmt.Errorf("failed to decode connz: %w", err)
+	}
+
+	pending := make(map[string]int64)
+	congested := make(map[string]bool)
+	lastClosedCID := a.lastClosedCID
+	for _, conn := range connz.Connections {
+		// JWT users are identified by the JWT name, like in the CONNECT parser
+		user := conn.NameTag
+		if user == "" {
+			user = conn.AuthorizedUser
+		}
+		if user == "" {
+			continue
+		}
+		if conn.Reason == "" {
+			pending[user] += conn.PendingBytes
+			continue
+		}
+		if conn.CID > a.lastClosedCID && strings.Contains(conn.Reason, "Slow Consumer") {
+			congested[user] = true
+		}
+		lastClosedCID = max(lastClosedCID, conn.CID)
+	}
+	a.lastClosedCID = lastClosedCID
+
+	for user, bytes := range pending {
+		if bytes > a.cfg.MaxPendingBytes {
+			congested[user] = true
+		}
+	}
+	return congested, nil
+}
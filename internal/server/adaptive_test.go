@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdaptiveLimiter_Adjust(t *testing.T) {
+	var connz string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(connz))
+	}))
+	defer ts.Close()
+
+	rlm := NewRateLimiterManager(&Config{DefaultBandwidth: 1024})
+	rlm.GetLimiter("alice")
+	rlm.GetLimiter("bob")
+
+	a := NewAdaptiveLimiter(AdaptiveConfig{
+		ConnzURL:        ts.URL,
+		Increase:        0.1,
+		Decrease:        0.5,
+		MinFactor:       0.2,
+		MaxFactor:       1.2,
+		MaxPendingBytes: 1000,
+	}, rlm)
+
+	steps := []struct {
+		name        string
+		connz       string
+		globalScale float64
+		expectAlice float64
+		expectBob   float64
+	}{
+		{
+			name:        "Healthy upstream grows rates",
+			connz:       `{"connections":[{"cid":1,"authorized_user":"alice"},{"cid":2,"name_tag":"bob","pending_bytes":10}]}`,
+			globalScale: 1,
+			expectAlice: 1.1,
+			expectBob:   1.1,
+		},
+		{
+			name:        "Pending bytes cut rate",
+			connz:       `{"connections":[{"cid":1,"authorized_user":"alice","pending_bytes":5000},{"cid":2,"name_tag":"bob"}]}`,
+			globalScale: 1,
+			expectAlice: 0.55,
+			expectBob:   1.2,
+		},
+		{
+			name:        "Slow consumer close cuts rate",
+			connz:       `{"connections":[{"cid":3,"name_tag":"bob","reason":"Slow Consumer (Pending Bytes)"}]}`,
+			globalScale: 1,
+			expectAlice: 0.65,
+			expectBob:   0.6,
+		},
+		{
+			name:        "Already seen slow consumer and upstream pressure hold rates",
+			connz:       `{"connections":[{"cid":3,"name_tag":"bob","reason":"Slow Consumer (Pending Bytes)"}]}`,
+			globalScale: 0.5,
+			expectAlice: 0.65,
+			expectBob:   0.6,
+		},
+	}
+
+	for _, step := range steps {
+		connz = step.connz
+		rlm.SetScale(step.globalScale)
+		if err := a.adjust(context.Background()); err != nil {
+			t.Fatalf("%s: adjust failed: %v", step.name, err)
+		}
+		if got := rlm.UserScale("alice"); !approxEqual(got, step.expectAlice) {
+			t.Errorf("%s: expected alice factor %v, got %v", step.name, step.expectAlice, got)
+		}
+		if got := rlm.UserScale("bob"); !approxEqual(got, step.expectBob) {
+			t.Errorf("%s: expected bob factor %v, got %v", step.name, step.expectBob, got)
+		}
+	}
+}
+
+func approxEqual(a, b float64) bool {
+	d := a - b
+	return d < 1e-9 && d > -1e-9
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Varz is the build and runtime information served by the /varz endpoint.
+type Varz struct {
+	Version    string    `json:"version"`
+	Commit     string    `json:"commit"`
+	GoVersion  string    `json:"go"`
+	Goroutines int       `json:"goroutines"`
+	HeapAlloc  uint64    `json:"heap_alloc"`
+	HeapSys    uint64    `json:"heap_sys"`
+	ConfigHash string    `json:"config_hash"`
+	RateScale  float64   `json:"rate_scale"`
+	Start      time.Time `json:"start"`
+	Now        time.Time `json:"now"`
+	Uptime     string    `json:"uptime"`
+	LameDuck   bool      `json:"lame_duck,omitempty"`
+}
+
+// Varz returns a snapshot of the proxy's build and runtime information.
+func (p *Proxy) Varz() *Varz {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	now := time.Now()
+	return &Varz{
+		Version:    Version,
+		Commit:     Commit,
+		GoVersion:  runtime.Version(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  mem.HeapAlloc,
+		HeapSys:    mem.HeapSys,
+		ConfigHash: p.currentConfig().Hash,
+		RateScale:  p.rateLimiterMgr.GlobalScale(),
+		Start:      p.start,
+		Now:        now,
+		Uptime:     now.Sub(p.start).Round(time.Second).String(),
+		LameDuck:   p.lameDuck.active(),
+	}
+}
+
+// AdminHandler returns the HTTP handler serving the admin endpoints, and
+// /metrics and /healthz unless they have listeners of their own.
+func (p *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/varz", p.handleVarz)
+	if p.currentConfig().MetricsAddr == "" {
+		mux.Handle("/metrics", registry)
+	}
+	if p.currentConfig().HealthAddr == "" {
+		mux.HandleFunc("/healthz", p.handleHealth)
+	}
+	mux.HandleFunc("GET /dashboard", p.handleDashboard)
+	mux.HandleFunc("GET /dashboard/data", p.handleDashboardData)
+	mux.HandleFunc("GET /api/v1/limits", p.handleLimits)
+	mux.HandleFunc("GET /api/v1/users", p.handleUsers)
+	mux.HandleFunc("GET /api/v1/users/{user}", p.handleUser)
+	mux.HandleFunc("PUT /api/v1/users/{user}", p.handleSetUser)
+	mux.HandleFunc("DELETE /api/v1/users/{user}/bandwidth", p.handleResetUser)
+	mux.HandleFunc("DELETE /api/v1/users/{user}/connections", p.handleDisconnectUser)
+	mux.HandleFunc("GET /api/v1/tenants/{tenant}/users", p.handleTenantUsers)
+	mux.HandleFunc("PUT /api/v1/tenants/{tenant}/users/{user}", p.handleSetTenantUser)
+	mux.HandleFunc("GET /api/v1/freezes", p.handleFreezes)
+	mux.HandleFunc("POST /api/v1/freezes", p.handleAddFreeze)
+	mux.HandleFunc("DELETE /api/v1/freezes/{id}", p.handleRemoveFreeze)
+	mux.HandleFunc("GET /api/v1/recommendations", p.handleRecommendations)
+	mux.HandleFunc("POST /api/v1/lameduck", p.handleLameDuck)
+	mux.HandleFunc("GET /api/v1/pause", p.handlePause)
+	mux.HandleFunc("POST /api/v1/pause", p.handleStartPause)
+	mux.HandleFunc("DELETE /api/v1/pause", p.handleResume)
+	return p.auditMutations(mux)
+}
+
+// TenantUser is a tenant user's limit as served by the admin API.
+type TenantUser struct {
+	User       string           `json:"user"`
+	Bandwidth  int64            `json:"bandwidth"`
+	Active     bool             `json:"active"`
+	Throughput *ThroughputStats `json:"throughput,omitempty"`
+	Rebound    int              `json:"rebound,omitempty"` // live connections moved to a new limit
+}
+
+func (p *Proxy) handleTenantUsers(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := p.authorizeTenant(w, r, scopeRead)
+	if !ok {
+		return
+	}
+
+	active := make(map[string]bool)
+	for _, user := range p.rateLimiterMgr.ActiveUsers() {
+		active[user] = true
+	}
+
+	users := make([]TenantUser, 0, len(tenant.Users))
+	for user := range tenant.Users {
+		tu := TenantUser{
+			User:      user,
+			Bandwidth: p.rateLimiterMgr.Bandwidth(user),
+			Active:    active[user],
+		}
+		if tu.Active {
+			stats := p.rateLimiterMgr.Stats(user)
+			tu.Throughput = &stats
+		}
+		users = append(users, tu)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].User < users[j].User })
+	writeJSON(w, http.StatusOK, users)
+}
+
+func (p *Proxy) handleSetTenantUser(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := p.authorizeTenant(w, r, scopeWrite)
+	if !ok {
+		return
+	}
+	user := r.PathValue("user")
+	if _, ok := tenant.Users[user]; !ok {
+		writeError(w, http.StatusNotFound, "unknown user")
+		return
+	}
+
+	var req struct {
+		Bandwidth int64 `json:"bandwidth"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Bandwidth <= 0 {
+		writeError(w, http.StatusBadRequest, "bandwidth must be a positive number of bytes per second")
+		return
+	}
+
+	previous := p.rateLimiterMgr.Bandwidth(user)
+	p.rateLimiterMgr.SetBandwidth(user, req.Bandwidth)
+	p.persistState()
+	auditChange(r, TenantUser{User: user, Bandwidth: previous}, TenantUser{User: user, Bandwidth: req.Bandwidth})
+	// SetBandwidth moved the user's live connections to the new limit
+	resp := TenantUser{User: user, Bandwidth: req.Bandwidth, Rebound: p.rateLimiterMgr.Connections(user)}
+	log.Info().Str("tenant", r.PathValue("tenant")).Str("user", user).Int64("previous_bandwidth", previous).
+		Int64("bandwidth", req.Bandwidth).Int("rebound", resp.Rebound).Str("remote", r.RemoteAddr).
+		Msg("User bandwidth changed")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// adminScope is the access an admin API request needs.
+type adminScope int
+
+const (
+	scopeRead  adminScope = iota // view limits and usage
+	scopeWrite                   // change limits
+)
+
+// authorizeTenant checks the request's bearer token against the global and
+// the tenant's tokens granting scope, writing an error response if it
+// doesn't match. Read-write tokens also grant read access.
+func (p *Proxy) authorizeTenant(w http.ResponseWriter, r *http.Request, scope adminScope) (*TenantConfig, bool) {
+	tenant, ok := p.currentConfig().Tenants[r.PathValue("tenant")]
+	token := bearerToken(r)
+	adminToken, readToken := p.adminTokens()
+	write := tokenMatches(token, adminToken) || (ok && tokenMatches(token, tenant.AdminToken))
+	read := tokenMatches(token, readToken) || (ok && tokenMatches(token, tenant.ReadToken))
+	if token == "" || !(write || read) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return nil, false
+	}
+	if scope == scopeWrite && !write {
+		writeError(w, http.StatusForbidden, "read-only token")
+		return nil, false
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown tenant")
+		return nil, false
+	}
+	return tenant, true
+}
+
+// authorizeAdmin checks the request's bearer token against the global
+// tokens granting scope, writing an error response if it doesn't match.
+func (p *Proxy) authorizeAdmin(w http.ResponseWriter, r *http.Request, scope adminScope) bool {
+	token := bearerToken(r)
+	adminToken, readToken := p.adminTokens()
+	write := tokenMatches(token, adminToken)
+	read := tokenMatches(token, readToken)
+	if token == "" || !(write || read) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return false
+	}
+	if scope == scopeWrite && !write {
+		writeError(w, http.StatusForbidden, "read-only token")
+		return false
+	}
+	return true
+}
+
+// bearerToken returns the request's bearer token. Browsers, which can't send
+// one, may send it as the password of basic authentication instead.
+func bearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, token, _ = r.BasicAuth()
+	}
+	return token
+}
+
+// tokenMatches compares tokens in constant time. An empty expected token never matches.
+func tokenMatches(token, expected string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+func (p *Proxy) handleVarz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, p.Varz())
+}
+
+// MetricsHandler returns the HTTP handler serving /metrics on its own
+// listener.
+func (p *Proxy) MetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	return mux
+}
+
+// HealthHandler returns the HTTP handler serving /healthz on its own
+// listener.
+func (p *Proxy) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", p.handleHealth)
+	return mux
+}
+
+// Health is the state served by the /healthz endpoint.
+type Health struct {
+	// "ok", "lame_duck" while draining or "over_budget" while approaching
+	// a resource ceiling
+	Status string `json:"status"`
+}
+
+// handleHealth answers health checks, failing them in lame duck mode and
+// over the resource budget so load balancers stop sending clients.
+func (p *Proxy) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if p.lameDuck.active() {
+		writeJSON(w, http.StatusServiceUnavailable, Health{Status: "lame_duck"})
+		return
+	}
+	if p.budget.overBudget() != nil {
+		writeJSON(w, http.StatusServiceUnavailable, Health{Status: "over_budget"})
+		return
+	}
+	writeJSON(w, http.StatusOK, Health{Status: "ok"})
+}
+
+// httpEndpoint is an HTTP listener of the proxy.
+type httpEndpoint struct {
+	name    string
+	addr    string
+	handler func() http.Handler
+}
+
+// endpoints returns the configured HTTP listeners: admin, and metrics and
+// health if split off, unless disabled.
+func (p *Proxy) endpoints() []httpEndpoint {
+	cfg := p.currentConfig()
+	var endpoints []httpEndpoint
+	for _, e := range []httpEndpoint{
+		{"Admin", cfg.AdminAddr, p.AdminHandler},
+		{"Metrics", cfg.MetricsAddr, p.MetricsHandler},
+		{"Health", cfg.HealthAddr, p.HealthHandler},
+	} {
+		if e.addr != "" && e.addr != EndpointDisabled {
+			endpoints = append(endpoints, e)
+		}
+	}
+	return endpoints
+}
+
+// startEndpoint starts serving an HTTP endpoint in the background.
+func (p *Proxy) startEndpoint(e httpEndpoint) (*http.Server, error) {
+	listener, err := net.Listen("tcp", e.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s address %s: %w", strings.ToLower(e.name), e.addr, err)
+	}
+	log.Info().Str("addr", listener.Addr().String()).Msg(e.name + " endpoint listening")
+
+	srv := &http.Server{Handler: e.handler()}
+	go func() {
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msg(e.name + " endpoint stopped")
+		}
+	}()
+	return srv, nil
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Debug().Err(err).Msg("Failed to write admin response")
+	}
+}
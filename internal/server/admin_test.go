@@ -0,0 +1,292 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+func newTestProxy(cfg *Config) *Proxy {
+	p := &Proxy{
+		rateLimiterMgr: NewRateLimiterManager(cfg),
+		start:          time.Now(),
+	}
+	p.config.Store(cfg)
+	return p
+}
+
+func TestAdmin_Varz(t *testing.T) {
+	p := newTestProxy(&Config{DefaultBandwidth: 1024, Hash: "abc123"})
+
+	rec := httptest.NewRecorder()
+	p.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/varz", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+
+	var varz Varz
+	if err := json.Unmarshal(rec.Body.Bytes(), &varz); err != nil {
+		t.Fatalf("Failed to decode /varz response: %v", err)
+	}
+	if varz.Version != Version {
+		t.Errorf("Expected version %q, got %q", Version, varz.Version)
+	}
+	if varz.ConfigHash != "abc123" {
+		t.Errorf("Expected config hash %q, got %q", "abc123", varz.ConfigHash)
+	}
+	if varz.Goroutines <= 0 {
+		t.Errorf("Expected positive goroutine count, got %d", varz.Goroutines)
+	}
+	if varz.Uptime == "" {
+		t.Error("Expected uptime to be set")
+	}
+}
+
+func TestAdmin_Metrics(t *testing.T) {
+	p := newTestProxy(&Config{DefaultBandwidth: 1024})
+	metricReadPauses.Add(1, "metrics-test")
+
+	rec := httptest.NewRecorder()
+	p.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE nats_limiter_proxy_client_read_pauses_total counter",
+		`nats_limiter_proxy_client_read_pauses_total{user="metrics-test"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected /metrics to contain %q", want)
+		}
+	}
+}
+
+func TestAdmin_TenantScopedTokens(t *testing.T) {
+	p := newTestProxy(&Config{
+		DefaultBandwidth: 1024,
+		AdminToken:       "root-token",
+		AdminReadToken:   "root-viewer",
+		Tenants: map[string]*TenantConfig{
+			"acme":   {AdminToken: "acme-token", ReadToken: "acme-viewer", Users: map[string]int64{"acme-alice": 2048}},
+			"globex": {AdminToken: "globex-token", Users: map[string]int64{"globex-bob": 4096}},
+		},
+	})
+	handler := p.AdminHandler()
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		status int
+	}{
+		{"List own users", "GET", "/api/v1/tenants/acme/users", "acme-token", "", http.StatusOK},
+		{"List other tenant's users", "GET", "/api/v1/tenants/globex/users", "acme-token", "", http.StatusUnauthorized},
+		{"List without token", "GET", "/api/v1/tenants/acme/users", "", "", http.StatusUnauthorized},
+		{"Global token lists any tenant", "GET", "/api/v1/tenants/globex/users", "root-token", "", http.StatusOK},
+		{"Set own user's limit", "PUT", "/api/v1/tenants/acme/users/acme-alice", "acme-token", `{"bandwidth": 8192}`, http.StatusOK},
+		{"Set other tenant's user via own tenant", "PUT", "/api/v1/tenants/acme/users/globex-bob", "acme-token", `{"bandwidth": 8192}`, http.StatusNotFound},
+		{"Set invalid limit", "PUT", "/api/v1/tenants/acme/users/acme-alice", "acme-token", `{"bandwidth": 0}`, http.StatusBadRequest},
+		{"List with own read token", "GET", "/api/v1/tenants/acme/users", "acme-viewer", "", http.StatusOK},
+		{"List other tenant's users with read token", "GET", "/api/v1/tenants/globex/users", "acme-viewer", "", http.StatusUnauthorized},
+		{"Global read token lists any tenant", "GET", "/api/v1/tenants/globex/users", "root-viewer", "", http.StatusOK},
+		{"Set limit with read token", "PUT", "/api/v1/tenants/acme/users/acme-alice", "acme-viewer", `{"bandwidth": 1}`, http.StatusForbidden},
+		{"Set limit with global read token", "PUT", "/api/v1/tenants/globex/users/globex-bob", "root-viewer", `{"bandwidth": 1}`, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(tt.method, tt.path, tt.token, tt.body)
+			if rec.Code != tt.status {
+				t.Errorf("Expected status %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	if bw := p.rateLimiterMgr.Bandwidth("acme-alice"); bw != 8192 {
+		t.Errorf("Expected acme-alice bandwidth 8192, got %d", bw)
+	}
+	if bw := p.rateLimiterMgr.Bandwidth("globex-bob"); bw != 4096 {
+		t.Errorf("Expected globex-bob bandwidth unchanged at 4096, got %d", bw)
+	}
+}
+
+func TestAdmin_TenantUserThroughput(t *testing.T) {
+	p := newTestProxy(&Config{
+		DefaultBandwidth: 1024,
+		AdminToken:       "root-token",
+		Tenants: map[string]*TenantConfig{
+			"acme": {Users: map[string]int64{"acme-alice": 2048, "acme-bob": 2048}},
+		},
+	})
+	p.rateLimiterMgr.GetLimiter("acme-alice")
+	p.rateLimiterMgr.RecordBytes("acme-alice", 5000)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/tenants/acme/users", nil)
+	req.Header.Set("Authorization", "Bearer root-token")
+	rec := httptest.NewRecorder()
+	p.AdminHandler().ServeHTTP(rec, req)
+
+	var users []TenantUser
+	if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("Expected 2 users, got %d", len(users))
+	}
+	if alice := users[0]; alice.Throughput == nil || alice.Throughput.Total != 5000 || alice.Throughput.Rate60s <= 0 {
+		t.Errorf("Expected acme-alice's throughput, got %+v", alice.Throughput)
+	}
+	if bob := users[1]; bob.Throughput != nil {
+		t.Errorf("Expected no throughput for inactive acme-bob, got %+v", bob.Throughput)
+	}
+}
+
+func TestAdmin_RebindLiveConnections(t *testing.T) {
+	p := newTestProxy(&Config{
+		DefaultBandwidth: 1024,
+		AdminToken:       "root-token",
+		Tenants: map[string]*TenantConfig{
+			"acme": {Users: map[string]int64{"acme-alice": 2048}},
+		},
+	})
+	clientR, clientW := io.Pipe()
+	parser := NewClientMessageParser(clientR, io.Discard, p.rateLimiterMgr)
+	done := make(chan error, 1)
+	go func() { done <- parser.ParseAndForward() }()
+	clientW.Write([]byte("CONNECT {\"user\":\"acme-alice\"}\r\nPING\r\n"))
+
+	set := func(body string) TenantUser {
+		req := httptest.NewRequest(http.MethodPut, "/api/v1/tenants/acme/users/acme-alice", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer root-token")
+		rec := httptest.NewRecorder()
+		p.AdminHandler().ServeHTTP(rec, req)
+		var tu TenantUser
+		if err := json.Unmarshal(rec.Body.Bytes(), &tu); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return tu
+	}
+	bound := func() *ratelimit.Bucket { return parser.serverWriter.limits.Load().rateLimiter }
+
+	// The PING was read once the connection is bound to the original limit.
+	// The old limiter doesn't keep admitting the live connection's traffic
+	// alongside the new one.
+	clientW.Write([]byte("PING\r\n"))
+	if tu := set(`{"bandwidth": 4096}`); tu.Rebound != 1 || bound() != p.rateLimiterMgr.GetLimiter("acme-alice") || bound().Capacity() != 4096 {
+		t.Errorf("Expected the live connection rebound to the new limit, got %d rebound and capacity %d", tu.Rebound, bound().Capacity())
+	}
+
+	clientW.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if n := p.rateLimiterMgr.RebindUser("acme-alice"); n != 0 {
+		t.Errorf("Expected closed connections unbound, got %d rebound", n)
+	}
+}
+
+func TestAdmin_Dashboard(t *testing.T) {
+	p := newTestProxy(&Config{DefaultBandwidth: 1024, Users: map[string]int64{"dash-alice": 4096}, AdminReadToken: "view"})
+	handler := p.AdminHandler()
+
+	for _, path := range []string{"/dashboard", "/dashboard/data"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Expected %s to prompt for a token, got status %d", path, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/dashboard", nil)
+	req.SetBasicAuth("", "view")
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("Expected the dashboard page, got status %d and %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	p.rateLimiterMgr.GetLimiter("dash-alice")
+	unbind := p.rateLimiterMgr.Bind("dash-alice", func() {})
+	defer unbind()
+	p.rateLimiterMgr.RecordBytes("dash-alice", 3000)
+	metricThrottles.Add(2, "dash-alice")
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/dashboard/data", nil)
+	req.Header.Set("Authorization", "Bearer view")
+	handler.ServeHTTP(rec, req)
+	var d Dashboard
+	if err := json.Unmarshal(rec.Body.Bytes(), &d); err != nil {
+		t.Fatalf("Failed to decode dashboard data: %v", err)
+	}
+	if len(d.Users) != 1 {
+		t.Fatalf("Expected 1 active user, got %+v", d.Users)
+	}
+	if u := d.Users[0]; u.User != "dash-alice" || u.Bandwidth != 4096 || u.Connections != 1 || u.Throughput.Total != 3000 || u.Throttles != 2 {
+		t.Errorf("Unexpected dashboard user %+v", u)
+	}
+}
+
+func TestAdmin_SplitEndpoints(t *testing.T) {
+	p := newTestProxy(&Config{DefaultBandwidth: 1024, AdminAddr: ":8223", MetricsAddr: "10.0.0.1:9090", HealthAddr: EndpointDisabled})
+
+	for path, handler := range map[string]http.Handler{"/metrics": p.AdminHandler(), "/healthz": p.AdminHandler()} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Expected %s not served by the admin endpoint, got %d", path, rec.Code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	p.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "# TYPE") {
+		t.Errorf("Expected metrics on their own endpoint, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	var names []string
+	for _, e := range p.endpoints() {
+		names = append(names, e.name+"="+e.addr)
+	}
+	if got := strings.Join(names, ","); got != "Admin=:8223,Metrics=10.0.0.1:9090" {
+		t.Errorf("Expected the admin and metrics listeners only, got %s", got)
+	}
+}
+
+func TestAdmin_Health(t *testing.T) {
+	p := newTestProxy(&Config{DefaultBandwidth: 1024, LameDuckDuration: time.Second})
+	for _, expected := range []int{http.StatusOK, http.StatusServiceUnavailable} {
+		rec := httptest.NewRecorder()
+		p.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if rec.Code != expected {
+			t.Errorf("Expected status %d, got %d", expected, rec.Code)
+		}
+		p.startLameDuck(50*time.Millisecond, 10*time.Millisecond)
+	}
+}
+
+func TestLoadConfig_SharedEndpointAddress(t *testing.T) {
+	if _, err := LoadConfig(writeTestConfig(t, "admin_addr: \":8223\"\nmetrics_addr: \":8223\"\n")); err == nil {
+		t.Error("Expected metrics_addr sharing the admin listener refused")
+	}
+}
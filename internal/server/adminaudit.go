@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// AdminAuditRecord attributes an admin API mutation to who called it.
+type AdminAuditRecord struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	// Token identifies the bearer token by what it grants and a
+	// fingerprint, e.g. "tenant/acme:1a2b3c4d", never the token itself.
+	Token   string          `json:"token,omitempty"`
+	Remote  string          `json:"remote"` // source IP
+	Status  int             `json:"status"`
+	Payload json.RawMessage `json:"payload,omitempty"` // request body, if JSON
+	// Before and After are what the mutation changed, if it succeeded.
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// maxAuditPayload bounds the request body kept in a record.
+const maxAuditPayload = 64 << 10
+
+type auditKey struct{}
+
+// auditChange records what a mutation changed in the request's audit record.
+func auditChange(r *http.Request, before, after interface{}) {
+	if record, ok := r.Context().Value(auditKey{}).(*AdminAuditRecord); ok {
+		record.Before, record.After = before, after
+	}
+}
+
+// auditStatus captures the status of a response.
+type auditStatus struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditStatus) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditStatus) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// auditMutations records every admin API request that may change state,
+// authorized or not, in the log and the admin audit log file if configured.
+func (p *Proxy) auditMutations(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		record := &AdminAuditRecord{
+			Time:   time.Now(),
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Token:  p.tokenID(r),
+			Remote: r.RemoteAddr,
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			record.Remote = host
+		}
+		if r.Body != nil {
+			body, _ := io.ReadAll(io.LimitReader(r.Body, maxAuditPayload+1))
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+			if len(body) <= maxAuditPayload && json.Valid(body) {
+				record.Payload = body
+			}
+		}
+		sw := &auditStatus{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), auditKey{}, record)))
+		record.Status = sw.status
+		p.writeAudit(record)
+	})
+}
+
+// tokenID identifies the request's bearer token by the token it matches,
+// and a fingerprint telling rotated tokens apart.
+func (p *Proxy) tokenID(r *http.Request) string {
+	token := bearerToken(r)
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	fingerprint := hex.EncodeToString(sum[:4])
+	adminToken, readToken := p.adminTokens()
+	switch {
+	case tokenMatches(token, adminToken):
+		return "admin:" + fingerprint
+	case tokenMatches(token, readToken):
+		return "read:" + fingerprint
+	}
+	for name, tenant := range p.currentConfig().Tenants {
+		switch {
+		case tokenMatches(token, tenant.AdminToken):
+			return "tenant/" + name + ":" + fingerprint
+		case tokenMatches(token, tenant.ReadToken):
+			return "tenant-read/" + name + ":" + fingerprint
+		}
+	}
+	return "unknown:" + fingerprint
+}
+
+// auditFileMu serializes appending to admin audit log files.
+var auditFileMu sync.Mutex
+
+// writeAudit logs a record and appends it to the admin audit log file. The
+// file is opened for each record, mutations being rare, so it can be rotated
+// by moving it away.
+func (p *Proxy) writeAudit(record *AdminAuditRecord) {
+	log.Info().Str("audit", "admin").Str("method", record.Method).Str("path", record.Path).
+		Str("token", record.Token).Str("remote", record.Remote).Int("status", record.Status).
+		Msg("Admin API mutation")
+	path := p.currentConfig().AdminAuditLog
+	if path == "" {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to encode admin audit record")
+		return
+	}
+	auditFileMu.Lock()
+	defer auditFileMu.Unlock()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err == nil {
+		_, err = f.Write(append(data, '\n'))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Str("file", path).Msg("Failed to write admin audit record")
+		metricAdminAuditErrors.Add(1)
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdmin_AuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	p := newTestProxy(&Config{
+		DefaultBandwidth: 1024,
+		AdminToken:       "root-token",
+		AdminAuditLog:    path,
+		Tenants: map[string]*TenantConfig{
+			"acme": {AdminToken: "acme-token", Users: map[string]int64{"acme-alice": 2048}},
+		},
+	})
+	handler := p.AdminHandler()
+	do := func(method, target, token, body string) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.7:51234"
+		req.Header.Set("Authorization", "Bearer "+token)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	do("GET", "/api/v1/tenants/acme/users", "acme-token", "")
+	do("PUT", "/api/v1/tenants/acme/users/acme-alice", "acme-token", `{"bandwidth": 8192}`)
+	do("POST", "/api/v1/freezes", "stolen-token", `{"subjects": ["orders.>"], "duration": "1m"}`)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []map[string]interface{}
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Invalid audit record %s: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected the 2 mutations recorded, not reads, got %d", len(records))
+	}
+
+	set := records[0]
+	if token, _ := set["token"].(string); !strings.HasPrefix(token, "tenant/acme:") || strings.Contains(token, "acme-token") {
+		t.Errorf("Expected the tenant's token identified by a fingerprint, got %q", token)
+	}
+	if set["remote"] != "192.0.2.7" || set["status"] != float64(http.StatusOK) || set["method"] != "PUT" {
+		t.Errorf("Unexpected record %v", set)
+	}
+	before, _ := set["before"].(map[string]interface{})
+	after, _ := set["after"].(map[string]interface{})
+	if before["bandwidth"] != float64(2048) || after["bandwidth"] != float64(8192) {
+		t.Errorf("Expected the change from 2048 to 8192 recorded, got %v -> %v", before, after)
+	}
+	if payload, _ := set["payload"].(map[string]interface{}); payload["bandwidth"] != float64(8192) {
+		t.Errorf("Expected the payload recorded, got %v", set["payload"])
+	}
+
+	denied := records[1]
+	if token, _ := denied["token"].(string); !strings.HasPrefix(token, "unknown:") || denied["status"] != float64(http.StatusUnauthorized) {
+		t.Errorf("Expected the unauthorized attempt recorded, got %v", denied)
+	}
+	if _, ok := denied["after"]; ok {
+		t.Errorf("Expected no change recorded for a denied attempt, got %v", denied["after"])
+	}
+}
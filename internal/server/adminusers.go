@@ -0,0 +1,241 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+)
+
+var errAdminDisconnect = errors.New("disconnected through the admin API")
+
+// UserLimit is a user's limit and live connections as served by the admin
+// API.
+type UserLimit struct {
+	User        string           `json:"user"`
+	Route       string           `json:"route,omitempty"` // server name of the route limiting the user, if not the default
+	Bandwidth   int64            `json:"bandwidth"`
+	Override    bool             `json:"override,omitempty"` // set at runtime, not configured
+	Connections int              `json:"connections"`
+	Throughput  *ThroughputStats `json:"throughput,omitempty"`
+	Rebound     int              `json:"rebound,omitempty"` // live connections moved to a new limit
+}
+
+// Limits are the limits in effect as served by the admin API.
+type Limits struct {
+	DefaultBandwidth int64             `json:"default_bandwidth"`
+	Users            map[string]int64  `json:"users"`            // configured
+	Overrides        map[string]int64  `json:"overrides"`        // set at runtime
+	Routes           map[string]Limits `json:"routes,omitempty"` // of the routes' upstreams, by server name
+}
+
+// routeOf returns the proxy a request's route query parameter, the server
+// name of a route, selects and its name, or p itself without one. Each
+// route's users are limited by the route's own configuration. It writes an
+// error response for unknown routes.
+func (p *Proxy) routeOf(w http.ResponseWriter, r *http.Request) (*Proxy, string, bool) {
+	name := r.URL.Query().Get("route")
+	if name == "" {
+		return p, "", true
+	}
+	route, ok := p.routes[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown route")
+		return nil, "", false
+	}
+	return route, name, true
+}
+
+// userConns returns the live connections of each user that identified,
+// of the proxy itself and not of its routes.
+func (p *Proxy) userConns() map[string][]*liveConn {
+	conns := make(map[string][]*liveConn)
+	for _, c := range p.conns.list() {
+		if user := c.user(); user != "" {
+			conns[user] = append(conns[user], c)
+		}
+	}
+	return conns
+}
+
+// userLimit returns a user's limit, with connections live.
+func (p *Proxy) userLimit(user string, connections int) UserLimit {
+	_, override := p.rateLimiterMgr.Overrides()[user]
+	ul := UserLimit{
+		User:        user,
+		Bandwidth:   p.rateLimiterMgr.Bandwidth(user),
+		Override:    override,
+		Connections: connections,
+	}
+	if connections > 0 {
+		stats := p.rateLimiterMgr.Stats(user)
+		ul.Throughput = &stats
+	}
+	return ul
+}
+
+func (p *Proxy) handleLimits(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizeAdmin(w, r, scopeRead) {
+		return
+	}
+	limits := p.limits()
+	for name, route := range p.routes {
+		if limits.Routes == nil {
+			limits.Routes = make(map[string]Limits, len(p.routes))
+		}
+		limits.Routes[name] = route.limits()
+	}
+	writeJSON(w, http.StatusOK, limits)
+}
+
+// limits returns the limits in effect of the proxy itself.
+func (p *Proxy) limits() Limits {
+	config := p.currentConfig()
+	users := config.Users
+	if users == nil {
+		users = map[string]int64{}
+	}
+	return Limits{
+		DefaultBandwidth: config.DefaultBandwidth,
+		Users:            users,
+		Overrides:        p.rateLimiterMgr.Overrides(),
+	}
+}
+
+// handleUsers lists the users with live connections or a limiter, of the
+// proxy and its routes.
+func (p *Proxy) handleUsers(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizeAdmin(w, r, scopeRead) {
+		return
+	}
+	users := p.activeUsers("")
+	for name, route := range p.routes {
+		users = append(users, route.activeUsers(name)...)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].User != users[j].User {
+			return users[i].User < users[j].User
+		}
+		return users[i].Route < users[j].Route
+	})
+	writeJSON(w, http.StatusOK, users)
+}
+
+// activeUsers returns the limits of the users with live connections or a
+// limiter of the proxy itself, serving as the route of that name.
+func (p *Proxy) activeUsers(route string) []UserLimit {
+	conns := p.userConns()
+	active := make(map[string]bool)
+	for user := range conns {
+		active[user] = true
+	}
+	for _, user := range p.rateLimiterMgr.ActiveUsers() {
+		active[user] = true
+	}
+
+	users := make([]UserLimit, 0, len(active))
+	for user := range active {
+		ul := p.userLimit(user, len(conns[user]))
+		ul.Route = route
+		users = append(users, ul)
+	}
+	return users
+}
+
+func (p *Proxy) handleUser(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizeAdmin(w, r, scopeRead) {
+		return
+	}
+	rp, route, ok := p.routeOf(w, r)
+	if !ok {
+		return
+	}
+	user := r.PathValue("user")
+	ul := rp.userLimit(user, len(rp.userConns()[user]))
+	ul.Route = route
+	writeJSON(w, http.StatusOK, ul)
+}
+
+func (p *Proxy) handleSetUser(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizeAdmin(w, r, scopeWrite) {
+		return
+	}
+	rp, route, ok := p.routeOf(w, r)
+	if !ok {
+		return
+	}
+	user := r.PathValue("user")
+	var req struct {
+		Bandwidth int64 `json:"bandwidth"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Bandwidth <= 0 {
+		writeError(w, http.StatusBadRequest, "bandwidth must be a positive number of bytes per second")
+		return
+	}
+
+	previous := rp.userLimit(user, 0)
+	rp.rateLimiterMgr.SetBandwidth(user, req.Bandwidth)
+	rp.persistState()
+	resp := rp.userLimit(user, len(rp.userConns()[user]))
+	resp.Route = route
+	// SetBandwidth moved the user's live connections to the new limit
+	resp.Rebound = rp.rateLimiterMgr.Connections(user)
+	auditChange(r, UserLimit{User: user, Route: route, Bandwidth: previous.Bandwidth, Override: previous.Override},
+		UserLimit{User: user, Route: route, Bandwidth: req.Bandwidth, Override: true})
+	log.Info().Str("audit", "bandwidth").Str("user", user).Str("route", route).Int64("previous_bandwidth", previous.Bandwidth).
+		Int64("bandwidth", req.Bandwidth).Int("rebound", resp.Rebound).Str("remote", r.RemoteAddr).
+		Msg("User bandwidth changed")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleResetUser drops the bandwidth set at runtime for a user, restoring
+// the configured limit.
+func (p *Proxy) handleResetUser(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizeAdmin(w, r, scopeWrite) {
+		return
+	}
+	rp, route, ok := p.routeOf(w, r)
+	if !ok {
+		return
+	}
+	user := r.PathValue("user")
+	previous := rp.userLimit(user, 0)
+	if !rp.rateLimiterMgr.ResetBandwidth(user) {
+		writeError(w, http.StatusNotFound, "no bandwidth set for user")
+		return
+	}
+	rp.persistState()
+	resp := rp.userLimit(user, len(rp.userConns()[user]))
+	resp.Route = route
+	// ResetBandwidth moved them back to the configured limit
+	resp.Rebound = rp.rateLimiterMgr.Connections(user)
+	auditChange(r, UserLimit{User: user, Route: route, Bandwidth: previous.Bandwidth, Override: true},
+		UserLimit{User: user, Route: route, Bandwidth: resp.Bandwidth})
+	log.Info().Str("audit", "bandwidth").Str("user", user).Str("route", route).Int64("previous_bandwidth", previous.Bandwidth).
+		Int64("bandwidth", resp.Bandwidth).Int("rebound", resp.Rebound).Str("remote", r.RemoteAddr).
+		Msg("User bandwidth reset to configured limit")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleDisconnectUser closes the live connections of a user.
+func (p *Proxy) handleDisconnectUser(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizeAdmin(w, r, scopeWrite) {
+		return
+	}
+	rp, route, ok := p.routeOf(w, r)
+	if !ok {
+		return
+	}
+	user := r.PathValue("user")
+	conns := rp.userConns()[user]
+	for _, c := range conns {
+		// Concurrently, so a slow client doesn't hold the others up
+		go c.closeWithError(closeAdminDisconnect, errAdminDisconnect)
+	}
+	auditChange(r, UserLimit{User: user, Route: route, Connections: len(conns)}, UserLimit{User: user, Route: route})
+	log.Info().Str("audit", "disconnect").Str("user", user).Str("route", route).Int("connections", len(conns)).Str("remote", r.RemoteAddr).
+		Msg("User disconnected")
+	writeJSON(w, http.StatusOK, map[string]int{"disconnected": len(conns)})
+}
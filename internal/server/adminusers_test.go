@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdmin_Users(t *testing.T) {
+	p := newTestProxy(&Config{
+		DefaultBandwidth: 1024,
+		Users:            map[string]int64{"alice": 2048},
+		AdminToken:       "root-token",
+		AdminReadToken:   "read-token",
+	})
+	dial, servers := pipeDialer()
+	p.SetDialer(dial)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, _ := runTestServer(ctx, t, p)
+	defer srv.Stop(time.Second)
+
+	var clients []net.Conn
+	for _, user := range []string{"alice", "alice", "bob"} {
+		client, err := net.Dial("tcp", srv.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer client.Close()
+		go io.Copy(io.Discard, <-servers)
+		client.Write([]byte("CONNECT {\"user\":\"" + user + "\"}\r\n"))
+		clients = append(clients, client)
+	}
+
+	do := func(method, path, token, body string, v any) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		p.AdminHandler().ServeHTTP(rec, req)
+		if v != nil && rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+		}
+		return rec.Code
+	}
+
+	var users []UserLimit
+	for deadline := time.Now().Add(2 * time.Second); len(users) != 2 || users[0].Connections != 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected alice's and bob's connections listed, got %+v", users)
+		}
+		time.Sleep(10 * time.Millisecond)
+		do(http.MethodGet, "/api/v1/users", "read-token", "", &users)
+	}
+	if users[0].User != "alice" || users[0].Bandwidth != 2048 || users[1].User != "bob" || users[1].Bandwidth != 1024 {
+		t.Errorf("Expected alice's and bob's limits, got %+v", users)
+	}
+
+	if code := do(http.MethodPut, "/api/v1/users/bob", "read-token", `{"bandwidth": 4096}`, nil); code != http.StatusForbidden {
+		t.Errorf("Expected read-only tokens refused, got %d", code)
+	}
+	var bob UserLimit
+	do(http.MethodPut, "/api/v1/users/bob", "root-token", `{"bandwidth": 4096}`, &bob)
+	if bob.Bandwidth != 4096 || !bob.Override || bob.Rebound != 1 {
+		t.Errorf("Expected bob's live connection rebound to 4096 bytes/s, got %+v", bob)
+	}
+	var limits Limits
+	do(http.MethodGet, "/api/v1/limits", "read-token", "", &limits)
+	if limits.DefaultBandwidth != 1024 || limits.Users["alice"] != 2048 || limits.Overrides["bob"] != 4096 {
+		t.Errorf("Expected configured limits and bob's override, got %+v", limits)
+	}
+	var reset UserLimit
+	do(http.MethodDelete, "/api/v1/users/bob/bandwidth", "root-token", "", &reset)
+	if reset.Bandwidth != 1024 || reset.Override {
+		t.Errorf("Expected bob back on the default limit, got %+v", reset)
+	}
+	if code := do(http.MethodDelete, "/api/v1/users/bob/bandwidth", "root-token", "", nil); code != http.StatusNotFound {
+		t.Errorf("Expected no bandwidth left to reset, got %d", code)
+	}
+
+	var disconnected map[string]int
+	do(http.MethodDelete, "/api/v1/users/alice/connections", "root-token", "", &disconnected)
+	if disconnected["disconnected"] != 2 {
+		t.Errorf("Expected alice's 2 connections disconnected, got %v", disconnected)
+	}
+	for _, client := range clients[:2] {
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if line, _ := io.ReadAll(client); string(line) != "-ERR 'Disconnected By Operator'\r\n" {
+			t.Errorf("Expected alice told why the connection closed, got %q", line)
+		}
+	}
+}
+
+func TestAdmin_RouteUsers(t *testing.T) {
+	p := newTestProxy(&Config{DefaultBandwidth: 1024, AdminToken: "root-token"})
+	route := newTestProxy(&Config{DefaultBandwidth: 8192, Users: map[string]int64{"carol": 4096}})
+	p.routes = map[string]*Proxy{"b.example.com": route}
+	route.rateLimiterMgr.GetLimiter("carol")
+	p.rateLimiterMgr.GetLimiter("alice")
+
+	do := func(method, path, body string, v any) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer root-token")
+		rec := httptest.NewRecorder()
+		p.AdminHandler().ServeHTTP(rec, req)
+		if v != nil && rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+		}
+		return rec.Code
+	}
+
+	var users []UserLimit
+	do(http.MethodGet, "/api/v1/users", "", &users)
+	if len(users) != 2 || users[0].User != "alice" || users[0].Route != "" ||
+		users[1].User != "carol" || users[1].Route != "b.example.com" || users[1].Bandwidth != 4096 {
+		t.Errorf("Expected alice and the route's carol listed, got %+v", users)
+	}
+
+	var carol UserLimit
+	do(http.MethodPut, "/api/v1/users/carol?route=b.example.com", `{"bandwidth": 2048}`, &carol)
+	if carol.Route != "b.example.com" || carol.Bandwidth != 2048 || route.rateLimiterMgr.Bandwidth("carol") != 2048 {
+		t.Errorf("Expected carol's limit set on the route, got %+v", carol)
+	}
+	if _, ok := p.rateLimiterMgr.Overrides()["carol"]; ok {
+		t.Error("Expected the default upstream's limits unchanged")
+	}
+	if code := do(http.MethodGet, "/api/v1/users/carol?route=c.example.com", "", nil); code != http.StatusNotFound {
+		t.Errorf("Expected an unknown route refused, got %d", code)
+	}
+
+	var limits Limits
+	do(http.MethodGet, "/api/v1/limits", "", &limits)
+	if r := limits.Routes["b.example.com"]; r.DefaultBandwidth != 8192 || r.Overrides["carol"] != 2048 {
+		t.Errorf("Expected the route's limits, got %+v", limits)
+	}
+}
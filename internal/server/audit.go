@@ -0,0 +1,40 @@
+package server
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// flowAudit counts the bytes and messages of one direction of a connection as
+// they enter and leave the proxy, so loss or duplication inside the proxy
+// shows up as a mismatch once the connection closes. Bytes the proxy drops or
+// adds on purpose, such as answered service requests, rejected messages or
+// rewritten subjects, are counted as adjustments.
+type flowAudit struct {
+	bytesIn       int64
+	bytesOut      int64
+	bytesAdjusted int64 // expected bytesOut - bytesIn
+	msgsIn        int64
+	msgsOut       int64
+	msgsDropped   int64
+}
+
+// mismatch returns the bytes and messages that left the proxy beyond those
+// expected, negative if some went missing.
+func (a *flowAudit) mismatch() (bytes, msgs int64) {
+	return a.bytesOut - a.bytesIn - a.bytesAdjusted, a.msgsOut + a.msgsDropped - a.msgsIn
+}
+
+// check logs and counts a mismatch of a closed connection's direction.
+func (a *flowAudit) check(direction, user string) bool {
+	bytes, msgs := a.mismatch()
+	if bytes == 0 && msgs == 0 {
+		return true
+	}
+	metricFlowMismatches.Add(1, direction)
+	log.Error().Str("direction", direction).Str("user", user).
+		Int64("bytes_in", a.bytesIn).Int64("bytes_out", a.bytesOut).Int64("bytes_adjusted", a.bytesAdjusted).
+		Int64("msgs_in", a.msgsIn).Int64("msgs_out", a.msgsOut).Int64("msgs_dropped", a.msgsDropped).
+		Int64("bytes_mismatch", bytes).Int64("msgs_mismatch", msgs).
+		Msg("Bytes or messages lost or duplicated inside the proxy")
+	return false
+}
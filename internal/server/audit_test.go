@@ -0,0 +1,45 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFlowAudit_Check(t *testing.T) {
+	balanced := flowAudit{bytesIn: 100, bytesOut: 90, bytesAdjusted: -10, msgsIn: 3, msgsOut: 2, msgsDropped: 1}
+	if !balanced.check("upstream", "alice") {
+		t.Error("Expected adjusted flows to balance")
+	}
+
+	before := metricFlowMismatches.Get("upstream")
+	duplicated := flowAudit{bytesIn: 100, bytesOut: 150, msgsIn: 2, msgsOut: 3}
+	if duplicated.check("upstream", "alice") {
+		t.Error("Expected duplicated bytes and messages detected")
+	}
+	if bytes, msgs := duplicated.mismatch(); bytes != 50 || msgs != 1 {
+		t.Errorf("Expected 50 bytes and 1 message duplicated, got %d and %d", bytes, msgs)
+	}
+	if got := metricFlowMismatches.Get("upstream") - before; got != 1 {
+		t.Errorf("Expected 1 mismatch counted, got %d", got)
+	}
+}
+
+func TestForwardDownstream_FlowAudit(t *testing.T) {
+	var client bytes.Buffer
+	cw := newClientWriter(&client)
+	cw.WriteFrame([]byte("-ERR 'Injected'\r\n"))
+
+	upstream := "INFO {}\r\nMSG foo 1 5\r\nhello\r\nPING\r\nMSG bar 2 3\r\nab"
+	err := forwardDownstream(strings.NewReader(upstream), cw)
+	if err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+	if client.Len() != len(upstream)+len("-ERR 'Injected'\r\n") {
+		t.Errorf("Expected upstream data and the injected frame written, got %q", client.String())
+	}
+	if !cw.checkFlow(err, "alice") {
+		t.Errorf("Expected the downstream flow to balance, got %+v", cw.audit)
+	}
+}
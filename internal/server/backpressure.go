@@ -0,0 +1,49 @@
+package server
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// backpressureReader stops reading from the client while the user's rate
+// limiter is over budget, so an over-limit burst is pushed back to the client
+// through TCP flow control instead of being absorbed by proxy buffers.
+type backpressureReader struct {
+	reader  io.Reader
+	limiter atomic.Pointer[ratelimit.Bucket] // rebound from other goroutines
+	quota   atomic.Pointer[connQuota]        // the connection's share of limiter, if guaranteed
+	user    string
+}
+
+func (br *backpressureReader) Read(p []byte) (int, error) {
+	if limiter := br.limiter.Load(); limiter != nil {
+		br.waitForBudget(limiter, br.quota.Load())
+	}
+	return br.reader.Read(p)
+}
+
+// waitForBudget blocks until the limiter has tokens available again, or the
+// connection has some of its guaranteed share left.
+func (br *backpressureReader) waitForBudget(limiter *ratelimit.Bucket, quota *connQuota) {
+	available := limiter.Available()
+	if available > 0 || (quota != nil && quota.available()) {
+		return
+	}
+
+	start := time.Now()
+	for available <= 0 && (quota == nil || !quota.available()) {
+		deficit := float64(1 - available)
+		wait := time.Duration(deficit / limiter.Rate() * float64(time.Second))
+		if quota != nil {
+			// Woken up no later than the share refills
+			wait = min(wait, time.Duration(float64(time.Second)/quota.bucket.Rate()*float64(max(quota.shares(), 1))))
+		}
+		time.Sleep(wait)
+		available = limiter.Available()
+	}
+	metricReadPauses.Add(1, br.user)
+	metricReadPausedSeconds.Add(int64(time.Since(start)), br.user)
+}
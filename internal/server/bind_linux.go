@@ -0,0 +1,24 @@
+package server
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindToInterface returns a dialer control function binding sockets to a
+// network interface with SO_BINDTODEVICE.
+func bindToInterface(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+		if sockErr != nil {
+			return fmt.Errorf("failed to bind to interface %s: %w", iface, sockErr)
+		}
+		return nil
+	}, nil
+}
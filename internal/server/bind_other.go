@@ -0,0 +1,12 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+func bindToInterface(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, errors.New("upstream_bind_interface is only supported on Linux")
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ResourceBudgetConfig configures ceilings on the proxy's own goroutines and
+// open files. Approaching either, the proxy stops accepting clients and fails
+// health checks until usage falls back, rather than run out of memory or file
+// descriptors and fail every tenant's connections at once.
+type ResourceBudgetConfig struct {
+	// MaxGoroutines is the goroutine ceiling. Zero doesn't bound goroutines.
+	MaxGoroutines int `yaml:"max_goroutines"`
+	// MaxOpenFiles is the open file ceiling, connections included. Zero
+	// defaults to the process's file descriptor limit (ulimit -n), where it
+	// can be read.
+	MaxOpenFiles int `yaml:"max_open_files"`
+	// Threshold is the fraction of a ceiling at which clients stop being
+	// accepted. Defaults to 0.9.
+	Threshold float64 `yaml:"threshold"`
+	// Interval between checks of usage. Defaults to 1s.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// normalize applies defaults and validates the configuration.
+func (c *ResourceBudgetConfig) normalize() error {
+	if c.MaxGoroutines < 0 || c.MaxOpenFiles < 0 {
+		return fmt.Errorf("resource_budget ceilings must not be negative")
+	}
+	if c.Threshold == 0 {
+		c.Threshold = 0.9
+	}
+	if c.Threshold < 0 || c.Threshold > 1 {
+		return fmt.Errorf("resource_budget threshold must be between 0 and 1")
+	}
+	if c.Interval <= 0 {
+		c.Interval = time.Second
+	}
+	return nil
+}
+
+// resourceBudget tracks whether the proxy is over its resource budget.
+type resourceBudget struct {
+	cfg      *ResourceBudgetConfig
+	maxFiles int // 0 if open files aren't bounded
+
+	mu       sync.Mutex
+	over     string        // the resource over budget, "" if none
+	cleared  chan struct{} // closed once back within budget, nil while within
+	usage    func() (goroutines, files int, err error)
+	reported bool // open files couldn't be counted, and it was logged
+}
+
+func newResourceBudget(cfg *ResourceBudgetConfig) *resourceBudget {
+	b := &resourceBudget{cfg: cfg, maxFiles: cfg.MaxOpenFiles, usage: processUsage}
+	if b.maxFiles == 0 {
+		if limit, err := fileLimit(); err == nil {
+			b.maxFiles = limit
+		} else {
+			log.Warn().Err(err).Msg("Open files unbounded by the resource budget, failed to read the file limit")
+		}
+	}
+	return b
+}
+
+// processUsage returns the process's goroutines and open files.
+func processUsage() (int, int, error) {
+	files, err := openFiles()
+	return runtime.NumGoroutine(), files, err
+}
+
+// check samples usage against the budget, alerting once it's approached.
+func (b *resourceBudget) check() {
+	goroutines, files, err := b.usage()
+	metricGoroutines.Set(int64(goroutines))
+	if err == nil {
+		metricOpenFiles.Set(int64(files))
+	} else if !b.reported {
+		log.Warn().Err(err).Msg("Failed to count open files for the resource budget")
+		b.reported = true
+	}
+
+	over := ""
+	switch {
+	case b.cfg.MaxGoroutines > 0 && float64(goroutines) >= b.cfg.Threshold*float64(b.cfg.MaxGoroutines):
+		over = "goroutines"
+	case b.maxFiles > 0 && err == nil && float64(files) >= b.cfg.Threshold*float64(b.maxFiles):
+		over = "open_files"
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case over != "" && b.over == "":
+		log.Error().Str("resource", over).Int("goroutines", goroutines).Int("open_files", files).
+			Int("max_goroutines", b.cfg.MaxGoroutines).Int("max_open_files", b.maxFiles).
+			Msg("Approaching resource ceiling, no longer accepting clients")
+		metricResourceBudgetExceeded.Add(1, over)
+		metricOverResourceBudget.Set(1)
+		b.cleared = make(chan struct{})
+	case over == "" && b.over != "":
+		log.Info().Int("goroutines", goroutines).Int("open_files", files).Msg("Back within resource budget, accepting clients")
+		metricOverResourceBudget.Set(0)
+		close(b.cleared)
+		b.cleared = nil
+	}
+	b.over = over
+}
+
+// overBudget returns a channel closed once the proxy is back within its
+// budget, or nil if it is within it.
+func (b *resourceBudget) overBudget() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cleared
+}
+
+// runResourceBudget checks usage against the budget until ctx is cancelled.
+func (p *Proxy) runResourceBudget(ctx context.Context) {
+	p.budget.check()
+	ticker := time.NewTicker(p.budget.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.budget.check()
+		}
+	}
+}
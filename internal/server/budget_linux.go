@@ -0,0 +1,27 @@
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// procSelfFD lists the process's open files, a variable for tests.
+var procSelfFD = "/proc/self/fd"
+
+// openFiles returns the number of files the process has open.
+func openFiles() (int, error) {
+	entries, err := os.ReadDir(procSelfFD)
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// fileLimit returns the process's soft limit of open files.
+func fileLimit() (int, error) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, err
+	}
+	return int(min(limit.Cur, 1<<31-1)), nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package server
+
+import "errors"
+
+var errNoFileCount = errors.New("open files can only be counted on Linux")
+
+func openFiles() (int, error) {
+	return 0, errNoFileCount
+}
+
+func fileLimit() (int, error) {
+	return 0, errNoFileCount
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResourceBudget_Check(t *testing.T) {
+	b := newResourceBudget(&ResourceBudgetConfig{MaxGoroutines: 100, MaxOpenFiles: 1000, Threshold: 0.9})
+	goroutines, files := 50, 500
+	b.usage = func() (int, int, error) { return goroutines, files, nil }
+
+	b.check()
+	if b.overBudget() != nil {
+		t.Fatal("Expected usage within budget")
+	}
+	goroutines = 90
+	b.check()
+	cleared := b.overBudget()
+	if cleared == nil || b.over != "goroutines" {
+		t.Fatalf("Expected the goroutine threshold approached, over %q", b.over)
+	}
+	goroutines, files = 50, 950
+	b.check()
+	if b.overBudget() == nil || b.over != "open_files" {
+		t.Fatalf("Expected the open file threshold approached, over %q", b.over)
+	}
+	files = 100
+	b.check()
+	select {
+	case <-cleared:
+	default:
+		t.Fatal("Expected waiters released once back within budget")
+	}
+	if b.overBudget() != nil {
+		t.Error("Expected usage within budget again")
+	}
+}
+
+func TestResourceBudget_ProcessUsage(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("open files are only counted on Linux")
+	}
+	goroutines, files, err := processUsage()
+	if err != nil || goroutines < 1 || files < 3 {
+		t.Errorf("Expected the process's usage, got %d goroutines and %d files (%v)", goroutines, files, err)
+	}
+	if limit, err := fileLimit(); err != nil || limit < files {
+		t.Errorf("Expected the file limit above the files open, got %d (%v)", limit, err)
+	}
+}
+
+func TestServer_ResourceBudget(t *testing.T) {
+	cfg := &Config{DefaultBandwidth: 1 << 20, ResourceBudget: &ResourceBudgetConfig{
+		MaxGoroutines: 100, Threshold: 0.9, Interval: 10 * time.Millisecond,
+	}}
+	p := newTestProxy(cfg)
+	p.budget = newResourceBudget(cfg.ResourceBudget)
+	var goroutines atomic.Int64
+	goroutines.Store(95)
+	p.budget.usage = func() (int, int, error) { return int(goroutines.Load()), 0, nil }
+	p.budget.check()
+	dial, servers := pipeDialer()
+	p.SetDialer(dial)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, _ := runTestServer(ctx, t, p)
+	defer srv.Stop(time.Second)
+
+	rec := httptest.NewRecorder()
+	p.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected health checks failed over budget, got %d", rec.Code)
+	}
+
+	// The client waits in the listen backlog while over budget
+	client, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	select {
+	case <-servers:
+		t.Fatal("Expected the client not accepted over budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	goroutines.Store(10)
+	select {
+	case upstream := <-servers:
+		upstream.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the client accepted once back within budget")
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BurstCreditConfig configures banking users' unused rate as burst credit,
+// spent once their bucket runs dry. Over longer horizons than the bucket's
+// burst, users are then held to their rate on average, e.g. "1MB/s over the
+// hour" with a Max of 3600MB.
+type BurstCreditConfig struct {
+	// Max is the most credit a user can hold, in bytes.
+	Max int64 `yaml:"max"`
+	// DailyCap bounds the credit a user banks per day (UTC), in bytes.
+	// Zero bounds it by Max only.
+	DailyCap int64 `yaml:"daily_cap"`
+	// Interval between banking unused rate. Defaults to 1s.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// normalize applies defaults and validates the configuration.
+func (c *BurstCreditConfig) normalize() error {
+	if c.Max <= 0 {
+		return fmt.Errorf("burst_credit max must be positive")
+	}
+	if c.DailyCap < 0 {
+		return fmt.Errorf("burst_credit daily_cap must not be negative")
+	}
+	if c.Interval <= 0 {
+		c.Interval = time.Second
+	}
+	return nil
+}
+
+// burstCredit is a user's banked unused rate.
+type burstCredit struct {
+	mu      sync.Mutex
+	balance int64
+	banked  int64     // today
+	day     time.Time // UTC midnight banked is counted from
+	last    int64     // total bytes sent as of the previous banking
+	started bool      // last is set
+}
+
+// bank adds up to n bytes of credit, within the daily cap and max.
+func (c *burstCredit) bank(cfg *BurstCreditConfig, n int64, now time.Time) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if day := now.UTC().Truncate(24 * time.Hour); !day.Equal(c.day) {
+		c.day, c.banked = day, 0
+	}
+	if cfg.DailyCap > 0 {
+		n = min(n, cfg.DailyCap-c.banked)
+	}
+	n = max(min(n, cfg.Max-c.balance), 0)
+	c.balance += n
+	c.banked += n
+	return n
+}
+
+// spend takes up to n bytes of credit, returning how many it got.
+func (c *burstCredit) spend(n int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n = min(n, c.balance)
+	c.balance -= n
+	return n
+}
+
+// Balance returns the credit held.
+func (c *burstCredit) Balance() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.balance
+}
+
+// GetBurstCredit returns a user's burst credit, creating it if it doesn't
+// exist, or nil unless burst credit is enabled.
+func (rlm *RateLimiterManager) GetBurstCredit(username string) *burstCredit {
+	if rlm.config.BurstCredit == nil || username == "" {
+		return nil
+	}
+	v, ok := rlm.credits.Load(username)
+	if !ok {
+		v, _ = rlm.credits.LoadOrStore(username, &burstCredit{})
+	}
+	return v.(*burstCredit)
+}
+
+// BankBurstCredit banks the rate each user with traffic left unused over
+// the last interval. Users whose rate is scaled down bank their scaled rate.
+func (rlm *RateLimiterManager) BankBurstCredit(interval time.Duration) {
+	cfg := rlm.config.BurstCredit
+	now := rlm.Clock().Now()
+	for user, total := range rlm.TotalBytes() {
+		if rlm.IsBypassed(user, nil) {
+			continue
+		}
+		credit := rlm.GetBurstCredit(user)
+		credit.mu.Lock()
+		sent, started := total-credit.last, credit.started
+		credit.last, credit.started = total, true
+		credit.mu.Unlock()
+		if !started {
+			continue
+		}
+		allowed := float64(rlm.Bandwidth(user)) * rlm.Scale(user) * interval.Seconds()
+		if unused := int64(allowed) - sent; unused > 0 {
+			metricBurstCreditBanked.Add(credit.bank(cfg, unused, now), user)
+		}
+	}
+}
+
+// runBurstCredit banks unused rate until ctx is cancelled.
+func (p *Proxy) runBurstCredit(ctx context.Context) {
+	interval := p.currentConfig().BurstCredit.Interval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.rateLimiterMgr.BankBurstCredit(interval)
+		}
+	}
+}
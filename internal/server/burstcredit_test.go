@@ -0,0 +1,66 @@
+package server
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBurstCredit_Bank(t *testing.T) {
+	cfg := &BurstCreditConfig{Max: 1000, DailyCap: 600}
+	day := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	var c burstCredit
+	if got := c.bank(cfg, 400, day); got != 400 {
+		t.Errorf("Expected 400 banked, got %d", got)
+	}
+	if got := c.bank(cfg, 400, day.Add(time.Hour)); got != 200 {
+		t.Errorf("Expected the daily cap to leave 200, got %d", got)
+	}
+	if got := c.bank(cfg, 600, day.Add(12*time.Hour)); got != 400 {
+		t.Errorf("Expected the next day's banking capped by max to 400, got %d", got)
+	}
+	if got := c.spend(1500); got != 1000 || c.Balance() != 0 {
+		t.Errorf("Expected the whole balance of 1000 spent, got %d leaving %d", got, c.Balance())
+	}
+}
+
+func TestRateLimiterManager_BankBurstCredit(t *testing.T) {
+	cfg := &Config{DefaultBandwidth: 1000, BurstCredit: &BurstCreditConfig{Max: 1 << 20}}
+	rlm := NewRateLimiterManager(cfg)
+	rlm.RecordBytes("alice", 100)
+	rlm.BankBurstCredit(time.Second) // starts counting
+	rlm.RecordBytes("alice", 300)
+	rlm.BankBurstCredit(time.Second)
+	if got := rlm.Usage("alice").BurstCredit; got != 700 {
+		t.Errorf("Expected the 700 bytes unused banked, got %d", got)
+	}
+	rlm.RecordBytes("alice", 5000)
+	rlm.BankBurstCredit(time.Second)
+	if got := rlm.Usage("alice").BurstCredit; got != 700 {
+		t.Errorf("Expected nothing banked over the rate, got %d", got)
+	}
+}
+
+func TestRateLimitedWriter_SpendsBurstCredit(t *testing.T) {
+	clock := newFakeClock()
+	rlm := NewRateLimiterManager(&Config{DefaultBandwidth: 1000, BurstCredit: &BurstCreditConfig{Max: 1 << 20}})
+	rlm.SetClock(clock)
+	credit := rlm.GetBurstCredit("alice")
+	credit.bank(rlm.config.BurstCredit, 3000, clock.Now())
+
+	w := NewRateLimitedWriter(io.Discard)
+	w.SetClock(clock)
+	w.Rebind("alice", rlm.GetLimiter("alice"), nil, nil, nil, credit, nil)
+	// The bucket's 1000 bytes and the 3000 banked go through at once
+	w.Write(make([]byte, 4000))
+	if slept := clock.Slept(); slept != 0 {
+		t.Errorf("Expected the burst covered by credit, waited %v", slept)
+	}
+	if credit.Balance() != 0 {
+		t.Errorf("Expected the credit spent, %d left", credit.Balance())
+	}
+	w.Write(make([]byte, 1000))
+	if slept := clock.Slept(); slept < 900*time.Millisecond {
+		t.Errorf("Expected the rate applied once credit is spent, waited %v", slept)
+	}
+}
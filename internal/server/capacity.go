@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// egressBandwidthAnnotation is the pod annotation the Kubernetes bandwidth
+// plugin shapes egress traffic with, e.g. "100M" for 100Mbit/s.
+const egressBandwidthAnnotation = "kubernetes.io/egress-bandwidth"
+
+// defaultAnnotationsFile is where pod annotations are conventionally mounted
+// with the downward API.
+const defaultAnnotationsFile = "/etc/podinfo/annotations"
+
+// errNoCapacity is returned when no capacity source is available.
+var errNoCapacity = errors.New("no network capacity found")
+
+// detectCapacity returns the proxy's network capacity in bytes per second,
+// preferring the pod's egress bandwidth annotation over the interface speed.
+func detectCapacity(cfg *UplinkConfig) (int64, error) {
+	annotations := cfg.AnnotationsFile
+	if annotations == "" {
+		annotations = defaultAnnotationsFile
+	}
+	bits, err := annotationBandwidth(annotations)
+	if err == nil {
+		return bits / 8, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, errNoCapacity) {
+		return 0, err
+	}
+
+	iface := cfg.Interface
+	if iface == "" {
+		if iface, err = defaultInterface(); err != nil {
+			return 0, err
+		}
+	}
+	mbits, err := interfaceSpeed(iface)
+	if err != nil {
+		return 0, err
+	}
+	return mbits * 1000 * 1000 / 8, nil
+}
+
+// annotationBandwidth returns the egress bandwidth in bits per second from a
+// downward API annotations file, with lines like key="value".
+func annotationBandwidth(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || key != egressBandwidthAnnotation {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		bits, err := parseQuantity(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s annotation %q: %w", egressBandwidthAnnotation, value, err)
+		}
+		return bits, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errNoCapacity
+}
+
+// quantitySuffixes are the Kubernetes quantity suffixes used for bandwidths.
+var quantitySuffixes = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+	{"k", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+}
+
+// parseQuantity parses a Kubernetes quantity such as "100M" or "1Gi".
+func parseQuantity(s string) (int64, error) {
+	multiplier := 1.0
+	for _, q := range quantitySuffixes {
+		if number, ok := strings.CutSuffix(s, q.suffix); ok {
+			s, multiplier = number, q.multiplier
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("not a positive quantity")
+	}
+	return int64(v * multiplier), nil
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Paths of the kernel interfaces capacity detection reads, variables for tests.
+var (
+	sysClassNet  = "/sys/class/net"
+	procNetRoute = "/proc/net/route"
+)
+
+// interfaceSpeed returns the link speed of a network interface in Mbit/s.
+func interfaceSpeed(iface string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(sysClassNet, iface, "speed"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read speed of %s: %w", iface, err)
+	}
+	speed, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || speed <= 0 {
+		// Virtual interfaces such as veth report -1 or fail the read
+		return 0, fmt.Errorf("%s doesn't report a link speed: %w", iface, errNoCapacity)
+	}
+	return speed, nil
+}
+
+// defaultInterface returns the interface of the IPv4 default route.
+func defaultInterface() (string, error) {
+	f, err := os.Open(procNetRoute)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[1] == "00000000" {
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no default route: %w", errNoCapacity)
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectCapacity_InterfaceSpeed(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "eth0"), 0o755)
+	os.MkdirAll(filepath.Join(dir, "veth0"), 0o755)
+	os.WriteFile(filepath.Join(dir, "eth0", "speed"), []byte("1000\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "veth0", "speed"), []byte("-1\n"), 0o644)
+	route := filepath.Join(dir, "route")
+	os.WriteFile(route, []byte("Iface\tDestination\tGateway\n"+
+		"veth0\t0010A8C0\t00000000\n"+
+		"eth0\t00000000\t0100A8C0\n"), 0o644)
+
+	defer func(net, r string) { sysClassNet, procNetRoute = net, r }(sysClassNet, procNetRoute)
+	sysClassNet, procNetRoute = dir, route
+	cfg := &UplinkConfig{AnnotationsFile: filepath.Join(dir, "missing")}
+
+	capacity, err := detectCapacity(cfg)
+	if err != nil || capacity != 125e6 {
+		t.Errorf("Expected 125MB/s from eth0's speed, got %d, %v", capacity, err)
+	}
+
+	cfg.Interface = "veth0"
+	if _, err := detectCapacity(cfg); err == nil {
+		t.Error("Expected detection to fail for an interface without a link speed")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package server
+
+import "fmt"
+
+func interfaceSpeed(iface string) (int64, error) {
+	return 0, fmt.Errorf("interface speed detection is only supported on Linux: %w", errNoCapacity)
+}
+
+func defaultInterface() (string, error) {
+	return "", fmt.Errorf("interface detection is only supported on Linux: %w", errNoCapacity)
+}
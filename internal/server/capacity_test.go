@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseQuantity(t *testing.T) {
+	tests := []struct {
+		in     string
+		expect int64
+	}{
+		{"100M", 100e6},
+		{"1G", 1e9},
+		{"1.5k", 1500},
+		{"10Mi", 10 << 20},
+		{"12345", 12345},
+	}
+	for _, tt := range tests {
+		got, err := parseQuantity(tt.in)
+		if err != nil || got != tt.expect {
+			t.Errorf("parseQuantity(%q) = %d, %v; expected %d", tt.in, got, err, tt.expect)
+		}
+	}
+	for _, in := range []string{"", "M", "-1M", "fast"} {
+		if _, err := parseQuantity(in); err == nil {
+			t.Errorf("Expected parseQuantity(%q) to fail", in)
+		}
+	}
+}
+
+func TestDetectCapacity(t *testing.T) {
+	dir := t.TempDir()
+	annotations := filepath.Join(dir, "annotations")
+	os.WriteFile(annotations, []byte("app=\"proxy\"\nkubernetes.io/egress-bandwidth=\"80M\"\n"), 0o644)
+
+	capacity, err := detectCapacity(&UplinkConfig{AnnotationsFile: annotations})
+	if err != nil || capacity != 10e6 {
+		t.Errorf("Expected 10MB/s from the annotation, got %d, %v", capacity, err)
+	}
+
+	os.WriteFile(annotations, []byte("app=\"proxy\"\n"), 0o644)
+	_, err = detectCapacity(&UplinkConfig{AnnotationsFile: annotations, Interface: "does-not-exist"})
+	if err == nil {
+		t.Error("Expected detection to fail without annotation or interface speed")
+	}
+
+	_, err = annotationBandwidth(filepath.Join(dir, "missing"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a missing annotations file to be reported as such, got %v", err)
+	}
+}
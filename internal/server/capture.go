@@ -0,0 +1,290 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+// CaptureConfig configures capturing a sample of published messages, their
+// subjects, sizes and optionally headers and payload prefixes, to a sink for
+// offline traffic analysis.
+type CaptureConfig struct {
+	// Percent of messages captured, up to 100.
+	Percent float64 `yaml:"percent"`
+	// Subjects limits capture to matching subjects. Empty captures all.
+	Subjects []string `yaml:"subjects"`
+
+	// File appends records as JSON lines. Either File or Subject is
+	// required.
+	File string `yaml:"file"`
+	// MaxBytes stops appending to File once it is this large. Zero doesn't
+	// cap it.
+	MaxBytes int64 `yaml:"max_bytes"`
+	// Subject publishes records to the upstream instead, e.g. into a
+	// JetStream stream capturing it.
+	Subject string `yaml:"subject"`
+	// Credentials is a creds file authenticating the proxy with the
+	// upstream, if it requires it.
+	Credentials string `yaml:"credentials"`
+
+	// Privacy controls. Headers records header "names" (default), "all"
+	// names and values, or "none".
+	Headers string `yaml:"headers"`
+	// PayloadBytes records up to this many bytes of payloads. Zero, the
+	// default, records none.
+	PayloadBytes int `yaml:"payload_bytes"`
+	// SubjectTokens keeps only the first tokens of subjects, replacing the
+	// others, which often carry IDs, with "*". Zero keeps whole subjects.
+	SubjectTokens int `yaml:"subject_tokens"`
+	// PseudonymizeUsers records a salted hash of user names instead.
+	PseudonymizeUsers bool   `yaml:"pseudonymize_users"`
+	Salt              string `yaml:"salt"`
+}
+
+// Capture header modes.
+const (
+	CaptureHeadersNone  = "none"
+	CaptureHeadersNames = "names"
+	CaptureHeadersAll   = "all"
+)
+
+// normalize applies defaults and validates the configuration.
+func (c *CaptureConfig) normalize() error {
+	if c.Percent <= 0 || c.Percent > 100 {
+		return fmt.Errorf("traffic_capture percent must be in (0, 100]")
+	}
+	if (c.File == "") == (c.Subject == "") {
+		return fmt.Errorf("traffic_capture requires either a file or a subject")
+	}
+	switch c.Headers {
+	case "":
+		c.Headers = CaptureHeadersNames
+	case CaptureHeadersNone, CaptureHeadersNames, CaptureHeadersAll:
+	default:
+		return fmt.Errorf("invalid traffic_capture headers %q", c.Headers)
+	}
+	if c.PayloadBytes < 0 || c.SubjectTokens < 0 || c.MaxBytes < 0 {
+		return fmt.Errorf("traffic_capture payload_bytes, subject_tokens and max_bytes must not be negative")
+	}
+	return nil
+}
+
+// captureRecord is a captured message.
+type captureRecord struct {
+	Time       time.Time           `json:"time"`
+	User       string              `json:"user"`
+	Subject    string              `json:"subject"`
+	Reply      bool                `json:"reply,omitempty"` // whether it's a request
+	Size       int                 `json:"size"`
+	HeaderSize int                 `json:"header_size,omitempty"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Payload    []byte              `json:"payload,omitempty"` // prefix, base64 in JSON
+}
+
+// captureQueue bounds the records waiting for the sink; more are dropped.
+const captureQueue = 4096
+
+// trafficCapture samples published messages into a sink. Records are
+// written in the background, so a slow sink drops records instead of
+// slowing publishers down.
+type trafficCapture struct {
+	cfg     *CaptureConfig
+	records chan []byte
+	stopped atomic.Bool // the sink is full
+}
+
+var errCaptureFull = errors.New("capture file reached max_bytes")
+
+func newTrafficCapture(cfg *CaptureConfig) *trafficCapture {
+	return &trafficCapture{cfg: cfg, records: make(chan []byte, captureQueue)}
+}
+
+// observe captures a PUB or HPUB frame of user, with Percent probability.
+// The frame is whole, or its start if it was over the parser's buffer.
+func (t *trafficCapture) observe(user string, frame []byte, now time.Time) {
+	if t.stopped.Load() || rand.Float64()*100 >= t.cfg.Percent {
+		return
+	}
+	record, ok := t.record(user, frame, now)
+	if !ok {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	select {
+	case t.records <- append(data, '\n'):
+	default:
+		metricCaptureRecords.Add(1, "dropped")
+	}
+}
+
+// record parses a frame into a record with the privacy controls applied.
+func (t *trafficCapture) record(user string, frame []byte, now time.Time) (captureRecord, bool) {
+	end := bytes.Index(frame, []byte("\r\n"))
+	if end < 0 {
+		return captureRecord{}, false
+	}
+	args := bytes.Fields(frame[:end])
+	hdr := len(args) > 0 && strings.EqualFold(string(args[0]), "HPUB")
+	if len(args) < 3 || (hdr && len(args) < 4) {
+		return captureRecord{}, false
+	}
+	args = args[1:]
+	subject := string(args[0])
+	if len(t.cfg.Subjects) > 0 && !matchesAny(t.cfg.Subjects, subject) {
+		return captureRecord{}, false
+	}
+	record := captureRecord{
+		Time:    now,
+		User:    user,
+		Subject: truncateSubject(subject, t.cfg.SubjectTokens),
+		Size:    parseSize(args[len(args)-1]),
+	}
+	if hdr {
+		record.Reply = len(args) == 4
+		record.HeaderSize = parseSize(args[len(args)-2])
+	} else {
+		record.Reply = len(args) == 3
+	}
+	if t.cfg.PseudonymizeUsers {
+		sum := sha256.Sum256([]byte(t.cfg.Salt + user))
+		record.User = hex.EncodeToString(sum[:8])
+	}
+
+	// Of frames over the parser's buffer, only the start is seen
+	payload := frame[end+2:]
+	if len(payload) > record.Size {
+		payload = payload[:record.Size]
+	}
+	if record.HeaderSize < 0 || record.Size < record.HeaderSize {
+		return captureRecord{}, false
+	}
+	if hdr && t.cfg.Headers != CaptureHeadersNone && len(payload) >= record.HeaderSize {
+		record.Headers = parseHeaders(payload[:record.HeaderSize], t.cfg.Headers == CaptureHeadersAll)
+	}
+	if n := min(t.cfg.PayloadBytes, len(payload)-record.HeaderSize); n > 0 {
+		record.Payload = bytes.Clone(payload[record.HeaderSize : record.HeaderSize+n])
+	}
+	return record, true
+}
+
+// truncateSubject keeps the first tokens of subject, replacing the others
+// with "*". Zero tokens keeps the whole subject.
+func truncateSubject(subject string, tokens int) string {
+	if tokens == 0 {
+		return subject
+	}
+	parts := strings.Split(subject, ".")
+	for i := tokens; i < len(parts); i++ {
+		parts[i] = "*"
+	}
+	return strings.Join(parts, ".")
+}
+
+// parseHeaders parses a NATS/1.0 header block, with empty values unless
+// values are wanted.
+func parseHeaders(block []byte, values bool) map[string][]string {
+	_, rest, ok := bytes.Cut(block, []byte("\r\n"))
+	if !ok {
+		return nil
+	}
+	headers := make(map[string][]string)
+	for _, line := range bytes.Split(rest, []byte("\r\n")) {
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok || len(name) == 0 {
+			continue
+		}
+		key := string(bytes.TrimSpace(name))
+		if values {
+			headers[key] = append(headers[key], string(bytes.TrimSpace(value)))
+		} else if _, seen := headers[key]; !seen {
+			headers[key] = []string{}
+		}
+	}
+	return headers
+}
+
+// runCapture writes records to the sink until ctx is cancelled or the sink
+// is full.
+func (p *Proxy) runCapture(ctx context.Context) {
+	cfg := p.currentConfig().TrafficCapture
+	write, closeSink, err := p.openCaptureSink(cfg)
+	if err != nil {
+		log.Error().Err(err).Msg("Traffic capture disabled")
+		return
+	}
+	defer closeSink()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case record := <-p.capture.records:
+			if err := write(record); errors.Is(err, errCaptureFull) {
+				log.Warn().Str("file", cfg.File).Msg("Traffic capture stopped, file reached max_bytes")
+				p.capture.stopped.Store(true)
+				return
+			} else if err != nil {
+				log.Warn().Err(err).Msg("Failed to write capture record")
+				metricCaptureRecords.Add(1, "error")
+				continue
+			}
+			metricCaptureRecords.Add(1, "ok")
+		}
+	}
+}
+
+// openCaptureSink opens the configured file or upstream subject.
+func (p *Proxy) openCaptureSink(cfg *CaptureConfig) (write func([]byte) error, closeSink func(), err error) {
+	if cfg.File != "" {
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		size := info.Size()
+		write = func(record []byte) error {
+			if cfg.MaxBytes > 0 && size+int64(len(record)) > cfg.MaxBytes {
+				return errCaptureFull
+			}
+			n, err := f.Write(record)
+			size += int64(n)
+			return err
+		}
+		return write, func() { f.Close() }, nil
+	}
+
+	url := "nats://" + net.JoinHostPort(p.upstreamHost, strconv.Itoa(p.upstreamPort))
+	opts := []nats.Option{nats.Name("nats-limiter-proxy traffic capture"), nats.MaxReconnects(-1), nats.RetryOnFailedConnect(true)}
+	if cfg.Credentials != "" {
+		opts = append(opts, nats.UserCredentials(cfg.Credentials))
+	}
+	nc, err := nats.Connect(url, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	write = func(record []byte) error {
+		return nc.Publish(cfg.Subject, bytes.TrimSuffix(record, []byte("\n")))
+	}
+	return write, func() { nc.Flush(); nc.Close() }, nil
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+func TestTrafficCapture_Record(t *testing.T) {
+	capture := newTrafficCapture(&CaptureConfig{Percent: 100, Headers: CaptureHeadersNames, PayloadBytes: 3, SubjectTokens: 2})
+	now := time.Now()
+	frame := []byte("HPUB orders.eu.12345 _INBOX.1 35 40\r\nNATS/1.0\r\nTrace-Id: abc\r\nKey: v\r\n\r\nhello\r\n")
+	record, ok := capture.record("alice", frame, now)
+	if !ok {
+		t.Fatal("Expected the frame captured")
+	}
+	if record.Subject != "orders.eu.*" || !record.Reply || record.Size != 40 || record.HeaderSize != 35 {
+		t.Errorf("Expected the truncated subject and sizes, got %+v", record)
+	}
+	if values, ok := record.Headers["Trace-Id"]; !ok || len(values) != 0 || len(record.Headers) != 2 {
+		t.Errorf("Expected header names only, got %v", record.Headers)
+	}
+	if string(record.Payload) != "hel" {
+		t.Errorf("Expected a 3 byte payload prefix, got %q", record.Payload)
+	}
+
+	capture.cfg.PseudonymizeUsers = true
+	capture.cfg.PayloadBytes = 0
+	capture.cfg.Subjects = []string{"orders.>"}
+	record, _ = capture.record("alice", []byte("PUB orders.us 5\r\nhello\r\n"), now)
+	if record.User == "alice" || len(record.User) != 16 || record.Payload != nil || record.Reply {
+		t.Errorf("Expected a pseudonymized user and no payload, got %+v", record)
+	}
+	if _, ok := capture.record("alice", []byte("PUB payments.us 5\r\nhello\r\n"), now); ok {
+		t.Error("Expected subjects outside the filter skipped")
+	}
+}
+
+func TestClientMessageParser_CaptureLargeFrames(t *testing.T) {
+	var output bytes.Buffer
+	large := strings.Repeat("x", 10000)
+	input := "CONNECT {\"user\":\"alice\"}\r\n" +
+		"HPUB metrics.cpu 25 10025\r\nNATS/1.0\r\nTrace-Id: a\r\n\r\n" + large + "\r\n" +
+		"PUB metrics.mem 2\r\nhi\r\n"
+	mockRLM := &mockRateLimiterManager{bucket: ratelimit.NewBucketWithRate(1<<20, 1<<20)}
+	parser := NewClientMessageParser(strings.NewReader(input), &output, mockRLM)
+	capture := newTrafficCapture(&CaptureConfig{Percent: 100, Headers: CaptureHeadersNames, PayloadBytes: 4})
+	parser.SetTrafficCapture(capture)
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+
+	var records []captureRecord
+	for len(capture.records) > 0 {
+		var record captureRecord
+		json.Unmarshal(<-capture.records, &record)
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected both frames captured, got %+v", records)
+	}
+	if r := records[0]; r.Subject != "metrics.cpu" || r.Size != 10025 || r.HeaderSize != 25 || len(r.Headers) != 1 || string(r.Payload) != "xxxx" {
+		t.Errorf("Expected the frame over the buffer captured with its sizes and headers, got %+v", r)
+	}
+	if r := records[1]; r.Subject != "metrics.mem" || r.Size != 2 {
+		t.Errorf("Expected the next frame captured whole, got %+v", r)
+	}
+}
+
+func TestProxy_CaptureToFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "capture.jsonl")
+	cfg := &Config{TrafficCapture: &CaptureConfig{Percent: 100, File: file, MaxBytes: 300}}
+	if err := cfg.TrafficCapture.normalize(); err != nil {
+		t.Fatalf("normalize failed: %v", err)
+	}
+	p := newTestProxy(cfg)
+	p.capture = newTrafficCapture(cfg.TrafficCapture)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		p.runCapture(ctx)
+		close(done)
+	}()
+
+	for range 10 {
+		p.capture.observe("alice", []byte("PUB metrics.cpu 2\r\nhi\r\n"), time.Now())
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected capture to stop at max_bytes")
+	}
+	data, _ := os.ReadFile(file)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(data) > 300 || len(lines) < 2 {
+		t.Fatalf("Expected records up to max_bytes, got %d bytes", len(data))
+	}
+	var record captureRecord
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil || record.Subject != "metrics.cpu" || record.Size != 2 {
+		t.Errorf("Expected a JSON record of the message, got %q", lines[0])
+	}
+	if !p.capture.stopped.Load() {
+		t.Error("Expected sampling stopped once the file is full")
+	}
+}
+
+func TestLoadConfig_InvalidTrafficCapture(t *testing.T) {
+	for _, yaml := range []string{
+		"traffic_capture:\n  file: c.jsonl\n",
+		"traffic_capture:\n  percent: 1\n",
+		"traffic_capture:\n  percent: 1\n  file: c.jsonl\n  subject: capture\n",
+		"traffic_capture:\n  percent: 1\n  file: c.jsonl\n  headers: some\n",
+	} {
+		if _, err := LoadConfig(writeTestConfig(t, yaml)); err == nil {
+			t.Errorf("Expected an error for %q", yaml)
+		}
+	}
+}
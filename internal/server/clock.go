@@ -0,0 +1,18 @@
+package server
+
+import "time"
+
+// Clock is the time source rate limiters measure refills with and throttled
+// writes wait on. Tests replace it to throttle without sleeping; the limiters
+// and the writers charging them must share the same clock.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// systemClock is the real time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
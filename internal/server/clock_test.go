@@ -0,0 +1,128 @@
+package server
+
+import (
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// fakeClock is a Clock whose Sleep advances time instantly, so throttling can
+// be measured without waiting for it.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	slept time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.slept += d
+}
+
+// Slept returns the total time slept.
+func (c *fakeClock) Slept() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.slept
+}
+
+func TestRateLimitedWriter_FakeClock(t *testing.T) {
+	clock := newFakeClock()
+	w := NewRateLimitedWriter(io.Discard)
+	w.SetClock(clock)
+	w.UpdateRateLimiter(ratelimit.NewBucketWithRateAndClock(100, 100, clock))
+
+	// The first 100 bytes are the burst, the next 500 take 5s at 100 bytes/s
+	for i := 0; i < 6; i++ {
+		w.Write(make([]byte, 100))
+	}
+	if slept := clock.Slept(); slept != 5*time.Second {
+		t.Errorf("Expected 5s of throttling, got %v", slept)
+	}
+}
+
+func TestRateLimiterManager_SetClock(t *testing.T) {
+	clock := newFakeClock()
+	rlm := NewRateLimiterManager(&Config{DefaultBandwidth: 1000})
+	before := rlm.GetLimiter("alice")
+	rlm.SetClock(clock)
+
+	limiter := rlm.GetLimiter("alice")
+	if limiter == before {
+		t.Fatal("Expected limiters recreated with the new clock")
+	}
+	if wait := limiter.Take(3000); wait != 2*time.Second {
+		t.Errorf("Expected a 2s wait for 3000 bytes at 1000 bytes/s, got %v", wait)
+	}
+	clock.Sleep(2 * time.Second)
+	if available := limiter.Available(); available != 0 {
+		t.Errorf("Expected the bucket drained after sleeping off the debt, got %d", available)
+	}
+}
+
+// timedWriter records when each write happens on a clock.
+type timedWriter struct {
+	clock *fakeClock
+	start time.Time
+	times []time.Duration
+	sizes []int
+}
+
+func (w *timedWriter) Write(p []byte) (int, error) {
+	w.times = append(w.times, w.clock.Now().Sub(w.start))
+	w.sizes = append(w.sizes, len(p))
+	return len(p), nil
+}
+
+func TestRateLimitedWriter_ChunksLargeWrites(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunkSize int
+		sizes     []int
+		times     []time.Duration
+	}{
+		{"Chunks of the bucket capacity", 0, []int{500, 500, 500, 500}, []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second}},
+		{"Configured chunk size", 250, []int{250, 250, 250, 250, 250, 250, 250, 250}, []time.Duration{
+			0, 0, 500 * time.Millisecond, time.Second, 1500 * time.Millisecond,
+			2 * time.Second, 2500 * time.Millisecond, 3 * time.Second,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			out := &timedWriter{clock: clock, start: clock.Now()}
+			w := NewRateLimitedWriter(out)
+			w.SetClock(clock)
+			w.SetChunkSize(tt.chunkSize)
+			w.UpdateRateLimiter(ratelimit.NewBucketWithRateAndClock(500, 500, clock))
+
+			if n, err := w.Write(make([]byte, 2000)); n != 2000 || err != nil {
+				t.Fatalf("Expected 2000 bytes written, got %d, %v", n, err)
+			}
+			if !slices.Equal(out.sizes, tt.sizes) {
+				t.Errorf("Expected writes of %v bytes, got %v", tt.sizes, out.sizes)
+			}
+			for i, at := range out.times {
+				if i < len(tt.times) && (at-tt.times[i]).Abs() > time.Millisecond {
+					t.Errorf("Expected write %d at %v, got %v", i, tt.times[i], at)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// closeReason describes why a proxied connection ended.
+type closeReason string
+
+const (
+	closeClientEOF          closeReason = "client_eof"
+	closeClientError        closeReason = "client_error"
+	closeUpstreamEOF        closeReason = "upstream_eof"
+	closeUpstreamError      closeReason = "upstream_error"
+	closeClientWriteError   closeReason = "client_write_error"
+	closeUpstreamWriteError closeReason = "upstream_write_error"
+	closePendingLimit       closeReason = "pending_limit"
+	closeDialError          closeReason = "upstream_dial_error"
+	closePolicyRejected     closeReason = "policy_rejected"
+	closeTLSHandshake       closeReason = "tls_handshake_error"
+	closeWebSocketUpgrade   closeReason = "websocket_upgrade_error"
+	closeMaxConnectionAge   closeReason = "max_connection_age"
+	closeLameDuck           closeReason = "lame_duck"
+	closeUnknownUser        closeReason = "unknown_user"
+	closeUpstreamAuth       closeReason = "upstream_auth_error"
+	closeClientAuth         closeReason = "client_auth_error"
+	closeMemoryCap          closeReason = "memory_cap"
+	closeAdminDisconnect    closeReason = "admin_disconnect"
+	closeHeldSignedConnect  closeReason = "held_signed_connect"
+)
+
+// clientErrors are the -ERR messages sent to the client before the proxy
+// closes a connection for its own reasons, so client logs show why.
+var clientErrors = map[closeReason]string{
+	closeDialError:       "Upstream Unavailable",
+	closePendingLimit:    "Maximum Pending Bytes Exceeded",
+	closePolicyRejected:  "Authorization Violation",
+	closeUnknownUser:     "Authorization Violation",
+	closeClientAuth:      "Authorization Violation",
+	closeMemoryCap:       "Maximum Buffer Memory Exceeded",
+	closeAdminDisconnect: "Disconnected By Operator",
+}
+
+// clientErrorLine returns the -ERR protocol line for a close reason, or nil
+// if the client isn't told about it.
+func clientErrorLine(reason closeReason) []byte {
+	msg, ok := clientErrors[reason]
+	if !ok {
+		return nil
+	}
+	return []byte("-ERR '" + msg + "'\r\n")
+}
+
+// closeError attributes an error to the reason it ends the connection.
+type closeError struct {
+	reason closeReason
+	err    error
+}
+
+func (e *closeError) Error() string {
+	return string(e.reason) + ": " + e.err.Error()
+}
+
+func (e *closeError) Unwrap() error {
+	return e.err
+}
+
+// closeReasonOf returns why an error (nil on a clean EOF) ended the
+// client->upstream direction if fromClient is set, or else the
+// upstream->client direction.
+func closeReasonOf(err error, fromClient bool) closeReason {
+	var ce *closeError
+	switch {
+	case errors.As(err, &ce):
+		return ce.reason
+	case errors.Is(err, errPendingLimitExceeded):
+		return closePendingLimit
+	case fromClient && (err == nil || errors.Is(err, io.EOF)):
+		return closeClientEOF
+	case fromClient:
+		return closeClientError
+	case err == nil || errors.Is(err, io.EOF):
+		return closeUpstreamEOF
+	default:
+		return closeUpstreamError
+	}
+}
+
+// closeRecorder records the first reason a connection ends; the other
+// direction's error is usually just a consequence of it.
+type closeRecorder struct {
+	once   sync.Once
+	reason closeReason
+	err    error
+}
+
+func (r *closeRecorder) record(err error, fromClient bool) {
+	r.once.Do(func() {
+		r.reason = closeReasonOf(err, fromClient)
+		r.err = err
+	})
+}
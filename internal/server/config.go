@@ -0,0 +1,1028 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	DefaultBandwidth int64 `yaml:"default_bandwidth"`
+	// Users sets bandwidth for specific users. An entry is either the
+	// bandwidth or {bandwidth, burst} to give the user a burst of their own,
+	// see UserBursts.
+	Users map[string]int64 `yaml:"users"`
+	// DefaultBurst is the burst of users' own limits, for users without a
+	// burst of their own. Defaults to the burst of bucket.
+	DefaultBurst time.Duration `yaml:"default_burst"`
+	// UserBursts overrides DefaultBurst for specific users, e.g. 100ms for
+	// users whose bursts overwhelm consumers, or 10s for batch users
+	// uploading more than a second's worth at once. The burst of a users
+	// entry is merged into it, taking precedence.
+	UserBursts map[string]time.Duration `yaml:"user_bursts"`
+
+	// Clients sets bandwidth by the name clients announce in CONNECT, for
+	// applications sharing one user's credentials. Each named application
+	// gets a limit of its own per user, charged on top of the user's limit.
+	Clients map[string]int64 `yaml:"clients"`
+
+	// GeoIP labels connections with the country and region of the client's
+	// address and limits them differently. Nil disables it.
+	GeoIP *GeoIPConfig `yaml:"geoip"`
+
+	// Bucket shapes the token buckets of all limiters.
+	Bucket BucketConfig `yaml:"bucket"`
+	// LimitRamp spreads a user's limit reduction made at runtime, e.g. via
+	// the admin API, over this long: the rate steps down linearly from the
+	// old limit instead of stalling connections at once. Zero applies
+	// reductions immediately.
+	LimitRamp time.Duration `yaml:"limit_ramp"`
+
+	// Tenants namespaces users by tenant, each with an admin token scoped to
+	// viewing and adjusting limits of the tenant's own users.
+	Tenants map[string]*TenantConfig `yaml:"tenants"`
+
+	// RequireKnownUser rejects clients that don't identify as a user with a
+	// limit of their own, configured here or for a tenant, or set through the
+	// admin API or by the policy hook, or as a bypassed user, instead of
+	// giving them DefaultBandwidth.
+	// The proxy then gates access as well as limiting it.
+	RequireKnownUser bool `yaml:"require_known_user"`
+
+	// Bypass lists service accounts that aren't rate limited at all.
+	Bypass BypassConfig `yaml:"bypass"`
+
+	// ControlLane guarantees each user a minimum bandwidth for protocol ops
+	// and control subjects, separate from their bulk limit. Nil disables it.
+	ControlLane *ControlLaneConfig `yaml:"control_lane"`
+
+	// ClassRules route messages to limit classes by expressions over the
+	// user, subject, size and time, checked before the subject lists of the
+	// control lane and object store.
+	ClassRules []*ClassRule `yaml:"class_rules"`
+
+	// ObjectStore gives object store uploads their own per-user limit, so
+	// large object PUTs and messaging don't starve each other. Nil disables it.
+	ObjectStore *ObjectStoreConfig `yaml:"object_store"`
+
+	// Streams caps the ingest rate of JetStream streams, keyed by stream
+	// name, across all users publishing to their subjects. A subject of
+	// several streams is capped by the first by name.
+	Streams map[string]*StreamConfig `yaml:"streams"`
+
+	// ReplayBoost temporarily raises the limits of users whose consumers
+	// start pulling from JetStream, so catching up after downtime isn't held
+	// to steady-state limits. Nil disables it.
+	ReplayBoost *ReplayBoostConfig `yaml:"replay_boost"`
+
+	// BurstCredit banks users' unused rate beyond their bucket's capacity,
+	// to be spent on bursts later. Nil disables it.
+	BurstCredit *BurstCreditConfig `yaml:"burst_credit"`
+
+	// ConnectionQuotas guarantees each of a user's connections an equal
+	// share of the user's bandwidth, forwarded without waiting on the other
+	// connections, which borrow what idle ones leave. A bulk upload then
+	// can't starve the same app's other connections. Connections limited
+	// by their CONNECT name or country aren't guaranteed a share.
+	ConnectionQuotas bool `yaml:"connection_quotas"`
+
+	// UpstreamScheduler bounds concurrent upstream writes, scheduling them
+	// in weighted round-robin across limit classes. Nil doesn't bound them.
+	UpstreamScheduler *UpstreamSchedulerConfig `yaml:"upstream_scheduler"`
+
+	// ResourceBudget bounds the proxy's own goroutines and open files, no
+	// longer accepting clients as they are approached. Nil doesn't bound
+	// them.
+	ResourceBudget *ResourceBudgetConfig `yaml:"resource_budget"`
+
+	// MemoryCap caps the buffer memory of all client connections, shedding
+	// connections past it. Nil doesn't cap it.
+	MemoryCap *MemoryCapConfig `yaml:"memory_cap"`
+
+	// MetricLabels bounds the metric label values clients announce in
+	// CONNECT. Nil keeps the first 50 distinct values of each.
+	MetricLabels *MetricLabelsConfig `yaml:"metric_labels"`
+
+	// Middleware selects the named middleware published messages pass
+	// through per user or tenant. Nil runs all of it for everyone.
+	Middleware *MiddlewareConfig `yaml:"middleware"`
+
+	// MaxPendingBytes caps the bytes read from a user's clients but not yet
+	// forwarded upstream, across all of the user's connections. Zero disables it.
+	MaxPendingBytes int64 `yaml:"max_pending_bytes"`
+	// PendingLimitAction is what happens to a connection when the user is
+	// over MaxPendingBytes: "pause" (default) stops reading from the client
+	// until pending bytes drain, "close" closes the connection.
+	PendingLimitAction string `yaml:"pending_limit_action"`
+
+	// PauseReads stops reading from a client while its user is over budget,
+	// pushing back through TCP flow control instead of buffering the burst.
+	PauseReads bool `yaml:"pause_reads"`
+	// OrderingWatchdog checksums every flush on both sides of the connection
+	// writers, reporting bytes reordered, interleaved or corrupted inside the
+	// proxy. It's a debugging aid for new fast paths, not for production.
+	OrderingWatchdog bool `yaml:"ordering_watchdog"`
+	// ClientReadBuffer sets the kernel receive buffer size of client
+	// connections, bounding how much an over-limit burst can queue in the
+	// kernel. Zero keeps the system default.
+	ClientReadBuffer int `yaml:"client_read_buffer"`
+
+	// Downstream configures limiting of upstream->client traffic.
+	Downstream DownstreamConfig `yaml:"downstream"`
+
+	// UsageSubject is a subject clients can send requests to for their own
+	// current limit and usage, answered by the proxy (e.g. "$PROXY.USAGE").
+	// Empty disables it.
+	UsageSubject string `yaml:"usage_subject"`
+	// StatusSubject is a subject clients can send requests to for the state
+	// of the token bucket their connection is charged to, to pace themselves
+	// (e.g. "$PROXY.STATUS"). Empty disables it.
+	StatusSubject string `yaml:"status_subject"`
+	// Freezes are scheduled windows blocking publishes of users to subjects,
+	// e.g. for coordinated cutovers. More can be added via the admin API.
+	Freezes []*Freeze `yaml:"freezes"`
+
+	// AdminToken grants access to the admin API for all tenants.
+	AdminToken string `yaml:"admin_token"`
+	// AdminReadToken grants view-only access to the admin API for all
+	// tenants, e.g. for dashboards and scrapers. Changing limits requires
+	// AdminToken.
+	AdminReadToken string `yaml:"admin_read_token"`
+	// AdminTokenFile and AdminReadTokenFile read the tokens from files
+	// instead, e.g. mounted secrets, reloaded when they change.
+	AdminTokenFile     string `yaml:"admin_token_file"`
+	AdminReadTokenFile string `yaml:"admin_read_token_file"`
+	// ReloadInterval is how often token files and TLS certificates are
+	// checked for changes. Defaults to 10s.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	// StateFile keeps runtime state, the limit overrides set via the admin
+	// API and the buckets of strict users, across restarts. Empty keeps it
+	// in memory only.
+	StateFile string `yaml:"state_file"`
+	// StrictUsers are users on strict budgets whose bucket state is kept in
+	// the state file, so a restart doesn't refill their burst. Requires
+	// StateFile.
+	StrictUsers []string `yaml:"strict_users"`
+	// StateInterval is how often the buckets of strict users are saved.
+	// Defaults to 10s.
+	StateInterval time.Duration `yaml:"state_interval"`
+
+	// AdminAddr is the listen address of the admin HTTP endpoint (e.g. ":8223").
+	// Empty disables the admin endpoint.
+	AdminAddr string `yaml:"admin_addr"`
+	// MetricsAddr serves /metrics on a listener of its own, e.g. on a
+	// cluster-internal interface only, and HealthAddr /healthz. Empty serves
+	// them on the admin endpoint; "off" doesn't serve them.
+	MetricsAddr string `yaml:"metrics_addr"`
+	HealthAddr  string `yaml:"health_addr"`
+	// AdminAuditLog appends a JSON line per admin API mutation to this file:
+	// who called it, from where, and what it changed. Mutations are logged
+	// either way.
+	AdminAuditLog string `yaml:"admin_audit_log"`
+
+	// TLS terminates TLS from clients at the proxy, which then expects
+	// clients to handshake first, unless TLS.InfoFirst. Nil accepts plain
+	// connections.
+	TLS *TLSConfig `yaml:"tls"`
+	// UpstreamTLS connects to the upstream over TLS, upgrading after its
+	// INFO as NATS clients do. Nil connects in plaintext.
+	UpstreamTLS *UpstreamTLSConfig `yaml:"upstream_tls"`
+
+	// DialTimeout bounds how long connecting to the upstream may take,
+	// including waiting for a free dial slot. Defaults to 5s.
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+	// UpstreamBindAddress is the local IP address upstream connections are
+	// made from, on hosts with several. Empty lets the system choose.
+	UpstreamBindAddress string `yaml:"upstream_bind_address"`
+	// UpstreamBindInterface pins upstream connections to a network interface
+	// (e.g. "eth1") regardless of routing. Linux only; empty doesn't pin.
+	UpstreamBindInterface string `yaml:"upstream_bind_interface"`
+	// UpstreamFallbackDelay is how long the address family the resolver
+	// returns first may take before the other family is dialed in parallel
+	// (Happy Eyeballs), when the upstream host resolves to both. Defaults to
+	// 300ms; negative tries the families one after the other.
+	UpstreamFallbackDelay time.Duration `yaml:"upstream_fallback_delay"`
+	// MaxConcurrentDials limits upstream dials in flight at once, so accept
+	// storms can't pile up dials against a slow upstream. Defaults to 128.
+	MaxConcurrentDials int `yaml:"max_concurrent_dials"`
+
+	// ParseWorkers bounds how many connections parse client data at once,
+	// e.g. to the cores the proxy should use for it. Connections wait for a
+	// free worker only while they have data to parse. Zero doesn't bound it.
+	ParseWorkers int `yaml:"parse_workers"`
+
+	// ConnectDiagnostics logs why no identity was found in a client's
+	// CONNECT (malformed JSON, auth without a user name, an oversized line),
+	// with up to this many bytes of its options, secrets redacted. Such
+	// clients get the default limit. Zero logs nothing; failures are counted
+	// either way.
+	ConnectDiagnostics int `yaml:"connect_diagnostics"`
+
+	// IdentityCacheSize is how many recently presented JWTs have their
+	// resolved identity and limit cached, so reconnect storms of clients
+	// sharing credentials don't decode the same JWT, or run the policy
+	// hook's connect hook, again for every connection. Zero disables the
+	// cache.
+	IdentityCacheSize int `yaml:"identity_cache_size"`
+
+	// MaxConnectionAge is how long a client connection is proxied before the
+	// client is sent a lame duck INFO asking it to reconnect, e.g. to another
+	// replica or to pick up changed policies. It varies by up to 10% per
+	// connection, so clients connected together don't reconnect together.
+	// Zero doesn't limit it.
+	MaxConnectionAge time.Duration `yaml:"max_connection_age"`
+	// MaxConnectionAgeGrace is how long a client asked to reconnect has
+	// before the proxy closes its connection. Defaults to 30s.
+	MaxConnectionAgeGrace time.Duration `yaml:"max_connection_age_grace"`
+
+	// LameDuckDuration is how long lame duck mode, started through the admin
+	// API, takes to close all client connections. Defaults to 2m.
+	LameDuckDuration time.Duration `yaml:"lame_duck_duration"`
+	// LameDuckGracePeriod is how long clients are given to reconnect on
+	// their own before lame duck mode starts closing connections. Defaults
+	// to 10s.
+	LameDuckGracePeriod time.Duration `yaml:"lame_duck_grace_period"`
+
+	// UpstreamAuth authenticates clients' upstream connections with the
+	// proxy's own credentials instead of theirs. Nil forwards clients'
+	// credentials.
+	UpstreamAuth *UpstreamAuthConfig `yaml:"upstream_auth"`
+
+	// InfoPassthrough forwards the upstream's INFO lines unmodified and sends
+	// clients no INFO of the proxy's own, for clients that must see exactly
+	// what the upstream sent, e.g. to sign its nonce. Clients of TLS
+	// terminated at the proxy aren't told TLS is required, clients of
+	// connections closed for lame duck mode or their age aren't asked to
+	// reconnect first, and clients can't be held while the upstream is
+	// unavailable. With UpstreamTLS, requires TLS, as the upstream's INFO
+	// asks clients for TLS.
+	InfoPassthrough bool `yaml:"info_passthrough"`
+
+	// UpstreamUnavailable configures what clients see when the upstream can't
+	// be reached. Nil sends -ERR and closes the connection.
+	UpstreamUnavailable *UnavailableConfig `yaml:"upstream_unavailable"`
+
+	// UpstreamRetryBuffer is the maximum size in bytes of an in-flight frame
+	// kept for replay if the upstream connection fails. When non-zero, the
+	// proxy redials the upstream once and replays the client's CONNECT,
+	// subscriptions and the in-flight frame. Connections authenticated with a
+	// nonce signature (JWT/nkey) can't be replayed. Zero disables reconnects.
+	UpstreamRetryBuffer int `yaml:"upstream_retry_buffer"`
+
+	// UpstreamPressure enables tightening all users' rates while the upstream
+	// reports slow consumers or high memory usage. Nil disables it.
+	UpstreamPressure *PressureConfig `yaml:"upstream_pressure"`
+
+	// Adaptive enables the experimental AIMD mode adjusting each user's
+	// effective rate based on upstream congestion signals. Nil disables it.
+	Adaptive *AdaptiveConfig `yaml:"adaptive"`
+
+	// Uplink enables sharing a bandwidth-constrained uplink between users with
+	// per-user minimum guarantees. Nil disables it.
+	Uplink *UplinkConfig `yaml:"uplink"`
+
+	// SoftLimit warns about users crossing a threshold below their limit.
+	// Nil disables it.
+	SoftLimit *SoftLimitConfig `yaml:"soft_limit"`
+
+	// Recommendations samples users' throughput to suggest limits via the
+	// admin API. Nil disables it.
+	Recommendations *RecommendationConfig `yaml:"recommendations"`
+
+	// TrafficCapture records a sample of published messages for offline
+	// analysis. Nil disables it.
+	TrafficCapture *CaptureConfig `yaml:"traffic_capture"`
+
+	// Shadow mirrors clients' publishes to a second upstream. Nil disables
+	// it.
+	Shadow *ShadowConfig `yaml:"shadow"`
+
+	// UsageExport writes per-user usage records into a JetStream stream on
+	// the upstream cluster. Nil disables it.
+	UsageExport *UsageExportConfig `yaml:"usage_export"`
+
+	// RepublishGuard flags users republishing identical payloads at high
+	// frequency. Nil disables it.
+	RepublishGuard *RepublishGuardConfig `yaml:"republish_guard"`
+
+	// PayloadSampling classifies a sample of messages by content type, e.g.
+	// to see whether compression would help. Nil disables it.
+	PayloadSampling *PayloadSamplingConfig `yaml:"payload_sampling"`
+
+	// PolicyHook loads site-specific connect and publish hooks from a Go
+	// plugin. Nil disables it.
+	PolicyHook *PolicyHookConfig `yaml:"policy_hook"`
+
+	// Hash is the SHA-256 of the raw config file, used to verify which
+	// configuration a running proxy was started with.
+	Hash string `yaml:"-"`
+}
+
+// Upstream unavailable modes.
+const (
+	UnavailableClose = "close" // send -ERR and close
+	UnavailableHold  = "hold"  // send an INFO banner and keep retrying the upstream
+)
+
+// UnavailableConfig configures handling of clients while the upstream is
+// unreachable.
+type UnavailableConfig struct {
+	// Mode is "close" (default) or "hold". Held clients that signed the
+	// banner's missing nonce, with nkeys or JWTs, are closed once the upstream
+	// is back, to reconnect and sign the upstream's.
+	Mode string `yaml:"mode"`
+	// RetryInterval between upstream dials while holding. Defaults to 1s.
+	RetryInterval time.Duration `yaml:"retry_interval"`
+	// HoldTimeout is how long a client is held before it gets -ERR and is
+	// closed. Defaults to 30s.
+	HoldTimeout time.Duration `yaml:"hold_timeout"`
+	// Info holds fields of the INFO banner sent to held clients, overriding
+	// the defaults, which include "ldm": true so clients treat the server as
+	// in lame duck mode.
+	Info map[string]interface{} `yaml:"info"`
+}
+
+// TenantConfig configures a tenant's users and admin access.
+type TenantConfig struct {
+	// AdminToken grants access to the admin API for this tenant's users only.
+	AdminToken string `yaml:"admin_token"`
+	// ReadToken grants view-only access to this tenant's users.
+	ReadToken string `yaml:"read_token"`
+	// Users maps the tenant's user names to their bandwidth in bytes per second.
+	Users map[string]int64 `yaml:"users"`
+}
+
+// TenantOf returns the tenant a user belongs to, or "" if none.
+func (cfg *Config) TenantOf(username string) string {
+	for name, tenant := range cfg.Tenants {
+		if _, ok := tenant.Users[username]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// GeoIPConfig locates clients with a MaxMind database.
+type GeoIPConfig struct {
+	// Database is the path of a MaxMind GeoIP2 or GeoLite2 Country or City
+	// database.
+	Database string `yaml:"database"`
+	// Countries maps ISO 3166-1 country codes to the bandwidth in bytes per
+	// second traffic from there is limited to, on top of default_bandwidth,
+	// for users without a bandwidth of their own.
+	Countries map[string]int64 `yaml:"countries"`
+	// Regions groups countries into named regions, labelling connections
+	// with their region and limiting traffic from a region like a country.
+	Regions map[string]GeoRegion `yaml:"regions"`
+}
+
+// GeoRegion is a named group of countries.
+type GeoRegion struct {
+	// Countries are the ISO 3166-1 country codes of the region's countries.
+	Countries []string `yaml:"countries"`
+	// Bandwidth limits traffic from the region like Countries limits that
+	// of a country. Zero labels connections without limiting them.
+	Bandwidth int64 `yaml:"bandwidth"`
+}
+
+// regionOf returns the region of a country, or "" if it's in none.
+func (c *GeoIPConfig) regionOf(country string) string {
+	if c == nil {
+		return ""
+	}
+	for name, region := range c.Regions {
+		if slices.Contains(region.Countries, country) {
+			return name
+		}
+	}
+	return ""
+}
+
+// TLSConfig configures TLS termination of client connections.
+type TLSConfig struct {
+	// Cert and Key are the PEM files of the certificate served to clients.
+	// Optional with ACME, serving names ACME doesn't cover.
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ACME obtains and renews certificates of the listed host names from a
+	// certificate authority such as Let's Encrypt.
+	ACME *ACMEConfig `yaml:"acme"`
+	// CA is the PEM file of the certificate authorities client certificates
+	// are verified against. Clients must then present a certificate one of
+	// them issued. Empty doesn't ask clients for certificates.
+	CA string `yaml:"ca"`
+	// InfoFirst also serves clients that expect the upstream's INFO before
+	// upgrading to TLS, as NATS clients do unless told to handshake first.
+	// Clients that don't start the handshake within a short delay are sent
+	// the INFO, like nats-server's handshake_first: auto. Such clients are
+	// served by the proxy's own upstream, not SNI routes.
+	InfoFirst bool `yaml:"info_first"`
+	// HandshakeTimeout bounds the TLS handshake, and the WebSocket upgrade
+	// of WebSocket clients. Defaults to 5s.
+	HandshakeTimeout time.Duration `yaml:"handshake_timeout"`
+	// WebSocket also accepts WebSocket clients on the port, told apart from
+	// NATS clients by negotiating HTTP/1.1 with ALPN.
+	WebSocket bool `yaml:"websocket"`
+	// Routes sends clients to other upstream clusters by the server name
+	// (SNI) they connect to, keyed by host name. Clients connecting to other
+	// names are served by the proxy's own upstream.
+	Routes map[string]*SNIRoute `yaml:"routes"`
+}
+
+// ACMEConfig configures automatic certificate management with ACME.
+type ACMEConfig struct {
+	// Hosts are the host names certificates are obtained for.
+	Hosts []string `yaml:"hosts"`
+	// Email is the account contact the CA sends expiry notices to.
+	Email string `yaml:"email"`
+	// CacheDir keeps the account key and certificates across restarts, so
+	// they aren't requested again.
+	CacheDir string `yaml:"cache_dir"`
+	// DirectoryURL is the CA's ACME directory. Defaults to Let's Encrypt.
+	DirectoryURL string `yaml:"directory_url"`
+	// Challenge is the challenge solver: "tls-alpn-01" (default), answered
+	// on the client port, or "http-01", answered on HTTPAddr.
+	Challenge string `yaml:"challenge"`
+	// HTTPAddr is the listen address answering http-01 challenges.
+	// Defaults to ":80".
+	HTTPAddr string `yaml:"http_addr"`
+	// RenewBefore is how long before expiry certificates are renewed.
+	// Defaults to 30 days.
+	RenewBefore time.Duration `yaml:"renew_before"`
+}
+
+// SNIRoute is an upstream cluster served to clients connecting to a server
+// name.
+type SNIRoute struct {
+	// Upstream is the host:port of the cluster.
+	Upstream string `yaml:"upstream"`
+	// Config is the route's own configuration file, whose limits apply to
+	// its clients. Its listener settings (tls, admin_addr) are ignored.
+	Config string `yaml:"config"`
+	// Cert and Key are the PEM files of the route's certificate, if the
+	// proxy's doesn't cover its name.
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// BypassConfig lists users that bypass rate limiting entirely.
+type BypassConfig struct {
+	// Users are user name patterns, where '*' matches any sequence of
+	// characters, e.g. "monitoring-*".
+	Users []string `yaml:"users"`
+	// JWTClaims bypasses JWT-authenticated users having all of the given
+	// claims, keyed by dotted path, e.g. {"nats.tags": "bypass"}. A claim
+	// matches if it equals the value or is a list containing it.
+	JWTClaims map[string]string `yaml:"jwt_claims"`
+}
+
+// BucketConfig shapes token buckets. By default a bucket holds one second
+// worth of bytes and refills in the smallest steps the rate allows, which
+// lets a low limit send a full second of traffic at once after idling.
+type BucketConfig struct {
+	// Burst is how much traffic, in time at the limited rate, a bucket holds.
+	// Defaults to 1s.
+	Burst time.Duration `yaml:"burst"`
+	// RefillInterval paces refills in fixed steps of this interval's worth of
+	// bytes, stretched for rates too low to refill a byte per interval.
+	// Zero refills continuously.
+	RefillInterval time.Duration `yaml:"refill_interval"`
+	// ChunkSize bounds how many bytes of a write are charged to a bucket at
+	// once, so a message larger than the bucket proceeds chunk by chunk at the
+	// limited rate. Chunks never exceed a bucket's capacity. Zero charges up
+	// to the capacity at once.
+	ChunkSize int `yaml:"chunk_size"`
+}
+
+// ControlLaneConfig configures the per-user control-plane lane.
+type ControlLaneConfig struct {
+	// Bandwidth is the control lane rate in bytes per second per user.
+	Bandwidth int64 `yaml:"bandwidth"`
+	// Subjects are the subjects (wildcards allowed) whose messages are
+	// charged to the control lane instead of the bulk limit.
+	Subjects []string `yaml:"subjects"`
+}
+
+// ObjectStoreConfig configures the object store limit class.
+type ObjectStoreConfig struct {
+	// Bandwidth is the object store rate in bytes per second per user.
+	Bandwidth int64 `yaml:"bandwidth"`
+	// Subjects charged to the object store limit. Defaults to "$O.>".
+	Subjects []string `yaml:"subjects"`
+}
+
+// StreamConfig configures a JetStream stream's ingest cap.
+type StreamConfig struct {
+	// Subjects of the stream (wildcards allowed).
+	Subjects []string `yaml:"subjects"`
+	// Bandwidth in bytes per second shared by all publishers to the stream.
+	Bandwidth int64 `yaml:"bandwidth"`
+}
+
+// ReplayBoostConfig configures the JetStream consumer replay boost.
+type ReplayBoostConfig struct {
+	// Multiplier applied to the user's rate while boosted. Defaults to 2.
+	Multiplier float64 `yaml:"multiplier"`
+	// Duration of a boost. Defaults to 30s.
+	Duration time.Duration `yaml:"duration"`
+	// Cooldown is the minimum time between the starts of a user's boosts, so
+	// steady-state pulling isn't boosted forever. Defaults to 5m.
+	Cooldown time.Duration `yaml:"cooldown"`
+	// Subjects whose publishes start a boost. Defaults to JetStream pull
+	// requests, "$JS.API.CONSUMER.MSG.NEXT.>".
+	Subjects []string `yaml:"subjects"`
+}
+
+// EndpointDisabled as metrics_addr or health_addr doesn't serve the endpoint.
+const EndpointDisabled = "off"
+
+// Downstream limit modes.
+const (
+	DownstreamOff        = "off"        // upstream->client traffic isn't limited
+	DownstreamGlobal     = "global"     // one bucket shared by all connections
+	DownstreamConnection = "connection" // one bucket per connection
+	DownstreamUser       = "user"       // one bucket per subscribing user, shared by their connections
+	DownstreamShared     = "shared"     // the user's own bucket, shared with what they publish
+)
+
+// DownstreamConfig configures limiting of upstream->client traffic.
+type DownstreamConfig struct {
+	// Mode is one of "off" (default), "global", "connection", "user" or
+	// "shared". In user mode every copy of a message fanned out to a user's
+	// subscriptions is charged to that user, capping their aggregate
+	// delivery rate. In shared mode it's charged to the user's own limit,
+	// capping what they publish and receive together; Bandwidth and Users
+	// don't apply.
+	Mode string `yaml:"mode"`
+	// Bandwidth in bytes per second. Defaults to DefaultBandwidth.
+	Bandwidth int64 `yaml:"bandwidth"`
+	// Users overrides Bandwidth for specific users in user mode.
+	Users map[string]int64 `yaml:"users"`
+	// QueueGroups limits the messages delivered to queue groups, keyed by
+	// queue group name, each limit shared by all members of a user's group
+	// so a scaled-out consumer fleet is limited as one consumer. Applies in
+	// any mode, on top of the mode's limit.
+	QueueGroups map[string]int64 `yaml:"queue_groups"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.normalize(); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	cfg.Hash = hex.EncodeToString(sum[:])
+	return &cfg, nil
+}
+
+// userEntry is the long form of a users entry.
+type userEntry struct {
+	Bandwidth int64         `yaml:"bandwidth"`
+	Burst     time.Duration `yaml:"burst"`
+}
+
+// UnmarshalYAML decodes the configuration, accepting users entries in their
+// long form, whose bursts are merged into UserBursts.
+func (cfg *Config) UnmarshalYAML(node *yaml.Node) error {
+	bursts := make(map[string]time.Duration)
+	for i := 0; node.Kind == yaml.MappingNode && i+1 < len(node.Content); i += 2 {
+		if users := node.Content[i+1]; node.Content[i].Value == "users" && users.Kind == yaml.MappingNode {
+			for j := 1; j < len(users.Content); j += 2 {
+				if users.Content[j].Kind != yaml.MappingNode {
+					continue
+				}
+				var entry userEntry
+				if err := users.Content[j].Decode(&entry); err != nil {
+					return err
+				}
+				if entry.Burst != 0 {
+					bursts[users.Content[j-1].Value] = entry.Burst
+				}
+				users.Content[j] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.FormatInt(entry.Bandwidth, 10)}
+			}
+		}
+	}
+	type plain Config
+	if err := node.Decode((*plain)(cfg)); err != nil {
+		return err
+	}
+	if len(bursts) > 0 && cfg.UserBursts == nil {
+		cfg.UserBursts = make(map[string]time.Duration, len(bursts))
+	}
+	for user, burst := range bursts {
+		cfg.UserBursts[user] = burst
+	}
+	return nil
+}
+
+// normalize applies defaults and validates the configuration.
+func (cfg *Config) normalize() error {
+	if cfg.DefaultBandwidth == 0 {
+		cfg.DefaultBandwidth = 10 * 1024 * 1024 // 10MB/s
+	}
+	if cfg.DefaultBandwidth < 0 {
+		return fmt.Errorf("default_bandwidth must be positive")
+	}
+	if err := checkBandwidths("user", cfg.Users); err != nil {
+		return err
+	}
+	if err := checkBandwidths("client", cfg.Clients); err != nil {
+		return err
+	}
+	if geo := cfg.GeoIP; geo != nil {
+		if geo.Database == "" {
+			return fmt.Errorf("geoip database is required")
+		}
+		if err := checkBandwidths("geoip country", geo.Countries); err != nil {
+			return err
+		}
+		regions := make(map[string]string)
+		for name, region := range geo.Regions {
+			if region.Bandwidth < 0 {
+				return fmt.Errorf("geoip region %q: bandwidth must not be negative, got %d", name, region.Bandwidth)
+			}
+			if len(region.Countries) == 0 {
+				return fmt.Errorf("geoip region %q has no countries", name)
+			}
+			for _, country := range region.Countries {
+				if other, ok := regions[country]; ok {
+					return fmt.Errorf("geoip country %q is in regions %q and %q", country, other, name)
+				}
+				regions[country] = name
+			}
+		}
+	}
+	if t := cfg.TLS; t != nil {
+		// With ACME alone, hosts it doesn't cover fail the handshake
+		staticCert := t.ACME == nil || t.Cert != "" || t.Key != ""
+		if staticCert && (t.Cert == "" || t.Key == "") {
+			return fmt.Errorf("tls cert and key are required")
+		}
+		if a := t.ACME; a != nil {
+			if len(a.Hosts) == 0 {
+				return fmt.Errorf("tls acme hosts are required")
+			}
+			if a.CacheDir == "" {
+				return fmt.Errorf("tls acme cache_dir is required")
+			}
+			for i, host := range a.Hosts {
+				a.Hosts[i] = strings.ToLower(host)
+			}
+			switch a.Challenge {
+			case "":
+				a.Challenge = challengeTLSALPN
+			case challengeTLSALPN, challengeHTTP:
+			default:
+				return fmt.Errorf("invalid tls acme challenge %q: must be %s or %s", a.Challenge, challengeTLSALPN, challengeHTTP)
+			}
+			if a.Challenge == challengeHTTP && a.HTTPAddr == "" {
+				a.HTTPAddr = ":80"
+			}
+			if a.RenewBefore < 0 {
+				return fmt.Errorf("tls acme renew_before must not be negative")
+			}
+		}
+		if t.HandshakeTimeout <= 0 {
+			t.HandshakeTimeout = 5 * time.Second
+		}
+		if t.InfoFirst && cfg.InfoPassthrough {
+			return fmt.Errorf("tls info_first requires the proxy to announce TLS in INFO, not info_passthrough")
+		}
+		routes := make(map[string]*SNIRoute, len(t.Routes))
+		for name, route := range t.Routes {
+			if route == nil || route.Config == "" {
+				return fmt.Errorf("tls route %q requires a config", name)
+			}
+			if _, port, err := net.SplitHostPort(route.Upstream); err != nil || !validPort(port) {
+				return fmt.Errorf("tls route %q has an invalid upstream %q: must be host:port", name, route.Upstream)
+			}
+			if (route.Cert == "") != (route.Key == "") {
+				return fmt.Errorf("tls route %q requires both cert and key", name)
+			}
+			routes[strings.ToLower(name)] = route
+		}
+		t.Routes = routes
+	}
+	owner := make(map[string]string)
+	for name, tenant := range cfg.Tenants {
+		if tenant == nil {
+			return fmt.Errorf("tenant %q has no configuration", name)
+		}
+		if err := checkBandwidths("user", tenant.Users); err != nil {
+			return err
+		}
+		for user := range tenant.Users {
+			if _, ok := cfg.Users[user]; ok {
+				return fmt.Errorf("user %q of tenant %q is also configured globally", user, name)
+			}
+			if other, ok := owner[user]; ok {
+				return fmt.Errorf("user %q belongs to both tenants %q and %q", user, other, name)
+			}
+			owner[user] = name
+		}
+	}
+	for _, pattern := range cfg.Bypass.Users {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid bypass user pattern %q: %w", pattern, err)
+		}
+	}
+	switch cfg.PendingLimitAction {
+	case "", "pause", "close":
+	default:
+		return fmt.Errorf("invalid pending_limit_action %q", cfg.PendingLimitAction)
+	}
+	switch cfg.Downstream.Mode {
+	case "":
+		cfg.Downstream.Mode = DownstreamOff
+	case DownstreamOff, DownstreamGlobal, DownstreamConnection, DownstreamUser, DownstreamShared:
+	default:
+		return fmt.Errorf("invalid downstream mode %q", cfg.Downstream.Mode)
+	}
+	if err := checkBandwidths("downstream user", cfg.Downstream.Users); err != nil {
+		return err
+	}
+	if err := checkBandwidths("queue group", cfg.Downstream.QueueGroups); err != nil {
+		return err
+	}
+	if cfg.Downstream.Bandwidth == 0 {
+		cfg.Downstream.Bandwidth = cfg.DefaultBandwidth
+	}
+	if cfg.Bucket.Burst < 0 || cfg.Bucket.RefillInterval < 0 || cfg.Bucket.ChunkSize < 0 {
+		return fmt.Errorf("bucket burst, refill_interval and chunk_size must not be negative")
+	}
+	if cfg.DefaultBurst < 0 {
+		return fmt.Errorf("default_burst must not be negative")
+	}
+	for user, burst := range cfg.UserBursts {
+		if burst <= 0 {
+			return fmt.Errorf("burst of user %q must be positive", user)
+		}
+	}
+	if cfg.LimitRamp < 0 {
+		return fmt.Errorf("limit_ramp must not be negative")
+	}
+	if len(cfg.StrictUsers) > 0 && cfg.StateFile == "" {
+		return fmt.Errorf("strict_users requires state_file")
+	}
+	if cfg.AdminToken != "" && cfg.AdminTokenFile != "" {
+		return fmt.Errorf("admin_token and admin_token_file are mutually exclusive")
+	}
+	if cfg.AdminReadToken != "" && cfg.AdminReadTokenFile != "" {
+		return fmt.Errorf("admin_read_token and admin_read_token_file are mutually exclusive")
+	}
+	if cfg.ReloadInterval <= 0 {
+		cfg.ReloadInterval = 10 * time.Second
+	}
+	if cfg.StateInterval <= 0 {
+		cfg.StateInterval = 10 * time.Second
+	}
+	listeners := make(map[string]string)
+	for _, l := range []struct{ key, addr string }{
+		{"admin_addr", cfg.AdminAddr}, {"metrics_addr", cfg.MetricsAddr}, {"health_addr", cfg.HealthAddr},
+	} {
+		if l.addr == "" || l.addr == EndpointDisabled {
+			continue
+		}
+		if other, ok := listeners[l.addr]; ok {
+			return fmt.Errorf("%s must differ from %s; leave it empty to serve on the admin endpoint", l.key, other)
+		}
+		listeners[l.addr] = l.key
+	}
+	if addr := cfg.UpstreamBindAddress; addr != "" && net.ParseIP(addr) == nil {
+		return fmt.Errorf("invalid upstream_bind_address %q: not an IP address", addr)
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 5 * time.Second
+	}
+	if cfg.UpstreamFallbackDelay == 0 {
+		cfg.UpstreamFallbackDelay = 300 * time.Millisecond
+	}
+	if cfg.MaxConcurrentDials <= 0 {
+		cfg.MaxConcurrentDials = 128
+	}
+	if cfg.ConnectDiagnostics < 0 {
+		return fmt.Errorf("connect_diagnostics must not be negative")
+	}
+	if cfg.IdentityCacheSize < 0 {
+		return fmt.Errorf("identity_cache_size must not be negative")
+	}
+	if cfg.ParseWorkers < 0 {
+		return fmt.Errorf("parse_workers must not be negative")
+	}
+	if cfg.MaxConnectionAge < 0 || cfg.MaxConnectionAgeGrace < 0 {
+		return fmt.Errorf("max_connection_age and max_connection_age_grace must not be negative")
+	}
+	if cfg.MaxConnectionAgeGrace == 0 {
+		cfg.MaxConnectionAgeGrace = 30 * time.Second
+	}
+	if cfg.LameDuckDuration <= 0 {
+		cfg.LameDuckDuration = 2 * time.Minute
+	}
+	if cfg.LameDuckGracePeriod <= 0 {
+		cfg.LameDuckGracePeriod = 10 * time.Second
+	}
+	if cfg.LameDuckGracePeriod >= cfg.LameDuckDuration {
+		return fmt.Errorf("lame_duck_grace_period must be shorter than lame_duck_duration")
+	}
+	for i, f := range cfg.Freezes {
+		if f == nil {
+			return fmt.Errorf("freeze %d is empty", i)
+		}
+		if err := f.validate(); err != nil {
+			return err
+		}
+	}
+	for i, rule := range cfg.ClassRules {
+		if rule == nil {
+			return fmt.Errorf("class rule %d is empty", i)
+		}
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("invalid class rule %q: %w", rule.When, err)
+		}
+	}
+	if o := cfg.ObjectStore; o != nil && len(o.Subjects) == 0 {
+		o.Subjects = []string{"$O.>"}
+	}
+	for name, stream := range cfg.Streams {
+		if stream == nil || stream.Bandwidth <= 0 || len(stream.Subjects) == 0 {
+			return fmt.Errorf("stream %q requires subjects and a positive bandwidth", name)
+		}
+	}
+	if b := cfg.ReplayBoost; b != nil {
+		if b.Multiplier <= 0 {
+			b.Multiplier = 2
+		}
+		if b.Duration <= 0 {
+			b.Duration = 30 * time.Second
+		}
+		if b.Cooldown <= 0 {
+			b.Cooldown = 5 * time.Minute
+		}
+		if len(b.Subjects) == 0 {
+			b.Subjects = []string{"$JS.API.CONSUMER.MSG.NEXT.>"}
+		}
+	}
+	if u := cfg.Uplink; u != nil {
+		if u.Capacity <= 0 && u.DetectCapacity {
+			capacity, err := detectCapacity(u)
+			if err != nil {
+				return fmt.Errorf("failed to detect uplink capacity: %w", err)
+			}
+			log.Info().Int64("capacity", capacity).Msg("Detected uplink capacity")
+			u.Capacity = capacity
+		}
+		if u.Capacity <= 0 {
+			return fmt.Errorf("uplink requires a positive capacity")
+		}
+	}
+	if ps := cfg.PayloadSampling; ps != nil {
+		if ps.Every <= 0 {
+			ps.Every = 100
+		}
+		if ps.PrefixBytes <= 0 {
+			ps.PrefixBytes = 64
+		}
+	}
+	if s := cfg.SoftLimit; s != nil {
+		if err := s.normalize(); err != nil {
+			return err
+		}
+	}
+	if u := cfg.UpstreamScheduler; u != nil {
+		if err := u.normalize(); err != nil {
+			return err
+		}
+	}
+	if b := cfg.BurstCredit; b != nil {
+		if err := b.normalize(); err != nil {
+			return err
+		}
+	}
+	if r := cfg.ResourceBudget; r != nil {
+		if err := r.normalize(); err != nil {
+			return err
+		}
+	}
+	if u := cfg.UpstreamTLS; u != nil {
+		if err := u.normalize(); err != nil {
+			return err
+		}
+		// The upstream's INFO, passed through, would ask clients served in
+		// plaintext to upgrade to TLS the proxy doesn't terminate
+		if cfg.InfoPassthrough && cfg.TLS == nil {
+			return fmt.Errorf("upstream_tls with info_passthrough requires tls for clients")
+		}
+	}
+	if m := cfg.MemoryCap; m != nil {
+		if err := m.normalize(); err != nil {
+			return err
+		}
+	}
+	if m := cfg.MetricLabels; m != nil {
+		if err := m.normalize(); err != nil {
+			return err
+		}
+	}
+	if m := cfg.Middleware; m != nil {
+		for tenant := range m.Tenants {
+			if _, ok := cfg.Tenants[tenant]; !ok {
+				return fmt.Errorf("middleware configured for unknown tenant %q", tenant)
+			}
+		}
+	}
+	if r := cfg.Recommendations; r != nil {
+		if err := r.normalize(); err != nil {
+			return err
+		}
+	}
+	if c := cfg.TrafficCapture; c != nil {
+		if err := c.normalize(); err != nil {
+			return err
+		}
+	}
+	if s := cfg.Shadow; s != nil {
+		if _, port, err := net.SplitHostPort(s.Upstream); err != nil || !validPort(port) {
+			return fmt.Errorf("invalid shadow upstream %q: must be host:port", s.Upstream)
+		}
+		if s.Buffer <= 0 {
+			s.Buffer = 1 << 20
+		}
+	}
+	if u := cfg.UsageExport; u != nil {
+		if err := u.normalize(); err != nil {
+			return err
+		}
+	}
+	if g := cfg.RepublishGuard; g != nil {
+		switch g.Action {
+		case "", RepublishAlert, RepublishThrottle:
+		default:
+			return fmt.Errorf("invalid republish_guard action %q", g.Action)
+		}
+	}
+	if a := cfg.UpstreamAuth; a != nil {
+		if err := a.normalize(); err != nil {
+			return err
+		}
+		// Identities the upstream doesn't check must be verified before
+		// they're limited or bypassed by name
+		if a.Clients == nil && (len(cfg.Users) > 0 || len(cfg.Bypass.Users) > 0 || len(cfg.Bypass.JWTClaims) > 0) {
+			return fmt.Errorf("upstream_auth with users or bypass requires upstream_auth clients to verify them")
+		}
+	}
+	if u := cfg.UpstreamUnavailable; u != nil && u.Mode == UnavailableHold && cfg.InfoPassthrough {
+		return fmt.Errorf("upstream_unavailable mode hold sends an INFO, which info_passthrough disables")
+	}
+	if u := cfg.UpstreamUnavailable; u != nil {
+		switch u.Mode {
+		case "":
+			u.Mode = UnavailableClose
+		case UnavailableClose, UnavailableHold:
+		default:
+			return fmt.Errorf("invalid upstream_unavailable mode %q", u.Mode)
+		}
+		if u.RetryInterval <= 0 {
+			u.RetryInterval = time.Second
+		}
+		if u.HoldTimeout <= 0 {
+			u.HoldTimeout = 30 * time.Second
+		}
+	}
+	return nil
+}
+
+// validPort reports whether port is a TCP port number.
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// checkBandwidths rejects bandwidths that aren't positive, which would
+// otherwise leave the traffic unlimited. Any positive number of bytes per
+// second works, down to a byte per second.
+func checkBandwidths(kind string, bandwidths map[string]int64) error {
+	for name, bw := range bandwidths {
+		if bw <= 0 {
+			return fmt.Errorf("%s %q: bandwidth must be a positive number of bytes per second, got %d", kind, name, bw)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+//go:build conformance
+
+// Conformance tests drive nats.go client operations through an in-process
+// proxy against a real NATS server with JetStream enabled:
+//
+//	docker compose up -d nats
+//	CONFORMANCE_UPSTREAM=localhost:4222 CONFORMANCE_CREDS=local/nsc/nkeys/creds/root/app/alice.creds \
+//		go test -tags=conformance -run Conformance ./internal/server
+//
+// CONFORMANCE_UPSTREAM defaults to localhost:4222. CONFORMANCE_CREDS, or else
+// CONFORMANCE_USER and CONFORMANCE_PASS, authenticate the client.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// conformanceCase is a client operation that must behave through the proxy as
+// it does against the server.
+type conformanceCase struct {
+	name string
+	run  func(nc *nats.Conn) error
+}
+
+var conformanceCases = []conformanceCase{
+	{"publish/subscribe", conformPubSub},
+	{"large payload", conformLargePayload},
+	{"queue group", conformQueueGroup},
+	{"request/reply", conformRequestReply},
+	{"headers", conformHeaders},
+	{"flush", func(nc *nats.Conn) error { return nc.FlushTimeout(2 * time.Second) }},
+	{"JetStream stream", conformJetStream},
+}
+
+// startConformanceProxy runs a proxy in front of the conformance upstream,
+// returning the URL clients connect to.
+func startConformanceProxy(t *testing.T) string {
+	t.Helper()
+	upstream := os.Getenv("CONFORMANCE_UPSTREAM")
+	if upstream == "" {
+		upstream = "localhost:4222"
+	}
+	host, portStr, err := net.SplitHostPort(upstream)
+	if err != nil {
+		t.Fatalf("Invalid CONFORMANCE_UPSTREAM %q: %v", upstream, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatalf("Invalid CONFORMANCE_UPSTREAM port %q: %v", portStr, err)
+	}
+	if conn, err := net.DialTimeout("tcp", upstream, 2*time.Second); err != nil {
+		t.Fatalf("Upstream %s unreachable, start a NATS server first: %v", upstream, err)
+	} else {
+		conn.Close()
+	}
+
+	p, err := NewProxy(host, port, writeTestConfig(t, "default_bandwidth: 104857600\n"))
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	srv, err := NewServer(p, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go srv.Run(ctx)
+	t.Cleanup(func() {
+		cancel()
+		srv.Stop(time.Second)
+	})
+	return "nats://" + srv.Addr().String()
+}
+
+func conformanceOptions() []nats.Option {
+	opts := []nats.Option{nats.Name("conformance"), nats.Timeout(5 * time.Second)}
+	if creds := os.Getenv("CONFORMANCE_CREDS"); creds != "" {
+		opts = append(opts, nats.UserCredentials(creds))
+	} else if user := os.Getenv("CONFORMANCE_USER"); user != "" {
+		opts = append(opts, nats.UserInfo(user, os.Getenv("CONFORMANCE_PASS")))
+	}
+	return opts
+}
+
+func TestConformance(t *testing.T) {
+	url := startConformanceProxy(t)
+	nc, err := nats.Connect(url, conformanceOptions()...)
+	if err != nil {
+		t.Fatalf("Failed to connect through the proxy: %v", err)
+	}
+	defer nc.Close()
+
+	for _, tc := range conformanceCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.run(nc); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// conformSubject returns a subject unique to this run.
+func conformSubject(name string) string {
+	return fmt.Sprintf("conformance.%s.%d", name, time.Now().UnixNano())
+}
+
+func conformPubSub(nc *nats.Conn) error {
+	subject := conformSubject("pubsub")
+	sub, err := nc.SubscribeSync(subject)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	for i := 0; i < 100; i++ {
+		if err := nc.Publish(subject, []byte(strconv.Itoa(i))); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < 100; i++ {
+		msg, err := sub.NextMsg(2 * time.Second)
+		if err != nil {
+			return fmt.Errorf("message %d: %w", i, err)
+		}
+		if string(msg.Data) != strconv.Itoa(i) {
+			return fmt.Errorf("expected message %d in order, got %q", i, msg.Data)
+		}
+	}
+	return nil
+}
+
+func conformLargePayload(nc *nats.Conn) error {
+	subject := conformSubject("large")
+	sub, err := nc.SubscribeSync(subject)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	// Spans many parser buffer flushes
+	payload := bytes.Repeat([]byte("0123456789abcdef"), int(min(nc.MaxPayload(), 1<<20))/16)
+	if err := nc.Publish(subject, payload); err != nil {
+		return err
+	}
+	msg, err := sub.NextMsg(5 * time.Second)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(msg.Data, payload) {
+		return fmt.Errorf("payload of %d bytes corrupted, got %d bytes", len(payload), len(msg.Data))
+	}
+	return nil
+}
+
+func conformQueueGroup(nc *nats.Conn) error {
+	subject := conformSubject("queue")
+	var mu sync.Mutex
+	received := 0
+	for i := 0; i < 3; i++ {
+		sub, err := nc.QueueSubscribe(subject, "workers", func(*nats.Msg) {
+			mu.Lock()
+			received++
+			mu.Unlock()
+		})
+		if err != nil {
+			return err
+		}
+		defer sub.Unsubscribe()
+	}
+	for i := 0; i < 30; i++ {
+		if err := nc.Publish(subject, []byte("job")); err != nil {
+			return err
+		}
+	}
+	if err := nc.Flush(); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := received
+		mu.Unlock()
+		if n == 30 {
+			return nil
+		}
+		if n > 30 {
+			return fmt.Errorf("expected each job delivered once, got %d deliveries", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("expected 30 jobs delivered to the queue group, got %d", received)
+}
+
+func conformRequestReply(nc *nats.Conn) error {
+	subject := conformSubject("service")
+	sub, err := nc.Subscribe(subject, func(m *nats.Msg) {
+		m.Respond(append([]byte("re:"), m.Data...))
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	resp, err := nc.Request(subject, []byte("ping"), 2*time.Second)
+	if err != nil {
+		return err
+	}
+	if string(resp.Data) != "re:ping" {
+		return fmt.Errorf("expected reply re:ping, got %q", resp.Data)
+	}
+	return nil
+}
+
+func conformHeaders(nc *nats.Conn) error {
+	if !nc.HeadersSupported() {
+		return fmt.Errorf("headers not supported through the proxy")
+	}
+	subject := conformSubject("headers")
+	sub, err := nc.SubscribeSync(subject)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	msg := nats.NewMsg(subject)
+	msg.Header.Set("X-Trace", "abc")
+	msg.Header.Add("X-Multi", "1")
+	msg.Header.Add("X-Multi", "2")
+	msg.Data = []byte("body")
+	if err := nc.PublishMsg(msg); err != nil {
+		return err
+	}
+	got, err := sub.NextMsg(2 * time.Second)
+	if err != nil {
+		return err
+	}
+	if got.Header.Get("X-Trace") != "abc" || len(got.Header.Values("X-Multi")) != 2 || string(got.Data) != "body" {
+		return fmt.Errorf("headers or body changed: %v %q", got.Header, got.Data)
+	}
+	return nil
+}
+
+func conformJetStream(nc *nats.Conn) error {
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+	stream := fmt.Sprintf("CONFORMANCE_%d", time.Now().UnixNano())
+	subject := conformSubject("js")
+	if _, err := js.AddStream(&nats.StreamConfig{Name: stream, Subjects: []string{subject}, Storage: nats.MemoryStorage}); err != nil {
+		return fmt.Errorf("add stream: %w", err)
+	}
+	defer js.DeleteStream(stream)
+
+	for i := 0; i < 10; i++ {
+		if _, err := js.Publish(subject, []byte(strconv.Itoa(i))); err != nil {
+			return fmt.Errorf("publish %d: %w", i, err)
+		}
+	}
+	info, err := js.StreamInfo(stream)
+	if err != nil {
+		return fmt.Errorf("stream info: %w", err)
+	}
+	if info.State.Msgs != 10 {
+		return fmt.Errorf("expected 10 stored messages, got %d", info.State.Msgs)
+	}
+
+	sub, err := js.PullSubscribe(subject, "conformance")
+	if err != nil {
+		return fmt.Errorf("pull subscribe: %w", err)
+	}
+	msgs, err := sub.Fetch(10, nats.MaxWait(2*time.Second))
+	if err != nil {
+		return fmt.Errorf("fetch: %w", err)
+	}
+	for i, msg := range msgs {
+		if string(msg.Data) != strconv.Itoa(i) {
+			return fmt.Errorf("expected message %d, got %q", i, msg.Data)
+		}
+		if err := msg.Ack(); err != nil {
+			return fmt.Errorf("ack: %w", err)
+		}
+	}
+	if len(msgs) != 10 {
+		return fmt.Errorf("expected 10 fetched messages, got %d", len(msgs))
+	}
+	return nil
+}
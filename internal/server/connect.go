@@ -0,0 +1,197 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// redacted replaces secret values in logged CONNECT options.
+const redacted = "[REDACTED]"
+
+// connectSecrets are the CONNECT options holding credentials.
+var connectSecrets = map[string]bool{
+	"pass":       true,
+	"auth_token": true,
+	"sig":        true,
+	"jwt":        true,
+}
+
+// jwtPattern matches a JWT: three base64url segments, the first a JSON header.
+var jwtPattern = regexp.MustCompile(`^eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*$`)
+
+// redactConnect returns a copy of CONNECT options safe to log: credentials
+// and any value that looks like a JWT are replaced, other options such as
+// user, lang and version are kept.
+func redactConnect(obj map[string]interface{}) map[string]interface{} {
+	safe := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		if connectSecrets[k] {
+			v = redacted
+		} else if s, ok := v.(string); ok && jwtPattern.MatchString(s) {
+			v = redacted
+		}
+		safe[k] = v
+	}
+	return safe
+}
+
+// connectTagField is the custom CONNECT option clients classify their own
+// traffic with, e.g. {"proxy_tag":"telemetry"}. The NATS server ignores
+// options it doesn't know.
+const connectTagField = "proxy_tag"
+
+// maxTagLength bounds tags, which become metric labels.
+const maxTagLength = 64
+
+// ClientInfo identifies the client library behind a connection, as announced
+// in its CONNECT, and the tag the client classified its traffic with.
+type ClientInfo struct {
+	Lang    string `json:"lang,omitempty"`
+	Version string `json:"version,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Tag     string `json:"tag,omitempty"`
+}
+
+// clientInfoFrom extracts the client library and tag from CONNECT options.
+// Tags longer than maxTagLength are ignored.
+func clientInfoFrom(obj map[string]interface{}) ClientInfo {
+	var ci ClientInfo
+	ci.Lang, _ = obj["lang"].(string)
+	ci.Version, _ = obj["version"].(string)
+	ci.Name, _ = obj["name"].(string)
+	if tag, _ := obj[connectTagField].(string); len(tag) <= maxTagLength {
+		ci.Tag = tag
+	}
+	return ci
+}
+
+// MarshalZerologObject adds the client library fields to a log event.
+func (ci ClientInfo) MarshalZerologObject(e *zerolog.Event) {
+	e.Str("lang", ci.Lang).Str("version", ci.Version).Str("name", ci.Name)
+	if ci.Tag != "" {
+		e.Str("tag", ci.Tag)
+	}
+}
+
+// otherLabel replaces client-announced label values past the bound.
+const otherLabel = "other"
+
+// MetricLabelsConfig bounds the metric label values clients announce in
+// CONNECT: their library, its version and their proxy_tag. Any client can
+// announce anything, so without a bound each new value is a new series.
+type MetricLabelsConfig struct {
+	// Langs are the client libraries labelled as announced. Empty labels
+	// the first MaxValues announced.
+	Langs []string `yaml:"langs"`
+
+	// Tags are the proxy_tags labelled as announced. Empty labels the
+	// first MaxValues announced.
+	Tags []string `yaml:"tags"`
+
+	// MaxValues is the number of distinct values of each label kept, past
+	// which they're labelled "other". Defaults to 50.
+	MaxValues int `yaml:"max_values"`
+}
+
+// normalize validates the configuration and applies defaults.
+func (c *MetricLabelsConfig) normalize() error {
+	if c.MaxValues < 0 {
+		return fmt.Errorf("metric_labels max_values must not be negative")
+	}
+	if c.MaxValues == 0 {
+		c.MaxValues = 50
+	}
+	return nil
+}
+
+// labelBound bounds the values of a metric label: those allowed, or without
+// an allow-list the first max seen, are kept and others are "other".
+type labelBound struct {
+	allowed map[string]bool // nil to keep the first max values seen
+	max     int
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func newLabelBound(allowed []string, max int) *labelBound {
+	b := &labelBound{max: max, seen: make(map[string]bool)}
+	if len(allowed) > 0 {
+		b.allowed = make(map[string]bool, len(allowed))
+		for _, v := range allowed {
+			b.allowed[v] = true
+		}
+	}
+	return b
+}
+
+// label returns the label for value v.
+func (b *labelBound) label(v string) string {
+	if b.allowed != nil {
+		if b.allowed[v] {
+			return v
+		}
+		return otherLabel
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.seen[v] {
+		if len(b.seen) >= b.max {
+			return otherLabel
+		}
+		b.seen[v] = true
+	}
+	return v
+}
+
+// clientLabels bounds the metric labels of client-announced values. Versions
+// are bounded per lang, and those of a lang labelled "other" are too.
+type clientLabels struct {
+	langs *labelBound
+	tags  *labelBound
+	max   int
+
+	mu       sync.Mutex
+	versions map[string]*labelBound
+}
+
+// defaultClientLabels bounds labels for parsers without their own bound.
+var defaultClientLabels = newClientLabels(nil)
+
+// newClientLabels bounds labels as cfg configures, nil for the defaults.
+func newClientLabels(cfg *MetricLabelsConfig) *clientLabels {
+	if cfg == nil {
+		cfg = &MetricLabelsConfig{}
+		cfg.normalize()
+	}
+	return &clientLabels{
+		langs:    newLabelBound(cfg.Langs, cfg.MaxValues),
+		tags:     newLabelBound(cfg.Tags, cfg.MaxValues),
+		max:      cfg.MaxValues,
+		versions: make(map[string]*labelBound),
+	}
+}
+
+// client returns the lang and version labels of a client.
+func (l *clientLabels) client(ci ClientInfo) (string, string) {
+	lang := l.langs.label(ci.Lang)
+	if lang == otherLabel {
+		return otherLabel, otherLabel
+	}
+	l.mu.Lock()
+	versions, ok := l.versions[lang]
+	if !ok {
+		versions = newLabelBound(nil, l.max)
+		l.versions[lang] = versions
+	}
+	l.mu.Unlock()
+	return lang, versions.label(ci.Version)
+}
+
+// tag returns the label of a client's tag.
+func (l *clientLabels) tag(tag string) string {
+	return l.tags.label(tag)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// connectFailure is why no identity was extracted from a CONNECT, leaving
+// the client in the default bucket.
+type connectFailure string
+
+const (
+	connectOversized     connectFailure = "oversized"        // the line didn't fit in the parse buffer
+	connectMalformed     connectFailure = "malformed_json"   // the options aren't a JSON object
+	connectInvalidJWT    connectFailure = "invalid_jwt"      // the jwt has no name or sub claim
+	connectUnsupported   connectFailure = "unsupported_auth" // e.g. nkey or token auth, which carry no user name
+	connectNoCredentials connectFailure = "no_credentials"
+)
+
+// connectAuthFields are the CONNECT options authenticating clients without
+// a user name the proxy can limit them as.
+var connectAuthFields = []string{"auth_token", "nkey", "pass"}
+
+// connectSecretValues matches the values of secret CONNECT options in raw,
+// possibly malformed or truncated JSON.
+var connectSecretValues = regexp.MustCompile(`"(pass|auth_token|sig|jwt)"(\s*:\s*)"(?:[^"\\]|\\.)*(?:"|$)`)
+
+// jwtValues matches JWT-looking strings anywhere.
+var jwtValues = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_.-]*`)
+
+// redactConnectLine returns the first n bytes of raw CONNECT options, with
+// secrets replaced first so truncation can't reveal part of one.
+func redactConnectLine(raw []byte, n int) string {
+	safe := connectSecretValues.ReplaceAllString(string(raw), `"$1"$2"`+redacted+`"`)
+	safe = jwtValues.ReplaceAllString(safe, redacted)
+	if len(safe) > n {
+		safe = safe[:n] + "..."
+	}
+	return safe
+}
+
+// connectFailureOf tells why parsed CONNECT options without a user or JWT
+// identify nobody.
+func connectFailureOf(obj map[string]interface{}) (connectFailure, []string) {
+	var fields []string
+	for _, field := range connectAuthFields {
+		if _, ok := obj[field]; ok {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 {
+		return connectNoCredentials, nil
+	}
+	sort.Strings(fields)
+	return connectUnsupported, fields
+}
+
+// connectFailed counts a CONNECT no identity was extracted from and, if
+// diagnostics are on, logs why with the start of its redacted options.
+func (c *ClientMessageParser) connectFailed(reason connectFailure, raw []byte, fields []string) {
+	metricConnectIdentityFailures.Add(1, string(reason))
+	if c.connectDiagnostics <= 0 {
+		return
+	}
+	e := log.Warn().Str("reason", string(reason))
+	if len(fields) > 0 {
+		e = e.Str("auth_fields", strings.Join(fields, ","))
+	}
+	if raw != nil {
+		e = e.Str("connect", redactConnectLine(raw, c.connectDiagnostics))
+	}
+	e.EmbedObject(c.client).Msg("No identity in CONNECT, client gets the default limit")
+}
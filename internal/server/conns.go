@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// liveConn is a client connection being served.
+type liveConn struct {
+	conn   net.Conn
+	cw     *clientWriter
+	closed *closeRecorder
+	start  time.Time
+	limits *RateLimiterManager
+	mem    *connMemory // nil unless buffer memory is capped
+}
+
+// close closes the connection for reason, unless it already ended.
+func (c *liveConn) close(reason closeReason, err error) {
+	c.closed.record(&closeError{reason: reason, err: err}, false)
+	c.conn.Close()
+}
+
+// closeWithError closes the connection for reason, telling the client why
+// unless it doesn't read within a second.
+func (c *liveConn) closeWithError(reason closeReason, err error) {
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.cw.WriteFrame(clientErrorLine(reason))
+	c.close(reason, err)
+}
+
+// user returns the user the client identified as, "" until it did.
+func (c *liveConn) user() string {
+	if user := c.cw.identity.Load(); user != nil {
+		return *user
+	}
+	return ""
+}
+
+// connRegistry tracks the client connections a proxy serves. The zero value
+// is an empty registry.
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[*liveConn]struct{}
+}
+
+// add registers a connection until the returned function is called.
+func (r *connRegistry) add(c *liveConn) (remove func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns == nil {
+		r.conns = make(map[*liveConn]struct{})
+	}
+	r.conns[c] = struct{}{}
+	return func() {
+		r.mu.Lock()
+		delete(r.conns, c)
+		r.mu.Unlock()
+	}
+}
+
+// list returns the registered connections.
+func (r *connRegistry) list() []*liveConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conns := make([]*liveConn, 0, len(r.conns))
+	for c := range r.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PayloadSamplingConfig configures sampling of message payloads to classify
+// traffic by content type. Only the classification is recorded, payloads are
+// never logged or stored.
+type PayloadSamplingConfig struct {
+	// Every samples one in this many messages of a connection. Defaults to 100.
+	Every int `yaml:"every"`
+	// PrefixBytes is how much of a payload is inspected. Defaults to 64.
+	PrefixBytes int `yaml:"prefix_bytes"`
+}
+
+// Magic numbers of compressed formats.
+var compressionMagics = []struct {
+	name  string
+	magic []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"lz4", []byte{0x04, 0x22, 0x4d, 0x18}},
+	{"snappy", []byte("\xff\x06\x00\x00sNaPpY")},
+	{"s2", []byte("\xff\x06\x00\x00S2sTwO")},
+}
+
+// classifyPayload returns the likely content type of a payload from its
+// prefix: "empty", a compression format, "json", "text", "protobuf" or "binary".
+func classifyPayload(prefix []byte) string {
+	if len(prefix) == 0 {
+		return "empty"
+	}
+	for _, c := range compressionMagics {
+		if bytes.HasPrefix(prefix, c.magic) {
+			return c.name
+		}
+	}
+	if trimmed := bytes.TrimLeft(prefix, " \t\r\n"); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && isText(trimmed) {
+		return "json"
+	}
+	if isText(prefix) {
+		return "text"
+	}
+	if isProtobuf(prefix) {
+		return "protobuf"
+	}
+	return "binary"
+}
+
+// isText reports whether p is printable UTF-8, tolerating a rune cut off at
+// the end of the prefix.
+func isText(p []byte) bool {
+	for len(p) > 0 {
+		r, size := utf8.DecodeRune(p)
+		if r == utf8.RuneError && size <= 1 {
+			return len(p) < utf8.UTFMax && !utf8.FullRune(p)
+		}
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+		p = p[size:]
+	}
+	return true
+}
+
+// isProtobuf reports whether p parses as protobuf wire format fields, the
+// last of which may be cut off at the end of the prefix.
+func isProtobuf(p []byte) bool {
+	fields := 0
+	for len(p) > 0 {
+		tag, n := binary.Uvarint(p)
+		if n <= 0 {
+			return fields > 0 && n == 0
+		}
+		if tag>>3 == 0 {
+			return false
+		}
+		p = p[n:]
+		switch tag & 7 {
+		case 0: // varint
+			if _, n = binary.Uvarint(p); n < 0 {
+				return false
+			}
+			if n == 0 {
+				return fields > 0
+			}
+			p = p[n:]
+		case 1: // fixed64
+			p = p[min(8, len(p)):]
+		case 2: // length-delimited
+			length, n := binary.Uvarint(p)
+			if n < 0 {
+				return false
+			}
+			if n == 0 {
+				return fields > 0
+			}
+			p = p[n:]
+			p = p[min(length, uint64(len(p))):]
+		case 5: // fixed32
+			p = p[min(4, len(p)):]
+		default:
+			return false
+		}
+		fields++
+	}
+	return fields > 0
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+func TestClassifyPayload(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(`{"hello":"world"}`))
+	w.Close()
+
+	tests := []struct {
+		name    string
+		payload []byte
+		expect  string
+	}{
+		{"Empty", nil, "empty"},
+		{"JSON object", []byte(`  {"id": 1, "name": "ünïcode"}`), "json"},
+		{"JSON array cut off", []byte(`[1, 2, 3, "abc`), "json"},
+		{"Text", []byte("temperature=21.5 unit=C"), "text"},
+		{"Text with cut off rune", []byte("caf\xc3"), "text"},
+		{"Gzip", gz.Bytes(), "gzip"},
+		{"Zstd", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x58}, "zstd"},
+		// field 1 varint 150, field 2 string "testing"
+		{"Protobuf", []byte{0x08, 0x96, 0x01, 0x12, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}, "protobuf"},
+		{"Protobuf cut off", []byte{0x08, 0x96, 0x01, 0x12, 0x07, 't', 'e'}, "protobuf"},
+		{"Binary", []byte{0x00, 0xff, 0xfe, 0x07, 0x03}, "binary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyPayload(tt.payload); got != tt.expect {
+				t.Errorf("Expected %q, got %q", tt.expect, got)
+			}
+		})
+	}
+}
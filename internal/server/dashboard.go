@@ -0,0 +1,78 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// dashboardPage is a single page polling the dashboard data, for operators
+// without a Prometheus and Grafana stack.
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// Dashboard is the live state served to the dashboard page.
+type Dashboard struct {
+	Now   time.Time       `json:"now"`
+	Scale float64         `json:"rate_scale"`
+	Users []DashboardUser `json:"users"`
+}
+
+// DashboardUser is a rate limited user's live state.
+type DashboardUser struct {
+	User             string          `json:"user"`
+	Bandwidth        int64           `json:"bandwidth"`
+	Connections      int             `json:"connections"`
+	Throughput       ThroughputStats `json:"throughput"`
+	Throttles        int64           `json:"throttles"`         // writes delayed by the limit
+	ThrottledSeconds float64         `json:"throttled_seconds"` // time those writes waited
+}
+
+// Dashboard returns a snapshot of the users that currently have a rate limiter.
+func (p *Proxy) Dashboard() *Dashboard {
+	rlm := p.rateLimiterMgr
+	users := rlm.ActiveUsers()
+	sort.Strings(users)
+
+	d := &Dashboard{Now: time.Now(), Scale: rlm.GlobalScale(), Users: make([]DashboardUser, 0, len(users))}
+	for _, user := range users {
+		d.Users = append(d.Users, DashboardUser{
+			User:             user,
+			Bandwidth:        rlm.Bandwidth(user),
+			Connections:      rlm.Connections(user),
+			Throughput:       rlm.Stats(user),
+			Throttles:        metricThrottles.Get(user),
+			ThrottledSeconds: time.Duration(metricThrottleWaitSeconds.Get(user)).Seconds(),
+		})
+	}
+	return d
+}
+
+// authorizeDashboard checks the request grants read access like the admin
+// API does, prompting browsers for the token as a basic authentication
+// password. They then send it with the page's data requests too.
+func (p *Proxy) authorizeDashboard(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("WWW-Authenticate", `Basic realm="nats-limiter-proxy"`)
+	if !p.authorizeAdmin(w, r, scopeRead) {
+		return false
+	}
+	w.Header().Del("WWW-Authenticate")
+	return true
+}
+
+func (p *Proxy) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizeDashboard(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardPage)
+}
+
+func (p *Proxy) handleDashboardData(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizeDashboard(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, p.Dashboard())
+}
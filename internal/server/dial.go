@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// upstreamDialer returns the dialer of upstream connections, bound to the
+// configured source address and interface. When the upstream resolves to
+// both IPv4 and IPv6 addresses, the dialer races the families (Happy
+// Eyeballs), giving the first the resolver returns the fallback delay's head
+// start.
+func upstreamDialer(cfg *Config) (*net.Dialer, error) {
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout, FallbackDelay: cfg.UpstreamFallbackDelay}
+	if addr := cfg.UpstreamBindAddress; addr != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(addr)}
+	}
+	if iface := cfg.UpstreamBindInterface; iface != "" {
+		control, err := bindToInterface(iface)
+		if err != nil {
+			return nil, err
+		}
+		dialer.Control = control
+	}
+	return dialer, nil
+}
+
+var errDialSlotTimeout = errors.New("timed out waiting for a free upstream dial slot")
+
+// dialUpstream dials the upstream once a dial slot is free, giving up after
+// the dial timeout. While forwarding is paused the upstream is failing over,
+// so dials wait for the pause to end first.
+func (p *Proxy) dialUpstream() (net.Conn, error) {
+	p.pause.wait()
+	release, err := p.acquireDialSlot()
+	if err != nil {
+		metricUpstreamDialFailures.Add(1, dialErrorType(err))
+		return nil, err
+	}
+	defer release()
+
+	start := time.Now()
+	conn, err := p.dial()
+	if err == nil && p.upstreamTLS != nil {
+		conn, err = p.upgradeUpstream(conn, p.upstreamTLS)
+	}
+	metricUpstreamDials.Add(1)
+	metricUpstreamDialSeconds.Add(int64(time.Since(start)))
+	if err != nil {
+		metricUpstreamDialFailures.Add(1, dialErrorType(err))
+		metricUpstreamUp.Set(0)
+		return nil, err
+	}
+	metricUpstreamUp.Set(1)
+	return conn, nil
+}
+
+// dialShadow dials the shadow upstream like the upstream: once a dial slot
+// is free, and over TLS if the upstream is. It isn't held by pauses, which
+// are for failovers of the upstream.
+func (p *Proxy) dialShadow(dial DialFunc, tlsConfig *tls.Config) (net.Conn, error) {
+	release, err := p.acquireDialSlot()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	conn, err := dial()
+	if err == nil && tlsConfig != nil {
+		conn, err = p.upgradeUpstream(conn, tlsConfig)
+	}
+	return conn, err
+}
+
+// acquireDialSlot waits up to the dial timeout for a free dial slot,
+// returning the function releasing it.
+func (p *Proxy) acquireDialSlot() (release func(), err error) {
+	if p.dialSlots == nil {
+		return func() {}, nil
+	}
+	timer := time.NewTimer(p.currentConfig().DialTimeout)
+	defer timer.Stop()
+	select {
+	case p.dialSlots <- struct{}{}:
+		return func() { <-p.dialSlots }, nil
+	case <-timer.C:
+		return nil, errDialSlotTimeout
+	}
+}
+
+// dialErrorType classifies a dial error for metrics.
+func dialErrorType(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errDialSlotTimeout):
+		return "slot_timeout"
+	case errors.Is(err, errUpstreamTLS):
+		return "tls"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	default:
+		return "other"
+	}
+}
+
+// maxHeldBytes bounds what a held client may send before the upstream is
+// back, typically no more than its CONNECT and a PING.
+const maxHeldBytes = 64 * 1024
+
+var (
+	errHeldBufferFull    = errors.New("client sent too much while held")
+	errHeldSignedConnect = errors.New("client signed its CONNECT while held, without the upstream's nonce")
+)
+
+// holdClient keeps a client whose upstream couldn't be dialed connected,
+// sending it an INFO banner so it backs off gracefully, and retries the
+// upstream until the hold timeout or until the client leaves. It returns the
+// upstream, whose own INFO then reaches the client as usual, and the client
+// connection replaying what the client sent while held, or on failure the
+// client connection as it was.
+func (p *Proxy) holdClient(clientConn net.Conn, cfg *UnavailableConfig) (net.Conn, net.Conn, error) {
+	clientConn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := clientConn.Write(holdInfo(cfg.Info)); err != nil {
+		return nil, clientConn, &closeError{closeClientWriteError, err}
+	}
+	clientConn.SetWriteDeadline(time.Time{})
+	metricHeldClients.Add(1)
+	defer metricHeldClients.Add(-1)
+
+	// Read the client while held, to notice it leaving
+	var held []byte
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := clientConn.Read(buf)
+			held = append(held, buf[:n]...)
+			if err == nil && len(held) > maxHeldBytes {
+				err = errHeldBufferFull
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	stopReading := func() error {
+		clientConn.SetReadDeadline(time.Now())
+		err := <-done
+		clientConn.SetReadDeadline(time.Time{})
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil
+		}
+		return err
+	}
+
+	deadline := time.Now().Add(cfg.HoldTimeout)
+	for {
+		select {
+		case err := <-done:
+			return nil, clientConn, &closeError{closeReasonOf(err, true), err}
+		case <-time.After(min(cfg.RetryInterval, time.Until(deadline))):
+		}
+		conn, err := p.dialUpstream()
+		if err != nil && time.Now().Before(deadline) {
+			continue
+		}
+		if rerr := stopReading(); rerr != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return nil, clientConn, &closeError{closeReasonOf(rerr, true), rerr}
+		}
+		if err != nil {
+			return nil, clientConn, err
+		}
+		// A CONNECT signed while held signed the banner's missing nonce, and
+		// the upstream would refuse it: the client is closed to reconnect and
+		// sign the upstream's
+		if line, _, _ := bytes.Cut(held, []byte("\n")); bytes.HasPrefix(bytes.ToUpper(line), []byte("CONNECT")) && isSignedConnect(line) {
+			conn.Close()
+			return nil, clientConn, &closeError{closeHeldSignedConnect, errHeldSignedConnect}
+		}
+		return conn, &prefixConn{Conn: clientConn, prefix: held}, nil
+	}
+}
+
+// holdInfo returns the INFO line sent to held clients, with fields overriding
+// the defaults.
+func holdInfo(fields map[string]interface{}) []byte {
+	info := map[string]interface{}{
+		"server_id":   "nats-limiter-proxy",
+		"server_name": "nats-limiter-proxy",
+		"version":     Version,
+		"proto":       1,
+		"headers":     true,
+		"max_payload": 1024 * 1024,
+		"ldm":         true,
+	}
+	for k, v := range fields {
+		info[k] = v
+	}
+	data, _ := json.Marshal(info)
+	return append(append([]byte("INFO "), data...), '\r', '\n')
+}
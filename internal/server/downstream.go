@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// clientWriter serializes writes to the client connection so that frames
+// injected by the proxy never interleave with frames forwarded from upstream.
+type clientWriter struct {
+	mu       sync.Mutex
+	out      *bufio.Writer
+	audit    flowAudit         // bytes written and injected are counted with mu held
+	watchdog *orderingWatchdog // checksums of frames buffered and written, if on
+	user     string            // user messages delivered are accounted to, set with mu held
+	queues   queueSubs         // subscriptions in limited queue groups
+	secure   bool              // the proxy terminated TLS, which INFO lines must announce
+	info     []byte            // latest INFO line written, set with mu held
+	// The client is served without TLS, which INFO lines of an upstream
+	// requiring it mustn't ask for
+	plaintext bool
+	// INFO lines are forwarded as is and none are sent of the proxy's own
+	infoPassthrough bool
+	verbose         bool        // the client is in verbose mode, set with mu held
+	acks            verboseAcks // owed by the upstream, if verbose
+
+	// The user, for readers that mustn't wait for mu
+	identity atomic.Pointer[string]
+	// The user bypasses rate limiting
+	bypassed atomic.Bool
+	// Accounts buffers grown for long upstream lines, nil unless capped
+	mem *connMemory
+}
+
+func newClientWriter(w io.Writer) *clientWriter {
+	cw := &clientWriter{}
+	cw.out = bufio.NewWriterSize(clientSideWriter{w, cw}, 32*1024)
+	return cw
+}
+
+// setOrderingWatchdog checks that frames buffered for the client reach it
+// whole and in order, whether forwarded from upstream or injected.
+func (cw *clientWriter) setOrderingWatchdog() {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.watchdog = &orderingWatchdog{}
+}
+
+// setUser accounts the messages delivered to the client's subscriptions to
+// user.
+func (cw *clientWriter) setUser(user string) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.user = user
+	cw.identity.Store(&user)
+}
+
+// clientSideWriter attributes write errors to the client connection, so they
+// aren't mistaken for upstream read errors.
+type clientSideWriter struct {
+	w  io.Writer
+	cw *clientWriter // written to with cw.mu held
+}
+
+func (w clientSideWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.cw.audit.bytesOut += int64(n)
+	w.cw.watchdog.wrote(p[:n])
+	if err != nil {
+		err = &closeError{reason: closeClientWriteError, err: err}
+	}
+	return n, err
+}
+
+// WriteFrame writes a complete protocol frame injected by the proxy to the
+// client.
+func (cw *clientWriter) WriteFrame(frame []byte) error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.audit.bytesAdjusted += int64(len(frame))
+	return cw.writeFrame(frame)
+}
+
+// writeFrame writes a frame and flushes it. Callers must hold cw.mu.
+func (cw *clientWriter) writeFrame(frame []byte) error {
+	cw.watchdog.send(frame)
+	if _, err := cw.out.Write(frame); err != nil {
+		return err
+	}
+	if err := cw.out.Flush(); err != nil {
+		return err
+	}
+	cw.watchdog.check("downstream")
+	return nil
+}
+
+// checkFlow checks that all bytes forwardDownstream read from the upstream
+// and the proxy injected were written to the client, once forwardDownstream
+// returned err. After a client write error it's unknown how many were.
+// Messages pass through unchanged, so only the parser audits them.
+func (cw *clientWriter) checkFlow(err error, user string) bool {
+	if closeReasonOf(err, false) == closeClientWriteError {
+		return true
+	}
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.audit.check("downstream", user)
+}
+
+// forwardDownstream forwards upstream data to the client until the upstream
+// fails. MSG and HMSG frames are written whole, so frames injected through
+// the client writer always land on frame boundaries. Messages delivered to a
+// limited queue group wait for the group's limit.
+func forwardDownstream(upstream io.Reader, cw *clientWriter) error {
+	reader := bufio.NewReaderSize(upstream, 32*1024)
+	var payloads io.Reader = reader
+	if cw.watchdog != nil {
+		payloads = watchdogReader{reader, cw.watchdog}
+	}
+	var line []byte
+
+	for {
+		line = line[:0]
+		for {
+			chunk, err := reader.ReadSlice('\n')
+			held := cap(line)
+			line = append(line, chunk...)
+			cw.mem.grow(int64(cap(line) - held))
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil {
+				if len(line) > 0 {
+					cw.mu.Lock()
+					cw.audit.bytesIn += int64(len(line))
+					cw.writeFrame(line)
+					cw.mu.Unlock()
+				}
+				return err
+			}
+			break
+		}
+
+		payload := msgPayloadSize(line)
+		if payload > 0 {
+			if sub, ok := cw.queues.lookup(line); ok {
+				// Charged before taking the lock, so frames injected for
+				// the client aren't held up
+				sub.limiter.Wait(int64(len(line) + payload))
+				metricQueueGroupBytes.Add(int64(len(line)+payload), sub.queue)
+			}
+		}
+
+		cw.mu.Lock()
+		cw.audit.bytesIn += int64(len(line))
+		if (cw.secure || cw.plaintext) && payload == 0 {
+			adjusted := tlsInfo(line, cw.secure)
+			cw.audit.bytesAdjusted += int64(len(adjusted) - len(line))
+			line = adjusted
+		}
+		if payload == 0 && bytes.HasPrefix(line, []byte("INFO ")) {
+			cw.info = bytes.Clone(line)
+		}
+		cw.watchdog.send(line)
+		_, err := cw.out.Write(line)
+		if err == nil && cw.verbose && payload == 0 && isAck(line) {
+			// Written ahead of the proxy's replies to later ops
+			cw.acks.received()
+		}
+		if err == nil && payload > 0 {
+			var n int64
+			n, err = io.CopyN(cw.out, payloads, int64(payload))
+			cw.audit.bytesIn += n
+			if cw.user != "" {
+				metricDeliveredBytes.Add(int64(len(line))+n, cw.user)
+			}
+		}
+		if err == nil && reader.Buffered() == 0 {
+			// Nothing else ready from upstream - don't hold back what we have
+			if err = cw.out.Flush(); err == nil {
+				cw.watchdog.check("downstream")
+			}
+		}
+		if err != nil {
+			// Still deliver the frames before a message cut off by the upstream
+			cw.out.Flush()
+		}
+		cw.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// msgPayloadSize returns the number of payload bytes (including the trailing
+// CRLF) following a MSG or HMSG protocol line, or 0 for other lines.
+func msgPayloadSize(line []byte) int {
+	if len(line) < 4 {
+		return 0
+	}
+	switch {
+	case bytes.EqualFold(line[:4], []byte("MSG ")), bytes.EqualFold(line[:4], []byte("MSG\t")):
+	case len(line) >= 5 && (bytes.EqualFold(line[:5], []byte("HMSG ")) || bytes.EqualFold(line[:5], []byte("HMSG\t"))):
+	default:
+		return 0
+	}
+	fields := bytes.Fields(line)
+	size := parseSize(fields[len(fields)-1])
+	if size < 0 {
+		return 0
+	}
+	return size + 2
+}
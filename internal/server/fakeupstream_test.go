@@ -0,0 +1,347 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// fakeNATS is an in-memory NATS server speaking enough of the protocol
+// for end-to-end tests through the proxy without a real server: it accepts
+// any CONNECT, answers PING and delivers PUB and HPUB to matching SUBs,
+// including its own connection's, one member per queue group.
+type fakeNATS struct {
+	ln       net.Listener
+	info     []byte
+	tls      *tls.Config // upgrades connections after the INFO, if set
+	mu       sync.Mutex
+	conns    map[*fakeConn]struct{}
+	connects []map[string]interface{} // CONNECT fields, in order received
+}
+
+// fakeConn is a connection to the fake upstream.
+type fakeConn struct {
+	conn net.Conn
+	mu   sync.Mutex // serializes writes
+	subs map[string]fakeSub
+}
+
+type fakeSub struct {
+	subject, queue string
+}
+
+// startFakeNATS serves a fake upstream on a local port until the test ends,
+// greeting connections with an INFO naming id.
+func startFakeNATS(t *testing.T, id string) *fakeNATS {
+	t.Helper()
+	return serveFakeNATS(t, id, nil)
+}
+
+// startFakeTLSNATS serves a fake upstream requiring TLS, upgrading
+// connections after the INFO with the certificate in certFile and keyFile.
+func startFakeTLSNATS(t *testing.T, id, certFile, keyFile string) *fakeNATS {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair failed: %v", err)
+	}
+	return serveFakeNATS(t, id, &tls.Config{Certificates: []tls.Certificate{cert}})
+}
+
+func serveFakeNATS(t *testing.T, id string, config *tls.Config) *fakeNATS {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	info := `{"server_id":"` + id + `","version":"2.10.0","proto":1,"headers":true,"max_payload":1048576`
+	if config != nil {
+		info += `,"tls_required":true`
+	}
+	f := &fakeNATS{
+		ln:    ln,
+		info:  []byte("INFO " + info + "}\r\n"),
+		tls:   config,
+		conns: make(map[*fakeConn]struct{}),
+	}
+	go f.accept()
+	t.Cleanup(f.close)
+	return f
+}
+
+// startFakeProxy runs a proxy with the config yaml in front of a fake
+// upstream, returning the upstream and the URL clients connect to.
+func startFakeProxy(t *testing.T, yaml string) (*fakeNATS, string) {
+	t.Helper()
+	f := startFakeNATS(t, "fake")
+	addr := f.ln.Addr().(*net.TCPAddr)
+	p, err := NewProxy(addr.IP.String(), addr.Port, writeTestConfig(t, yaml))
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	srv, _ := runTestServer(ctx, t, p)
+	t.Cleanup(func() {
+		cancel()
+		srv.Stop(time.Second)
+	})
+	return f, "nats://" + srv.Addr().String()
+}
+
+// Addr returns the address the fake upstream listens on.
+func (f *fakeNATS) Addr() string {
+	return f.ln.Addr().String()
+}
+
+// Connects returns the CONNECT fields received so far.
+func (f *fakeNATS) Connects() []map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[string]interface{}(nil), f.connects...)
+}
+
+func (f *fakeNATS) close() {
+	f.ln.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for c := range f.conns {
+		c.conn.Close()
+	}
+}
+
+func (f *fakeNATS) accept() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			conn.Write(f.info)
+			if f.tls != nil {
+				tlsConn := tls.Server(conn, f.tls)
+				if err := tlsConn.Handshake(); err != nil {
+					conn.Close()
+					return
+				}
+				conn = tlsConn
+			}
+			c := &fakeConn{conn: conn, subs: make(map[string]fakeSub)}
+			f.mu.Lock()
+			f.conns[c] = struct{}{}
+			f.mu.Unlock()
+			defer func() {
+				f.mu.Lock()
+				delete(f.conns, c)
+				f.mu.Unlock()
+				conn.Close()
+			}()
+			f.serve(c, bufio.NewReader(conn))
+		}()
+	}
+}
+
+// serve handles a connection's protocol lines until it fails or closes.
+func (f *fakeNATS) serve(c *fakeConn, r *bufio.Reader) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		op, args, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		fields := strings.Fields(args)
+		switch strings.ToUpper(op) {
+		case "CONNECT":
+			var obj map[string]interface{}
+			if err := json.Unmarshal([]byte(args), &obj); err != nil {
+				c.write([]byte("-ERR 'Invalid CONNECT'\r\n"))
+				return err
+			}
+			f.mu.Lock()
+			f.connects = append(f.connects, obj)
+			f.mu.Unlock()
+		case "PING":
+			c.write([]byte("PONG\r\n"))
+		case "PONG":
+		case "SUB":
+			if len(fields) < 2 {
+				return fmt.Errorf("invalid SUB %q", line)
+			}
+			sub := fakeSub{subject: fields[0]}
+			if len(fields) == 3 {
+				sub.queue = fields[1]
+			}
+			f.mu.Lock()
+			c.subs[fields[len(fields)-1]] = sub
+			f.mu.Unlock()
+		case "UNSUB":
+			if len(fields) < 1 {
+				return fmt.Errorf("invalid UNSUB %q", line)
+			}
+			f.mu.Lock()
+			delete(c.subs, fields[0])
+			f.mu.Unlock()
+		case "PUB", "HPUB":
+			headers := strings.ToUpper(op) == "HPUB"
+			sizes := 1
+			if headers {
+				sizes = 2
+			}
+			if len(fields) < 1+sizes || len(fields) > 2+sizes {
+				return fmt.Errorf("invalid %s %q", op, line)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return err
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return err
+			}
+			reply := ""
+			if len(fields) == 2+sizes {
+				reply = fields[1]
+			}
+			f.publish(fields[0], reply, fields[len(fields)-sizes:], payload)
+		default:
+			c.write([]byte("-ERR 'Unknown Protocol Operation'\r\n"))
+		}
+	}
+}
+
+// publish delivers a message to every matching subscription, and to one
+// member of each matching queue group.
+func (f *fakeNATS) publish(subject, reply string, sizes []string, payload []byte) {
+	op := "MSG"
+	if len(sizes) == 2 {
+		op = "HMSG"
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	queues := make(map[string]bool)
+	for c := range f.conns {
+		for sid, sub := range c.subs {
+			if !subjectMatches(sub.subject, subject) || queues[sub.queue] {
+				continue
+			}
+			if sub.queue != "" {
+				queues[sub.queue] = true
+			}
+			fields := []string{op, subject, sid}
+			if reply != "" {
+				fields = append(fields, reply)
+			}
+			fields = append(fields, sizes...)
+			c.write(append([]byte(strings.Join(fields, " ")+"\r\n"), payload...))
+		}
+	}
+}
+
+func (c *fakeConn) write(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.Write(b)
+}
+
+func TestFakeUpstream_EndToEnd(t *testing.T) {
+	f, url := startFakeProxy(t, "default_bandwidth: 10485760\n")
+	nc, err := nats.Connect(url, nats.UserInfo("alice", "secret"), nats.Timeout(2*time.Second))
+	if err != nil {
+		t.Fatalf("Failed to connect through the proxy: %v", err)
+	}
+	defer nc.Close()
+
+	t.Run("publish/subscribe", func(t *testing.T) {
+		sub, err := nc.SubscribeSync("e2e.>")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Unsubscribe()
+		for i := 0; i < 10; i++ {
+			nc.Publish("e2e.pub", []byte(strconv.Itoa(i)))
+		}
+		for i := 0; i < 10; i++ {
+			msg, err := sub.NextMsg(2 * time.Second)
+			if err != nil {
+				t.Fatalf("Message %d: %v", i, err)
+			}
+			if string(msg.Data) != strconv.Itoa(i) {
+				t.Fatalf("Expected message %d in order, got %q", i, msg.Data)
+			}
+		}
+	})
+
+	t.Run("request/reply", func(t *testing.T) {
+		sub, err := nc.Subscribe("e2e.echo", func(m *nats.Msg) { m.Respond(m.Data) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Unsubscribe()
+		msg, err := nc.Request("e2e.echo", []byte("ping"), 2*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Data) != "ping" {
+			t.Errorf("Expected the request echoed, got %q", msg.Data)
+		}
+	})
+
+	t.Run("headers", func(t *testing.T) {
+		sub, err := nc.SubscribeSync("e2e.headers")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Unsubscribe()
+		out := nats.NewMsg("e2e.headers")
+		out.Header.Set("Trace", "abc")
+		out.Data = []byte("body")
+		if err := nc.PublishMsg(out); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := sub.NextMsg(2 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Header.Get("Trace") != "abc" || string(msg.Data) != "body" {
+			t.Errorf("Expected the header and body delivered, got %v %q", msg.Header, msg.Data)
+		}
+	})
+
+	if connects := f.Connects(); len(connects) != 1 || connects[0]["user"] != "alice" {
+		t.Errorf("Expected alice's CONNECT forwarded, got %v", connects)
+	}
+}
+
+func TestFakeUpstream_RateLimit(t *testing.T) {
+	_, url := startFakeProxy(t, "default_bandwidth: 1048576\nusers:\n  alice: 65536\n")
+	nc, err := nats.Connect(url, nats.UserInfo("alice", "secret"), nats.Timeout(2*time.Second))
+	if err != nil {
+		t.Fatalf("Failed to connect through the proxy: %v", err)
+	}
+	defer nc.Close()
+
+	// The first 64KB are the bucket's burst, the next 64KB take a second
+	payload := make([]byte, 16<<10)
+	start := time.Now()
+	for i := 0; i < 8; i++ {
+		if err := nc.Publish("e2e.limited", payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nc.FlushTimeout(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("Expected alice held to 64KB/s, 128KB took %v", elapsed)
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Freeze blocks publishes of users to subjects for a time window, e.g. while
+// producers must pause for a cutover, while subscriptions keep being served.
+type Freeze struct {
+	ID string `json:"id" yaml:"-"`
+	// Users are the users frozen. Empty freezes all users.
+	Users []string `json:"users,omitempty" yaml:"users"`
+	// Subjects are the subjects frozen, NATS wildcards allowed. Empty
+	// freezes all subjects.
+	Subjects []string `json:"subjects,omitempty" yaml:"subjects"`
+	// Start and End bound the window. A zero Start freezes right away, a
+	// zero End until the freeze is removed.
+	Start  time.Time `json:"start,omitzero" yaml:"start"`
+	End    time.Time `json:"end,omitzero" yaml:"end"`
+	Reason string    `json:"reason,omitempty" yaml:"reason"`
+}
+
+// active reports whether the freeze window contains now.
+func (f *Freeze) active(now time.Time) bool {
+	return (f.Start.IsZero() || !now.Before(f.Start)) && (f.End.IsZero() || now.Before(f.End))
+}
+
+// expired reports whether the freeze window ended before now.
+func (f *Freeze) expired(now time.Time) bool {
+	return !f.End.IsZero() && !now.Before(f.End)
+}
+
+// applies reports whether the freeze covers publishes of user to subject.
+func (f *Freeze) applies(user, subject string) bool {
+	return (len(f.Users) == 0 || slices.Contains(f.Users, user)) &&
+		(len(f.Subjects) == 0 || matchesAny(f.Subjects, subject))
+}
+
+// validate checks a freeze's window.
+func (f *Freeze) validate() error {
+	if !f.Start.IsZero() && !f.End.IsZero() && !f.End.After(f.Start) {
+		return fmt.Errorf("freeze end %s must be after its start %s", f.End, f.Start)
+	}
+	return nil
+}
+
+// freezeList holds the scheduled and admin-created freezes.
+type freezeList struct {
+	mu      sync.RWMutex
+	freezes []*Freeze
+	nextID  int
+}
+
+// newFreezeList returns a list of the configured freezes.
+func newFreezeList(configured []*Freeze) *freezeList {
+	l := &freezeList{}
+	for i, f := range configured {
+		f := *f
+		f.ID = "config-" + strconv.Itoa(i)
+		l.freezes = append(l.freezes, &f)
+	}
+	return l
+}
+
+// frozen returns the freeze blocking publishes of user to subject at the
+// clock's time, if any.
+func (l *freezeList) frozen(user, subject string, clock Clock) *Freeze {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.freezes) == 0 {
+		return nil
+	}
+	now := clock.Now()
+	for _, f := range l.freezes {
+		if f.active(now) && f.applies(user, subject) {
+			return f
+		}
+	}
+	return nil
+}
+
+// list returns the freezes that haven't expired by now, forgetting the
+// others.
+func (l *freezeList) list(now time.Time) []Freeze {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.freezes = slices.DeleteFunc(l.freezes, func(f *Freeze) bool { return f.expired(now) })
+	freezes := make([]Freeze, len(l.freezes))
+	for i, f := range l.freezes {
+		freezes[i] = *f
+	}
+	return freezes
+}
+
+// add adds a freeze, assigning it an ID.
+func (l *freezeList) add(f Freeze) Freeze {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nextID++
+	f.ID = strconv.Itoa(l.nextID)
+	l.freezes = append(l.freezes, &f)
+	return f
+}
+
+// remove removes a freeze, reporting whether it existed.
+func (l *freezeList) remove(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := len(l.freezes)
+	l.freezes = slices.DeleteFunc(l.freezes, func(f *Freeze) bool { return f.ID == id })
+	return len(l.freezes) < n
+}
+
+// created returns the freezes added via the admin API that haven't expired
+// by now, which the state file keeps across restarts.
+func (l *freezeList) created(now time.Time) []Freeze {
+	var freezes []Freeze
+	for _, f := range l.list(now) {
+		if _, err := strconv.Atoi(f.ID); err == nil {
+			freezes = append(freezes, f)
+		}
+	}
+	return freezes
+}
+
+// restore adds freezes persisted before a restart, keeping their IDs.
+func (l *freezeList) restore(freezes []Freeze) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, f := range freezes {
+		id, err := strconv.Atoi(f.ID)
+		if err != nil {
+			continue
+		}
+		l.nextID = max(l.nextID, id)
+		l.freezes = append(l.freezes, &f)
+	}
+}
+
+// Frozen reports whether publishes of a user to a subject are blocked by a
+// freeze. Freeze windows are timed by the limiters' clock.
+func (rlm *RateLimiterManager) Frozen(username, subject string) bool {
+	return rlm.freezes.frozen(username, subject, rlm.Clock()) != nil
+}
+
+func (p *Proxy) handleFreezes(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizeAdmin(w, r, scopeRead) {
+		return
+	}
+	writeJSON(w, http.StatusOK, p.rateLimiterMgr.freezes.list(p.rateLimiterMgr.Clock().Now()))
+}
+
+func (p *Proxy) handleAddFreeze(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizeAdmin(w, r, scopeWrite) {
+		return
+	}
+	var req struct {
+		Freeze
+		// Duration sets End relative to Start, or to now if Start is zero
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid freeze")
+		return
+	}
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "duration must be positive, e.g. \"15m\"")
+			return
+		}
+		req.End = p.rateLimiterMgr.Clock().Now().Add(d)
+		if !req.Start.IsZero() {
+			req.End = req.Start.Add(d)
+		}
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	f := p.rateLimiterMgr.freezes.add(req.Freeze)
+	p.persistState()
+	auditChange(r, nil, f)
+	log.Info().Str("audit", "freeze").Str("id", f.ID).Strs("users", f.Users).Strs("subjects", f.Subjects).
+		Time("start", f.Start).Time("end", f.End).Str("reason", f.Reason).Str("remote", r.RemoteAddr).
+		Msg("Publish freeze added")
+	writeJSON(w, http.StatusCreated, f)
+}
+
+func (p *Proxy) handleRemoveFreeze(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizeAdmin(w, r, scopeWrite) {
+		return
+	}
+	id := r.PathValue("id")
+	var removed *Freeze
+	for _, f := range p.rateLimiterMgr.freezes.list(p.rateLimiterMgr.Clock().Now()) {
+		if f.ID == id {
+			removed = &f
+		}
+	}
+	if !p.rateLimiterMgr.freezes.remove(id) {
+		writeError(w, http.StatusNotFound, "unknown freeze")
+		return
+	}
+	p.persistState()
+	auditChange(r, removed, nil)
+	log.Info().Str("audit", "freeze").Str("id", id).Str("remote", r.RemoteAddr).Msg("Publish freeze removed")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientMessageParser_PublishFreeze(t *testing.T) {
+	rlm := NewRateLimiterManager(&Config{Freezes: []*Freeze{
+		{Users: []string{"alice"}, Subjects: []string{"orders.>"}},
+		{Subjects: []string{"later"}, Start: time.Now().Add(time.Hour)},
+	}})
+
+	var output, client bytes.Buffer
+	input := "CONNECT {\"user\":\"alice\"}\r\n" +
+		"SUB orders.> 1\r\n" +
+		"PUB orders.new 2\r\nok\r\n" +
+		"PUB invoices.new 2\r\nok\r\n" +
+		"PUB later 2\r\nok\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &output, rlm)
+	parser.SetClock(newFakeClock())
+	parser.SetClientWriter(newClientWriter(&client))
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+
+	expected := "CONNECT {\"user\":\"alice\"}\r\nSUB orders.> 1\r\nPUB invoices.new 2\r\nok\r\nPUB later 2\r\nok\r\n"
+	if output.String() != expected {
+		t.Errorf("Expected the frozen publish dropped.\nExpected: %q\nGot: %q", expected, output.String())
+	}
+	if errs := "-ERR 'Permissions Violation for Publish to \"orders.new\"'\r\n"; client.String() != errs {
+		t.Errorf("Expected permission violation %q, got %q", errs, client.String())
+	}
+	if rlm.Frozen("bob", "orders.new") {
+		t.Error("Expected other users not frozen")
+	}
+}
+
+func TestRateLimiterManager_FreezeClock(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now().Add(time.Hour)
+	rlm := NewRateLimiterManager(&Config{Freezes: []*Freeze{{Start: start, End: start.Add(time.Hour)}}})
+	rlm.SetClock(clock)
+
+	if rlm.Frozen("alice", "orders.new") {
+		t.Error("Expected no freeze before its window by the limiters' clock")
+	}
+	clock.Sleep(time.Hour)
+	if !rlm.Frozen("alice", "orders.new") {
+		t.Error("Expected the freeze active within its window by the limiters' clock")
+	}
+	clock.Sleep(time.Hour)
+	if rlm.Frozen("alice", "orders.new") || len(rlm.freezes.list(clock.Now())) != 0 {
+		t.Error("Expected the freeze expired after its window by the limiters' clock")
+	}
+}
+
+func TestAdmin_Freezes(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	p := newTestProxy(&Config{AdminToken: "root-token", AdminReadToken: "read-token", StateFile: stateFile})
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		p.AdminHandler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/api/v1/freezes", "read-token", `{"users": ["alice"]}`); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a read-only token, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/api/v1/freezes", "root-token", `{"duration": "-1m"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a negative duration, got %d", rec.Code)
+	}
+
+	rec := do(http.MethodPost, "/api/v1/freezes", "root-token", `{"users": ["alice"], "subjects": ["orders.>"], "duration": "15m", "reason": "cutover"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created Freeze
+	json.Unmarshal(rec.Body.Bytes(), &created)
+	if created.ID == "" || time.Until(created.End) < 14*time.Minute {
+		t.Errorf("Expected a freeze ending in 15m, got %+v", created)
+	}
+	if !p.rateLimiterMgr.Frozen("alice", "orders.new") {
+		t.Error("Expected alice's publishes to orders frozen")
+	}
+
+	rec = do(http.MethodGet, "/api/v1/freezes", "read-token", "")
+	var freezes []Freeze
+	json.Unmarshal(rec.Body.Bytes(), &freezes)
+	if rec.Code != http.StatusOK || len(freezes) != 1 || freezes[0].Reason != "cutover" {
+		t.Errorf("Expected the freeze listed, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Freezes survive a restart
+	restarted := newTestProxy(p.currentConfig())
+	if err := restarted.restoreState(); err != nil {
+		t.Fatalf("restoreState failed: %v", err)
+	}
+	if !restarted.rateLimiterMgr.Frozen("alice", "orders.new") {
+		t.Error("Expected the freeze restored after restart")
+	}
+
+	if rec := do(http.MethodDelete, "/api/v1/freezes/"+created.ID, "root-token", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", rec.Code)
+	}
+	if p.rateLimiterMgr.Frozen("alice", "orders.new") {
+		t.Error("Expected the freeze lifted")
+	}
+	if rec := do(http.MethodDelete, "/api/v1/freezes/"+created.ID, "root-token", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a removed freeze, got %d", rec.Code)
+	}
+}
+
+func TestLoadConfig_InvalidFreeze(t *testing.T) {
+	yaml := "freezes:\n  - start: 2026-11-01T03:00:00Z\n    end: 2026-11-01T02:00:00Z\n"
+	if _, err := LoadConfig(writeTestConfig(t, yaml)); err == nil {
+		t.Error("Expected an error for a freeze ending before it starts")
+	}
+}
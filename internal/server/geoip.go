@@ -0,0 +1,55 @@
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoLocator resolves the ISO 3166-1 country code of a client address, or ""
+// if unknown.
+type GeoLocator interface {
+	Country(ip net.IP) (string, error)
+}
+
+// maxmindLocator looks addresses up in a MaxMind GeoIP2 or GeoLite2 Country
+// or City database.
+type maxmindLocator struct {
+	db *maxminddb.Reader
+}
+
+// openGeoLocator opens the MaxMind database at path.
+func openGeoLocator(path string) (*maxmindLocator, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open geoip database %s: %w", path, err)
+	}
+	return &maxmindLocator{db: db}, nil
+}
+
+func (l *maxmindLocator) Country(ip net.IP) (string, error) {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := l.db.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+	return record.Country.ISOCode, nil
+}
+
+// countryOf returns the country of a connection's remote address, or "" if
+// it can't be located.
+func countryOf(locator GeoLocator, addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	country, err := locator.Country(tcp.IP)
+	if err != nil {
+		return ""
+	}
+	return country
+}
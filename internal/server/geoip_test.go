@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeLocator locates addresses from a fixed table.
+type fakeLocator map[string]string
+
+func (l fakeLocator) Country(ip net.IP) (string, error) {
+	country, ok := l[ip.String()]
+	if !ok {
+		return "", errors.New("address not found")
+	}
+	return country, nil
+}
+
+func TestCountryOf(t *testing.T) {
+	locator := fakeLocator{"203.0.113.7": "BR"}
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4222}, "BR"},
+		{&net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 4222}, ""},
+		{&net.UnixAddr{Name: "/tmp/nats.sock", Net: "unix"}, ""},
+	}
+	for _, tt := range tests {
+		if got := countryOf(locator, tt.addr); got != tt.want {
+			t.Errorf("countryOf(%s) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_GeoIPLimits(t *testing.T) {
+	cfg, err := LoadConfig(writeTestConfig(t, "default_bandwidth: 1048576\ngeoip:\n  database: /dev/null\n"+
+		"  countries:\n    BR: 4096\n  regions:\n    latam:\n      countries: [BR]\n      bandwidth: 8192\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	p := newTestProxy(cfg)
+	p.geo = fakeLocator{"127.0.0.1": "BR"}
+	dial, servers := pipeDialer()
+	p.SetDialer(dial)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, _ := runTestServer(ctx, t, p)
+
+	client, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	upstream := <-servers
+	defer upstream.Close()
+
+	countryBytes, regionBytes := metricCountryBytes.Get("BR"), metricRegionBytes.Get("latam")
+	input := "CONNECT {\"user\":\"geo-alice\"}\r\nPUB orders 1000\r\n" + strings.Repeat("x", 1000) + "\r\n"
+	go client.Write([]byte(input))
+	if got := readString(t, upstream, len(input)); got != input {
+		t.Errorf("Expected the publish forwarded, got %q", got)
+	}
+
+	status := p.rateLimiterMgr.Status("geo-alice", "", "BR")
+	if status.Capacity != 1048576 || len(status.Also) != 2 {
+		t.Fatalf("Expected geo-alice's bucket and its BR and latam buckets, got %+v", status)
+	}
+	for _, also := range status.Also {
+		if also.Available >= also.Capacity {
+			t.Errorf("Expected the publish charged to the %s%s bucket, got %+v", also.Country, also.Region, also)
+		}
+	}
+	// Bytes are counted once forwarded
+	if !eventually(func() bool {
+		return metricCountryBytes.Get("BR") > countryBytes && metricRegionBytes.Get("latam") > regionBytes
+	}) {
+		t.Error("Expected the client's bytes labelled with its country and region")
+	}
+}
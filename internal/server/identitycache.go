@@ -0,0 +1,110 @@
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// connectDecisionTTL is how long a cached policy hook decision about an
+// identity is reused, so decisions that change take effect soon.
+const connectDecisionTTL = 10 * time.Second
+
+// resolvedIdentity is what a JWT resolved to.
+type resolvedIdentity struct {
+	user string
+	// claims, if they were needed. Shared by the connections presenting the
+	// JWT, so never modified.
+	claims map[string]interface{}
+	// The policy hook's decision about the user and when it was made, nil
+	// without one
+	connect *connectDecision
+	decided time.Time
+}
+
+// identityCache keeps the identities of recently presented JWTs, keyed by
+// their hash, so a reconnect storm of clients sharing credentials doesn't
+// decode the same JWT for every connection. The least recently used
+// identities are evicted once it's full.
+type identityCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[[sha256.Size]byte]*list.Element
+	order   *list.List // of *identityEntry, most recently used first
+}
+
+type identityEntry struct {
+	key      [sha256.Size]byte
+	identity resolvedIdentity
+}
+
+func newIdentityCache(size int) *identityCache {
+	return &identityCache{size: size, entries: make(map[[sha256.Size]byte]*list.Element), order: list.New()}
+}
+
+func (c *identityCache) get(key [sha256.Size]byte) (resolvedIdentity, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return resolvedIdentity{}, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*identityEntry).identity, true
+}
+
+func (c *identityCache) add(key [sha256.Size]byte, identity resolvedIdentity) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*identityEntry).identity = identity
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&identityEntry{key: key, identity: identity})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*identityEntry).key)
+	}
+}
+
+// resolveJWT returns the identity a JWT resolves to: the user it identifies,
+// its claims if bypass rules or the policy hook need them, and the policy
+// hook's decision about the user. They come from the identity cache if the
+// connection has one, decisions only while under connectDecisionTTL old. The
+// user is empty if the JWT identifies none.
+func (c *ClientMessageParser) resolveJWT(token string) resolvedIdentity {
+	needClaims := c.policy != nil || (c.rateLimiterManager != nil && c.rateLimiterManager.UsesClaims())
+	var key [sha256.Size]byte
+	var resolved resolvedIdentity
+	cached := false
+	if c.identities != nil {
+		key = sha256.Sum256([]byte(token))
+		resolved, cached = c.identities.get(key)
+		if cached = cached && (resolved.claims != nil || !needClaims); cached {
+			metricIdentityCacheLookups.Add(1, "hit")
+		} else {
+			metricIdentityCacheLookups.Add(1, "miss")
+		}
+	}
+
+	if !cached {
+		resolved = resolvedIdentity{user: c.extractUsernameFromJWT(token)}
+		if resolved.user == "" {
+			return resolvedIdentity{}
+		}
+		if needClaims {
+			resolved.claims = decodeJWTClaims(token)
+		}
+	}
+	decide := c.policy != nil && (resolved.connect == nil || time.Since(resolved.decided) >= connectDecisionTTL)
+	if decide {
+		resolved.connect, resolved.decided = c.decideConnect(resolved.user, resolved.claims), time.Now()
+	}
+	if c.identities != nil && (!cached || decide) {
+		c.identities.add(key, resolved)
+	}
+	return resolved
+}
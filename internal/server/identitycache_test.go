@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdentityCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := newIdentityCache(2)
+	key := func(s string) [sha256.Size]byte { return sha256.Sum256([]byte(s)) }
+	c.add(key("a"), resolvedIdentity{user: "alice"})
+	c.add(key("b"), resolvedIdentity{user: "bob"})
+	c.get(key("a"))
+	c.add(key("c"), resolvedIdentity{user: "carol"})
+
+	if _, ok := c.get(key("b")); ok {
+		t.Error("Expected the least recently used identity evicted")
+	}
+	for k, user := range map[string]string{"a": "alice", "c": "carol"} {
+		if got, ok := c.get(key(k)); !ok || got.user != user {
+			t.Errorf("Expected %s cached, got %+v (%v)", user, got, ok)
+		}
+	}
+}
+
+func TestClientMessageParser_IdentityCache(t *testing.T) {
+	cache := newIdentityCache(16)
+	hits := metricIdentityCacheLookups.Get("hit")
+	token := testJWT(`{"name":"cached-alice","nats":{"tags":["bypass"]}}`)
+	connect := func(rlm RateLimiterManagerInterface) *ClientMessageParser {
+		input := "CONNECT {\"jwt\":\"" + token + "\"}\r\n"
+		parser := NewClientMessageParser(strings.NewReader(input), &bytes.Buffer{}, rlm)
+		parser.SetIdentityCache(cache)
+		if err := parser.ParseAndForward(); err != nil {
+			t.Fatalf("ParseAndForward failed: %v", err)
+		}
+		return parser
+	}
+
+	for range 3 {
+		if user := connect(&mockRateLimiterManager{}).GetUser(); user != "cached-alice" {
+			t.Errorf("Expected user cached-alice, got %q", user)
+		}
+	}
+	if got := metricIdentityCacheLookups.Get("hit") - hits; got != 2 {
+		t.Errorf("Expected 2 cache hits, got %d", got)
+	}
+
+	// Identities cached without claims are resolved again once claims are
+	// needed
+	before := metricBypassedConnections.Get("cached-alice")
+	rlm := NewRateLimiterManager(&Config{
+		DefaultBandwidth: 1024,
+		Bypass:           BypassConfig{JWTClaims: map[string]string{"nats.tags": "bypass"}},
+	})
+	connect(rlm)
+	connect(rlm)
+	if got := metricBypassedConnections.Get("cached-alice") - before; got != 2 {
+		t.Errorf("Expected both connections bypassed by their claims, got %d", got)
+	}
+}
+
+func TestClientMessageParser_IdentityCacheDecisions(t *testing.T) {
+	cache := newIdentityCache(16)
+	rlm := NewRateLimiterManager(&Config{DefaultBandwidth: 1024})
+	var calls atomic.Int32
+	hook := NewPolicyHook(PolicyHookConfig{}, rlm, func(user string, claims map[string]interface{}) (int64, string) {
+		calls.Add(1)
+		return 4096, ""
+	}, nil)
+	token := testJWT(`{"name":"decided-alice"}`)
+	connect := func() {
+		input := "CONNECT {\"jwt\":\"" + token + "\"}\r\n"
+		parser := NewClientMessageParser(strings.NewReader(input), &bytes.Buffer{}, rlm)
+		parser.SetIdentityCache(cache)
+		parser.SetPolicyHook(hook, nil)
+		if err := parser.ParseAndForward(); err != nil {
+			t.Fatalf("ParseAndForward failed: %v", err)
+		}
+	}
+
+	for range 3 {
+		connect()
+	}
+	if calls.Load() != 1 || rlm.Bandwidth("decided-alice") != 4096 {
+		t.Errorf("Expected one connect hook call limiting to 4096, got %d calls and %d", calls.Load(), rlm.Bandwidth("decided-alice"))
+	}
+
+	// Decisions are made again once they're too old
+	key := sha256.Sum256([]byte(token))
+	id, _ := cache.get(key)
+	id.decided = time.Now().Add(-connectDecisionTTL)
+	cache.add(key, id)
+	connect()
+	if calls.Load() != 2 {
+		t.Errorf("Expected an expired decision made again, got %d calls", calls.Load())
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+var errNotInfo = errors.New("not an INFO line")
+
+// setInfoField returns an INFO line with a field set to a JSON value. The
+// other fields, notably the nonce clients sign to authenticate with nkeys,
+// are kept byte for byte: their values aren't decoded, and nothing is
+// escaped that the upstream didn't escape.
+func setInfoField(line []byte, key, value string) ([]byte, error) {
+	body, ok := bytes.CutPrefix(line, []byte("INFO "))
+	if !ok {
+		return nil, errNotInfo
+	}
+	var info map[string]json.RawMessage
+	if err := json.Unmarshal(bytes.TrimSpace(body), &info); err != nil {
+		return nil, err
+	}
+	info[key] = json.RawMessage(value)
+	buf := bytes.NewBufferString("INFO ")
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(info); err != nil {
+		return nil, err
+	}
+	buf.Truncate(buf.Len() - 1) // Encode's newline
+	buf.WriteString("\r\n")
+	return buf.Bytes(), nil
+}
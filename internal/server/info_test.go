@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// nonceInfo is an upstream INFO requiring a nonce signature, with values
+// a decode and re-encode would alter.
+const nonceInfo = `INFO {"server_id":"NABC","nonce":"a<b>&cé","max_payload":9007199254740993,"auth_required":true}` + "\r\n"
+
+func TestSetInfoField(t *testing.T) {
+	got, err := setInfoField([]byte(nonceInfo), "tls_required", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"nonce":"a<b>&cé"`, `"max_payload":9007199254740993`, `"tls_required":true`} {
+		if !bytes.Contains(got, []byte(field)) {
+			t.Errorf("Expected %s in %q", field, got)
+		}
+	}
+	if !bytes.HasPrefix(got, []byte("INFO {")) || !bytes.HasSuffix(got, []byte("}\r\n")) {
+		t.Errorf("Expected a whole INFO line, got %q", got)
+	}
+	if _, err := setInfoField([]byte("PING\r\n"), "ldm", "true"); err != errNotInfo {
+		t.Errorf("Expected other lines refused, got %v", err)
+	}
+}
+
+func TestProxy_NonceHandshake(t *testing.T) {
+	client, upstream, _ := pipeConnection(t, newTestProxy(&Config{DefaultBandwidth: 1 << 20}))
+
+	go upstream.Write([]byte(nonceInfo))
+	if got := readString(t, client, len(nonceInfo)); got != nonceInfo {
+		t.Errorf("Expected the INFO forwarded unmodified.\nExpected: %q\nGot: %q", nonceInfo, got)
+	}
+
+	// CONNECT and its signature reach the upstream as sent, ahead of what
+	// the client pipelines after it
+	input := "CONNECT {\"nkey\":\"UABC\",\"sig\":\"c2lnbmF0dXJl\",\"verbose\":false}\r\nPING\r\nPUB foo 2\r\nhi\r\n"
+	go client.Write([]byte(input))
+	if got := readString(t, upstream, len(input)); got != input {
+		t.Errorf("Unexpected upstream data.\nExpected: %q\nGot: %q", input, got)
+	}
+}
+
+func TestForwardDownstream_InfoPassthrough(t *testing.T) {
+	for _, passthrough := range []bool{false, true} {
+		var client bytes.Buffer
+		cw := newClientWriter(&client)
+		cw.secure = !passthrough
+		cw.infoPassthrough = passthrough
+		if err := forwardDownstream(strings.NewReader(nonceInfo), cw); err != io.EOF {
+			t.Fatalf("Expected EOF, got %v", err)
+		}
+		if !strings.Contains(client.String(), `"nonce":"a<b>&cé"`) {
+			t.Errorf("Expected the nonce forwarded unmodified, got %q", client.String())
+		}
+		if passthrough && client.String() != nonceInfo {
+			t.Errorf("Expected the INFO forwarded as is, got %q", client.String())
+		}
+
+		client.Reset()
+		cw.lameDuck()
+		if passthrough != (client.Len() == 0) {
+			t.Errorf("Expected a lame duck INFO only without passthrough (%v), got %q", passthrough, client.String())
+		}
+	}
+}
+
+func TestLoadConfig_InfoPassthroughHold(t *testing.T) {
+	yaml := "info_passthrough: true\nupstream_unavailable:\n  mode: hold\n"
+	if _, err := LoadConfig(writeTestConfig(t, yaml)); err == nil {
+		t.Error("Expected holding clients refused with info_passthrough")
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+)
+
+// jwtIdentity is what a client's JWT identifies it by.
+type jwtIdentity struct {
+	Name    string
+	Subject string
+	Issuer  string
+}
+
+// user returns the name the client is limited as: the name claim, falling
+// back to sub.
+func (id jwtIdentity) user() string {
+	if id.Name != "" {
+		return id.Name
+	}
+	return id.Subject
+}
+
+// maxStackClaims is the size of claims decoded without allocating; NATS user
+// JWTs are well within it.
+const maxStackClaims = 2048
+
+// parseJWTIdentity extracts the name, sub and iss claims of a JWT without
+// verifying it, which is left to the upstream. It runs on every CONNECT, so
+// rather than decoding all claims it scans the top level of the claims JSON
+// for the three, skipping other values, and allocates only the strings it
+// returns.
+func parseJWTIdentity(token string) (jwtIdentity, bool) {
+	_, rest, ok := strings.Cut(token, ".")
+	if !ok {
+		return jwtIdentity{}, false
+	}
+	payload, _, _ := strings.Cut(rest, ".")
+	payload = strings.TrimRight(payload, "=")
+
+	var encoded [maxStackClaims * 4 / 3]byte
+	var decoded [maxStackClaims]byte
+	src, buf := encoded[:], decoded[:]
+	if len(payload) > len(src) {
+		src = make([]byte, len(payload))
+		buf = make([]byte, base64.RawURLEncoding.DecodedLen(len(payload)))
+	}
+	src = src[:copy(src, payload)]
+	n, err := base64.RawURLEncoding.Decode(buf, src)
+	if err != nil {
+		return jwtIdentity{}, false
+	}
+	s := claimScanner{data: buf[:n]}
+	if s.peek() != '{' {
+		return jwtIdentity{}, false
+	}
+	s.pos++
+	var id jwtIdentity
+	for first := true; ; first = false {
+		key, end, ok := s.member(first)
+		if !ok {
+			return jwtIdentity{}, false
+		}
+		if end {
+			break
+		}
+		var dst *string
+		switch string(key) {
+		case "name":
+			dst = &id.Name
+		case "sub":
+			dst = &id.Subject
+		case "iss":
+			dst = &id.Issuer
+		}
+		if dst == nil || s.peek() != '"' {
+			ok = s.skip()
+		} else {
+			*dst, ok = s.str()
+		}
+		if !ok {
+			return jwtIdentity{}, false
+		}
+	}
+	return id, true
+}
+
+// decodeJWTClaims decodes all claims of a JWT without verifying it, for the
+// bypass rules and policy hooks that match them.
+func decodeJWTClaims(token string) map[string]interface{} {
+	parts := strings.Split(token, ".")
+	if len(parts) < 2 {
+		return nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil
+	}
+	var claims map[string]interface{}
+	if json.Unmarshal(data, &claims) != nil {
+		return nil
+	}
+	return claims
+}
+
+// claimScanner scans the JSON of JWT claims.
+type claimScanner struct {
+	data []byte
+	pos  int
+}
+
+func (s *claimScanner) ws() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\r', '\n':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+// peek returns the next non-whitespace byte, or 0 at the end.
+func (s *claimScanner) peek() byte {
+	s.ws()
+	if s.pos == len(s.data) {
+		return 0
+	}
+	return s.data[s.pos]
+}
+
+// member scans to the next member of an object whose opening brace was
+// scanned, returning its key, or end once the closing brace is scanned.
+func (s *claimScanner) member(first bool) (key []byte, end, ok bool) {
+	switch s.peek() {
+	case '}':
+		s.pos++
+		return nil, true, true
+	case ',':
+		if first {
+			return nil, false, false
+		}
+		s.pos++
+	default:
+		if !first {
+			return nil, false, false
+		}
+	}
+	key, ok = s.rawStr()
+	if !ok || s.peek() != ':' {
+		return nil, false, false
+	}
+	s.pos++
+	return key, false, true
+}
+
+// rawStr scans a string, returning its contents with escapes undecoded.
+func (s *claimScanner) rawStr() ([]byte, bool) {
+	if s.peek() != '"' {
+		return nil, false
+	}
+	start := s.pos + 1
+	for i := start; i < len(s.data); i++ {
+		switch s.data[i] {
+		case '\\':
+			i++
+		case '"':
+			s.pos = i + 1
+			return s.data[start:i], true
+		}
+	}
+	return nil, false
+}
+
+// str scans a string, decoding escapes.
+func (s *claimScanner) str() (string, bool) {
+	start := s.pos
+	raw, ok := s.rawStr()
+	if !ok {
+		return "", false
+	}
+	if bytes.IndexByte(raw, '\\') < 0 {
+		return string(raw), true
+	}
+	// Rare enough to leave to encoding/json, on a copy so the claims
+	// buffer stays on the stack
+	var value string
+	err := json.Unmarshal(bytes.Clone(s.data[start:s.pos]), &value)
+	return value, err == nil
+}
+
+// skip scans a value of any type.
+func (s *claimScanner) skip() bool {
+	switch s.peek() {
+	case '"':
+		_, ok := s.rawStr()
+		return ok
+	case '{', '[':
+		depth := 0
+		for s.pos < len(s.data) {
+			switch s.data[s.pos] {
+			case '"':
+				if _, ok := s.rawStr(); !ok {
+					return false
+				}
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+			s.pos++
+			if depth == 0 {
+				return true
+			}
+		}
+		return false
+	case 0:
+		return false
+	default:
+		// A number, true, false or null
+		start := s.pos
+		for s.pos < len(s.data) {
+			switch s.data[s.pos] {
+			case ',', '}', ']', ' ', '\t', '\r', '\n':
+				return s.pos > start
+			}
+			s.pos++
+		}
+		return s.pos > start
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+
+	"nats-limiter-proxy/internal/creds"
+)
+
+// testJWT returns an unsigned JWT with the given claims JSON.
+func testJWT(claims string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"typ":"JWT","alg":"ed25519-nkey"}`)) + "." +
+		enc.EncodeToString([]byte(claims)) + ".sig"
+}
+
+func TestParseJWTIdentity(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims string
+		want   jwtIdentity
+	}{
+		{"all", `{"name":"alice","sub":"UABC","iss":"AXYZ"}`, jwtIdentity{"alice", "UABC", "AXYZ"}},
+		{"nested values skipped", `{"jti":"x","iat":1700000000,"nats":{"pub":{},"tags":["a","}"],"name":"inner"},"sub":"UABC"}`, jwtIdentity{Subject: "UABC"}},
+		{"escapes", `{"name":"al\"iceé"}`, jwtIdentity{Name: "al\"iceé"}},
+		{"whitespace", "{ \"name\" :\n \"bob\" , \"ok\": true , \"n\": null }", jwtIdentity{Name: "bob"}},
+		{"non-string name", `{"name":42,"sub":"UABC"}`, jwtIdentity{Subject: "UABC"}},
+		{"empty", `{}`, jwtIdentity{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseJWTIdentity(testJWT(tt.claims))
+			if !ok || got != tt.want {
+				t.Errorf("Expected %+v, got %+v (%v)", tt.want, got, ok)
+			}
+		})
+	}
+
+	for _, token := range []string{"", "nodots", "a.!!!.c", testJWT(`{"name":"alice"`), testJWT(`["alice"]`), testJWT(`{"name":"alice"}x`)[:20]} {
+		if id, ok := parseJWTIdentity(token); ok {
+			t.Errorf("Expected %q rejected, got %+v", token, id)
+		}
+	}
+}
+
+func TestParseJWTIdentity_GeneratedCreds(t *testing.T) {
+	env, err := creds.NewEnvironment("root", "app")
+	if err != nil {
+		t.Fatalf("NewEnvironment failed: %v", err)
+	}
+	token, _, err := env.UserJWT("alice")
+	if err != nil {
+		t.Fatalf("UserJWT failed: %v", err)
+	}
+	id, ok := parseJWTIdentity(token)
+	if !ok || id.user() != "alice" || !strings.HasPrefix(id.Subject, "U") || !strings.HasPrefix(id.Issuer, "A") {
+		t.Errorf("Unexpected identity %+v (%v)", id, ok)
+	}
+
+	// Only the returned strings are allocated
+	if allocs := testing.AllocsPerRun(100, func() { parseJWTIdentity(token) }); allocs > 3 {
+		t.Errorf("Expected at most 3 allocations, got %v", allocs)
+	}
+}
+
+// BenchmarkParseJWTIdentity compares scanning a user JWT for its identity
+// with decoding all of its claims.
+func BenchmarkParseJWTIdentity(b *testing.B) {
+	env, err := creds.NewEnvironment("root", "app")
+	if err != nil {
+		b.Fatalf("NewEnvironment failed: %v", err)
+	}
+	token, _, err := env.UserJWT("alice")
+	if err != nil {
+		b.Fatalf("UserJWT failed: %v", err)
+	}
+
+	b.Run("scan", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			parseJWTIdentity(token)
+		}
+	})
+	b.Run("DecodeUserClaims", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			jwt.DecodeUserClaims(token)
+		}
+	})
+}
+
+func TestClientMessageParser_JWTClaimsBypass(t *testing.T) {
+	rlm := NewRateLimiterManager(&Config{
+		DefaultBandwidth: 1024,
+		Bypass:           BypassConfig{JWTClaims: map[string]string{"nats.tags": "bypass"}},
+	})
+	before := metricBypassedConnections.Get("claims-bob")
+
+	token := testJWT(`{"name":"claims-bob","nats":{"tags":["team-a","bypass"]}}`)
+	input := "CONNECT {\"jwt\":\"" + token + "\"}\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &bytes.Buffer{}, rlm)
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if got := metricBypassedConnections.Get("claims-bob") - before; got != 1 {
+		t.Errorf("Expected the connection bypassed by its claims, got %d", got)
+	}
+}
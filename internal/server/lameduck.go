@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var errLameDuck = errors.New("proxy is in lame duck mode")
+
+// lameDuckState tracks lame duck mode, in which the proxy stops accepting
+// clients and closes its connections gradually, so a load balancer can
+// rotate it out without every client reconnecting at once. The zero value is
+// out of lame duck mode.
+type lameDuckState struct {
+	mu      sync.Mutex
+	started chan struct{} // closed when lame duck mode starts
+	done    chan struct{} // closed once its connections are closed
+}
+
+// channels returns the channels closed when lame duck mode starts and once
+// it's done.
+func (l *lameDuckState) channels() (started, done chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.started == nil {
+		l.started = make(chan struct{})
+		l.done = make(chan struct{})
+	}
+	return l.started, l.done
+}
+
+// active reports whether lame duck mode started.
+func (l *lameDuckState) active() bool {
+	started, _ := l.channels()
+	select {
+	case <-started:
+		return true
+	default:
+		return false
+	}
+}
+
+// startLameDuck enters lame duck mode, like nats-server's: clients are sent
+// an INFO with "ldm": true right away, and after the grace period their
+// connections are closed one by one, spread over the rest of duration. It
+// returns the number of connections to close, or false if lame duck mode
+// already started.
+func (p *Proxy) startLameDuck(duration, grace time.Duration) (int, bool) {
+	started, done := p.lameDuck.channels()
+	p.lameDuck.mu.Lock()
+	select {
+	case <-started:
+		p.lameDuck.mu.Unlock()
+		return 0, false
+	default:
+		close(started)
+	}
+	p.lameDuck.mu.Unlock()
+
+	conns := p.liveConns()
+	log.Warn().Int("connections", len(conns)).Dur("duration", duration).Dur("grace_period", grace).
+		Msg("Entering lame duck mode")
+	for _, c := range conns {
+		// Concurrently, so a slow client doesn't hold the others up
+		go c.cw.lameDuck()
+	}
+	go func() {
+		defer close(done)
+		time.Sleep(grace)
+		interval := (duration - grace) / time.Duration(max(len(conns), 1))
+		for i, c := range conns {
+			if i > 0 {
+				time.Sleep(interval)
+			}
+			c.close(closeLameDuck, errLameDuck)
+		}
+		// Connections accepted while lame duck mode started
+		for _, c := range p.liveConns() {
+			c.close(closeLameDuck, errLameDuck)
+		}
+		log.Info().Int("connections", len(conns)).Msg("Lame duck mode closed all connections")
+	}()
+	return len(conns), true
+}
+
+// liveConns returns the connections served by the proxy and its routes.
+func (p *Proxy) liveConns() []*liveConn {
+	conns := p.conns.list()
+	for _, route := range p.routes {
+		conns = append(conns, route.conns.list()...)
+	}
+	return conns
+}
+
+// LameDuck describes lame duck mode as started through the admin API.
+type LameDuck struct {
+	Duration    string `json:"duration"`
+	GracePeriod string `json:"grace_period"`
+	Connections int    `json:"connections"` // to be closed
+}
+
+func (p *Proxy) handleLameDuck(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizeAdmin(w, r, scopeWrite) {
+		return
+	}
+	var req struct {
+		// Duration overrides lame_duck_duration
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid lame duck request")
+		return
+	}
+	cfg := p.currentConfig()
+	duration, grace := cfg.LameDuckDuration, cfg.LameDuckGracePeriod
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= grace {
+			writeError(w, http.StatusBadRequest, "duration must be longer than the grace period, e.g. \"2m\"")
+			return
+		}
+		duration = d
+	}
+
+	n, ok := p.startLameDuck(duration, grace)
+	if !ok {
+		writeError(w, http.StatusConflict, "already in lame duck mode")
+		return
+	}
+	log.Info().Str("audit", "lame_duck").Dur("duration", duration).Str("remote", r.RemoteAddr).
+		Msg("Lame duck mode started")
+	resp := LameDuck{
+		Duration:    duration.String(),
+		GracePeriod: grace.String(),
+		Connections: n,
+	}
+	auditChange(r, nil, resp)
+	writeJSON(w, http.StatusAccepted, resp)
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxy_LameDuck(t *testing.T) {
+	p := newTestProxy(&Config{DefaultBandwidth: 1 << 20})
+	before := metricConnectionsClosed.Get(string(closeLameDuck))
+
+	banner := "INFO {\"server_id\":\"upstream\"}\r\n"
+	var clients []*bufio.Reader
+	var dones []chan struct{}
+	for range 2 {
+		client, upstream, done := pipeConnection(t, p)
+		go upstream.Write([]byte(banner))
+		reader := bufio.NewReader(client)
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if line, err := reader.ReadString('\n'); err != nil || line != banner {
+			t.Fatalf("Expected the upstream INFO, got %q (%v)", line, err)
+		}
+		clients = append(clients, reader)
+		dones = append(dones, done)
+	}
+
+	start := time.Now()
+	if n, ok := p.startLameDuck(200*time.Millisecond, 100*time.Millisecond); !ok || n != 2 {
+		t.Fatalf("Expected lame duck mode started for 2 connections, got %d, %v", n, ok)
+	}
+	if _, ok := p.startLameDuck(time.Second, 0); ok {
+		t.Error("Expected lame duck mode not to start twice")
+	}
+
+	// Clients are told right away
+	for _, reader := range clients {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		var info map[string]interface{}
+		if !strings.HasPrefix(line, "INFO ") || json.Unmarshal([]byte(line[5:]), &info) != nil {
+			t.Fatalf("Expected INFO line, got %q", line)
+		}
+		if info["ldm"] != true || info["server_id"] != "upstream" {
+			t.Errorf("Unexpected INFO fields: %v", info)
+		}
+	}
+
+	// And closed after the grace period
+	for _, done := range dones {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Connection wasn't closed in lame duck mode")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected connections closed after the grace period, took %v", elapsed)
+	}
+	if got := metricConnectionsClosed.Get(string(closeLameDuck)) - before; got != 2 {
+		t.Errorf("Expected 2 connections closed with reason %s, got %d", closeLameDuck, got)
+	}
+}
+
+func TestServer_LameDuckStopsAccepting(t *testing.T) {
+	p := newTestProxy(&Config{DefaultBandwidth: 1 << 20})
+	srv, result := runTestServer(context.Background(), t, p)
+	defer srv.Stop(time.Second)
+
+	p.startLameDuck(50*time.Millisecond, 10*time.Millisecond)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Expected Run to return nil after lame duck mode, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run didn't return after lame duck mode")
+	}
+	if _, err := net.Dial("tcp", srv.Addr().String()); err == nil {
+		t.Error("Expected the listener closed in lame duck mode")
+	}
+	if !p.Varz().LameDuck {
+		t.Error("Expected varz to report lame duck mode")
+	}
+}
+
+func TestAdmin_LameDuck(t *testing.T) {
+	p := newTestProxy(&Config{
+		DefaultBandwidth:    1 << 20,
+		AdminToken:          "secret",
+		AdminReadToken:      "viewer",
+		LameDuckDuration:    time.Minute,
+		LameDuckGracePeriod: 10 * time.Second,
+	})
+	do := func(token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/lameduck", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		p.AdminHandler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("viewer", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a read-only token, got %d", rec.Code)
+	}
+	if rec := do("secret", `{"duration":"5s"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a duration within the grace period, got %d", rec.Code)
+	}
+
+	rec := do("secret", `{"duration":"5m"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", rec.Code, rec.Body)
+	}
+	var got LameDuck
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if got.Duration != "5m0s" || got.GracePeriod != "10s" || got.Connections != 0 {
+		t.Errorf("Unexpected response: %+v", got)
+	}
+	if rec := do("secret", ""); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 when already in lame duck mode, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+var errMaxConnectionAge = errors.New("connection reached its maximum age")
+
+// connectionAge returns a connection's maximum age, limit varied by up to 10%
+// either way.
+func connectionAge(limit time.Duration) time.Duration {
+	jitter := limit / 10
+	if jitter <= 0 {
+		return limit
+	}
+	return limit - jitter + rand.N(2*jitter)
+}
+
+// expireConnection asks the client to reconnect once its connection reaches
+// age, and closes it after the grace period, unless done is closed first.
+func expireConnection(done <-chan struct{}, conn net.Conn, cw *clientWriter, closed *closeRecorder, age, grace time.Duration) {
+	timer := time.NewTimer(age)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+	cw.lameDuck()
+
+	timer.Reset(grace)
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+	closed.record(&closeError{reason: closeMaxConnectionAge, err: errMaxConnectionAge}, false)
+	conn.Close()
+}
+
+// lastInfo returns the latest INFO line written to the client, nil if none
+// yet.
+func (cw *clientWriter) lastInfo() []byte {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.info
+}
+
+// lameDuck sends the client the upstream's latest INFO with "ldm": true, so
+// it reconnects elsewhere before its connection is closed. Clients that
+// weren't sent an INFO yet, or with INFO passthrough, aren't told.
+func (cw *clientWriter) lameDuck() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.info == nil || cw.infoPassthrough {
+		return nil
+	}
+	line := lameDuckInfo(cw.info)
+	cw.audit.bytesAdjusted += int64(len(line))
+	return cw.writeFrame(line)
+}
+
+// lameDuckInfo returns an INFO line with "ldm": true added. Clients replace
+// their server info with each INFO they receive, so the other fields are
+// kept as they were.
+func lameDuckInfo(line []byte) []byte {
+	info, err := setInfoField(line, "ldm", "true")
+	if err != nil {
+		return holdInfo(nil)
+	}
+	return info
+}
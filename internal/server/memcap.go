@@ -0,0 +1,181 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+var errMemoryCap = errors.New("buffer memory cap exceeded")
+
+// connBuffers is the memory of the buffers every connection holds: the
+// client and upstream readers, the parser's frame buffer and the client
+// writer.
+const connBuffers = 4096 + 4096 + 32*1024 + 32*1024
+
+// MemoryCapConfig caps the buffer memory of all client connections together.
+// Past the cap, connections are shed, those of clients that haven't
+// identified first, then those of the users with the lowest bandwidth, the
+// newest first, unlimited and bypassing users last, so a burst of large
+// payloads can't exhaust the host.
+type MemoryCapConfig struct {
+	// MaxBytes is the cap on the buffer memory of all connections.
+	MaxBytes int64 `yaml:"max_bytes"`
+}
+
+// normalize validates the configuration.
+func (c *MemoryCapConfig) normalize() error {
+	if c.MaxBytes <= 0 {
+		return fmt.Errorf("memory_cap max_bytes must be positive")
+	}
+	return nil
+}
+
+// memoryCap accounts the buffer memory of all connections against the cap.
+type memoryCap struct {
+	max  int64
+	used atomic.Int64
+	over chan struct{} // signalled when used exceeds max
+
+	mu      sync.Mutex  // serializes shedding
+	claimed atomic.Bool // a proxy sheds connections over the cap
+}
+
+func newMemoryCap(cfg *MemoryCapConfig) *memoryCap {
+	return &memoryCap{max: cfg.MaxBytes, over: make(chan struct{}, 1)}
+}
+
+// claim reports whether the caller is the first to claim the cap, and so
+// the one to shed connections over it. The root proxy claims it ahead of its
+// routes sharing it, as its connections include theirs.
+func (m *memoryCap) claim() bool {
+	return m.claimed.CompareAndSwap(false, true)
+}
+
+// open accounts the fixed buffers of a new connection, and reserved bytes
+// more it may fill.
+func (m *memoryCap) open(reserved int64) *connMemory {
+	if m == nil {
+		return nil
+	}
+	c := &connMemory{cap: m}
+	c.grow(connBuffers + reserved)
+	return c
+}
+
+// connMemory is the buffer memory of a connection. A nil connMemory accounts
+// nothing.
+type connMemory struct {
+	cap  *memoryCap
+	used atomic.Int64
+	shed atomic.Bool // the connection is being closed to free its memory
+}
+
+// grow accounts n bytes more of the connection's buffers, or fewer if n is
+// negative.
+func (c *connMemory) grow(n int64) {
+	if c == nil || n == 0 {
+		return
+	}
+	c.used.Add(n)
+	used := c.cap.used.Add(n)
+	metricBufferMemory.Set(used)
+	if n > 0 && used > c.cap.max {
+		select {
+		case c.cap.over <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// release returns all of the connection's memory once it ended.
+func (c *connMemory) release() {
+	if c == nil {
+		return
+	}
+	c.grow(-c.used.Swap(0))
+}
+
+// shed closes connections of conns until their memory brings the total back
+// under the cap, least privileged first.
+func (m *memoryCap) shed(conns []*liveConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	excess := m.used.Load() - m.max
+	var candidates []*liveConn
+	for _, c := range conns {
+		if c.mem == nil {
+			continue
+		}
+		if c.mem.shed.Load() {
+			// Already on its way out
+			excess -= c.mem.used.Load()
+		} else {
+			candidates = append(candidates, c)
+		}
+	}
+	if excess <= 0 {
+		return
+	}
+
+	ranks := make(map[*liveConn]int64, len(candidates))
+	for _, c := range candidates {
+		ranks[c] = c.privilege()
+	}
+	slices.SortFunc(candidates, func(a, b *liveConn) int {
+		if ranks[a] != ranks[b] {
+			return cmp.Compare(ranks[a], ranks[b])
+		}
+		return b.start.Compare(a.start)
+	})
+	shed := 0
+	for _, c := range candidates {
+		if excess <= 0 {
+			break
+		}
+		c.mem.shed.Store(true)
+		excess -= c.mem.used.Load()
+		shed++
+		metricMemoryCapShed.Add(1)
+		go c.closeWithError(closeMemoryCap, errMemoryCap)
+	}
+	log.Warn().Int64("buffer_memory", m.used.Load()).Int64("max_bytes", m.max).Int("connections", shed).
+		Msg("Buffer memory cap exceeded, shedding connections")
+}
+
+// privilege ranks the connection for shedding: clients yet to identify rank
+// lowest, then users by bandwidth, with unlimited and bypassing users
+// highest.
+func (c *liveConn) privilege() int64 {
+	user := c.user()
+	switch {
+	case user == "":
+		return -1
+	case c.cw.bypassed.Load():
+		return math.MaxInt64
+	}
+	if bandwidth := c.limits.Bandwidth(user); bandwidth > 0 {
+		return bandwidth
+	}
+	return math.MaxInt64
+}
+
+// runMemoryCap sheds connections whenever the cap is exceeded, until ctx is
+// cancelled.
+func (p *Proxy) runMemoryCap(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.memory.over:
+			p.memory.shed(p.liveConns())
+		}
+	}
+}
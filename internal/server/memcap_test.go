@@ -0,0 +1,138 @@
+package server
+
+import (
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryCap_Shed(t *testing.T) {
+	cfg, err := LoadConfig(writeTestConfig(t, "default_bandwidth: 1024\nusers:\n  alice: 4096\n  bob: 2048\nmemory_cap:\n  max_bytes: 262144\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	rlm := NewRateLimiterManager(cfg)
+	m := newMemoryCap(cfg.MemoryCap)
+
+	// Started in order, the anonymous client first
+	start := time.Now()
+	conns := make(map[string]*liveConn)
+	errs := make(map[string]chan string)
+	for i, name := range []string{"anonymous", "alice", "bob", "bob-newer"} {
+		client, server := net.Pipe()
+		defer client.Close()
+		c := &liveConn{
+			conn: server, cw: newClientWriter(server), closed: &closeRecorder{},
+			start: start.Add(time.Duration(i) * time.Second), limits: rlm, mem: m.open(0),
+		}
+		if name != "anonymous" {
+			c.cw.setUser(strings.TrimSuffix(name, "-newer"))
+		}
+		conns[name] = c
+		errs[name] = make(chan string, 1)
+		go func() {
+			line, _ := io.ReadAll(client)
+			errs[name] <- string(line)
+		}()
+	}
+	shed := func(expected ...string) {
+		t.Helper()
+		select {
+		case <-m.over:
+		default:
+			t.Fatal("Expected the cap exceeded")
+		}
+		m.shed(slices.Collect(maps.Values(conns)))
+		for name, c := range conns {
+			if c.mem.shed.Load() != slices.Contains(expected, name) {
+				t.Errorf("Expected %v shed, %s shed: %v", expected, name, c.mem.shed.Load())
+			}
+		}
+		for _, name := range expected {
+			select {
+			case line := <-errs[name]:
+				if line != "-ERR 'Maximum Buffer Memory Exceeded'\r\n" {
+					t.Errorf("Expected %s told why it was shed, got %q", name, line)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Expected %s closed", name)
+			}
+			if conns[name].closed.reason != closeMemoryCap {
+				t.Errorf("Expected %s closed for the memory cap, got %q", name, conns[name].closed.reason)
+			}
+			conns[name].mem.release()
+			delete(conns, name)
+		}
+	}
+
+	// Four connections' buffers exceed the cap: the client yet to identify
+	// goes first
+	if m.used.Load() != 4*connBuffers {
+		t.Fatalf("Expected the buffers of 4 connections accounted, got %d", m.used.Load())
+	}
+	shed("anonymous")
+
+	// Then the newest connection of the user with the lowest bandwidth
+	conns["alice"].mem.grow(connBuffers)
+	shed("bob-newer")
+	if m.used.Load() != 3*connBuffers {
+		t.Errorf("Expected the shed connections' memory returned, got %d", m.used.Load())
+	}
+}
+
+func TestLiveConn_Privilege(t *testing.T) {
+	cfg, err := LoadConfig(writeTestConfig(t, "default_bandwidth: 1024\nusers:\n  alice: 4096\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	rlm := NewRateLimiterManager(cfg)
+	rlm.SetBandwidth("carol", 0)
+	privilege := func(user string, bypassed bool) int64 {
+		c := &liveConn{cw: newClientWriter(io.Discard), limits: rlm}
+		if user != "" {
+			c.cw.setUser(user)
+		}
+		c.cw.bypassed.Store(bypassed)
+		return c.privilege()
+	}
+
+	// Unlimited and bypassing users are shed last
+	anonymous, bob, alice := privilege("", false), privilege("bob", false), privilege("alice", false)
+	carol, ops := privilege("carol", false), privilege("ops", true)
+	if !(anonymous < bob && bob < alice && alice < carol && carol == ops) {
+		t.Errorf("Expected anonymous < bob < alice < carol = ops, got %d, %d, %d, %d, %d", anonymous, bob, alice, carol, ops)
+	}
+
+	// One proxy sheds over a cap shared with its routes
+	m := newMemoryCap(&MemoryCapConfig{MaxBytes: 1})
+	if !m.claim() || m.claim() {
+		t.Error("Expected the cap claimed by its first proxy only")
+	}
+}
+
+func TestUpstreamConn_MemoryAccounted(t *testing.T) {
+	dial, servers := pipeDialer()
+	conn, _ := dial()
+	go io.Copy(io.Discard, <-servers)
+	m := newMemoryCap(&MemoryCapConfig{MaxBytes: 1 << 30})
+	mem := m.open(0)
+	u := newUpstreamConn(conn, dial, 1<<20)
+	u.mem = mem
+	defer u.Close()
+
+	// The frame in flight is kept for replay, and accounted
+	if _, err := u.Write([]byte("PUB foo 100000\r\n" + strings.Repeat("x", 100000))); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if held := mem.used.Load() - connBuffers; held < 100000 {
+		t.Errorf("Expected the retry buffer accounted, %d bytes accounted", held)
+	}
+	mem.release()
+	if m.used.Load() != 0 {
+		t.Errorf("Expected all memory returned, %d bytes accounted", m.used.Load())
+	}
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metricVec is a set of int64 values of one metric, partitioned by the values
+// of its labels.
+type metricVec struct {
+	name   string
+	help   string
+	kind   string // "counter" or "gauge"
+	labels []string
+	unit   float64 // multiplier applied on export, e.g. 1e-9 for nanoseconds as seconds
+
+	mu     sync.RWMutex
+	values map[string]*metricValue
+}
+
+type metricValue struct {
+	labelValues []string
+	v           atomic.Int64
+}
+
+// With returns the value for the given label values, creating it if needed.
+func (m *metricVec) With(labelValues ...string) *atomic.Int64 {
+	key := strings.Join(labelValues, "\xff")
+
+	m.mu.RLock()
+	mv, ok := m.values[key]
+	m.mu.RUnlock()
+	if ok {
+		return &mv.v
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mv, ok := m.values[key]; ok {
+		return &mv.v
+	}
+	mv = &metricValue{labelValues: labelValues}
+	m.values[key] = mv
+	return &mv.v
+}
+
+// Add adds n to the value for the given label values.
+func (m *metricVec) Add(n int64, labelValues ...string) {
+	m.With(labelValues...).Add(n)
+}
+
+// Set sets the value for the given label values.
+func (m *metricVec) Set(n int64, labelValues ...string) {
+	m.With(labelValues...).Store(n)
+}
+
+// Get returns the value for the given label values.
+func (m *metricVec) Get(labelValues ...string) int64 {
+	return m.With(labelValues...).Load()
+}
+
+// Delete removes the value for the given label values.
+func (m *metricVec) Delete(labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, strings.Join(labelValues, "\xff"))
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.RLock()
+	values := make([]*metricValue, 0, len(m.values))
+	for _, mv := range m.values {
+		values = append(values, mv)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(values, func(i, j int) bool {
+		return strings.Join(values[i].labelValues, "\xff") < strings.Join(values[j].labelValues, "\xff")
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, mv := range values {
+		fmt.Fprint(w, m.name)
+		if len(m.labels) > 0 {
+			pairs := make([]string, len(m.labels))
+			for i, label := range m.labels {
+				pairs[i] = label + `="` + labelEscaper.Replace(mv.labelValues[i]) + `"`
+			}
+			fmt.Fprintf(w, "{%s}", strings.Join(pairs, ","))
+		}
+		v := mv.v.Load()
+		if m.unit != 1 {
+			fmt.Fprintf(w, " %s\n", strconv.FormatFloat(float64(v)*m.unit, 'g', -1, 64))
+		} else {
+			fmt.Fprintf(w, " %d\n", v)
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsRegistry holds all metrics exported by the proxy.
+type metricsRegistry struct {
+	vecs []*metricVec
+}
+
+func (r *metricsRegistry) newMetric(kind, name, help string, unit float64, labels ...string) *metricVec {
+	m := &metricVec{
+		name:   "nats_limiter_proxy_" + name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		unit:   unit,
+		values: make(map[string]*metricValue),
+	}
+	r.vecs = append(r.vecs, m)
+	return m
+}
+
+func (r *metricsRegistry) newCounter(name, help string, labels ...string) *metricVec {
+	return r.newMetric("counter", name, help, 1, labels...)
+}
+
+func (r *metricsRegistry) newGauge(name, help string, labels ...string) *metricVec {
+	return r.newMetric("gauge", name, help, 1, labels...)
+}
+
+// newDurationCounter creates a counter accumulating nanoseconds, exported in seconds.
+func (r *metricsRegistry) newDurationCounter(name, help string, labels ...string) *metricVec {
+	return r.newMetric("counter", name, help, 1e-9, labels...)
+}
+
+// write writes all metrics in the Prometheus text exposition format.
+func (r *metricsRegistry) write(w io.Writer) {
+	for _, m := range r.vecs {
+		m.write(w)
+	}
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.write(w)
+}
+
+var registry = &metricsRegistry{}
+
+var (
+	metricConnectionsClosed = registry.newCounter("connections_closed_total",
+		"Number of client connections closed, by the reason they ended.", "reason")
+	metricClientConnections = registry.newCounter("client_connections_total",
+		"Number of client connections, by the client library announced in CONNECT.", "lang", "version")
+	metricWebSocketConnections = registry.newCounter("websocket_connections_total",
+		"Number of client connections served over WebSocket.")
+	metricSNIConnections = registry.newCounter("sni_connections_total",
+		"Number of client connections routed to another upstream, by the TLS server name they connected to.", "server_name")
+	metricReloads = registry.newCounter("reloads_total",
+		"Number of reloads of changed certificates and secrets, by kind and result.", "kind", "result")
+	metricSoftLimitWarnings = registry.newCounter("soft_limit_warnings_total",
+		"Number of warnings about users over their soft limit, at most one per user and cooldown.", "user")
+	metricCaptureRecords = registry.newCounter("capture_records_total",
+		"Number of sampled messages captured, by result: ok, error or dropped while the sink was behind.", "result")
+	metricShadowBytes = registry.newCounter("shadow_bytes_total",
+		"Bytes of publishes mirrored to the shadow upstream.")
+	metricShadowFailures = registry.newCounter("shadow_failures_total",
+		"Number of connections whose mirroring to the shadow upstream stopped, by reason.", "reason")
+	metricUsageRecords = registry.newCounter("usage_records_total",
+		"Number of usage records exported to JetStream, by result.", "result")
+	metricCountryConnections = registry.newCounter("country_connections_total",
+		"Number of client connections, by the country of the client's address. Counted only with geoip on.", "country")
+	metricCountryBytes = registry.newCounter("country_bytes_total",
+		"Bytes received from clients, by the country of the client's address.", "country")
+	metricFlowMismatches = registry.newCounter("flow_mismatches_total",
+		"Connections whose bytes or messages out of the proxy didn't match those in, by direction.", "direction")
+	metricOrderingViolations = registry.newCounter("ordering_violations_total",
+		"Flushes whose bytes reached the connection reordered, interleaved or corrupted, by direction. Counted only with ordering_watchdog on.", "direction")
+	metricUpstreamDials = registry.newCounter("upstream_dials_total",
+		"Number of upstream dials attempted.")
+	metricUpstreamDialSeconds = registry.newDurationCounter("upstream_dial_seconds_total",
+		"Time spent dialing the upstream.")
+	metricUpstreamDialFailures = registry.newCounter("upstream_dial_failures_total",
+		"Number of failed upstream dials, by error type.", "error")
+	metricUpstreamUp = registry.newGauge("upstream_up",
+		"Whether the last upstream dial succeeded.")
+	metricHeldClients = registry.newGauge("held_clients",
+		"Number of clients held while waiting for the upstream to become reachable.")
+	metricBypassedConnections = registry.newCounter("bypassed_connections_total",
+		"Number of connections that bypassed rate limiting.", "user")
+	metricClientBytes = registry.newCounter("client_bytes_total",
+		"Bytes received from clients and forwarded upstream.", "user")
+	metricTagBytes = registry.newCounter("tag_bytes_total",
+		"Bytes received from clients, by the proxy_tag they sent in CONNECT.", "tag")
+	metricThrottleWaitSeconds = registry.newDurationCounter("throttle_wait_seconds_total",
+		"Time spent waiting for rate limit tokens before forwarding client data.", "user")
+	metricThrottles = registry.newCounter("throttles_total",
+		"Number of client writes delayed waiting for rate limit tokens.", "user")
+	metricDeliveredBytes = registry.newCounter("delivered_bytes_total",
+		"Bytes of messages delivered to clients' subscriptions, by subscribing user. A message fanned out to several subscriptions counts once per copy.", "user")
+	metricQueueGroupBytes = registry.newCounter("queue_group_bytes_total",
+		"Bytes of messages delivered to limited queue groups, by queue group.", "queue")
+	metricObjectBytes = registry.newCounter("object_bytes_total",
+		"Object store chunk bytes forwarded under the object store limit.", "user")
+	metricObjectThrottleWaitSeconds = registry.newDurationCounter("object_throttle_wait_seconds_total",
+		"Time object store uploads waited for the object store limit.", "user")
+	metricUplinkDemand = registry.newGauge("uplink_demand_bytes",
+		"Estimated total demand on the uplink in bytes per second.")
+	metricUplinkAllocated = registry.newGauge("uplink_allocated_bytes",
+		"Uplink rate allotted to a user in bytes per second.", "user")
+	metricFrozenPublishes = registry.newCounter("frozen_publishes_total",
+		"Publishes rejected by a publish freeze.", "user")
+	metricPolicyHookRejections = registry.newCounter("policy_hook_rejections_total",
+		"Connections and messages rejected by the policy hook.", "hook")
+	metricPolicyHookOverruns = registry.newCounter("policy_hook_overruns_total",
+		"Policy hook calls that exceeded their budget.", "hook")
+	metricRepublishRepeats = registry.newCounter("republish_repeats_total",
+		"Messages repeating a payload the user published more often than the republish guard threshold.", "user")
+	metricPayloadSamples = registry.newCounter("payload_samples_total",
+		"Sampled messages by the content type of their payload.", "user", "type")
+	metricStreamBytes = registry.newCounter("stream_bytes_total",
+		"Bytes published to capped JetStream streams.", "stream")
+	metricStreamThrottleWaitSeconds = registry.newDurationCounter("stream_throttle_wait_seconds_total",
+		"Time publishes waited for a JetStream stream's ingest cap.", "stream")
+	metricReplayBoosts = registry.newCounter("replay_boosts_total",
+		"Number of JetStream replay boosts granted.", "user")
+	metricReplayBoostedBytes = registry.newCounter("replay_boosted_bytes_total",
+		"Bytes forwarded while the user's rate was boosted for JetStream replay.", "user")
+	metricReadPauses = registry.newCounter("client_read_pauses_total",
+		"Number of times reading from a client was paused while its user was over budget.", "user")
+	metricReadPausedSeconds = registry.newDurationCounter("client_read_paused_seconds_total",
+		"Time spent with client reads paused while the user was over budget.", "user")
+	metricConnectIdentityFailures = registry.newCounter("connect_identity_failures_total",
+		"Number of CONNECTs no identity was found in, leaving the client in the default bucket, by reason.", "reason")
+	metricIdentityCacheLookups = registry.newCounter("identity_cache_lookups_total",
+		"Number of JWT identity cache lookups, by result (hit or miss).", "result")
+	metricParseWorkersBusy = registry.newGauge("parse_workers_busy",
+		"Number of parse workers parsing client data.")
+	metricParseBusySeconds = registry.newDurationCounter("parse_busy_seconds_total",
+		"Time parse workers spent parsing client data.")
+	metricParseWaitSeconds = registry.newDurationCounter("parse_wait_seconds_total",
+		"Time connections waited for a free parse worker.")
+	metricQuotaBytes = registry.newCounter("connection_quota_bytes_total",
+		"Bytes charged within connections' guaranteed share of their user's bandwidth, or borrowed beyond it, by kind.", "user", "kind")
+	metricBurstCreditBanked = registry.newCounter("burst_credit_banked_bytes_total",
+		"Unused rate banked as burst credit.", "user")
+	metricBurstCreditSpent = registry.newCounter("burst_credit_spent_bytes_total",
+		"Burst credit spent on traffic the user's bucket couldn't cover.", "user")
+	metricUpstreamWriteWaitSeconds = registry.newDurationCounter("upstream_write_wait_seconds_total",
+		"Time upstream writes waited for a scheduler slot, by limit class.", "class")
+	metricAdminAuditErrors = registry.newCounter("admin_audit_errors_total",
+		"Number of admin audit records that couldn't be written to the audit log file.")
+	metricPreAuthBytes = registry.newCounter("pre_auth_bytes_total",
+		"Bytes forwarded before the client identified itself, charged to the user once it did.", "user")
+	metricGoroutines = registry.newGauge("goroutines",
+		"Number of goroutines of the proxy, if a resource budget is configured.")
+	metricOpenFiles = registry.newGauge("open_files",
+		"Number of files the proxy has open, connections included, if a resource budget is configured.")
+	metricOverResourceBudget = registry.newGauge("over_resource_budget",
+		"Whether the proxy is approaching a resource ceiling and not accepting clients (1) or not (0).")
+	metricResourceBudgetExceeded = registry.newCounter("resource_budget_exceeded_total",
+		"Number of times the proxy approached a resource ceiling, by resource.", "resource")
+	metricBufferMemory = registry.newGauge("buffer_memory_bytes",
+		"Buffer memory of all client connections, if it is capped.")
+	metricMemoryCapShed = registry.newCounter("memory_cap_shed_total",
+		"Number of connections closed to bring buffer memory back under the cap.")
+	metricForwardingPaused = registry.newGauge("forwarding_paused",
+		"Whether forwarding to the upstream is paused through the admin API (1) or not (0).")
+	metricRegionConnections = registry.newCounter("region_connections_total",
+		"Number of client connections, by the geoip region of the client's address.", "region")
+	metricRegionBytes = registry.newCounter("region_bytes_total",
+		"Bytes received from clients, by the geoip region of the client's address.", "region")
+)
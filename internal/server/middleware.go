@@ -0,0 +1,257 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Frame is a message a client publishes, as middleware sees it once its PUB
+// or HPUB line is parsed, before the message is forwarded.
+type Frame struct {
+	Op         string // "PUB" or "HPUB"
+	User       string // empty until the client authenticated
+	Subject    string
+	Reply      string
+	HeaderSize int        // bytes of HPUB headers, part of Size
+	Size       int        // bytes of the payload
+	Class      limitClass // limit class the message is charged to
+}
+
+// FrameMiddleware inspects a frame and returns it, possibly with a changed
+// Subject, Reply or Class, or an error rejecting the message: the client
+// gets the permissions violation the NATS server would send. Changes to
+// other fields are ignored.
+type FrameMiddleware func(Frame) (Frame, error)
+
+// MiddlewareConfig selects which named middleware runs for whom, so costly
+// middleware only runs for tenants needing it: the proxy's own, see
+// builtinMiddleware, and that added with Proxy.UseNamed. A user's own entry
+// takes precedence over their tenant's, which takes precedence over the
+// default. Middleware added with Use always runs, as do freezes and limits.
+type MiddlewareConfig struct {
+	// Default names the middleware run for users without an entry. Omitted,
+	// all of it runs.
+	Default []string `yaml:"default"`
+	// Tenants names the middleware run for each tenant's users.
+	Tenants map[string][]string `yaml:"tenants"`
+	// Users names the middleware run for each user.
+	Users map[string][]string `yaml:"users"`
+}
+
+// names returns the middleware names the config selects.
+func (c *MiddlewareConfig) names() []string {
+	names := slices.Clone(c.Default)
+	for _, n := range c.Tenants {
+		names = append(names, n...)
+	}
+	for _, n := range c.Users {
+		names = append(names, n...)
+	}
+	return names
+}
+
+// enabled reports whether the middleware called name runs for user, of
+// tenant.
+func (c *MiddlewareConfig) enabled(name, user, tenant string) bool {
+	if c == nil {
+		return true
+	}
+	names, ok := c.Users[user]
+	if !ok && tenant != "" {
+		names, ok = c.Tenants[tenant]
+	}
+	if !ok {
+		names, ok = c.Default, c.Default != nil
+	}
+	return !ok || slices.Contains(names, name)
+}
+
+// Names the middleware config selects the proxy's own features published
+// messages pass through by.
+const (
+	middlewarePolicy         = "policy" // the policy hook's publish checks and rewrites
+	middlewareRepublishGuard = "republish_guard"
+	middlewareCapture        = "capture"
+	middlewareShadow         = "shadow"
+)
+
+var builtinMiddleware = []string{middlewarePolicy, middlewareRepublishGuard, middlewareCapture, middlewareShadow}
+
+// namedMiddleware is middleware the config can select by name, if named.
+type namedMiddleware struct {
+	name string
+	mw   FrameMiddleware
+}
+
+// frameChain applies middleware in order, stopping at the first error.
+type frameChain []FrameMiddleware
+
+func (chain frameChain) apply(f Frame) (Frame, error) {
+	for _, mw := range chain {
+		var err error
+		if f, err = mw(f); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+// Use appends middleware to the chain published messages pass through, after
+// the proxy's own policy, freeze and limit class checks, on the SNI routes
+// too. Subjects it rewrites go through the policy and freeze checks again.
+// It must be called before the proxy serves connections.
+func (p *Proxy) Use(mw ...FrameMiddleware) {
+	for _, m := range mw {
+		p.UseNamed("", m)
+	}
+}
+
+// UseNamed appends middleware the middleware config can enable or disable
+// per user or tenant by name, see Use.
+func (p *Proxy) UseNamed(name string, mw FrameMiddleware) {
+	p.middleware = append(p.middleware, namedMiddleware{name, mw})
+	for _, route := range p.routes {
+		route.UseNamed(name, mw)
+	}
+}
+
+// middlewareEnabled returns a function reporting whether the middleware
+// called name runs for a user with config.
+func middlewareEnabled(config *Config) func(name, user string) bool {
+	return func(name, user string) bool {
+		tenant := ""
+		if config.Middleware != nil && user != "" {
+			tenant = config.TenantOf(user)
+		}
+		return config.Middleware.enabled(name, user, tenant)
+	}
+}
+
+// middlewareFor returns a function selecting the middleware chain of a user
+// with config.
+func (p *Proxy) middlewareFor(config *Config) func(user string) []FrameMiddleware {
+	enabled := middlewareEnabled(config)
+	return func(user string) []FrameMiddleware {
+		var chain []FrameMiddleware
+		for _, m := range p.middleware {
+			if m.name == "" || enabled(m.name, user) {
+				chain = append(chain, m.mw)
+			}
+		}
+		return chain
+	}
+}
+
+// checkMiddleware verifies that the middleware configs of the proxy and its
+// routes only name middleware there is, so a typo can't silently change
+// what runs.
+func (p *Proxy) checkMiddleware() error {
+	known := slices.Clone(builtinMiddleware)
+	for _, m := range p.middleware {
+		known = append(known, m.name)
+	}
+	proxies := []*Proxy{p}
+	for _, route := range p.routes {
+		proxies = append(proxies, route)
+	}
+	for _, proxy := range proxies {
+		m := proxy.currentConfig().Middleware
+		if m == nil {
+			continue
+		}
+		for _, name := range m.names() {
+			if name == "" || !slices.Contains(known, name) {
+				return fmt.Errorf("middleware config names unknown middleware %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// SetBuiltinMiddleware turns off the proxy's own middleware for users
+// enabled doesn't run it for, once the client authenticates.
+func (c *ClientMessageParser) SetBuiltinMiddleware(enabled func(name, user string) bool) {
+	c.builtinEnabled = enabled
+}
+
+// dropBuiltins turns off the proxy's own middleware that doesn't run for the
+// connection's user. A dropped shadow stops being mirrored to, and is
+// closed with the connection.
+func (c *ClientMessageParser) dropBuiltins() {
+	if !c.builtinEnabled(middlewarePolicy, c.user) {
+		c.policy = nil
+	}
+	if !c.builtinEnabled(middlewareRepublishGuard, c.user) {
+		c.guard = nil
+	}
+	if !c.builtinEnabled(middlewareCapture, c.user) {
+		c.capture = nil
+	}
+	if !c.builtinEnabled(middlewareShadow, c.user) {
+		c.shadow = nil
+	}
+}
+
+// SetMiddleware passes published messages through chain.
+func (c *ClientMessageParser) SetMiddleware(chain []FrameMiddleware) {
+	c.SetMiddlewareFor(func(string) []FrameMiddleware { return chain })
+}
+
+// SetMiddlewareFor passes published messages through the chain chainFor
+// selects for the connection's user.
+func (c *ClientMessageParser) SetMiddlewareFor(chainFor func(user string) []FrameMiddleware) {
+	c.middlewareFor = chainFor
+	c.middleware, c.middlewareUser = chainFor(""), ""
+}
+
+// applyMiddleware passes the current PUB/HPUB frame with args through the
+// middleware chain, rewriting its line if the subject or reply changed. It
+// returns the arguments forwarded.
+func (c *ClientMessageParser) applyMiddleware(hdr bool, args [][]byte) [][]byte {
+	if c.user != c.middlewareUser {
+		c.middleware, c.middlewareUser = c.middlewareFor(c.user), c.user
+	}
+	if len(c.middleware) == 0 {
+		return args
+	}
+	in := Frame{Op: "PUB", User: c.user, Subject: string(args[0]), Class: c.class}
+	sizes := args[len(args)-1:]
+	if hdr {
+		in.Op = "HPUB"
+		sizes = args[len(args)-2:]
+		in.HeaderSize = parseSize(sizes[0])
+	}
+	if len(args) > len(sizes)+1 {
+		in.Reply = string(args[1])
+	}
+	in.Size = parseSize(args[len(args)-1])
+
+	out, err := c.middleware.apply(in)
+	if err != nil {
+		log.Debug().Err(err).Str("user", c.user).Str("subject", in.Subject).Msg("Middleware rejected publish")
+		c.rejected = in.Subject
+		return args
+	}
+	if out.Class != in.Class && out.Class >= 0 && int(out.Class) < len(classNames) {
+		c.class = out.Class
+	}
+	if out.Subject == in.Subject && out.Reply == in.Reply {
+		return args
+	}
+	rewritten := [][]byte{[]byte(out.Subject)}
+	if out.Reply != "" {
+		rewritten = append(rewritten, []byte(out.Reply))
+	}
+	rewritten = append(rewritten, sizes...)
+	if out.Subject == "" || !c.rewritePubLine(hdr, rewritten) {
+		log.Warn().Str("user", c.user).Str("subject", in.Subject).Msg("Publish can't be rewritten by middleware, rejecting it")
+		c.rejected = in.Subject
+		return args
+	}
+	if out.Subject != in.Subject && c.rateLimiterManager != nil {
+		c.stream, c.streamLimiter = c.rateLimiterManager.GetStreamLimiter(out.Subject)
+	}
+	return rewritten
+}
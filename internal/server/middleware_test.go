@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/juju/ratelimit"
+)
+
+func TestClientMessageParser_Middleware(t *testing.T) {
+	var output, client bytes.Buffer
+	clock := newFakeClock()
+	control := ratelimit.NewBucketWithRateAndClock(1, 1000, clock)
+	mockRLM := &mockRateLimiterManager{controlBucket: control}
+
+	input := "CONNECT {\"user\":\"alice\"}\r\n" +
+		"PUB orders.new _INBOX.1 2\r\nok\r\n" +
+		"HPUB secret.keys 12 14\r\nNATS/1.0\r\n\r\nok\r\n" +
+		"PUB pings 2\r\nok\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &output, mockRLM)
+	parser.SetClock(clock)
+	parser.SetClientWriter(newClientWriter(&client))
+
+	var seen []string
+	parser.SetMiddleware([]FrameMiddleware{
+		func(f Frame) (Frame, error) {
+			seen = append(seen, f.Op+" "+f.User+" "+f.Subject)
+			if strings.HasPrefix(f.Subject, "secret.") {
+				return f, errors.New("no secrets")
+			}
+			return f, nil
+		},
+		func(f Frame) (Frame, error) {
+			// Runs after the previous middleware, for frames it let through
+			if f.Subject == "orders.new" {
+				f.Subject, f.Reply = "tenant-a.orders.new", ""
+			}
+			if f.Subject == "pings" {
+				f.Class = classControl
+			}
+			return f, nil
+		},
+	})
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+
+	expected := "CONNECT {\"user\":\"alice\"}\r\nPUB tenant-a.orders.new 2\r\nok\r\nPUB pings 2\r\nok\r\n"
+	if output.String() != expected {
+		t.Errorf("Expected rewritten and filtered output.\nExpected: %q\nGot: %q", expected, output.String())
+	}
+	if errs := "-ERR 'Permissions Violation for Publish to \"secret.keys\"'\r\n"; client.String() != errs {
+		t.Errorf("Expected permission violation %q, got %q", errs, client.String())
+	}
+	if want := []string{"PUB alice orders.new", "HPUB alice secret.keys", "PUB alice pings"}; strings.Join(seen, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected middleware to see %v, got %v", want, seen)
+	}
+	// The control lane is charged for the CONNECT and the message moved to it
+	if charged := 1000 - control.Available(); charged != int64(len("CONNECT {\"user\":\"alice\"}\r\nPUB pings 2\r\nok\r\n")) {
+		t.Errorf("Expected the control lane charged for pings, %d bytes charged", charged)
+	}
+}
+
+func TestClientMessageParser_MiddlewareRewritesChecked(t *testing.T) {
+	var output, client bytes.Buffer
+	input := "CONNECT {\"user\":\"alice\"}\r\n" +
+		"PUB orders.new 2\r\nok\r\n" +
+		"PUB orders.old 2\r\nok\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &output, &mockRateLimiterManager{})
+	parser.SetPolicyHook(NewPolicyHook(PolicyHookConfig{}, nil, nil, func(user, subject string, size int) (string, string) {
+		if strings.HasPrefix(subject, "secret.") {
+			return "", "no secrets"
+		}
+		return "", ""
+	}), newClientWriter(&client))
+	parser.SetMiddleware([]FrameMiddleware{func(f Frame) (Frame, error) {
+		// Rewrites into a subject the policy denies
+		if f.Subject == "orders.new" {
+			f.Subject = "secret.orders"
+		}
+		return f, nil
+	}})
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+
+	expected := "CONNECT {\"user\":\"alice\"}\r\nPUB orders.old 2\r\nok\r\n"
+	if output.String() != expected {
+		t.Errorf("Expected the rewritten publish rejected.\nExpected: %q\nGot: %q", expected, output.String())
+	}
+	if errs := "-ERR 'Permissions Violation for Publish to \"secret.orders\"'\r\n"; client.String() != errs {
+		t.Errorf("Expected permission violation %q, got %q", errs, client.String())
+	}
+}
+
+func TestProxy_MiddlewareFor(t *testing.T) {
+	cfg := &Config{
+		Tenants: map[string]*TenantConfig{"acme": {Users: map[string]int64{"alice": 1024, "bob": 1024}}},
+		Middleware: &MiddlewareConfig{
+			Default: []string{},
+			Tenants: map[string][]string{"acme": {"acl", "compress"}},
+			Users:   map[string][]string{"bob": {"acl"}},
+		},
+	}
+	p := newTestProxy(cfg)
+	var ran []string
+	for _, name := range []string{"", "acl", "compress"} {
+		p.UseNamed(name, func(f Frame) (Frame, error) {
+			ran = append(ran, name)
+			return f, nil
+		})
+	}
+
+	for user, expected := range map[string]string{
+		"alice": ",acl,compress", // the tenant's
+		"bob":   ",acl",          // the user's own, over the tenant's
+		"carol": "",              // the default, only what always runs
+	} {
+		ran = nil
+		frameChain(p.middlewareFor(cfg)(user)).apply(Frame{User: user})
+		if got := strings.Join(ran, ","); got != expected {
+			t.Errorf("Expected middleware %q run for %s, got %q", expected, user, got)
+		}
+	}
+
+	cfg.Middleware = nil
+	ran = nil
+	frameChain(p.middlewareFor(cfg)("carol")).apply(Frame{})
+	if len(ran) != 3 {
+		t.Errorf("Expected all middleware run without config, got %v", ran)
+	}
+}
+
+func TestClientMessageParser_BuiltinMiddleware(t *testing.T) {
+	var output bytes.Buffer
+	input := "CONNECT {\"user\":\"loader\"}\r\nPUB secret.keys 2\r\nok\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &output, &mockRateLimiterManager{})
+	parser.SetPolicyHook(NewPolicyHook(PolicyHookConfig{}, nil, nil, func(user, subject string, size int) (string, string) {
+		return "", "no secrets"
+	}), nil)
+	parser.SetBuiltinMiddleware(middlewareEnabled(&Config{Middleware: &MiddlewareConfig{
+		Users: map[string][]string{"loader": {middlewareCapture}},
+	}}))
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if output.String() != input {
+		t.Errorf("Expected the policy hook skipped for loader, got %q", output.String())
+	}
+}
+
+func TestProxy_CheckMiddleware(t *testing.T) {
+	cfg := &Config{Middleware: &MiddlewareConfig{Default: []string{"policy", "capture"}, Users: map[string][]string{"bob": {"compress"}}}}
+	p := newTestProxy(cfg)
+	if err := p.checkMiddleware(); err == nil || !strings.Contains(err.Error(), `"compress"`) {
+		t.Errorf("Expected unregistered middleware refused, got %v", err)
+	}
+	p.UseNamed("compress", func(f Frame) (Frame, error) { return f, nil })
+	if err := p.checkMiddleware(); err != nil {
+		t.Errorf("Expected built-in and registered middleware accepted, got %v", err)
+	}
+}
+
+func TestLoadConfig_MiddlewareUnknownTenant(t *testing.T) {
+	yaml := "middleware:\n  tenants:\n    acme: [acl]\n"
+	if _, err := LoadConfig(writeTestConfig(t, yaml)); err == nil {
+		t.Error("Expected middleware of an unknown tenant refused")
+	}
+}
@@ -15,10 +15,16 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/juju/ratelimit"
 	"github.com/rs/zerolog/log"
 )
@@ -100,46 +106,397 @@ const (
 // RateLimiterManagerInterface defines the interface for rate limiter management
 type RateLimiterManagerInterface interface {
 	GetLimiter(username string) *ratelimit.Bucket
+	GetConnectionLimiters(username, client, country string) []*ratelimit.Bucket
+	GetControlLimiter(username string) *ratelimit.Bucket
+	GetObjectLimiter(username string) *ratelimit.Bucket
+	MessageClass(username, tag, subject string, size int) limitClass
+	GetStreamLimiter(subject string) (string, *ratelimit.Bucket)
+	GetPendingTracker(username string) *pendingTracker
+	IsBypassed(username string, claims map[string]interface{}) bool
+	IsKnownUser(username string) bool
+	UsesClaims() bool
+	ObservePublish(username, subject string)
+	RecordBytes(username string, n int)
+	Scale(username string) float64
+	RampFactor(limiter *ratelimit.Bucket) float64
+	Bind(username string, rebind func()) (unbind func())
+	NewConnectionQuota(username string, limiter *ratelimit.Bucket) *connQuota
+	GetBurstCredit(username string) *burstCredit
+	Frozen(username, subject string) bool
+	GetDeliveryLimiter(username string) *ratelimit.Bucket
+	GetQueueLimiter(username, queue string) *ratelimit.Bucket
 }
 
-// RateLimitedWriter wraps an io.Writer and applies rate limiting to all writes
+// RateLimitedWriter wraps an io.Writer and applies rate limiting to all writes.
+// Its limiters can be swapped while writes are in flight: each write charges
+// the limiters bound when it started, never a mix of two identities.
 type RateLimitedWriter struct {
-	writer      io.Writer
-	rateLimiter *ratelimit.Bucket
+	writer    io.Writer
+	clock     Clock      // waited on while throttled
+	chunkSize int        // bytes charged at once, 0 for up to a bucket's capacity
+	mu        sync.Mutex // serializes updates of limits
+	limits    atomic.Pointer[writerLimits]
+}
+
+// writerLimits is the set of limiters a RateLimitedWriter charges. It is never
+// modified once published, updates replace it as a whole.
+type writerLimits struct {
+	rateLimiter    *ratelimit.Bucket
+	controlLimiter *ratelimit.Bucket
+	objectLimiter  *ratelimit.Bucket
+	quota          *connQuota   // the connection's share of rateLimiter, if guaranteed
+	credit         *burstCredit // the user's banked unused rate, if any
+	scale          func() float64
+	user           string        // user throttle wait time is recorded for
+	record         func(n int64) // records the bytes written, if set
 }
 
 // NewRateLimitedWriter creates a new rate-limited writer
 func NewRateLimitedWriter(w io.Writer) *RateLimitedWriter {
-	return &RateLimitedWriter{
+	rlw := &RateLimitedWriter{
 		writer: w,
+		clock:  systemClock{},
 	}
+	rlw.limits.Store(&writerLimits{})
+	return rlw
 }
 
 // Write applies rate limiting and writes data to the underlying writer
 func (rlw *RateLimitedWriter) Write(data []byte) (int, error) {
-	if rlw.rateLimiter != nil {
-		// Apply rate limiting for each byte
-		rlw.rateLimiter.Wait(int64(len(data)))
+	return rlw.write(rlw.limits.Load(), data)
+}
+
+func (rlw *RateLimitedWriter) write(l *writerLimits, data []byte) (int, error) {
+	n, err := rlw.writeChunks(l.rateLimiter, data, func(n int64) { rlw.charge(l, n) })
+	if l.record != nil && n > 0 {
+		l.record(int64(n))
+	}
+	return n, err
+}
+
+// writeChunks writes data in chunks charged to limiter one at a time, so a
+// write larger than the bucket proceeds at the limited rate instead of
+// waiting for all of its tokens up front.
+func (rlw *RateLimitedWriter) writeChunks(limiter *ratelimit.Bucket, data []byte, charge func(n int64)) (int, error) {
+	chunk := rlw.chunk(limiter)
+	written := 0
+	for len(data) > 0 {
+		n := min(int64(len(data)), chunk)
+		charge(n)
+		m, err := rlw.writer.Write(data[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		data = data[n:]
+	}
+	return written, nil
+}
+
+// chunk returns how many bytes are charged to limiter at once: no more than
+// its capacity and the configured chunk size.
+func (rlw *RateLimitedWriter) chunk(limiter *ratelimit.Bucket) int64 {
+	if limiter == nil {
+		return math.MaxInt64
+	}
+	size := limiter.Capacity()
+	if rlw.chunkSize > 0 {
+		size = min(size, int64(rlw.chunkSize))
+	}
+	return max(size, 1)
+}
+
+// Charge charges n bytes to the rate limiter without writing, e.g. as a penalty.
+func (rlw *RateLimitedWriter) Charge(n int64) {
+	l := rlw.limits.Load()
+	chunk := rlw.chunk(l.rateLimiter)
+	for ; n > 0; n -= chunk {
+		rlw.charge(l, min(n, chunk))
+	}
+}
+
+// charge waits until the rate limiter of l allows n more bytes.
+func (rlw *RateLimitedWriter) charge(l *writerLimits, n int64) {
+	if l.rateLimiter == nil {
+		return
+	}
+	// Apply rate limiting for each byte, charging more (or fewer) tokens
+	// per byte while the effective rate is scaled. Rounding up keeps small
+	// writes from being charged nothing at all.
+	tokens := n
+	if l.scale != nil {
+		if scale := l.scale(); scale > 0 && scale != 1 {
+			tokens = int64(math.Ceil(float64(tokens) / scale))
+		}
+	}
+	if l.quota != nil {
+		// The connection's share goes through at once, leaving the user's
+		// bucket in debt that borrowing connections wait out
+		guaranteed := l.quota.take(tokens)
+		l.rateLimiter.Take(guaranteed)
+		if l.user != "" {
+			metricQuotaBytes.Add(guaranteed, l.user, "guaranteed")
+			metricQuotaBytes.Add(tokens-guaranteed, l.user, "borrowed")
+		}
+		if tokens -= guaranteed; tokens == 0 {
+			return
+		}
+	}
+	if l.credit != nil {
+		// What the bucket can't cover is spent from banked credit first
+		if short := tokens - max(l.rateLimiter.Available(), 0); short > 0 {
+			spent := l.credit.spend(short)
+			if l.user != "" {
+				metricBurstCreditSpent.Add(spent, l.user)
+			}
+			if tokens -= spent; tokens == 0 {
+				return
+			}
+		}
+	}
+	if wait := l.rateLimiter.Take(tokens); wait > 0 {
+		rlw.clock.Sleep(wait)
+		if l.user != "" {
+			metricThrottleWaitSeconds.Add(int64(wait), l.user)
+			metricThrottles.Add(1, l.user)
+		}
+	}
+}
+
+// WriteFrame writes data, part of a frame of class, charging the limiter of
+// the class for n bytes first. A message is charged whole with its first
+// part and later parts with nothing, so limits and metrics see whole
+// messages however the parser's buffer splits them. Protocol ops and
+// control subject messages are charged to the control lane limiter if set,
+// so they aren't stuck behind bulk traffic, and object store chunks to the
+// object store limiter if set, so uploads and messaging don't starve each
+// other.
+func (rlw *RateLimitedWriter) WriteFrame(class limitClass, data []byte, n int64) (int, error) {
+	l := rlw.limits.Load()
+	limiter, charge := rlw.classCharge(l, class)
+	chunk := rlw.chunk(limiter)
+	for ; n > 0; n -= chunk {
+		charge(min(n, chunk))
 	}
 	return rlw.writer.Write(data)
 }
 
+// classCharge returns the limiter traffic of class is charged to in l, and
+// the function charging it.
+func (rlw *RateLimitedWriter) classCharge(l *writerLimits, class limitClass) (*ratelimit.Bucket, func(n int64)) {
+	switch {
+	case class == classControl && l.controlLimiter != nil:
+		return l.controlLimiter, l.controlLimiter.Wait
+	case class == classObject && l.objectLimiter != nil:
+		return l.objectLimiter, func(n int64) {
+			if wait := l.objectLimiter.Take(n); wait > 0 {
+				rlw.clock.Sleep(wait)
+				if l.user != "" {
+					metricObjectThrottleWaitSeconds.Add(int64(wait), l.user)
+				}
+			}
+			if l.user != "" {
+				metricObjectBytes.Add(n, l.user)
+			}
+		}
+	}
+	return l.rateLimiter, func(n int64) { rlw.charge(l, n) }
+}
+
+// SetClock replaces the clock throttled writes wait on, which must be the
+// clock of the limiters charged.
+func (rlw *RateLimitedWriter) SetClock(clock Clock) {
+	rlw.clock = clock
+}
+
+// SetChunkSize bounds how many bytes are charged to a bucket at once, see
+// BucketConfig.ChunkSize.
+func (rlw *RateLimitedWriter) SetChunkSize(size int) {
+	rlw.chunkSize = size
+}
+
+// update atomically replaces the limits with a copy modified by fn.
+func (rlw *RateLimitedWriter) update(fn func(l *writerLimits)) {
+	rlw.mu.Lock()
+	defer rlw.mu.Unlock()
+	l := *rlw.limits.Load()
+	fn(&l)
+	rlw.limits.Store(&l)
+}
+
+// Rebind atomically switches the writer to another user's limiters, so no
+// write is charged partly to the old and partly to the new identity. quota
+// is the connection's guaranteed share of rateLimiter and credit the user's
+// burst credit, nil for none.
+func (rlw *RateLimitedWriter) Rebind(user string, rateLimiter, controlLimiter, objectLimiter *ratelimit.Bucket, quota *connQuota, credit *burstCredit, scale func() float64) {
+	rlw.mu.Lock()
+	defer rlw.mu.Unlock()
+	rlw.limits.Store(&writerLimits{
+		rateLimiter:    rateLimiter,
+		controlLimiter: controlLimiter,
+		objectLimiter:  objectLimiter,
+		quota:          quota,
+		credit:         credit,
+		scale:          scale,
+		user:           user,
+	})
+}
+
 // UpdateRateLimiter updates the rate limiter (e.g., when user changes)
 func (rlw *RateLimitedWriter) UpdateRateLimiter(rateLimiter *ratelimit.Bucket) {
-	rlw.rateLimiter = rateLimiter
+	rlw.update(func(l *writerLimits) { l.rateLimiter = rateLimiter })
+}
+
+// UpdateUser sets the user throttle wait time is recorded for
+func (rlw *RateLimitedWriter) UpdateUser(user string) {
+	rlw.update(func(l *writerLimits) { l.user = user })
+}
+
+// UpdateRecorder sets the function the bytes written are recorded with, nil
+// for none.
+func (rlw *RateLimitedWriter) UpdateRecorder(record func(n int64)) {
+	rlw.update(func(l *writerLimits) { l.record = record })
 }
 
+// UpdateControlLimiter updates the control lane rate limiter
+func (rlw *RateLimitedWriter) UpdateControlLimiter(controlLimiter *ratelimit.Bucket) {
+	rlw.update(func(l *writerLimits) { l.controlLimiter = controlLimiter })
+}
+
+// UpdateObjectLimiter updates the object store rate limiter
+func (rlw *RateLimitedWriter) UpdateObjectLimiter(objectLimiter *ratelimit.Bucket) {
+	rlw.update(func(l *writerLimits) { l.objectLimiter = objectLimiter })
+}
+
+// UpdateScale sets the function returning the current rate scale factor
+func (rlw *RateLimitedWriter) UpdateScale(scale func() float64) {
+	rlw.update(func(l *writerLimits) { l.scale = scale })
+}
+
+// ServiceHandler answers a request the client published to a proxy service
+// subject, returning the reply payload.
+type ServiceHandler func(user string, payload []byte) []byte
+
 // ClientMessageParser parses and forwards NATS protocol data efficiently for proxying.
 type ClientMessageParser struct {
-	clientReader *bufio.Reader
-	serverWriter *RateLimitedWriter
+	clientReader       *bufio.Reader
+	pendingReader      *pendingReader
+	backpressureReader *backpressureReader
+	serverWriter       *RateLimitedWriter
+	pauseReads         bool
 
 	state              parserState
 	as                 int
 	drop               int
 	rateLimiterManager RateLimiterManagerInterface
 
-	user string
+	// PUB/HPUB framing
+	argBuf       []byte     // arguments of the current PUB/HPUB/SUB/UNSUB
+	payloadLeft  int        // payload bytes (excluding CRLF) still expected
+	payloadStart int        // buffer position where the current payload starts
+	frameStart   int        // buffer position where the current frame starts, -1 once partially flushed
+	class        limitClass // limit class the current frame is charged to
+	msgSize      int64      // bytes of the current PUB/HPUB frame, charged with its first flush
+	msgCharged   bool       // the current frame's first flush happened
+
+	// Middleware published messages pass through, in order, selected for
+	// middlewareUser
+	middlewareFor  func(user string) []FrameMiddleware
+	middleware     frameChain
+	middlewareUser string
+	// Reports whether the proxy's own named middleware runs for a user,
+	// nil if all of it does
+	builtinEnabled func(name, user string) bool
+
+	// Holds forwarding while the proxy is paused, if set
+	pause *pauseGate
+
+	// Ingest cap of the stream the current frame is published to, if any
+	stream        string
+	streamLimiter *ratelimit.Bucket
+
+	// Budgets of the client's CONNECT name and location within the user's
+	// limit; replaced from other goroutines when the limiters are rebound
+	connLimiters atomic.Pointer[[]*ratelimit.Bucket]
+
+	// Proxy services answered by the proxy instead of being forwarded
+	services     map[string]ServiceHandler
+	clientWriter *clientWriter
+	subs         map[string]string // client subscriptions by sid, to address replies
+	service      ServiceHandler    // handler of the current frame, if it is a service request
+	reply        string            // reply subject of the current service request
+	// Bytes forwarded before the client identified itself, charged to its
+	// user once it does
+	preAuth int64
+
+	// The client asked for +OK acknowledgments, which replies of the
+	// proxy's own are ordered after those the upstream owes
+	verbose bool
+
+	// Site-specific policy hook, and the subject of the current frame if the
+	// hook rejected it
+	policy   *PolicyHook
+	rejected string
+
+	// Detector of republish loops shared by all connections, if enabled
+	guard *republishGuard
+
+	// Payload sampling: one in sampleEvery frames has the first samplePrefix
+	// bytes of its body, at sampleStart, classified
+	sampleEvery  int
+	samplePrefix int
+	sampleCount  int
+	sampling     bool
+	sampleStart  int
+
+	// Whether clients must identify as a configured user
+	requireKnown bool
+
+	// Credentials replacing the client's in CONNECT, if injected
+	upstreamAuth *upstreamAuth
+
+	// Bytes of CONNECT options logged when no identity is found in them,
+	// zero to log nothing
+	connectDiagnostics int
+
+	// Recently resolved JWT identities shared by all connections, if cached
+	identities *identityCache
+
+	user     string
+	client   ClientInfo
+	tagLabel string // the client's tag as labelled in metrics
+	country  string // of the client's address, if located
+	region   string // of the client's country, if in one
+	unbind   func() // unregisters the connection from its user's live connections
+
+	// Bound of the client-announced metric labels, nil for the defaults
+	labels *clientLabels
+
+	// Mirror of the publishes forwarded upstream, if shadowing is on
+	shadow *shadowConn
+	// Sampler of published frames, if traffic capture is on, and the start
+	// of the current frame once it's partially flushed
+	capture  *trafficCapture
+	captured []byte
+	// Soft limit warning tier, if configured, and when the connection last
+	// checked it and advised the client
+	soft        *softLimits
+	softChecked time.Time
+	softAdvised time.Time
+
+	// Writer of upstream->client traffic, charged to the user's delivery
+	// limit in per-user downstream mode
+	downstream *RateLimitedWriter
+
+	// Bytes and messages in and out, checked for loss or duplication on close
+	audit flowAudit
+	// Checksums of flushed and written bytes, if the ordering watchdog is on
+	watchdog *orderingWatchdog
+
+	// Parse workers the connection parses with, if bounded, and since when
+	// it holds one
+	workers   *parseWorkers
+	workStart time.Time
 
 	// Fixed-size buffer for memory efficiency in high-throughput scenarios
 	buffer    [4096]byte // Fixed buffer - no growth
@@ -153,8 +510,12 @@ func NewClientMessageParser(
 	serverWriter io.Writer,
 	rateLimiterManager RateLimiterManagerInterface,
 ) *ClientMessageParser {
+	br := &backpressureReader{reader: clientReader}
+	pr := &pendingReader{reader: br}
 	return &ClientMessageParser{
-		clientReader:       bufio.NewReader(clientReader),
+		clientReader:       bufio.NewReader(pr),
+		pendingReader:      pr,
+		backpressureReader: br,
 		serverWriter:       NewRateLimitedWriter(serverWriter),
 		state:              OP_START,
 		rateLimiterManager: rateLimiterManager,
@@ -164,32 +525,53 @@ func NewClientMessageParser(
 
 func (c *ClientMessageParser) ParseAndForward() error {
 	reader := c.clientReader
+	// Bytes read but never forwarded no longer count as pending once we return
+	defer func() { c.pendingReader.release(c.pendingReader.reserved) }()
+	defer func() {
+		if c.unbind != nil {
+			c.unbind()
+		}
+	}()
+	defer c.idle()
 
 	for {
+		if c.pendingReader.tracker != nil && c.bufferPos == 0 && reader.Buffered() == 0 {
+			// At a frame boundary with nothing buffered: wait for the user's
+			// pending bytes to drain before reading more from the client.
+			// Connections holding a partial frame keep reading so they can
+			// complete and release it.
+			c.idle()
+			if err := c.pendingReader.tracker.acquire(); err != nil {
+				log.Warn().Str("user", c.user).Msg("Closing connection over maximum pending bytes")
+				return err
+			}
+		}
+
 		b, err := reader.ReadByte()
 		if err != nil {
 			if err == io.EOF {
 				// Flush any remaining data in buffer
-				if c.bufferPos > 0 {
-					_, writeErr := c.serverWriter.Write(c.buffer[:c.bufferPos])
-					if writeErr != nil {
-						return writeErr
-					}
-					c.bufferPos = 0
-				}
-				return nil
+				return c.flush()
 			}
 			return err
 		}
+		c.audit.bytesIn++
 
 		// Add byte to buffer
-		if c.bufferPos >= 4096 {
+		if c.bufferPos >= len(c.buffer) {
+			if c.sampling && c.sampleStart < c.bufferPos {
+				c.samplePayload(c.bufferPos)
+			}
+			c.sampling = false
+			if c.capture != nil && c.frameStart >= 0 && (c.state == MSG_PAYLOAD || c.state == MSG_END_R || c.state == MSG_END_N) {
+				// Kept for the capture, which sees frames once whole
+				c.captured = append(c.captured[:0], c.buffer[c.frameStart:c.bufferPos]...)
+			}
 			// Buffer full - flush it with rate limiting
-			_, err = c.serverWriter.Write(c.buffer[:])
-			if err != nil {
+			if err := c.flush(); err != nil {
 				return err
 			}
-			c.bufferPos = 0
+			c.frameStart = -1
 		}
 
 		c.buffer[c.bufferPos] = b
@@ -197,6 +579,14 @@ func (c *ClientMessageParser) ParseAndForward() error {
 
 		switch c.state {
 		case OP_START:
+			c.class = classControl
+			c.msgSize, c.msgCharged = 0, false
+			c.service = nil
+			c.streamLimiter = nil
+			c.rejected = ""
+			c.sampling = false
+			c.captured = c.captured[:0]
+			c.frameStart = c.bufferPos - 1
 			switch b {
 			case 'P', 'p':
 				c.state = OP_P
@@ -204,9 +594,103 @@ func (c *ClientMessageParser) ParseAndForward() error {
 				c.state = OP_H
 			case 'C', 'c':
 				c.state = OP_C
+			case 'S', 's':
+				c.state = OP_S
+			case 'U', 'u':
+				c.state = OP_U
 			default:
 				c.state = OP_IGNORE
 			}
+		case OP_S:
+			switch b {
+			case 'U', 'u':
+				c.state = OP_SU
+			default:
+				c.state = OP_IGNORE
+			}
+		case OP_SU:
+			switch b {
+			case 'B', 'b':
+				c.state = OP_SUB
+			default:
+				c.state = OP_IGNORE
+			}
+		case OP_SUB:
+			switch b {
+			case ' ', '\t':
+				c.state = OP_SUB_SPC
+			default:
+				c.state = OP_IGNORE
+			}
+		case OP_SUB_SPC:
+			switch b {
+			case ' ', '\t':
+				// do nothing.
+			default:
+				c.state = SUB_ARG
+				c.argBuf = append(c.argBuf[:0], b)
+			}
+		case OP_U:
+			switch b {
+			case 'N', 'n':
+				c.state = OP_UN
+			default:
+				c.state = OP_IGNORE
+			}
+		case OP_UN:
+			switch b {
+			case 'S', 's':
+				c.state = OP_UNS
+			default:
+				c.state = OP_IGNORE
+			}
+		case OP_UNS:
+			switch b {
+			case 'U', 'u':
+				c.state = OP_UNSU
+			default:
+				c.state = OP_IGNORE
+			}
+		case OP_UNSU:
+			switch b {
+			case 'B', 'b':
+				c.state = OP_UNSUB
+			default:
+				c.state = OP_IGNORE
+			}
+		case OP_UNSUB:
+			switch b {
+			case ' ', '\t':
+				c.state = OP_UNSUB_SPC
+			default:
+				c.state = OP_IGNORE
+			}
+		case OP_UNSUB_SPC:
+			switch b {
+			case ' ', '\t':
+				// do nothing.
+			default:
+				c.state = UNSUB_ARG
+				c.argBuf = append(c.argBuf[:0], b)
+			}
+		case SUB_ARG, UNSUB_ARG:
+			switch b {
+			case '\r':
+				c.drop = 1
+			case '\n':
+				if c.requireKnown && c.user == "" {
+					return c.unknownUser("")
+				}
+				if c.state == SUB_ARG {
+					c.processSubArgs()
+				} else {
+					c.processUnsubArgs()
+				}
+			default:
+				if c.drop == 0 {
+					c.argBuf = append(c.argBuf, b)
+				}
+			}
 		case OP_H:
 			switch b {
 			case 'P', 'p':
@@ -231,10 +715,41 @@ func (c *ClientMessageParser) ParseAndForward() error {
 		case OP_HPUB:
 			switch b {
 			case ' ', '\t':
-				c.state = OP_IGNORE
+				c.state = OP_HPUB_SPC
 			default:
 				c.state = OP_IGNORE
 			}
+		case OP_HPUB_SPC:
+			switch b {
+			case ' ', '\t':
+				// do nothing.
+			default:
+				c.state = HPUB_ARG
+				c.argBuf = append(c.argBuf[:0], b)
+			}
+		case HPUB_ARG, PUB_ARG:
+			switch b {
+			case '\r':
+				c.drop = 1
+			case '\n':
+				if c.requireKnown && c.user == "" {
+					return c.unknownUser("")
+				}
+				if c.processPubArgs(c.state == HPUB_ARG) {
+					c.drop = 0
+					if c.rejected != "" && c.frameStart < 0 {
+						// Part of the line is already upstream, so the
+						// frame can't be dropped: end the connection
+						return &closeError{reason: closePolicyRejected, err: errRejectedLongLine}
+					}
+				} else {
+					c.state = OP_IGNORE
+				}
+			default:
+				if c.drop == 0 {
+					c.argBuf = append(c.argBuf, b)
+				}
+			}
 		case OP_P:
 			switch b {
 			case 'U', 'u':
@@ -252,10 +767,77 @@ func (c *ClientMessageParser) ParseAndForward() error {
 		case OP_PUB:
 			switch b {
 			case ' ', '\t':
+				c.state = OP_PUB_SPC
+			default:
 				c.state = OP_IGNORE
+			}
+		case OP_PUB_SPC:
+			switch b {
+			case ' ', '\t':
+				// do nothing.
 			default:
+				c.state = PUB_ARG
+				c.argBuf = append(c.argBuf[:0], b)
+			}
+		case MSG_PAYLOAD:
+			c.payloadLeft--
+			if c.payloadLeft == 0 {
+				c.state = MSG_END_R
+			}
+		case MSG_END_R:
+			if b == '\r' {
+				c.state = MSG_END_N
+			} else {
 				c.state = OP_IGNORE
 			}
+		case MSG_END_N:
+			if b == '\n' {
+				c.state = OP_START
+				c.audit.msgsIn++
+				forwarded := false
+				switch {
+				case c.rejected != "":
+					// Rejected by the policy hook - drop it and tell the client
+					c.audit.msgsDropped++
+					if err := c.rejectFrame(); err != nil {
+						return err
+					}
+				case c.service != nil && c.frameStart >= 0:
+					// Service request - answer it instead of forwarding
+					c.audit.msgsDropped++
+					if err := c.handleService(); err != nil {
+						return err
+					}
+				default:
+					forwarded = true
+					c.forwarded()
+					if c.sampling {
+						c.samplePayload(c.bufferPos - 2)
+					}
+					if c.guard != nil && c.user != "" && c.frameStart >= 0 {
+						payload := c.buffer[c.payloadStart : c.bufferPos-2]
+						if extra := c.guard.observe(c.user, payload, time.Now()); extra > 0 {
+							c.serverWriter.Charge(extra * int64(c.bufferPos-c.frameStart))
+						}
+					}
+					if c.capture != nil && c.user != "" {
+						frame := c.captured
+						if c.frameStart >= 0 {
+							frame = c.buffer[c.frameStart:c.bufferPos]
+						}
+						c.capture.observe(c.user, frame, time.Now())
+					}
+				}
+				// Frame complete - flush header and payload together
+				if err := c.flush(); err != nil {
+					return err
+				}
+				if forwarded {
+					c.audit.msgsOut++
+				}
+				continue
+			}
+			c.state = OP_IGNORE
 		case OP_C:
 			switch b {
 			case 'O', 'o':
@@ -316,86 +898,676 @@ func (c *ClientMessageParser) ParseAndForward() error {
 					// Note: For CONNECT, we assume the entire message fits in buffer
 					// since CONNECT messages are typically small
 					var arg []byte
-					if c.as < c.bufferPos-2 {
+					if c.frameStart >= 0 && c.as < c.bufferPos-2 {
 						arg = c.buffer[c.as : c.bufferPos-2]
 					}
 
 					var obj map[string]interface{}
-					if len(arg) > 0 && json.Unmarshal(arg, &obj) == nil {
+					if c.frameStart < 0 {
+						c.connectFailed(connectOversized, nil, nil)
+					} else if len(arg) == 0 || json.Unmarshal(arg, &obj) != nil {
+						c.connectFailed(connectMalformed, arg, nil)
+					} else {
+						if e := log.Debug(); e.Enabled() {
+							e.Interface("connect", redactConnect(obj)).Msg("Client CONNECT")
+						}
+						c.client = clientInfoFrom(obj)
+						labels := c.labels
+						if labels == nil {
+							labels = defaultClientLabels
+						}
+						if c.client.Tag != "" {
+							c.tagLabel = labels.tag(c.client.Tag)
+						}
+						if verbose, _ := obj["verbose"].(bool); verbose && c.clientWriter != nil {
+							c.verbose = true
+							c.clientWriter.setVerbose()
+						}
+						lang, version := labels.client(c.client)
+						metricClientConnections.Add(1, lang, version)
+						if c.upstreamAuth != nil {
+							if err := c.verifyClient(obj); err != nil {
+								return err
+							}
+						}
 						if user, ok := obj["user"].(string); ok {
-							c.processUser(user)
+							if err := c.processUser(user, nil, c.decideConnect(user, nil)); err != nil {
+								return err
+							}
 						} else if jwtToken, ok := obj["jwt"].(string); ok {
 							// Check for JWT authentication
-							user := c.extractUsernameFromJWT(jwtToken)
-							if user != "" {
-								c.processUser(user)
+							if id := c.resolveJWT(jwtToken); id.user != "" {
+								if err := c.processUser(id.user, id.claims, id.connect); err != nil {
+									return err
+								}
+							} else {
+								c.connectFailed(connectInvalidJWT, arg, nil)
 							}
+						} else {
+							reason, fields := connectFailureOf(obj)
+							c.connectFailed(reason, arg, fields)
 						}
 					}
-					c.drop, c.state = 0, OP_START
+					if c.requireKnown && c.user == "" {
+						return c.unknownUser("")
+					}
+					if c.upstreamAuth != nil {
+						if err := c.injectUpstreamAuth(obj); err != nil {
+							return err
+						}
+					}
+					c.state = OP_START
 				}
 			}
 		case OP_IGNORE:
 			// Continue processing but don't change state
 		}
 
+		if c.state == MSG_PAYLOAD || c.state == MSG_END_R || c.state == MSG_END_N {
+			// Payload bytes may contain CRLF, the frame ends after payloadLeft bytes
+			continue
+		}
 		if c.drop == 0 && b == '\r' {
 			c.drop = 1
 		}
 		if c.drop == 1 && b == '\n' {
 			c.drop, c.state = 0, OP_START
+			if c.frameStart < 0 || (c.bufferPos-c.frameStart > 2 && !isPing(c.buffer[c.frameStart:c.bufferPos])) {
+				c.forwarded()
+			}
 			// Message boundary reached - flush buffer to ensure message integrity
-			_, err = c.serverWriter.Write(c.buffer[:c.bufferPos])
-			if err != nil {
+			if err := c.flush(); err != nil {
 				return err
 			}
-			c.bufferPos = 0 // Reset buffer for next message
 		}
 
 	}
 }
 
-func (c *ClientMessageParser) processUser(user string) {
+// flush writes the buffered bytes to the server, charged to the limiter of the
+// current frame's limit class.
+func (c *ClientMessageParser) flush() error {
+	if c.rejected != "" {
+		c.discardFrame()
+	}
+	if c.bufferPos == 0 {
+		return nil
+	}
+	// Waiting for limits and the upstream doesn't take a parse worker
+	c.idle()
+	defer c.work()
+	c.pause.wait()
+	// Messages are charged and counted whole with their first flush
+	charged := int64(c.bufferPos)
+	if c.msgSize > 0 {
+		charged = 0
+		if !c.msgCharged {
+			charged, c.msgCharged = c.msgSize, true
+		}
+	}
+	if limiters := c.connLimiters.Load(); limiters != nil && c.class == classBulk && charged > 0 {
+		// Named clients and locations are limited on top of the user's limit
+		for _, limiter := range *limiters {
+			if wait := limiter.Take(charged); wait > 0 {
+				c.serverWriter.clock.Sleep(wait)
+				metricThrottleWaitSeconds.Add(int64(wait), c.user)
+			}
+		}
+	}
+	if c.streamLimiter != nil && charged > 0 {
+		// Stream caps apply to every publisher, on top of the user's limit
+		if wait := c.streamLimiter.Take(charged); wait > 0 {
+			c.serverWriter.clock.Sleep(wait)
+			metricStreamThrottleWaitSeconds.Add(int64(wait), c.stream)
+		}
+		metricStreamBytes.Add(charged, c.stream)
+	}
+	c.watchdog.send(c.buffer[:c.bufferPos])
+	n, err := c.serverWriter.WriteFrame(c.class, c.buffer[:c.bufferPos], charged)
+	c.audit.bytesOut += int64(n)
+	if err == nil {
+		c.watchdog.check("upstream")
+		if c.shadow != nil {
+			c.shadow.mirror(c.buffer[:c.bufferPos])
+		}
+	}
+	if c.user == "" {
+		c.preAuth += charged
+	}
+	if c.user != "" && c.rateLimiterManager != nil && charged > 0 {
+		c.rateLimiterManager.RecordBytes(c.user, int(charged))
+		if c.soft != nil {
+			c.checkSoftLimit(time.Now())
+		}
+	}
+	if c.tagLabel != "" && charged > 0 {
+		metricTagBytes.Add(charged, c.tagLabel)
+	}
+	if c.country != "" && charged > 0 {
+		metricCountryBytes.Add(charged, c.country)
+	}
+	if c.region != "" && charged > 0 {
+		metricRegionBytes.Add(charged, c.region)
+	}
+	c.pendingReader.release(int64(c.bufferPos))
+	c.bufferPos = 0 // Reset buffer for next message
+	if err != nil {
+		return &closeError{reason: closeUpstreamWriteError, err: err}
+	}
+	return nil
+}
+
+// processPubArgs parses the arguments of a PUB (subject [reply] size) or HPUB
+// (subject [reply] hdr_size total_size) and prepares for reading the payload.
+// It returns false if the arguments are malformed.
+func (c *ClientMessageParser) processPubArgs(hdr bool) bool {
+	var args [4][]byte
+	n := 0
+	for _, f := range bytes.Fields(c.argBuf) {
+		if n == len(args) {
+			return false
+		}
+		args[n] = f
+		n++
+	}
+
+	minArgs, maxArgs := 2, 3
+	if hdr {
+		minArgs, maxArgs = 3, 4
+	}
+	if n < minArgs || n > maxArgs {
+		return false
+	}
+	size := parseSize(args[n-1])
+	if size < 0 {
+		return false
+	}
+
+	c.checkPublish(hdr, args[:n], size)
+
+	if c.rateLimiterManager != nil {
+		c.class = c.rateLimiterManager.MessageClass(c.user, c.client.Tag, string(args[0]), size)
+		c.stream, c.streamLimiter = c.rateLimiterManager.GetStreamLimiter(string(args[0]))
+		if c.user != "" {
+			c.rateLimiterManager.ObservePublish(c.user, string(args[0]))
+		}
+	} else {
+		c.class = classBulk
+	}
+	if c.middlewareFor != nil && c.rejected == "" {
+		subject := string(args[0])
+		n = copy(args[:], c.applyMiddleware(hdr, args[:n]))
+		if c.rejected == "" && string(args[0]) != subject {
+			// A subject rewritten by middleware is checked as if published
+			subject = string(args[0])
+			c.checkPublish(hdr, args[:n], size)
+			if string(args[0]) != subject && c.rateLimiterManager != nil {
+				c.stream, c.streamLimiter = c.rateLimiterManager.GetStreamLimiter(string(args[0]))
+			}
+		}
+	}
+	if handler, ok := c.services[string(args[0])]; ok && n == maxArgs && c.rejected == "" {
+		c.service = handler
+		c.reply = string(args[1])
+	}
+	c.payloadStart = c.bufferPos
+	c.payloadLeft = size
+	// The whole frame: the buffered line, the payload and its CRLF
+	c.msgSize = int64(c.bufferPos) + int64(size) + 2
+	if c.sampleEvery > 0 && c.user != "" && c.rejected == "" && c.service == nil && c.frameStart >= 0 {
+		c.sampleCount++
+		if c.sampleCount%c.sampleEvery == 0 {
+			c.sampling = true
+			c.sampleStart = c.payloadStart
+			if hdr {
+				c.sampleStart += parseSize(args[n-2])
+			}
+		}
+	}
+	if size == 0 {
+		c.state = MSG_END_R
+	} else {
+		c.state = MSG_PAYLOAD
+	}
+	return true
+}
+
+// checkPublish runs the policy hook and the freezes on the current PUB/HPUB
+// frame with args, rejecting it, or rewriting its line if the policy hook
+// changes the subject.
+func (c *ClientMessageParser) checkPublish(hdr bool, args [][]byte, size int) {
+	if c.policy != nil && c.user != "" {
+		subject, err := c.policy.Publish(c.user, string(args[0]), size)
+		switch {
+		case err != nil:
+			c.rejected = string(args[0])
+		case subject != string(args[0]):
+			args[0] = []byte(subject)
+			if !c.rewritePubLine(hdr, args) {
+				c.rejected = subject
+			}
+		}
+	}
+
+	if c.rateLimiterManager != nil && c.user != "" && c.rejected == "" &&
+		c.rateLimiterManager.Frozen(c.user, string(args[0])) {
+		c.rejected = string(args[0])
+		metricFrozenPublishes.Add(1, c.user)
+	}
+}
+
+// rewritePubLine replaces the buffered PUB/HPUB line of the current frame with
+// one carrying args. It returns false if the new line doesn't fit the buffer.
+func (c *ClientMessageParser) rewritePubLine(hdr bool, args [][]byte) bool {
+	line := []byte("PUB ")
+	if hdr {
+		line = []byte("HPUB ")
+	}
+	line = append(line, bytes.Join(args, []byte(" "))...)
+	line = append(line, '\r', '\n')
+	return c.rewriteFrame(line)
+}
+
+// rewriteFrame replaces the buffered bytes of the current frame with line. It
+// returns false if line doesn't fit the buffer.
+func (c *ClientMessageParser) rewriteFrame(line []byte) bool {
+	if c.frameStart < 0 || c.frameStart+len(line) > len(c.buffer) {
+		return false
+	}
+	shrunk := c.bufferPos - c.frameStart - len(line)
+	if shrunk > 0 {
+		c.pendingReader.release(int64(shrunk))
+	}
+	c.audit.bytesAdjusted -= int64(shrunk)
+	c.bufferPos = c.frameStart + copy(c.buffer[c.frameStart:], line)
+	return true
+}
+
+// discardFrame drops the buffered bytes of the current frame.
+func (c *ClientMessageParser) discardFrame() {
+	start := max(c.frameStart, 0)
+	c.pendingReader.release(int64(c.bufferPos - start))
+	c.audit.bytesAdjusted -= int64(c.bufferPos - start)
+	c.bufferPos = start
+}
+
+// rejectFrame drops the current frame rejected by the policy hook and sends
+// the client the permissions violation the NATS server would.
+func (c *ClientMessageParser) rejectFrame() error {
+	c.discardFrame()
+	subject := c.rejected
+	c.rejected = ""
+	if c.clientWriter == nil {
+		return nil
+	}
+	return c.replyInOrder(fmt.Appendf(nil, "-ERR 'Permissions Violation for Publish to %q'\r\n", subject), false)
+}
+
+// processSubArgs tracks a client subscription (subject [queue] sid) so
+// service replies can be addressed to it, and deliveries to a limited queue
+// group are charged to the group.
+func (c *ClientMessageParser) processSubArgs() {
+	fields := bytes.Fields(c.argBuf)
+	if len(fields) != 2 && len(fields) != 3 {
+		return
+	}
+	sid := string(fields[len(fields)-1])
+	if c.subs != nil {
+		c.subs[sid] = string(fields[0])
+	}
+	if len(fields) == 3 && c.rateLimiterManager != nil && c.clientWriter != nil {
+		queue := string(fields[1])
+		if limiter := c.rateLimiterManager.GetQueueLimiter(c.user, queue); limiter != nil {
+			c.clientWriter.queues.add(sid, queueSub{queue: queue, limiter: limiter})
+		}
+	}
+}
+
+// processUnsubArgs stops tracking a client subscription (sid [max_msgs]).
+func (c *ClientMessageParser) processUnsubArgs() {
+	fields := bytes.Fields(c.argBuf)
+	if len(fields) == 0 {
+		return
+	}
+	if c.subs != nil {
+		delete(c.subs, string(fields[0]))
+	}
+	if c.clientWriter != nil {
+		c.clientWriter.queues.remove(string(fields[0]))
+	}
+}
+
+// handleService drops the current service request frame from the buffer and
+// sends the handler's reply to the client's subscription matching the reply
+// subject.
+func (c *ClientMessageParser) handleService() error {
+	payload := bytes.Clone(c.buffer[c.payloadStart : c.bufferPos-2])
+	c.pendingReader.release(int64(c.bufferPos - c.frameStart))
+	c.audit.bytesAdjusted -= int64(c.bufferPos - c.frameStart)
+	c.bufferPos = c.frameStart
+
+	sid := ""
+	for s, subject := range c.subs {
+		if subjectMatches(subject, c.reply) {
+			sid = s
+			break
+		}
+	}
+	if c.clientWriter == nil {
+		return nil
+	}
+	if sid == "" {
+		log.Debug().Str("reply", c.reply).Msg("No subscription for service reply")
+		if c.verbose {
+			return c.replyInOrder(nil, true)
+		}
+		return nil
+	}
+
+	resp := c.service(c.user, payload)
+	frame := fmt.Appendf(nil, "MSG %s %s %d\r\n", c.reply, sid, len(resp))
+	frame = append(frame, resp...)
+	frame = append(frame, '\r', '\n')
+	return c.replyInOrder(frame, true)
+}
+
+// samplePayload records the content type of the current frame's body, whose
+// prefix is buffered up to end.
+func (c *ClientMessageParser) samplePayload(end int) {
+	c.sampling = false
+	if c.sampleStart > end {
+		return
+	}
+	prefix := c.buffer[c.sampleStart:min(end, c.sampleStart+c.samplePrefix)]
+	metricPayloadSamples.Add(1, c.user, classifyPayload(prefix))
+}
+
+// parseSize parses a non-negative decimal size, returning -1 if invalid.
+func parseSize(d []byte) int {
+	if len(d) == 0 || len(d) > 9 {
+		return -1
+	}
+	n := 0
+	for _, dec := range d {
+		if dec < '0' || dec > '9' {
+			return -1
+		}
+		n = n*10 + int(dec-'0')
+	}
+	return n
+}
+
+// decideConnect runs the policy hook's connect hook for user, returning its
+// decision, or nil without one.
+func (c *ClientMessageParser) decideConnect(user string, claims map[string]interface{}) *connectDecision {
+	if c.policy == nil || c.user != "" {
+		return nil
+	}
+	if d, ok := c.policy.decideConnect(user, claims); ok {
+		return &d
+	}
+	return nil
+}
+
+// processUser authenticates the connection as user, applying the policy
+// hook's decision about them, if any.
+func (c *ClientMessageParser) processUser(user string, claims map[string]interface{}, connect *connectDecision) error {
 	if c.user != "" {
 		log.Warn().Str("oldUser", c.user).Str("newUser", user).Msg("User already authenticated, cannot re-authenticate")
-		return
+		return nil
+	}
+	log.Info().Str("user", user).EmbedObject(c.client).Msg("User authenticated")
+	if c.policy != nil && connect != nil {
+		if err := c.policy.applyConnect(user, *connect); err != nil {
+			return &closeError{reason: closePolicyRejected, err: err}
+		}
+	}
+	// After the policy hook, which may set the user's limit
+	if c.requireKnown && c.rateLimiterManager != nil &&
+		!c.rateLimiterManager.IsKnownUser(user) && !c.rateLimiterManager.IsBypassed(user, claims) {
+		return c.unknownUser(user)
 	}
-	log.Info().Str("user", user).Msg("User authenticated")
 	c.user = user
+	if c.clientWriter != nil {
+		c.clientWriter.setUser(user)
+	}
+	if c.builtinEnabled != nil {
+		c.dropBuiltins()
+	}
 	if c.rateLimiterManager != nil {
-		rateLimiter := c.rateLimiterManager.GetLimiter(user)
-		c.serverWriter.UpdateRateLimiter(rateLimiter)
+		if c.rateLimiterManager.IsBypassed(user, claims) {
+			log.Info().Str("user", user).Msg("User bypasses rate limiting")
+			metricBypassedConnections.Add(1, user)
+			if c.clientWriter != nil {
+				c.clientWriter.bypassed.Store(true)
+			}
+			c.soft = nil // no limit to warn about
+			return nil
+		}
+		if c.pauseReads {
+			c.backpressureReader.user = user
+		}
+		c.bindLimiters()
+		c.unbind = c.rateLimiterManager.Bind(user, c.bindLimiters)
+		c.pendingReader.tracker = c.rateLimiterManager.GetPendingTracker(user)
+		// Ops pipelined behind the CONNECT were read along with it, before
+		// the user was known: they're pending from now on like later reads
+		c.pendingReader.adopt(int64(c.bufferPos + c.clientReader.Buffered()))
+		if c.preAuth > 0 {
+			// Frames pipelined ahead of the CONNECT count against the
+			// user's limit, so they can't front-run it
+			c.idle()
+			c.serverWriter.Charge(c.preAuth)
+			c.work()
+			c.rateLimiterManager.RecordBytes(user, int(c.preAuth))
+			metricPreAuthBytes.Add(c.preAuth, user)
+			c.preAuth = 0
+		}
 	}
+	return nil
+}
+
+var errUnknownUser = errors.New("unknown user")
+
+// errRejectedLongLine ends a connection whose rejected publish had a line
+// too long for the buffer, so it couldn't be dropped whole.
+var errRejectedLongLine = errors.New("rejected publish over the buffer")
 
+// unknownUser rejects a client whose user isn't configured, or that didn't
+// identify itself, with required known users.
+func (c *ClientMessageParser) unknownUser(user string) error {
+	log.Warn().Str("user", user).EmbedObject(c.client).Msg("Rejecting unknown user")
+	return &closeError{reason: closeUnknownUser, err: errUnknownUser}
 }
 
-func (c *ClientMessageParser) extractUsernameFromJWT(jwtToken string) string {
-	// Parse JWT without verification since we just need to extract claims
-	token, _ := jwt.ParseWithClaims(jwtToken, jwt.MapClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Return nil to skip signature verification - we just need the claims
-		return nil, nil
+// bindLimiters binds the connection to its user's current limiters. It's
+// called again from other goroutines when the user's limit class changes.
+func (c *ClientMessageParser) bindLimiters() {
+	rlm := c.rateLimiterManager
+	user := c.user
+	rateLimiter := rlm.GetLimiter(user)
+	connLimiters := rlm.GetConnectionLimiters(user, c.client.Name, c.country)
+	c.connLimiters.Store(&connLimiters)
+	quota := rlm.NewConnectionQuota(user, rateLimiter)
+	credit := rlm.GetBurstCredit(user)
+	c.serverWriter.Rebind(user, rateLimiter, rlm.GetControlLimiter(user), rlm.GetObjectLimiter(user), quota, credit, func() float64 {
+		return rlm.Scale(user) * rlm.RampFactor(rateLimiter)
 	})
-
-	// Even with signature verification errors, we can still extract claims
-	if token != nil {
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			if name, exists := claims["name"]; exists {
-				if nameStr, ok := name.(string); ok {
-					return nameStr
-				}
-			}
-			if sub, exists := claims["sub"]; exists {
-				if subStr, ok := sub.(string); ok {
-					return subStr
-				}
+	if c.pauseReads {
+		c.backpressureReader.limiter.Store(rateLimiter)
+		c.backpressureReader.quota.Store(quota)
+	}
+	if c.downstream != nil {
+		if limiter := rlm.GetDeliveryLimiter(user); limiter != nil {
+			// Scaled like publishes, so a replay boost speeds up the
+			// deliveries of the replay
+			c.downstream.UpdateRateLimiter(limiter)
+			c.downstream.UpdateScale(func() float64 {
+				return rlm.Scale(user) * rlm.RampFactor(limiter)
+			})
+			// Deliveries spending the user's own limit count towards their
+			// throughput like publishes
+			var record func(n int64)
+			if limiter == rateLimiter {
+				record = func(n int64) { rlm.RecordBytes(user, int(n)) }
 			}
+			c.downstream.UpdateRecorder(record)
 		}
 	}
+}
 
-	return ""
+func (c *ClientMessageParser) extractUsernameFromJWT(jwtToken string) string {
+	id, _ := parseJWTIdentity(jwtToken)
+	return id.user()
+}
+
+// HandleService answers requests published to subject with handler instead of
+// forwarding them upstream. Replies are written to cw.
+func (c *ClientMessageParser) HandleService(subject string, handler ServiceHandler, cw *clientWriter) {
+	if c.services == nil {
+		c.services = make(map[string]ServiceHandler)
+		c.subs = make(map[string]string)
+	}
+	c.services[subject] = handler
+	c.clientWriter = cw
+}
+
+// SetPolicyHook runs the policy hook for the client's connect and publishes.
+// Publish rejections are reported to the client through cw.
+func (c *ClientMessageParser) SetPolicyHook(hook *PolicyHook, cw *clientWriter) {
+	c.policy = hook
+	c.clientWriter = cw
+}
+
+// SetClientWriter reports publishes rejected by a freeze to the client
+// through cw, and has cw charge deliveries to the client's subscriptions in
+// limited queue groups to their group.
+func (c *ClientMessageParser) SetClientWriter(cw *clientWriter) {
+	c.clientWriter = cw
+}
+
+// SetDownstream charges the messages delivered to the client through
+// downstream to its user's delivery limit once it authenticates.
+func (c *ClientMessageParser) SetDownstream(downstream *RateLimitedWriter) {
+	c.downstream = downstream
+}
+
+// SetShadow mirrors the frames forwarded upstream to a shadow upstream.
+func (c *ClientMessageParser) SetShadow(shadow *shadowConn) {
+	c.shadow = shadow
+}
+
+// SetTrafficCapture samples the client's published frames into
+// capture.
+func (c *ClientMessageParser) SetTrafficCapture(capture *trafficCapture) {
+	c.capture = capture
+}
+
+// SetSoftLimits warns about the user crossing their soft limit, and tracks
+// the client's subscriptions to address advisories to.
+func (c *ClientMessageParser) SetSoftLimits(soft *softLimits) {
+	c.soft = soft
+	if soft.cfg.AdvisorySubject != "" && c.subs == nil {
+		c.subs = make(map[string]string)
+	}
+}
+
+// SetRepublishGuard checks the client's whole frames for republish loops.
+func (c *ClientMessageParser) SetRepublishGuard(guard *republishGuard) {
+	c.guard = guard
+}
+
+// SetPayloadSampling classifies the content type of a sample of the client's
+// messages.
+func (c *ClientMessageParser) SetPayloadSampling(cfg PayloadSamplingConfig) {
+	c.sampleEvery = cfg.Every
+	c.samplePrefix = cfg.PrefixBytes
+}
+
+// SetRequireKnownUser rejects clients that don't identify as a configured
+// user instead of giving them the default limit.
+func (c *ClientMessageParser) SetRequireKnownUser() {
+	c.requireKnown = true
+}
+
+// SetUpstreamAuth forwards CONNECT with the proxy's upstream credentials
+// in place of the client's.
+func (c *ClientMessageParser) SetUpstreamAuth(auth *upstreamAuth) {
+	c.upstreamAuth = auth
+}
+
+// SetConnectDiagnostics logs why no identity was found in a CONNECT, with
+// up to n bytes of its redacted options.
+func (c *ClientMessageParser) SetConnectDiagnostics(n int) {
+	c.connectDiagnostics = n
+}
+
+// SetIdentityCache resolves JWTs through a cache shared by connections.
+func (c *ClientMessageParser) SetIdentityCache(cache *identityCache) {
+	c.identities = cache
+}
+
+// SetParseWorkers bounds the CPU parsing takes to a shared pool of parse
+// workers. It must be set before parsing starts.
+func (c *ClientMessageParser) SetParseWorkers(workers *parseWorkers) {
+	c.workers = workers
+	c.clientReader = bufio.NewReader(workerReader{c.pendingReader, c})
+}
+
+// SetClock replaces the clock throttled writes to the server wait on, which
+// must be the clock of the limiters charged.
+func (c *ClientMessageParser) SetClock(clock Clock) {
+	c.serverWriter.SetClock(clock)
+}
+
+// SetChunkSize bounds how many bytes are charged to a bucket at once, see
+// BucketConfig.ChunkSize.
+func (c *ClientMessageParser) SetChunkSize(size int) {
+	c.serverWriter.SetChunkSize(size)
+}
+
+// SetOrderingWatchdog checks that every flush reaches the upstream whole and
+// in order.
+func (c *ClientMessageParser) SetOrderingWatchdog() {
+	c.watchdog = &orderingWatchdog{}
+	c.serverWriter.writer = watchdogWriter{c.serverWriter.writer, c.watchdog}
+}
+
+// SetLocation sets the country and region the client connects from, which
+// label its traffic and may limit it.
+func (c *ClientMessageParser) SetLocation(country, region string) {
+	c.country, c.region = country, region
+}
+
+// SetClientLabels sets the bound of the metric labels the client announces.
+func (c *ClientMessageParser) SetClientLabels(labels *clientLabels) {
+	c.labels = labels
+}
+
+// SetPauseReads enables pausing reads from the client while the user's rate
+// limiter is over budget.
+func (c *ClientMessageParser) SetPauseReads(pause bool) {
+	c.pauseReads = pause
 }
 
 // GetUser returns the authenticated user name, or empty string if not authenticated
 func (c *ClientMessageParser) GetUser() string {
 	return c.user
 }
+
+// checkFlow checks that everything read from the client was forwarded
+// upstream, once ParseAndForward returned err. Bytes still buffered were
+// never forwarded; after an upstream write error it's unknown how many were.
+func (c *ClientMessageParser) checkFlow(err error) bool {
+	if closeReasonOf(err, true) == closeUpstreamWriteError {
+		return true
+	}
+	audit := c.audit
+	audit.bytesAdjusted -= int64(c.bufferPos)
+	return audit.check("upstream", c.user)
+}
+
+// GetClient returns the client library announced in CONNECT
+func (c *ClientMessageParser) GetClient() ClientInfo {
+	return c.client
+}
@@ -3,11 +3,16 @@ package server
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/juju/ratelimit"
+	"nats-limiter-proxy/internal/creds"
 )
 
 func TestClientMessageParser_ParseAndForward(t *testing.T) {
@@ -188,14 +193,11 @@ func TestClientMessageParser_BufferDuplicationIssue(t *testing.T) {
 }
 
 func TestClientMessageParser_RateLimitingOnBufferFlushes(t *testing.T) {
-	if testing.Short() {
-		t.Skip("Skipping rate limiting test in short mode")
-	}
-	
 	var output bytes.Buffer
 
 	// Create moderately restrictive rate limiter (100 bytes/second)
-	bucket := ratelimit.NewBucketWithRate(100, 100)
+	clock := newFakeClock()
+	bucket := ratelimit.NewBucketWithRateAndClock(100, 100, clock)
 
 	mockRLM := &mockRateLimiterManager{
 		bucket: bucket,
@@ -215,13 +217,13 @@ func TestClientMessageParser_RateLimitingOnBufferFlushes(t *testing.T) {
 		&output,
 		mockRLM,
 	)
+	parser.SetClock(clock)
 
-	start := time.Now()
 	err := parser.ParseAndForward()
 	if err != nil {
 		t.Fatalf("ParseAndForward failed: %v", err)
 	}
-	elapsed := time.Since(start)
+	elapsed := clock.Slept()
 
 	if parser.GetUser() != "alice" {
 		t.Fatalf("Expected user 'alice', got %q", parser.GetUser())
@@ -294,7 +296,8 @@ func TestClientMessageParser_RateLimitingIntegration(t *testing.T) {
 	var output bytes.Buffer
 
 	// Create a real rate limiter with very low rate (1 byte per second)
-	bucket := ratelimit.NewBucketWithRate(1, 1)
+	clock := newFakeClock()
+	bucket := ratelimit.NewBucketWithRateAndClock(1, 1, clock)
 
 	mockRLM := &mockRateLimiterManager{
 		bucket: bucket,
@@ -309,25 +312,33 @@ func TestClientMessageParser_RateLimitingIntegration(t *testing.T) {
 		&output,
 		mockRLM,
 	)
+	parser.SetClock(clock)
 
 	// Measure the rate limiting delay
-	start := time.Now()
 	err := parser.ParseAndForward()
 	if err != nil {
 		t.Fatalf("ParseAndForward failed: %v", err)
 	}
-	rateLimitWaitTime := time.Since(start)
+	rateLimitWaitTime := clock.Slept()
 
-	// With a 1 byte/second rate limit, we should see some delay
-	// (This is a basic test - in practice the delay depends on bucket state)
-	if rateLimitWaitTime < 0 {
+	// With a 1 byte/second rate limit, the PUB frame after the 1 byte burst
+	// waits a second per byte
+	if rateLimitWaitTime <= 0 {
 		t.Error("Expected some rate limiting delay, but got none")
 	}
 }
 
 // Mock RateLimiterManager for testing
 type mockRateLimiterManager struct {
-	bucket *ratelimit.Bucket
+	bucket          *ratelimit.Bucket
+	controlBucket   *ratelimit.Bucket
+	controlSubjects []string
+	objectBucket    *ratelimit.Bucket
+	objectSubjects  []string
+	pendingTracker  *pendingTracker
+	streamSubjects  []string
+	streamBucket    *ratelimit.Bucket
+	recorded        []int // bytes recorded per flush
 }
 
 func (m *mockRateLimiterManager) GetLimiter(username string) *ratelimit.Bucket {
@@ -340,6 +351,75 @@ func (m *mockRateLimiterManager) GetLimiter(username string) *ratelimit.Bucket {
 	return ratelimit.NewBucketWithRate(1000, 1000)
 }
 
+func (m *mockRateLimiterManager) GetConnectionLimiters(username, client, country string) []*ratelimit.Bucket {
+	return nil
+}
+
+func (m *mockRateLimiterManager) GetControlLimiter(username string) *ratelimit.Bucket {
+	return m.controlBucket
+}
+
+func (m *mockRateLimiterManager) MessageClass(username, tag, subject string, size int) limitClass {
+	switch {
+	case matchesAny(m.controlSubjects, subject):
+		return classControl
+	case matchesAny(m.objectSubjects, subject):
+		return classObject
+	}
+	return classBulk
+}
+
+func (m *mockRateLimiterManager) GetObjectLimiter(username string) *ratelimit.Bucket {
+	return m.objectBucket
+}
+
+func (m *mockRateLimiterManager) GetPendingTracker(username string) *pendingTracker {
+	return m.pendingTracker
+}
+
+func (m *mockRateLimiterManager) IsBypassed(username string, claims map[string]interface{}) bool {
+	return false
+}
+
+func (m *mockRateLimiterManager) UsesClaims() bool { return false }
+
+func (m *mockRateLimiterManager) IsKnownUser(username string) bool { return username == "alice" }
+
+func (m *mockRateLimiterManager) NewConnectionQuota(username string, limiter *ratelimit.Bucket) *connQuota {
+	return nil
+}
+
+func (m *mockRateLimiterManager) GetBurstCredit(username string) *burstCredit { return nil }
+
+func (m *mockRateLimiterManager) Scale(username string) float64 {
+	return 1
+}
+
+func (m *mockRateLimiterManager) RampFactor(limiter *ratelimit.Bucket) float64 {
+	return 1
+}
+
+func (m *mockRateLimiterManager) RecordBytes(username string, n int) {
+	m.recorded = append(m.recorded, n)
+}
+
+func (m *mockRateLimiterManager) ObservePublish(username, subject string) {}
+
+func (m *mockRateLimiterManager) Bind(username string, rebind func()) func() { return func() {} }
+
+func (m *mockRateLimiterManager) Frozen(username, subject string) bool { return false }
+
+func (m *mockRateLimiterManager) GetDeliveryLimiter(username string) *ratelimit.Bucket { return nil }
+
+func (m *mockRateLimiterManager) GetQueueLimiter(username, queue string) *ratelimit.Bucket { return nil }
+
+func (m *mockRateLimiterManager) GetStreamLimiter(subject string) (string, *ratelimit.Bucket) {
+	if m.streamBucket != nil && matchesAny(m.streamSubjects, subject) {
+		return "TEST", m.streamBucket
+	}
+	return "", nil
+}
+
 func TestClientMessageParser_LargePayload(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -580,7 +660,8 @@ func TestClientMessageParser_RateLimitingWithLargeMessages(t *testing.T) {
 	var output bytes.Buffer
 
 	// Create a very restrictive rate limiter (10 bytes/second)
-	bucket := ratelimit.NewBucketWithRate(10, 10)
+	clock := newFakeClock()
+	bucket := ratelimit.NewBucketWithRateAndClock(10, 10, clock)
 
 	mockRLM := &mockRateLimiterManager{
 		bucket: bucket,
@@ -600,21 +681,23 @@ func TestClientMessageParser_RateLimitingWithLargeMessages(t *testing.T) {
 		&output,
 		mockRLM,
 	)
+	parser.SetClock(clock)
 
-	start := time.Now()
 	err := parser.ParseAndForward()
 	if err != nil {
 		t.Fatalf("ParseAndForward failed: %v", err)
 	}
-	elapsed := time.Since(start)
+	elapsed := clock.Slept()
 
 	if parser.GetUser() != "alice" {
 		t.Fatalf("Expected user 'alice', got %q", parser.GetUser())
 	}
 
-	// With 10 bytes/second rate limit and ~1000 byte message, 
-	// we should see significant delay (but actual timing depends on bucket state)
-	t.Logf("Rate limited large message took %v", elapsed)
+	// With 10 bytes/second rate limit and ~1000 byte message,
+	// we should see a delay of ~100 seconds
+	if elapsed < 100*time.Second {
+		t.Errorf("Expected at least 100s of throttling, got %v", elapsed)
+	}
 	
 	// Verify the message was forwarded correctly despite rate limiting
 	outputStr := output.String()
@@ -628,7 +711,8 @@ func TestClientMessageParser_RateLimitingAccuracy(t *testing.T) {
 	var output bytes.Buffer
 
 	// Create rate limiter with known capacity
-	bucket := ratelimit.NewBucketWithRate(100, 100) // 100 bytes/second
+	clock := newFakeClock()
+	bucket := ratelimit.NewBucketWithRateAndClock(100, 100, clock) // 100 bytes/second
 
 	mockRLM := &mockRateLimiterManager{
 		bucket: bucket,
@@ -654,15 +738,18 @@ func TestClientMessageParser_RateLimitingAccuracy(t *testing.T) {
 		&output,
 		mockRLM,
 	)
+	parser.SetClock(clock)
 
-	start := time.Now()
 	err := parser.ParseAndForward()
 	if err != nil {
 		t.Fatalf("ParseAndForward failed: %v", err)
 	}
-	elapsed := time.Since(start)
-	
-	t.Logf("Combined messages took %v", elapsed)
+
+	// Everything beyond the 100 byte burst is paced at 100 bytes/second
+	expected := time.Duration(output.Len()-100) * time.Second / 100
+	if elapsed := clock.Slept(); elapsed != expected {
+		t.Errorf("Expected %v of throttling, got %v", expected, elapsed)
+	}
 
 	// Verify all messages were processed correctly
 	outputStr := output.String()
@@ -673,3 +760,548 @@ func TestClientMessageParser_RateLimitingAccuracy(t *testing.T) {
 		}
 	}
 }
+
+func TestClientMessageParser_ControlLane(t *testing.T) {
+	var output bytes.Buffer
+
+	// Bulk bucket with a single token: any bulk write would block for seconds
+	bulk := ratelimit.NewBucketWithRate(0.1, 1)
+	control := ratelimit.NewBucketWithRate(1000000, 1000000)
+
+	mockRLM := &mockRateLimiterManager{
+		bucket:          bulk,
+		controlBucket:   control,
+		controlSubjects: []string{"$JS.ACK.>"},
+	}
+
+	input := "CONNECT {\"user\":\"alice\"}\r\nPING\r\nSUB foo 1\r\nPUB $JS.ACK.stream.1 2\r\nok\r\nPONG\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &output, mockRLM)
+
+	start := time.Now()
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Control traffic was throttled by the bulk limiter, took %v", elapsed)
+	}
+	if output.String() != input {
+		t.Errorf("Output doesn't match input.\nExpected: %q\nGot: %q", input, output.String())
+	}
+	if bulk.Available() != 1 {
+		t.Errorf("Expected bulk bucket untouched, available %d", bulk.Available())
+	}
+}
+
+func TestClientMessageParser_ObjectStore(t *testing.T) {
+	var output bytes.Buffer
+
+	// Bulk bucket with a single token: any bulk write would block for seconds
+	bulk := ratelimit.NewBucketWithRate(0.1, 1)
+	control := ratelimit.NewBucketWithRate(1000000, 1000000)
+	object := ratelimit.NewBucketWithRate(1, 1000000)
+
+	mockRLM := &mockRateLimiterManager{
+		bucket:         bulk,
+		controlBucket:  control,
+		objectBucket:   object,
+		objectSubjects: []string{"$O.>"},
+	}
+
+	chunk := strings.Repeat("x", 8192)
+	input := "CONNECT {\"user\":\"alice\"}\r\nPUB $O.files.C.abc 8192\r\n" + chunk + "\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &output, mockRLM)
+
+	start := time.Now()
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Object upload was throttled by the bulk limiter, took %v", elapsed)
+	}
+	if output.String() != input {
+		t.Errorf("Output doesn't match input")
+	}
+	if bulk.Available() != 1 {
+		t.Errorf("Expected bulk bucket untouched, available %d", bulk.Available())
+	}
+	if used := 1000000 - object.Available(); used < 8192 {
+		t.Errorf("Expected the object chunk charged to the object bucket, used %d", used)
+	}
+}
+
+func TestClientMessageParser_PayloadFraming(t *testing.T) {
+	var output countingWriter
+	mockRLM := &mockRateLimiterManager{}
+
+	// Payloads containing CRLF and protocol-like content must be forwarded
+	// as part of their frame, not parsed as protocol ops.
+	input := "PUB a 12\r\nPING\r\nPONG\r\n\r\n" +
+		"HPUB b 18 35\r\nNATS/1.0\r\nA: 1\r\n\r\nCONNECT {}\r\nPUB\r\n\r\n" +
+		"PUB c 0\r\n\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &output, mockRLM)
+
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if output.String() != input {
+		t.Errorf("Output doesn't match input.\nExpected: %q\nGot: %q", input, output.String())
+	}
+	if parser.GetUser() != "" {
+		t.Errorf("CONNECT inside a payload must not authenticate, got user %q", parser.GetUser())
+	}
+	if output.writes != 3 {
+		t.Errorf("Expected each frame flushed in a single write, got %d writes", output.writes)
+	}
+}
+
+// countingWriter records written data and the number of writes.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestClientMessageParser_PauseReads(t *testing.T) {
+	var output bytes.Buffer
+
+	// Put the bucket 100 tokens in debt, i.e. ~100ms at 1000 bytes/second
+	bucket := ratelimit.NewBucketWithRate(1000, 100)
+	bucket.Take(200)
+
+	mockRLM := &mockRateLimiterManager{bucket: bucket}
+	pausesBefore := metricReadPauses.Get("pause-test")
+
+	// The reader only returns the PUB after CONNECT has been processed, so
+	// reading it must wait for the bucket to recover
+	input := io.MultiReader(
+		strings.NewReader("CONNECT {\"user\":\"pause-test\"}\r\n"),
+		strings.NewReader("PUB test 5\r\nhello\r\n"),
+	)
+	parser := NewClientMessageParser(input, &output, mockRLM)
+	parser.SetPauseReads(true)
+
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if got := metricReadPauses.Get("pause-test") - pausesBefore; got == 0 {
+		t.Error("Expected client reads to be paused while over budget")
+	}
+}
+
+func TestClientMessageParser_HandleService(t *testing.T) {
+	var output, client bytes.Buffer
+	mockRLM := &mockRateLimiterManager{}
+
+	input := "CONNECT {\"user\":\"alice\"}\r\n" +
+		"SUB _INBOX.abc.* 7\r\n" +
+		"PUB $PROXY.USAGE _INBOX.abc.1 3\r\nhi!\r\n" +
+		"PUB other 2\r\nok\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &output, mockRLM)
+	parser.HandleService("$PROXY.USAGE", func(user string, payload []byte) []byte {
+		return []byte(user + ":" + string(payload))
+	}, newClientWriter(&client))
+
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+
+	expected := "CONNECT {\"user\":\"alice\"}\r\nSUB _INBOX.abc.* 7\r\nPUB other 2\r\nok\r\n"
+	if output.String() != expected {
+		t.Errorf("Service request must not be forwarded.\nExpected: %q\nGot: %q", expected, output.String())
+	}
+	reply := "MSG _INBOX.abc.1 7 9\r\nalice:hi!\r\n"
+	if client.String() != reply {
+		t.Errorf("Expected reply %q, got %q", reply, client.String())
+	}
+	if !parser.checkFlow(nil) {
+		t.Error("Expected the answered request accounted for in the flow audit")
+	}
+}
+
+func TestClientMessageParser_GeneratedCreds(t *testing.T) {
+	env, err := creds.NewEnvironment("root", "app")
+	if err != nil {
+		t.Fatalf("NewEnvironment failed: %v", err)
+	}
+	token, _, err := env.UserJWT("alice")
+	if err != nil {
+		t.Fatalf("UserJWT failed: %v", err)
+	}
+
+	var output bytes.Buffer
+	input := "CONNECT {\"jwt\":\"" + token + "\",\"sig\":\"x\"}\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &output, &mockRateLimiterManager{})
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if parser.GetUser() != "alice" {
+		t.Errorf("Expected user alice, got %q", parser.GetUser())
+	}
+}
+
+func TestClientMessageParser_BinaryPayloads(t *testing.T) {
+	binary := make([]byte, 256)
+	for i := range binary {
+		binary[i] = byte(i)
+	}
+	large := bytes.Repeat([]byte("PING\r\nCONNECT {\"user\":\"x\"}\r\n"), 300) // spans buffer flushes
+
+	payloads := map[string][]byte{
+		"empty":                 {},
+		"crlf only":             []byte("\r\n"),
+		"double crlf":           []byte("\r\n\r\n"),
+		"lone cr":               []byte("\r"),
+		"lone lf":               []byte("\n"),
+		"ping":                  []byte("PING\r\n"),
+		"pong and ping":         []byte("PONG\r\nPING\r\n"),
+		"partial connect":       []byte("CONNECT {\"user\":\"mallory\""),
+		"full connect":          []byte("CONNECT {\"user\":\"mallory\"}\r\n"),
+		"connect jwt":           []byte("CONNECT {\"jwt\":\"a.b.c\"}\r\n"),
+		"pub header":            []byte("PUB other 5\r\nhello\r\n"),
+		"hpub header":           []byte("HPUB other 12 12\r\nNATS/1.0\r\n\r\n"),
+		"trailing cr":           []byte("data\r"),
+		"leading lf":            []byte("\ndata"),
+		"all byte values":       binary,
+		"protocol across flush": large,
+	}
+
+	for name, payload := range payloads {
+		for _, op := range []string{"PUB", "HPUB"} {
+			t.Run(op+"/"+name, func(t *testing.T) {
+				var frame string
+				if op == "PUB" {
+					frame = fmt.Sprintf("PUB test.subject reply %d\r\n%s\r\n", len(payload), payload)
+				} else {
+					hdr := "NATS/1.0\r\nX-Data: PING\r\n\r\n"
+					frame = fmt.Sprintf("HPUB test.subject %d %d\r\n%s%s\r\n", len(hdr), len(hdr)+len(payload), hdr, payload)
+				}
+				input := frame + "PING\r\n" + frame
+
+				for _, oneByte := range []bool{false, true} {
+					var output bytes.Buffer
+					var reader io.Reader = strings.NewReader(input)
+					if oneByte {
+						reader = iotest.OneByteReader(reader)
+					}
+					parser := NewClientMessageParser(reader, &output, &mockRateLimiterManager{})
+
+					if err := parser.ParseAndForward(); err != nil {
+						t.Fatalf("ParseAndForward failed: %v", err)
+					}
+					if output.String() != input {
+						t.Fatalf("Output doesn't match input (one byte reads: %t)", oneByte)
+					}
+					if parser.GetUser() != "" {
+						t.Errorf("Payload content must not authenticate, got user %q", parser.GetUser())
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestClientMessageParser_StreamCap(t *testing.T) {
+	// 10000 bytes/second with a 100 byte burst
+	mockRLM := &mockRateLimiterManager{
+		streamSubjects: []string{"orders.>"},
+		streamBucket:   ratelimit.NewBucketWithRate(10000, 100),
+	}
+	payload := strings.Repeat("x", 1000)
+
+	var output bytes.Buffer
+	input := fmt.Sprintf("PUB other 1000\r\n%s\r\n", payload)
+	start := time.Now()
+	if err := NewClientMessageParser(strings.NewReader(input), &output, mockRLM).ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Publish outside the stream shouldn't be capped, took %v", elapsed)
+	}
+
+	output.Reset()
+	input = fmt.Sprintf("PUB orders.new 1000\r\n%s\r\n", payload)
+	start = time.Now()
+	if err := NewClientMessageParser(strings.NewReader(input), &output, mockRLM).ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("Expected stream cap to delay the publish by ~90ms, took %v", elapsed)
+	}
+	if output.String() != input {
+		t.Errorf("Output doesn't match input")
+	}
+}
+
+func TestClientMessageParser_ChargesWholeMessages(t *testing.T) {
+	clock := newFakeClock()
+	mockRLM := &mockRateLimiterManager{bucket: ratelimit.NewBucketWithRateAndClock(1000, 1000, clock)}
+	connect := "CONNECT {\"user\":\"alice\"}\r\n"
+	pub := fmt.Sprintf("PUB big 10000\r\n%s\r\n", strings.Repeat("x", 10000))
+
+	var output bytes.Buffer
+	parser := NewClientMessageParser(strings.NewReader(connect+pub+"PING\r\n"), &output, mockRLM)
+	parser.SetClock(clock)
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if output.String() != connect+pub+"PING\r\n" {
+		t.Errorf("Output doesn't match input")
+	}
+	// The message spans three buffer flushes but is recorded once, whole
+	expected := []int{len(connect), len(pub), len("PING\r\n")}
+	if !reflect.DeepEqual(mockRLM.recorded, expected) {
+		t.Errorf("Expected bytes recorded per frame %v, got %v", expected, mockRLM.recorded)
+	}
+	// and charged whole: the bucket's burst covers 1000 bytes of it
+	if slept := clock.Slept(); slept < 9*time.Second {
+		t.Errorf("Expected the whole message charged, waited %v", slept)
+	}
+}
+
+func TestRateLimitedWriter_Rebind(t *testing.T) {
+	// Buckets refill slowly enough that only writes change what's available
+	const capacity = 1 << 30
+	alice := ratelimit.NewBucketWithRate(0.001, capacity)
+	bob := ratelimit.NewBucketWithRate(0.001, capacity)
+	full := func() float64 { return 1 }
+	half := func() float64 { return 0.5 }
+
+	rlw := NewRateLimitedWriter(io.Discard)
+	rlw.Rebind("alice", alice, nil, nil, nil, nil, full)
+
+	const writes, size = 10000, 100
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// Switch identity mid-stream; bob's writes are charged double
+			if i%2 == 0 {
+				rlw.Rebind("bob", bob, nil, nil, nil, nil, half)
+			} else {
+				rlw.Rebind("alice", alice, nil, nil, nil, nil, full)
+			}
+		}
+	}()
+
+	data := make([]byte, size)
+	for i := 0; i < writes; i++ {
+		if _, err := rlw.Write(data); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	// Every write is charged to one identity with that identity's scale
+	aliceBytes := capacity - alice.Available()
+	bobBytes := (capacity - bob.Available()) / 2
+	if aliceBytes+bobBytes != writes*size {
+		t.Errorf("Expected %d bytes charged, got %d to alice and %d to bob", writes*size, aliceBytes, bobBytes)
+	}
+}
+
+func TestClientMessageParser_Reconnect(t *testing.T) {
+	var output bytes.Buffer
+	mockRLM := &mockRateLimiterManager{}
+
+	input := "CONNECT {\"user\":\"alice\"}\r\nPUB foo 2\r\nok\r\n" +
+		"CONNECT {\"user\":\"bob\"}\r\nPUB foo 2\r\nok\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &output, mockRLM)
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if output.String() != input {
+		t.Errorf("Output doesn't match input.\nExpected: %q\nGot: %q", input, output.String())
+	}
+
+	// A second CONNECT doesn't rebind the connection to another user
+	if user := parser.serverWriter.limits.Load().user; user != "alice" {
+		t.Errorf("Expected writer bound to alice, got %q", user)
+	}
+}
+
+func TestClientMessageParser_PolicyHook(t *testing.T) {
+	var output, client bytes.Buffer
+	mockRLM := &mockRateLimiterManager{}
+
+	large := strings.Repeat("x", 10000)
+	input := "CONNECT {\"user\":\"alice\"}\r\n" +
+		"PUB orders.new 2\r\nok\r\n" +
+		"HPUB secret.keys 12 14\r\nNATS/1.0\r\n\r\nok\r\n" +
+		"PUB secret.dump 10000\r\n" + large + "\r\n" +
+		"PUB other 2\r\nok\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &output, mockRLM)
+	hook := NewPolicyHook(PolicyHookConfig{}, nil, nil, func(user, subject string, size int) (string, string) {
+		if strings.HasPrefix(subject, "secret.") {
+			return "", "no secrets"
+		}
+		if subject == "orders.new" {
+			return "tenant-a." + subject, ""
+		}
+		return "", ""
+	})
+	parser.SetPolicyHook(hook, newClientWriter(&client))
+
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+
+	expected := "CONNECT {\"user\":\"alice\"}\r\nPUB tenant-a.orders.new 2\r\nok\r\nPUB other 2\r\nok\r\n"
+	if output.String() != expected {
+		t.Errorf("Expected rewritten and filtered output.\nExpected: %q\nGot: %q", expected, output.String())
+	}
+	errs := "-ERR 'Permissions Violation for Publish to \"secret.keys\"'\r\n" +
+		"-ERR 'Permissions Violation for Publish to \"secret.dump\"'\r\n"
+	if client.String() != errs {
+		t.Errorf("Expected permission violations %q, got %q", errs, client.String())
+	}
+	if !parser.checkFlow(nil) {
+		t.Error("Expected rewritten and rejected messages accounted for in the flow audit")
+	}
+	if parser.audit.msgsIn != 4 || parser.audit.msgsOut != 2 || parser.audit.msgsDropped != 2 {
+		t.Errorf("Expected 4 messages in, 2 out and 2 dropped, got %+v", parser.audit)
+	}
+}
+
+func TestClientMessageParser_PolicyHookLongLine(t *testing.T) {
+	var output bytes.Buffer
+	mockRLM := &mockRateLimiterManager{}
+
+	// A line over the buffer is partly forwarded before it's checked
+	subject := "secret." + strings.Repeat("x", 5000)
+	input := "CONNECT {\"user\":\"alice\"}\r\nPUB " + subject + " 2\r\nok\r\nPUB other 2\r\nok\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &output, mockRLM)
+	parser.SetPolicyHook(NewPolicyHook(PolicyHookConfig{}, nil, nil, func(user, subject string, size int) (string, string) {
+		if strings.HasPrefix(subject, "secret.") {
+			return "", "no secrets"
+		}
+		return "", ""
+	}), nil)
+
+	err := parser.ParseAndForward()
+	if closeReasonOf(err, true) != closePolicyRejected {
+		t.Fatalf("Expected the connection ended by policy, got %v", err)
+	}
+	if strings.Contains(output.String(), "other") {
+		t.Errorf("Expected nothing forwarded after the rejected publish, got %q", output.String())
+	}
+}
+
+func TestClientMessageParser_PolicyHookRejectsConnect(t *testing.T) {
+	var output bytes.Buffer
+	mockRLM := &mockRateLimiterManager{}
+
+	input := "CONNECT {\"user\":\"mallory\"}\r\nPUB foo 2\r\nok\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &output, mockRLM)
+	parser.SetPolicyHook(NewPolicyHook(PolicyHookConfig{}, nil, func(user string, claims map[string]interface{}) (int64, string) {
+		return 0, "banned"
+	}, nil), nil)
+
+	err := parser.ParseAndForward()
+	if closeReasonOf(err, true) != closePolicyRejected {
+		t.Fatalf("Expected the connection rejected by policy, got %v", err)
+	}
+	if output.Len() != 0 {
+		t.Errorf("Expected nothing forwarded for a rejected connection, got %q", output.String())
+	}
+}
+
+func TestClientMessageParser_RepublishGuard(t *testing.T) {
+	var output bytes.Buffer
+	// Practically no refill: whatever is taken from the bucket stays missing
+	bucket := ratelimit.NewBucketWithRate(0.001, 1000000)
+	mockRLM := &mockRateLimiterManager{bucket: bucket}
+
+	connect := "CONNECT {\"user\":\"alice\"}\r\n"
+	frame := "PUB loop 2\r\nok\r\n"
+	input := connect + strings.Repeat(frame, 3)
+	parser := NewClientMessageParser(strings.NewReader(input), &output, mockRLM)
+	parser.SetRepublishGuard(newRepublishGuard(RepublishGuardConfig{Threshold: 2, Action: RepublishThrottle, Penalty: 10}))
+
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if output.String() != input {
+		t.Errorf("Expected repeated frames to still be forwarded")
+	}
+
+	// The third frame is over the threshold and charged 10 times its size
+	expected := int64(len(connect) + 2*len(frame) + 10*len(frame))
+	if used := 1000000 - bucket.Available(); used != expected {
+		t.Errorf("Expected %d bytes charged, got %d", expected, used)
+	}
+}
+
+func TestClientMessageParser_PayloadSampling(t *testing.T) {
+	var output bytes.Buffer
+	mockRLM := &mockRateLimiterManager{bucket: ratelimit.NewBucketWithRate(1000000, 1000000)}
+
+	input := "CONNECT {\"user\":\"sampled\"}\r\n" +
+		"PUB a 7\r\n{\"a\":1}\r\n" +
+		"PUB b 4\r\ntext\r\n" +
+		"HPUB c 12 19\r\nNATS/1.0\r\n\r\n{\"c\":3}\r\n" +
+		"PUB d 5000\r\n" + strings.Repeat("x", 5000) + "\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &output, mockRLM)
+	parser.SetPayloadSampling(PayloadSamplingConfig{Every: 1, PrefixBytes: 16})
+
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if output.String() != input {
+		t.Errorf("Expected sampling not to change the output")
+	}
+	for typ, expect := range map[string]int64{"json": 2, "text": 2} {
+		if got := metricPayloadSamples.Get("sampled", typ); got != expect {
+			t.Errorf("Expected %d %s samples, got %d", expect, typ, got)
+		}
+	}
+}
+
+func TestClientMessageParser_ClientInfo(t *testing.T) {
+	var output bytes.Buffer
+	mockRLM := &mockRateLimiterManager{bucket: ratelimit.NewBucketWithRate(1000000, 1000000)}
+
+	input := "CONNECT {\"user\":\"alice\",\"lang\":\"rust\",\"version\":\"0.99.1\",\"name\":\"billing\"}\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &output, mockRLM)
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+
+	expect := ClientInfo{Lang: "rust", Version: "0.99.1", Name: "billing"}
+	if got := parser.GetClient(); got != expect {
+		t.Errorf("Expected client %+v, got %+v", expect, got)
+	}
+	if got := metricClientConnections.Get("rust", "0.99.1"); got != 1 {
+		t.Errorf("Expected 1 rust 0.99.1 connection, got %d", got)
+	}
+}
+
+func TestClientMessageParser_ProxyTag(t *testing.T) {
+	var output bytes.Buffer
+	mockRLM := &mockRateLimiterManager{bucket: ratelimit.NewBucketWithRate(1000000, 1000000)}
+
+	connect := "CONNECT {\"user\":\"alice\",\"proxy_tag\":\"etl\"}\r\n"
+	pub := "PUB a 5\r\nhello\r\n"
+	parser := NewClientMessageParser(strings.NewReader(connect+pub), &output, mockRLM)
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+
+	if got := parser.GetClient().Tag; got != "etl" {
+		t.Errorf("Expected tag etl, got %q", got)
+	}
+	if got := metricTagBytes.Get("etl"); got != int64(len(connect+pub)) {
+		t.Errorf("Expected %d bytes tagged etl, got %d", len(connect+pub), got)
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxPause bounds how long forwarding may be paused, so a pause nobody
+// resumed can't stall every client for long.
+const maxPause = time.Minute
+
+// pauseGate holds all forwarding to the upstream while paused, e.g. for a few
+// seconds of upstream failover. Clients are pushed back through their
+// connections' buffers instead of erroring, and upstream dials, reconnects
+// included, wait for the failover to complete. The zero value isn't paused.
+type pauseGate struct {
+	mu      sync.Mutex
+	until   time.Time
+	resumed chan struct{} // closed on resume, nil while not paused
+	gen     int           // incremented on every pause, so stale timers don't resume
+}
+
+// pause pauses forwarding for d, or extends or shortens a pause to end d from
+// now. It returns at once, with the time the pause ends.
+func (g *pauseGate) pause(d time.Duration) time.Time {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+		metricForwardingPaused.Set(1)
+	}
+	g.until = time.Now().Add(d)
+	g.gen++
+	gen := g.gen
+	time.AfterFunc(d, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.gen == gen && g.resumeLocked() {
+			log.Info().Msg("Forwarding resumed at the end of the pause")
+		}
+	})
+	return g.until
+}
+
+// resume resumes forwarding, reporting whether it was paused.
+func (g *pauseGate) resume() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumeLocked()
+}
+
+func (g *pauseGate) resumeLocked() bool {
+	if g.resumed == nil {
+		return false
+	}
+	close(g.resumed)
+	g.resumed = nil
+	metricForwardingPaused.Set(0)
+	return true
+}
+
+// paused returns when the current pause ends, and whether forwarding is
+// paused.
+func (g *pauseGate) paused() (time.Time, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.until, g.resumed != nil
+}
+
+// wait waits while forwarding is paused. A nil gate never pauses.
+func (g *pauseGate) wait() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+}
+
+// SetPauseGate holds the client's frames while gate is paused.
+func (c *ClientMessageParser) SetPauseGate(gate *pauseGate) {
+	c.pause = gate
+}
+
+// Pause describes a pause of forwarding as served by the admin API.
+type Pause struct {
+	Paused bool       `json:"paused"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// pauseStatus returns the current pause of the proxy's forwarding.
+func (p *Proxy) pauseStatus() Pause {
+	until, paused := p.pause.paused()
+	if !paused {
+		return Pause{}
+	}
+	return Pause{Paused: true, Until: &until}
+}
+
+func (p *Proxy) handlePause(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizeAdmin(w, r, scopeRead) {
+		return
+	}
+	writeJSON(w, http.StatusOK, p.pauseStatus())
+}
+
+// handleStartPause pauses forwarding of the proxy and its routes.
+func (p *Proxy) handleStartPause(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizeAdmin(w, r, scopeWrite) {
+		return
+	}
+	var req struct {
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid pause request")
+		return
+	}
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d <= 0 || d > maxPause {
+		writeError(w, http.StatusBadRequest, "duration must be positive and at most "+maxPause.String()+", e.g. \"5s\"")
+		return
+	}
+
+	before := p.pauseStatus()
+	p.pause.pause(d)
+	for _, route := range p.routes {
+		route.pause.pause(d)
+	}
+	resp := p.pauseStatus()
+	auditChange(r, before, resp)
+	log.Warn().Str("audit", "pause").Dur("duration", d).Str("remote", r.RemoteAddr).Msg("Forwarding paused")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleResume resumes forwarding of the proxy and its routes before the
+// pause ends.
+func (p *Proxy) handleResume(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizeAdmin(w, r, scopeWrite) {
+		return
+	}
+	before := p.pauseStatus()
+	if !before.Paused {
+		// Routes are paused along with the proxy, and never on their own
+		writeError(w, http.StatusConflict, "not paused")
+		return
+	}
+	p.pause.resume()
+	for _, route := range p.routes {
+		route.pause.resume()
+	}
+	auditChange(r, before, Pause{})
+	log.Info().Str("audit", "pause").Str("remote", r.RemoteAddr).Msg("Forwarding resumed")
+	writeJSON(w, http.StatusOK, Pause{})
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestClientMessageParser_Paused(t *testing.T) {
+	var gate pauseGate
+	gate.pause(time.Minute)
+	input := "CONNECT {\"user\":\"alice\"}\r\nPUB foo 2\r\nok\r\n"
+	var output lockedBuffer
+	parser := NewClientMessageParser(strings.NewReader(input), &output, &mockRateLimiterManager{})
+	parser.SetPauseGate(&gate)
+	done := make(chan error, 1)
+	go func() { done <- parser.ParseAndForward() }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Expected forwarding held while paused, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if output.String() != "" {
+		t.Errorf("Expected nothing forwarded while paused, got %q", output.String())
+	}
+	gate.resume()
+	if err := <-done; err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if output.String() != input {
+		t.Errorf("Expected everything forwarded once resumed, got %q", output.String())
+	}
+}
+
+func TestPauseGate_Expires(t *testing.T) {
+	var gate pauseGate
+	gate.pause(time.Hour)
+	// Shortened by a new pause, the first one's timer doesn't end it
+	gate.pause(20 * time.Millisecond)
+	resumed := make(chan struct{})
+	go func() {
+		gate.wait()
+		close(resumed)
+	}()
+	select {
+	case <-resumed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected forwarding resumed at the end of the pause")
+	}
+	if _, paused := gate.paused(); paused {
+		t.Error("Expected the pause over")
+	}
+}
+
+func TestAdmin_Pause(t *testing.T) {
+	p := newTestProxy(&Config{DefaultBandwidth: 1024, AdminToken: "root-token"})
+	route := newTestProxy(&Config{DefaultBandwidth: 1024})
+	p.routes = map[string]*Proxy{"a.example.com": route}
+	do := func(method, body string) (int, Pause) {
+		t.Helper()
+		req := httptest.NewRequest(method, "/api/v1/pause", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer root-token")
+		rec := httptest.NewRecorder()
+		p.AdminHandler().ServeHTTP(rec, req)
+		var pause Pause
+		json.Unmarshal(rec.Body.Bytes(), &pause)
+		return rec.Code, pause
+	}
+
+	if code, _ := do(http.MethodPost, `{"duration": "1h"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected pauses longer than %v refused, got %d", maxPause, code)
+	}
+	if code, pause := do(http.MethodPost, `{"duration": "5s"}`); code != http.StatusOK || !pause.Paused || time.Until(*pause.Until) > 5*time.Second {
+		t.Errorf("Expected forwarding paused for 5s, got %d %+v", code, pause)
+	}
+	if _, pause := do(http.MethodGet, ""); !pause.Paused {
+		t.Error("Expected the pause listed")
+	}
+	if code, pause := do(http.MethodDelete, ""); code != http.StatusOK || pause.Paused {
+		t.Errorf("Expected forwarding resumed, got %d %+v", code, pause)
+	}
+	if _, paused := route.pause.paused(); paused {
+		t.Error("Expected the route resumed along with the proxy")
+	}
+
+	// Refused when not paused, leaving routes alone
+	route.pause.pause(5 * time.Second)
+	defer route.pause.resume()
+	if code, _ := do(http.MethodDelete, ""); code != http.StatusConflict {
+		t.Errorf("Expected resuming refused when not paused, got %d", code)
+	}
+	if _, paused := route.pause.paused(); !paused {
+		t.Error("Expected a refused resume to leave the route paused")
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var errPendingLimitExceeded = errors.New("maximum pending bytes exceeded")
+
+// pendingTracker bounds the bytes read from a user's clients but not yet
+// forwarded upstream, across all of the user's connections.
+type pendingTracker struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending int64
+	max     int64
+	close   bool // close connections over the limit instead of pausing reads
+}
+
+func newPendingTracker(max int64, close bool) *pendingTracker {
+	t := &pendingTracker{max: max, close: close}
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+func (t *pendingTracker) add(n int64) {
+	t.mu.Lock()
+	t.pending += n
+	t.mu.Unlock()
+}
+
+func (t *pendingTracker) release(n int64) {
+	t.mu.Lock()
+	t.pending -= n
+	t.mu.Unlock()
+	t.cond.Broadcast()
+}
+
+// acquire is called before a connection reads more client data. It blocks
+// while the user is at the limit, or returns errPendingLimitExceeded if
+// connections over the limit should be closed instead.
+func (t *pendingTracker) acquire() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.pending >= t.max {
+		if t.close {
+			return errPendingLimitExceeded
+		}
+		t.cond.Wait()
+	}
+	return nil
+}
+
+// Pending returns the bytes currently pending for the user.
+func (t *pendingTracker) Pending() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pending
+}
+
+// pendingReader accounts bytes read from a client connection against the
+// user's pendingTracker until they are released after being forwarded.
+type pendingReader struct {
+	reader   io.Reader
+	tracker  *pendingTracker
+	reserved int64
+}
+
+func (pr *pendingReader) Read(p []byte) (int, error) {
+	n, err := pr.reader.Read(p)
+	if pr.tracker != nil && n > 0 {
+		pr.reserved += int64(n)
+		pr.tracker.add(int64(n))
+	}
+	return n, err
+}
+
+// adopt counts n bytes read before the tracker was set as if read now.
+func (pr *pendingReader) adopt(n int64) {
+	if pr.tracker != nil && n > 0 {
+		pr.reserved += n
+		pr.tracker.add(n)
+	}
+}
+
+// release releases up to n reserved bytes after they have been forwarded.
+func (pr *pendingReader) release(n int64) {
+	if pr.tracker == nil {
+		return
+	}
+	n = min(n, pr.reserved)
+	if n > 0 {
+		pr.reserved -= n
+		pr.tracker.release(n)
+	}
+}
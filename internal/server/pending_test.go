@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+func TestPendingTracker_ParserLimit(t *testing.T) {
+	input := "CONNECT {\"user\":\"alice\"}\r\nPUB test 5\r\nhello\r\n"
+
+	t.Run("Close over limit", func(t *testing.T) {
+		tracker := newPendingTracker(10, true)
+		tracker.add(10) // another connection of the user holds the budget
+
+		var output bytes.Buffer
+		parser := NewClientMessageParser(strings.NewReader(input), &output, &mockRateLimiterManager{pendingTracker: tracker})
+
+		err := parser.ParseAndForward()
+		if !errors.Is(err, errPendingLimitExceeded) {
+			t.Fatalf("Expected errPendingLimitExceeded, got %v", err)
+		}
+		if tracker.Pending() != 10 {
+			t.Errorf("Expected closed connection to release its bytes, pending %d", tracker.Pending())
+		}
+	})
+
+	t.Run("Pause until drained", func(t *testing.T) {
+		tracker := newPendingTracker(10, false)
+		tracker.add(10)
+
+		var output bytes.Buffer
+		parser := NewClientMessageParser(strings.NewReader(input), &output, &mockRateLimiterManager{pendingTracker: tracker})
+
+		done := make(chan error, 1)
+		go func() { done <- parser.ParseAndForward() }()
+
+		select {
+		case err := <-done:
+			t.Fatalf("Expected reads to pause over the limit, returned %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		tracker.release(10)
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("ParseAndForward failed: %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Reads didn't resume after pending bytes drained")
+		}
+
+		if output.String() != input {
+			t.Errorf("Output doesn't match input.\nExpected: %q\nGot: %q", input, output.String())
+		}
+		if tracker.Pending() != 0 {
+			t.Errorf("Expected all pending bytes released, got %d", tracker.Pending())
+		}
+	})
+}
+
+func TestPendingTracker_ReleasedOnDisconnect(t *testing.T) {
+	for name, upstream := range map[string]io.Writer{
+		"Client gone mid-payload": io.Discard,
+		"Upstream write failed":   failingWriter{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tracker := newPendingTracker(1<<20, false)
+			mockRLM := &mockRateLimiterManager{
+				bucket:         ratelimit.NewBucketWithRate(1<<20, 1<<20),
+				pendingTracker: tracker,
+			}
+
+			// The client goes away partway through a PUB payload
+			input := "CONNECT {\"user\":\"alice\"}\r\nPUB foo 5000\r\n" + strings.Repeat("x", 1000)
+			parser := NewClientMessageParser(strings.NewReader(input), upstream, mockRLM)
+			parser.ParseAndForward()
+			if pending := tracker.Pending(); pending != 0 {
+				t.Errorf("Expected the bytes never forwarded released, %d pending", pending)
+			}
+		})
+	}
+}
+
+// failingWriter fails every write, like a broken upstream connection.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"plugin"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PolicyHookConfig configures site-specific policy hooks loaded from a Go
+// plugin (go build -buildmode=plugin). The plugin exports either or both of
+//
+//	func Connect(user string, claims map[string]interface{}) (bandwidth int64, reject string)
+//	func Publish(user, subject string, size int) (rewrite, reject string)
+//
+// Connect runs when a client authenticates and may set the user's bandwidth,
+// over the configured one but under admin overrides, or reject the
+// connection. Its claims may be shared with other connections
+// and must not be modified. Publish runs for every message and may rewrite
+// its subject or reject it. A non-empty reject is the reason logged.
+//
+// Hooks fail open: a hook that panics or exceeds its budget doesn't affect
+// the traffic. Only Go plugins are supported; running WASM modules would need
+// a WASM runtime this proxy doesn't include.
+type PolicyHookConfig struct {
+	Plugin string `yaml:"plugin"`
+	// ConnectBudget bounds how long a connection waits for Connect. Defaults to 50ms.
+	ConnectBudget time.Duration `yaml:"connect_budget"`
+	// MaxConnectCalls bounds the Connect calls in flight, counting those
+	// still running past their budget. Connections beyond it aren't
+	// decided on. Defaults to 64.
+	MaxConnectCalls int `yaml:"max_connect_calls"`
+	// PublishBudget is the time Publish may take per message. Publish runs
+	// inline, so overruns are counted rather than interrupted, and after
+	// MaxOverruns of them the Publish hook is disabled. Defaults to 50µs.
+	PublishBudget time.Duration `yaml:"publish_budget"`
+	// MaxOverruns defaults to 100.
+	MaxOverruns int64 `yaml:"max_overruns"`
+}
+
+// ConnectHook decides on an authenticated client, see PolicyHookConfig.
+type ConnectHook func(user string, claims map[string]interface{}) (bandwidth int64, reject string)
+
+// PublishHook decides on a published message, see PolicyHookConfig.
+type PublishHook func(user, subject string, size int) (rewrite, reject string)
+
+// errPolicyRejected is returned for traffic a policy hook rejected.
+var errPolicyRejected = errors.New("rejected by policy hook")
+
+// PolicyHook runs site-specific hooks within their budgets.
+type PolicyHook struct {
+	cfg     PolicyHookConfig
+	rlm     *RateLimiterManager
+	connect ConnectHook
+	publish PublishHook
+
+	calls           chan struct{} // a slot per Connect call in flight
+	overruns        atomic.Int64
+	publishDisabled atomic.Bool
+}
+
+// NewPolicyHook creates a policy hook running connect and publish, either of
+// which may be nil. Bandwidths decided by connect are applied to rlm.
+func NewPolicyHook(cfg PolicyHookConfig, rlm *RateLimiterManager, connect ConnectHook, publish PublishHook) *PolicyHook {
+	if cfg.ConnectBudget <= 0 {
+		cfg.ConnectBudget = 50 * time.Millisecond
+	}
+	if cfg.PublishBudget <= 0 {
+		cfg.PublishBudget = 50 * time.Microsecond
+	}
+	if cfg.MaxOverruns <= 0 {
+		cfg.MaxOverruns = 100
+	}
+	if cfg.MaxConnectCalls <= 0 {
+		cfg.MaxConnectCalls = 64
+	}
+	return &PolicyHook{cfg: cfg, rlm: rlm, connect: connect, publish: publish, calls: make(chan struct{}, cfg.MaxConnectCalls)}
+}
+
+// LoadPolicyHook loads the hooks of the configured plugin.
+func LoadPolicyHook(cfg PolicyHookConfig, rlm *RateLimiterManager) (*PolicyHook, error) {
+	p, err := plugin.Open(cfg.Plugin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open policy plugin: %w", err)
+	}
+
+	var connect ConnectHook
+	if sym, err := p.Lookup("Connect"); err == nil {
+		fn, ok := sym.(func(string, map[string]interface{}) (int64, string))
+		if !ok {
+			return nil, fmt.Errorf("policy plugin Connect has type %T", sym)
+		}
+		connect = fn
+	}
+	var publish PublishHook
+	if sym, err := p.Lookup("Publish"); err == nil {
+		fn, ok := sym.(func(string, string, int) (string, string))
+		if !ok {
+			return nil, fmt.Errorf("policy plugin Publish has type %T", sym)
+		}
+		publish = fn
+	}
+	if connect == nil && publish == nil {
+		return nil, fmt.Errorf("policy plugin %s exports neither Connect nor Publish", cfg.Plugin)
+	}
+	log.Info().Str("plugin", cfg.Plugin).Bool("connect", connect != nil).Bool("publish", publish != nil).
+		Msg("Loaded policy plugin")
+	return NewPolicyHook(cfg, rlm, connect, publish), nil
+}
+
+// Connect runs the connect hook for an authenticated user, applying the
+// bandwidth it decides. It returns errPolicyRejected if the user is rejected.
+func (h *PolicyHook) Connect(user string, claims map[string]interface{}) error {
+	d, ok := h.decideConnect(user, claims)
+	if !ok {
+		return nil
+	}
+	return h.applyConnect(user, d)
+}
+
+// connectDecision is what the connect hook decided about a user.
+type connectDecision struct {
+	bandwidth int64
+	reject    string
+}
+
+// decideConnect runs the connect hook for a user within its budget. It
+// returns false without a connect hook, if the hook overran its budget or if
+// too many calls are in flight, e.g. hung past their budget.
+func (h *PolicyHook) decideConnect(user string, claims map[string]interface{}) (connectDecision, bool) {
+	if h.connect == nil {
+		return connectDecision{}, false
+	}
+	select {
+	case h.calls <- struct{}{}:
+	default:
+		log.Warn().Str("user", user).Int("max_connect_calls", h.cfg.MaxConnectCalls).
+			Msg("Too many policy Connect hook calls in flight, skipping it")
+		metricPolicyHookOverruns.Add(1, "connect")
+		return connectDecision{}, false
+	}
+
+	done := make(chan connectDecision, 1)
+	go func() {
+		defer func() { <-h.calls }()
+		defer func() {
+			if r := recover(); r != nil {
+				log.Error().Interface("panic", r).Str("user", user).Msg("Policy Connect hook panicked")
+				done <- connectDecision{}
+			}
+		}()
+		bandwidth, reject := h.connect(user, claims)
+		done <- connectDecision{bandwidth, reject}
+	}()
+
+	select {
+	case d := <-done:
+		return d, true
+	case <-time.After(h.cfg.ConnectBudget):
+		log.Warn().Str("user", user).Dur("budget", h.cfg.ConnectBudget).Msg("Policy Connect hook exceeded its budget")
+		metricPolicyHookOverruns.Add(1, "connect")
+		return connectDecision{}, false
+	}
+}
+
+// applyConnect applies a connect decision to a connection of user,
+// returning errPolicyRejected if it rejects the user.
+func (h *PolicyHook) applyConnect(user string, d connectDecision) error {
+	if d.reject != "" {
+		log.Info().Str("user", user).Str("reason", d.reject).Msg("Connection rejected by policy hook")
+		metricPolicyHookRejections.Add(1, "connect")
+		return errPolicyRejected
+	}
+	if d.bandwidth > 0 && h.rlm != nil {
+		h.rlm.SetHookBandwidth(user, d.bandwidth)
+	}
+	return nil
+}
+
+// Publish runs the publish hook for a message. It returns the subject to
+// publish to, or errPolicyRejected if the message is rejected.
+func (h *PolicyHook) Publish(user, subject string, size int) (result string, err error) {
+	if h.publish == nil || h.publishDisabled.Load() {
+		return subject, nil
+	}
+
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error().Interface("panic", r).Str("user", user).Msg("Policy Publish hook panicked")
+			result, err = subject, nil
+		}
+		if time.Since(start) > h.cfg.PublishBudget {
+			metricPolicyHookOverruns.Add(1, "publish")
+			if h.overruns.Add(1) == h.cfg.MaxOverruns {
+				h.publishDisabled.Store(true)
+				log.Error().Dur("budget", h.cfg.PublishBudget).Int64("overruns", h.cfg.MaxOverruns).
+					Msg("Policy Publish hook keeps exceeding its budget, disabling it")
+			}
+		}
+	}()
+
+	rewrite, reject := h.publish(user, subject, size)
+	if reject != "" {
+		log.Debug().Str("user", user).Str("subject", subject).Str("reason", reject).Msg("Message rejected by policy hook")
+		metricPolicyHookRejections.Add(1, "publish")
+		return "", errPolicyRejected
+	}
+	if rewrite != "" {
+		return rewrite, nil
+	}
+	return subject, nil
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPolicyHook_Connect(t *testing.T) {
+	rlm := NewRateLimiterManager(&Config{DefaultBandwidth: 1024})
+	hook := NewPolicyHook(PolicyHookConfig{ConnectBudget: 50 * time.Millisecond}, rlm,
+		func(user string, claims map[string]interface{}) (int64, string) {
+			switch user {
+			case "batch":
+				return 4096, ""
+			case "slow":
+				time.Sleep(time.Second)
+				return 0, "too late to matter"
+			case "broken":
+				panic("oops")
+			}
+			return 0, ""
+		}, nil)
+
+	if err := hook.Connect("batch", nil); err != nil {
+		t.Errorf("Expected batch accepted, got %v", err)
+	}
+	if bw := rlm.Bandwidth("batch"); bw != 4096 {
+		t.Errorf("Expected the hook to set batch's bandwidth to 4096, got %d", bw)
+	}
+	if overrides := rlm.Overrides(); len(overrides) != 0 {
+		t.Errorf("Expected the hook's limit not taken for an admin override, got %v", overrides)
+	}
+	// Admin overrides take precedence over the hook's decisions
+	rlm.SetBandwidth("batch", 8192)
+	if err := hook.Connect("batch", nil); err != nil || rlm.Bandwidth("batch") != 8192 {
+		t.Errorf("Expected the admin override kept, got %d, %v", rlm.Bandwidth("batch"), err)
+	}
+
+	before := metricPolicyHookOverruns.Get("connect")
+	start := time.Now()
+	if err := hook.Connect("slow", nil); err != nil {
+		t.Errorf("Expected a hook over budget to fail open, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the connection to wait at most the budget, waited %v", elapsed)
+	}
+	if metricPolicyHookOverruns.Get("connect") != before+1 {
+		t.Error("Expected the overrun to be counted")
+	}
+
+	if err := hook.Connect("broken", nil); err != nil {
+		t.Errorf("Expected a panicking hook to fail open, got %v", err)
+	}
+}
+
+func TestPolicyHook_MaxConnectCalls(t *testing.T) {
+	hung := make(chan struct{})
+	defer close(hung)
+	var calls atomic.Int32
+	hook := NewPolicyHook(PolicyHookConfig{ConnectBudget: 10 * time.Millisecond, MaxConnectCalls: 1}, nil,
+		func(user string, claims map[string]interface{}) (int64, string) {
+			calls.Add(1)
+			<-hung
+			return 0, ""
+		}, nil)
+
+	// The first call hangs past its budget, holding the only slot
+	for range 3 {
+		if err := hook.Connect("alice", nil); err != nil {
+			t.Errorf("Expected the connection accepted, got %v", err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected no calls beyond the hung one, got %d", n)
+	}
+}
+
+func TestPolicyHook_PublishOverruns(t *testing.T) {
+	calls := 0
+	hook := NewPolicyHook(PolicyHookConfig{PublishBudget: time.Nanosecond, MaxOverruns: 3}, nil, nil,
+		func(user, subject string, size int) (string, string) {
+			calls++
+			time.Sleep(time.Millisecond)
+			return "", "rejected"
+		})
+
+	for i := 0; i < 5; i++ {
+		hook.Publish("alice", "foo", 2)
+	}
+	if calls != 3 {
+		t.Errorf("Expected the hook disabled after 3 overruns, called %d times", calls)
+	}
+	if subject, err := hook.Publish("alice", "foo", 2); err != nil || subject != "foo" {
+		t.Errorf("Expected a disabled hook to pass messages through, got %q, %v", subject, err)
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PressureConfig configures tightening of all users' rates while the upstream
+// server reports slow consumers or high memory usage.
+type PressureConfig struct {
+	// MonitorURL is the upstream's /varz monitoring endpoint,
+	// e.g. "http://nats:8222/varz".
+	MonitorURL string `yaml:"monitor_url"`
+	// Interval between polls. Defaults to 5s.
+	Interval time.Duration `yaml:"interval"`
+	// Factor applied to all users' rates while under pressure. Defaults to 0.5.
+	Factor float64 `yaml:"factor"`
+	// MaxMem is the upstream memory usage in bytes above which it is
+	// considered under pressure. Zero disables the memory check.
+	MaxMem int64 `yaml:"max_mem"`
+}
+
+// upstreamVarz holds the fields of the upstream's /varz response used to
+// detect pressure.
+type upstreamVarz struct {
+	Mem           int64 `json:"mem"`
+	SlowConsumers int64 `json:"slow_consumers"`
+}
+
+// PressureMonitor polls the upstream's monitoring endpoint and scales all
+// users' effective rates down while the upstream is under pressure, restoring
+// them once the pressure clears.
+type PressureMonitor struct {
+	cfg    PressureConfig
+	rlm    *RateLimiterManager
+	client *http.Client
+
+	polled        bool
+	slowConsumers int64
+	underPressure bool
+}
+
+// NewPressureMonitor creates a monitor adjusting rlm's rate scale.
+func NewPressureMonitor(cfg PressureConfig, rlm *RateLimiterManager) *PressureMonitor {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Second
+	}
+	if cfg.Factor <= 0 || cfg.Factor > 1 {
+		cfg.Factor = 0.5
+	}
+	return &PressureMonitor{
+		cfg:    cfg,
+		rlm:    rlm,
+		client: &http.Client{Timeout: cfg.Interval},
+	}
+}
+
+// Run polls the upstream until ctx is cancelled.
+func (m *PressureMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.poll(ctx); err != nil {
+			log.Warn().Err(err).Str("url", m.cfg.MonitorURL).Msg("Failed to poll upstream monitoring endpoint")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll fetches the upstream's /varz once and updates the rate scale.
+func (m *PressureMonitor) poll(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.cfg.MonitorURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var varz upstreamVarz
+	if err := json.NewDecoder(resp.Body).Decode(&varz); err != nil {
+		return fmt.Errorf("failed to decode varz: %w", err)
+	}
+
+	newSlowConsumers := m.polled && varz.SlowConsumers > m.slowConsumers
+	highMem := m.cfg.MaxMem > 0 && varz.Mem > m.cfg.MaxMem
+	m.polled = true
+	m.slowConsumers = varz.SlowConsumers
+
+	pressure := newSlowConsumers || highMem
+	if pressure == m.underPressure {
+		return nil
+	}
+	m.underPressure = pressure
+
+	if pressure {
+		log.Warn().Int64("mem", varz.Mem).Int64("slowConsumers", varz.SlowConsumers).
+			Float64("factor", m.cfg.Factor).Msg("Upstream under pressure, tightening rates")
+		m.rlm.SetScale(m.cfg.Factor)
+	} else {
+		log.Info().Msg("Upstream pressure cleared, restoring rates")
+		m.rlm.SetScale(1)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPressureMonitor_Poll(t *testing.T) {
+	var varz upstreamVarz
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(varz)
+	}))
+	defer ts.Close()
+
+	rlm := NewRateLimiterManager(&Config{DefaultBandwidth: 1024})
+	m := NewPressureMonitor(PressureConfig{MonitorURL: ts.URL, Factor: 0.25, MaxMem: 1000}, rlm)
+
+	steps := []struct {
+		name          string
+		mem           int64
+		slowConsumers int64
+		expectScale   float64
+	}{
+		{"Initial poll with existing slow consumers", 100, 5, 1},
+		{"New slow consumers", 100, 7, 0.25},
+		{"Slow consumers unchanged", 100, 7, 1},
+		{"High memory", 2000, 7, 0.25},
+		{"Memory back to normal", 500, 7, 1},
+	}
+
+	for _, step := range steps {
+		varz = upstreamVarz{Mem: step.mem, SlowConsumers: step.slowConsumers}
+		if err := m.poll(context.Background()); err != nil {
+			t.Fatalf("%s: poll failed: %v", step.name, err)
+		}
+		if got := rlm.GlobalScale(); got != step.expectScale {
+			t.Errorf("%s: expected scale %v, got %v", step.name, step.expectScale, got)
+		}
+	}
+}
@@ -1,26 +1,58 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog/log"
-	"gopkg.in/yaml.v3"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 )
 
-type Config struct {
-	DefaultBandwidth int64            `yaml:"default_bandwidth"`
-	Users            map[string]int64 `yaml:"users"`
-}
+// DialFunc opens a connection to the upstream NATS server.
+type DialFunc func() (net.Conn, error)
 
 type Proxy struct {
 	upstreamHost   string
 	upstreamPort   int
-	config         *Config
+	config         atomic.Pointer[Config] // immutable snapshot, replaced whole
 	rateLimiterMgr *RateLimiterManager
+	dial           DialFunc
+	shadowDial     DialFunc           // nil unless a shadow upstream is configured
+	upstreamTLS    *tls.Config        // nil unless upstream_tls is configured
+	capture        *trafficCapture    // nil unless traffic capture is configured
+	history        *throughputHistory // nil unless recommendations are configured
+	soft           *softLimits        // nil unless soft limits are configured
+	dialSlots      chan struct{}      // bounds concurrent upstream dials, nil for no bound
+	workers        *parseWorkers      // nil unless parse workers are bounded
+	identities     *identityCache     // nil unless JWT identities are cached
+	writeSched     *writeScheduler    // nil unless upstream writes are scheduled
+	budget         *resourceBudget    // nil unless a resource budget is configured
+	memory         *memoryCap         // nil unless buffer memory is capped, shared with routes
+	labels         *clientLabels      // bound of client-announced metric labels, shared with routes
+	middleware     []namedMiddleware  // published messages pass through, see Use
+	policy         *PolicyHook
+	guard          *republishGuard
+	geo            GeoLocator                   // nil unless geoip is configured
+	tls            atomic.Pointer[tls.Config]   // nil unless TLS is terminated at the proxy
+	secrets        atomic.Pointer[adminSecrets] // nil unless admin token files are configured
+	upstreamAuth   atomic.Pointer[upstreamAuth] // nil unless upstream_auth is configured
+	routes         map[string]*Proxy            // proxies of other upstreams, by SNI server name
+	acme           *autocert.Manager            // nil unless ACME is configured
+	conns          connRegistry                 // client connections being served
+	lameDuck       lameDuckState
+	pause          pauseGate  // holds forwarding while paused through the admin API
+	stateMu        sync.Mutex // serializes writing the state file
+	start          time.Time
 }
 
 type SwapReader struct {
@@ -41,82 +73,455 @@ func (s *SwapReader) Swap(r io.Reader) {
 	s.mu.Unlock()
 }
 
-func LoadConfig(path string) (*Config, error) {
-	f, err := os.Open(path)
+func NewProxy(upstreamHost string, upstreamPort int, configPath string) (*Proxy, error) {
+	config, err := LoadConfig(configPath)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to load config: %w", err)
 	}
-	defer f.Close()
-	var cfg Config
-	decoder := yaml.NewDecoder(f)
-	if err := decoder.Decode(&cfg); err != nil {
+	p, err := newProxy(upstreamHost, upstreamPort, config)
+	if err != nil {
 		return nil, err
 	}
-	if cfg.DefaultBandwidth == 0 {
-		cfg.DefaultBandwidth = 10 * 1024 * 1024 // 10MB/s
+	if config.TLS != nil {
+		if config.TLS.ACME != nil {
+			p.acme = newACMEManager(config.TLS.ACME)
+		}
+		if err := p.loadTLS(); err != nil {
+			return nil, err
+		}
+		if p.routes, err = newRoutes(config.TLS.Routes); err != nil {
+			return nil, err
+		}
+		for _, route := range p.routes {
+			// One label bound for all connections, as the metrics are shared
+			route.labels = p.labels
+			if p.memory != nil {
+				// One cap for all connections, whichever upstream they're routed to
+				route.memory = p.memory
+			}
+		}
 	}
-	return &cfg, nil
+	return p, nil
 }
 
-func NewProxy(upstreamHost string, upstreamPort int, configPath string) (*Proxy, error) {
-	config, err := LoadConfig(configPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load config: %w", err)
-	}
-
-	return &Proxy{
+// newProxy creates a proxy of an upstream with a loaded configuration,
+// without terminating TLS.
+func newProxy(upstreamHost string, upstreamPort int, config *Config) (*Proxy, error) {
+	var err error
+	p := &Proxy{
 		upstreamHost:   upstreamHost,
 		upstreamPort:   upstreamPort,
-		config:         config,
 		rateLimiterMgr: NewRateLimiterManager(config),
-	}, nil
+		dialSlots:      make(chan struct{}, config.MaxConcurrentDials),
+		start:          time.Now(),
+	}
+	p.config.Store(config)
+	if config.ParseWorkers > 0 {
+		p.workers = newParseWorkers(config.ParseWorkers)
+	}
+	if config.IdentityCacheSize > 0 {
+		p.identities = newIdentityCache(config.IdentityCacheSize)
+	}
+	if config.UpstreamScheduler != nil {
+		p.writeSched = newWriteScheduler(config.UpstreamScheduler)
+	}
+	if config.ResourceBudget != nil {
+		p.budget = newResourceBudget(config.ResourceBudget)
+	}
+	if config.MemoryCap != nil {
+		p.memory = newMemoryCap(config.MemoryCap)
+	}
+	p.labels = newClientLabels(config.MetricLabels)
+	dialer, err := upstreamDialer(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.UpstreamTLS != nil {
+		if p.upstreamTLS, err = newUpstreamTLSConfig(config.UpstreamTLS, upstreamHost); err != nil {
+			return nil, err
+		}
+	}
+	p.dial = func() (net.Conn, error) {
+		addr := net.JoinHostPort(p.upstreamHost, strconv.Itoa(p.upstreamPort))
+		return dialer.Dial("tcp", addr)
+	}
+	if config.SoftLimit != nil {
+		p.soft = newSoftLimits(config.SoftLimit, p.rateLimiterMgr)
+	}
+	if config.Recommendations != nil {
+		p.history = newThroughputHistory(config.Recommendations)
+	}
+	if config.TrafficCapture != nil {
+		p.capture = newTrafficCapture(config.TrafficCapture)
+	}
+	if config.Shadow != nil {
+		var shadowTLS *tls.Config
+		if config.UpstreamTLS != nil {
+			// Verified as the shadow's own host, not the upstream's server name
+			host, _, _ := net.SplitHostPort(config.Shadow.Upstream)
+			if shadowTLS, err = newUpstreamTLSConfig(config.UpstreamTLS, host); err != nil {
+				return nil, err
+			}
+			shadowTLS.ServerName = host
+		}
+		p.shadowDial = func() (net.Conn, error) {
+			return p.dialShadow(func() (net.Conn, error) {
+				return dialer.Dial("tcp", config.Shadow.Upstream)
+			}, shadowTLS)
+		}
+	}
+	if config.RepublishGuard != nil {
+		p.guard = newRepublishGuard(*config.RepublishGuard)
+	}
+	if config.PolicyHook != nil {
+		if p.policy, err = LoadPolicyHook(*config.PolicyHook, p.rateLimiterMgr); err != nil {
+			return nil, err
+		}
+	}
+	if config.GeoIP != nil {
+		if p.geo, err = openGeoLocator(config.GeoIP.Database); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.loadSecrets(); err != nil {
+		return nil, err
+	}
+	if err := p.loadUpstreamAuth(); err != nil {
+		return nil, err
+	}
+	if config.StateFile != "" {
+		if err := p.restoreState(); err != nil {
+			return nil, fmt.Errorf("failed to restore state: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// currentConfig returns the current configuration snapshot. Callers must
+// not modify it; a new configuration is stored as a new snapshot instead.
+func (p *Proxy) currentConfig() *Config {
+	return p.config.Load()
+}
+
+// SetDialer replaces how the proxy connects to the upstream, e.g. with
+// net.Pipe in tests.
+func (p *Proxy) SetDialer(dial DialFunc) {
+	p.dial = dial
 }
 
 func (p *Proxy) getBandwidthForUser(user string) int64 {
-	if user != "" && p.config.Users != nil {
-		if bw, ok := p.config.Users[user]; ok {
+	config := p.currentConfig()
+	if user != "" && config.Users != nil {
+		if bw, ok := config.Users[user]; ok {
 			return bw
 		}
 	}
-	return p.config.DefaultBandwidth
+	return config.DefaultBandwidth
 }
 
+// HandleConnection proxies a client connection to the upstream, or to the
+// upstream of the SNI route the client connected to with TLS. With TLS,
+// clients negotiating HTTP/1.1 are served over WebSocket.
 func (p *Proxy) HandleConnection(clientConn net.Conn) {
+	if p.tls.Load() == nil {
+		p.serve(clientConn, nil, nil)
+		return
+	}
+	if p.currentConfig().TLS.InfoFirst {
+		conn, first, err := startsHandshake(clientConn)
+		if err != nil {
+			log.Debug().Err(err).Str("remote", clientConn.RemoteAddr().String()).Msg("Client closed before TLS handshake")
+			clientConn.Close()
+			return
+		}
+		if !first {
+			p.serveInfoFirst(clientConn)
+			return
+		}
+		clientConn = conn
+	}
+	conn, err := p.handshake(clientConn)
+	if err != nil {
+		log.Warn().Err(err).Str("remote", clientConn.RemoteAddr().String()).Msg("TLS handshake failed")
+		metricConnectionsClosed.Add(1, string(closeTLSHandshake))
+		clientConn.Close()
+		return
+	}
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol == acme.ALPNProto {
+		// A tls-alpn-01 challenge, answered by the handshake
+		conn.Close()
+		return
+	}
+	route := p.route(state.ServerName)
+	if state.NegotiatedProtocol != alpnHTTP {
+		route.serve(conn, nil, nil)
+		return
+	}
+	ws, err := acceptWebSocket(conn, p.currentConfig().TLS.HandshakeTimeout)
+	if err != nil {
+		log.Warn().Err(err).Str("remote", clientConn.RemoteAddr().String()).Msg("WebSocket upgrade failed")
+		metricConnectionsClosed.Add(1, string(closeWebSocketUpgrade))
+		conn.Close()
+		return
+	}
+	metricWebSocketConnections.Add(1)
+	route.serve(ws, nil, nil)
+}
+
+// serve proxies a client connection, with TLS already terminated if used, to
+// a new upstream connection, or to upstream if it was dialed ahead to send
+// the client its INFO line, info.
+func (p *Proxy) serve(clientConn, upstream net.Conn, info []byte) {
 	defer clientConn.Close()
+	// One snapshot for the connection's lifetime, so it sees a consistent
+	// configuration even if it is replaced meanwhile.
+	config := p.currentConfig()
+
+	rawConn, secure := transportOf(clientConn)
+	if tcpConn, ok := rawConn.(*net.TCPConn); ok && config.ClientReadBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(config.ClientReadBuffer); err != nil {
+			log.Warn().Err(err).Msg("Failed to set client read buffer")
+		}
+	}
 
-	upstreamConn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", p.upstreamHost, p.upstreamPort))
+	conn := upstream
+	var err error
+	if conn == nil {
+		conn, err = p.dialUpstream()
+	}
+	if u := config.UpstreamUnavailable; err != nil && u != nil && u.Mode == UnavailableHold {
+		log.Warn().Err(err).Msg("Upstream unavailable, holding client")
+		conn, clientConn, err = p.holdClient(clientConn, u)
+	}
 	if err != nil {
+		reason := closeDialError
+		var ce *closeError
+		if errors.As(err, &ce) {
+			reason = ce.reason
+		}
 		log.Error().Err(err).Msg("Failed to connect to upstream")
+		metricConnectionsClosed.Add(1, string(reason))
+		if line := clientErrorLine(reason); line != nil {
+			clientConn.SetWriteDeadline(time.Now().Add(time.Second))
+			clientConn.Write(line)
+		}
 		return
 	}
+	upstreamConn := newUpstreamConn(conn, p.dialUpstream, config.UpstreamRetryBuffer)
 	defer upstreamConn.Close()
 
+	downstream := NewRateLimitedWriter(clientConn)
+	downstream.SetClock(p.rateLimiterMgr.Clock())
+	downstream.SetChunkSize(config.Bucket.ChunkSize)
+	downstream.UpdateRateLimiter(p.rateLimiterMgr.GetDownstreamLimiter())
+	cw := newClientWriter(downstream)
+	cw.secure = secure && !config.InfoPassthrough
+	cw.plaintext = !secure && p.upstreamTLS != nil && !config.InfoPassthrough
+	cw.infoPassthrough = config.InfoPassthrough
+	cw.info = info
+	if config.OrderingWatchdog {
+		cw.setOrderingWatchdog()
+	}
+
+	var reserved int64
+	if p.shadowDial != nil {
+		reserved = int64(config.Shadow.Buffer)
+	}
+	mem := p.memory.open(reserved)
+	defer mem.release()
+	upstreamConn.mem = mem
+	cw.mem = mem
+
+	closed := &closeRecorder{}
+	clientDone := make(chan struct{})
+	if config.MaxConnectionAge > 0 {
+		served := make(chan struct{})
+		defer close(served)
+		go expireConnection(served, clientConn, cw, closed, connectionAge(config.MaxConnectionAge), config.MaxConnectionAgeGrace)
+	}
+	defer p.conns.add(&liveConn{
+		conn: clientConn, cw: cw, closed: closed, start: time.Now(), limits: p.rateLimiterMgr, mem: mem,
+	})()
+
+	parser := NewClientMessageParser(
+		clientConn,
+		upstreamConn,
+		p.rateLimiterMgr,
+	)
+	var country, region string
+	if p.geo != nil {
+		country = countryOf(p.geo, clientConn.RemoteAddr())
+		region = config.GeoIP.regionOf(country)
+		parser.SetLocation(country, region)
+		if country != "" {
+			metricCountryConnections.Add(1, country)
+		}
+		if region != "" {
+			metricRegionConnections.Add(1, region)
+		}
+	}
+
 	// Client -> Upstream
 	go func() {
-		parser := NewClientMessageParser(
-			clientConn,
-			upstreamConn,
-			p.rateLimiterMgr,
-		)
-		parser.ParseAndForward()
+		defer close(clientDone)
+		parser.SetClock(p.rateLimiterMgr.Clock())
+		parser.SetChunkSize(config.Bucket.ChunkSize)
+		parser.SetPauseReads(config.PauseReads)
+		parser.SetClientLabels(p.labels)
+		parser.SetClientWriter(cw)
+		parser.SetDownstream(downstream)
+		if config.OrderingWatchdog {
+			parser.SetOrderingWatchdog()
+		}
+		if config.UsageSubject != "" {
+			parser.HandleService(config.UsageSubject, p.usageService, cw)
+		}
+		if config.StatusSubject != "" {
+			parser.HandleService(config.StatusSubject, func(user string, _ []byte) []byte {
+				return p.statusService(user, parser.GetClient().Name, country)
+			}, cw)
+		}
+		if p.policy != nil {
+			parser.SetPolicyHook(p.policy, cw)
+		}
+		if p.guard != nil {
+			parser.SetRepublishGuard(p.guard)
+		}
+		if config.PayloadSampling != nil {
+			parser.SetPayloadSampling(*config.PayloadSampling)
+		}
+		if p.workers != nil {
+			parser.SetParseWorkers(p.workers)
+		}
+		if p.identities != nil {
+			parser.SetIdentityCache(p.identities)
+		}
+		if p.writeSched != nil {
+			parser.SetUpstreamScheduler(p.writeSched)
+		}
+		parser.SetPauseGate(&p.pause)
+		if len(p.middleware) > 0 {
+			parser.SetMiddlewareFor(p.middlewareFor(config))
+		}
+		if config.Middleware != nil {
+			parser.SetBuiltinMiddleware(middlewareEnabled(config))
+		}
+		if config.RequireKnownUser {
+			parser.SetRequireKnownUser()
+		}
+		if config.ConnectDiagnostics > 0 {
+			parser.SetConnectDiagnostics(config.ConnectDiagnostics)
+		}
+		if auth := p.upstreamAuth.Load(); auth != nil {
+			parser.SetUpstreamAuth(auth)
+		}
+		if p.capture != nil {
+			parser.SetTrafficCapture(p.capture)
+		}
+		if p.soft != nil {
+			parser.SetSoftLimits(p.soft)
+		}
+		if p.shadowDial != nil {
+			shadow := newShadowConn(p.shadowDial, config.Shadow.Buffer, clientConn.RemoteAddr().String())
+			defer shadow.close()
+			parser.SetShadow(shadow)
+		}
+		err := parser.ParseAndForward()
+		parser.checkFlow(err)
+		closed.record(err, true)
+		if line := clientErrorLine(closeReasonOf(err, true)); line != nil {
+			cw.WriteFrame(line)
+		}
+		if err == nil && upstreamConn.CloseWrite() == nil {
+			// The client half-closed: keep delivering upstream messages
+			// until the upstream closes too
+			return
+		}
+		// Stop the upstream -> client direction too
+		upstreamConn.Close()
 	}()
 
-	io.Copy(clientConn, upstreamConn)
+	// Upstream -> Client
+	downErr := forwardDownstream(upstreamConn, cw)
+	closed.record(downErr, false)
+	// Stop the client -> upstream direction too, and wait for it to finish
+	clientConn.Close()
+	upstreamConn.Close()
+	<-clientDone
+	cw.checkFlow(downErr, parser.GetUser())
+
+	log.Info().Str("remote", clientConn.RemoteAddr().String()).Str("user", parser.GetUser()).
+		EmbedObject(parser.GetClient()).Str("country", country).Str("region", region).Str("reason", string(closed.reason)).AnErr("cause", closed.err).
+		Msg("Connection closed")
+	metricConnectionsClosed.Add(1, string(closed.reason))
 }
 
-func (p *Proxy) Start(port int) error {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+// usageService answers a client's usage request with its user's current
+// limit and consumption.
+func (p *Proxy) usageService(user string, _ []byte) []byte {
+	if user == "" {
+		return []byte(`{"error":"not authenticated"}`)
+	}
+	resp, err := json.Marshal(p.rateLimiterMgr.Usage(user))
 	if err != nil {
-		return fmt.Errorf("failed to listen on port %d: %w", port, err)
+		return []byte(`{"error":"internal error"}`)
 	}
-	log.Info().Int("port", port).Msg("NATS proxy listening")
+	return resp
+}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Error().Err(err).Msg("Accept error")
-			continue
-		}
-		go p.HandleConnection(conn)
+// statusService answers a client's status request with the state of the
+// buckets its connection is charged to.
+func (p *Proxy) statusService(user, client, country string) []byte {
+	if user == "" {
+		return []byte(`{"error":"not authenticated"}`)
+	}
+	resp, err := json.Marshal(p.rateLimiterMgr.Status(user, client, country))
+	if err != nil {
+		return []byte(`{"error":"internal error"}`)
+	}
+	return resp
+}
+
+// runBackground starts the configured background loops, which run until ctx
+// is cancelled.
+func (p *Proxy) runBackground(ctx context.Context) {
+	if p.currentConfig().UpstreamPressure != nil {
+		go NewPressureMonitor(*p.currentConfig().UpstreamPressure, p.rateLimiterMgr).Run(ctx)
+	}
+	if p.currentConfig().Adaptive != nil {
+		log.Warn().Msg("Adaptive rate limiting is experimental")
+		go NewAdaptiveLimiter(*p.currentConfig().Adaptive, p.rateLimiterMgr).Run(ctx)
+	}
+	if p.currentConfig().Uplink != nil {
+		go NewUplinkScheduler(*p.currentConfig().Uplink, p.rateLimiterMgr).Run(ctx)
+	}
+	if len(p.currentConfig().StrictUsers) > 0 {
+		go p.runStatePersister(ctx)
+	}
+	if p.history != nil {
+		go p.runThroughputSampler(ctx)
+	}
+	if p.currentConfig().BurstCredit != nil {
+		go p.runBurstCredit(ctx)
+	}
+	if p.capture != nil {
+		go p.runCapture(ctx)
+	}
+	if p.currentConfig().UsageExport != nil {
+		go p.runUsageExport(ctx)
+	}
+	if p.budget != nil {
+		go p.runResourceBudget(ctx)
+	}
+	if p.memory != nil && p.memory.claim() {
+		go p.runMemoryCap(ctx)
+	}
+	p.startReloader(ctx)
+	if p.acme != nil && p.currentConfig().TLS.ACME.Challenge == challengeHTTP {
+		go p.runACMEHTTP(ctx)
+	}
+	for _, route := range p.routes {
+		route.runBackground(ctx)
 	}
 }
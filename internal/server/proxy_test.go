@@ -0,0 +1,508 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pipeConnection runs HandleConnection for a client connected through
+// net.Pipe, with the upstream dialed through pipeDialer. It returns the test's
+// ends of the client and upstream connections and a channel closed once
+// HandleConnection returns.
+func pipeConnection(t *testing.T, p *Proxy) (client, upstream net.Conn, done chan struct{}) {
+	t.Helper()
+	dial, servers := pipeDialer()
+	p.SetDialer(dial)
+
+	client, proxySide := net.Pipe()
+	done = make(chan struct{})
+	go func() {
+		p.HandleConnection(proxySide)
+		close(done)
+	}()
+
+	select {
+	case upstream = <-servers:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for upstream dial")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		upstream.Close()
+	})
+	return client, upstream, done
+}
+
+// readString reads exactly n bytes from conn, failing the test on timeout.
+func readString(t *testing.T, conn net.Conn, n int) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	return string(buf)
+}
+
+func TestProxy_ClientToUpstream(t *testing.T) {
+	client, upstream, _ := pipeConnection(t, newTestProxy(&Config{DefaultBandwidth: 1 << 20}))
+
+	input := "CONNECT {\"user\":\"alice\"}\r\nPUB foo 5\r\nhello\r\nPING\r\n"
+	go client.Write([]byte(input))
+
+	if got := readString(t, upstream, len(input)); got != input {
+		t.Errorf("Unexpected upstream data.\nExpected: %q\nGot: %q", input, got)
+	}
+}
+
+func TestProxy_UpstreamToClient(t *testing.T) {
+	client, upstream, _ := pipeConnection(t, newTestProxy(&Config{DefaultBandwidth: 1 << 20}))
+
+	output := "INFO {}\r\nMSG foo 1 7\r\nPING\r\n\r\n+OK\r\n"
+	go upstream.Write([]byte(output))
+
+	if got := readString(t, client, len(output)); got != output {
+		t.Errorf("Unexpected client data.\nExpected: %q\nGot: %q", output, got)
+	}
+}
+
+func TestProxy_UpstreamAbruptClose(t *testing.T) {
+	client, upstream, done := pipeConnection(t, newTestProxy(&Config{DefaultBandwidth: 1 << 20}))
+
+	upstream.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("HandleConnection didn't return after the upstream closed")
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected client connection closed, got %v", err)
+	}
+}
+
+func TestProxy_ClientAbruptClose(t *testing.T) {
+	client, upstream, done := pipeConnection(t, newTestProxy(&Config{DefaultBandwidth: 1 << 20}))
+
+	input := "CONNECT {\"user\":\"alice\"}\r\nPUB foo 5\r\nhello\r\n"
+	go func() {
+		client.Write([]byte(input))
+		client.Close()
+	}()
+
+	// Everything the client sent before closing is still forwarded
+	if got := readString(t, upstream, len(input)); got != input {
+		t.Errorf("Unexpected upstream data.\nExpected: %q\nGot: %q", input, got)
+	}
+
+	// Then the upstream connection is torn down as well
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("HandleConnection didn't return after the client closed")
+	}
+	upstream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := upstream.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected upstream connection closed, got %v", err)
+	}
+}
+
+func TestProxy_CloseReason(t *testing.T) {
+	_, upstream, done := pipeConnection(t, newTestProxy(&Config{DefaultBandwidth: 1 << 20}))
+	before := metricConnectionsClosed.Get(string(closeUpstreamEOF))
+
+	upstream.Close()
+	<-done
+
+	if got := metricConnectionsClosed.Get(string(closeUpstreamEOF)) - before; got != 1 {
+		t.Errorf("Expected 1 connection closed with reason %s, got %d", closeUpstreamEOF, got)
+	}
+}
+
+func TestCloseReasonOf(t *testing.T) {
+	writeErr := &closeError{reason: closeUpstreamWriteError, err: io.ErrClosedPipe}
+	tests := []struct {
+		err        error
+		fromClient bool
+		want       closeReason
+	}{
+		{nil, true, closeClientEOF},
+		{io.ErrUnexpectedEOF, true, closeClientError},
+		{writeErr, true, closeUpstreamWriteError},
+		{errPendingLimitExceeded, true, closePendingLimit},
+		{io.EOF, false, closeUpstreamEOF},
+		{net.ErrClosed, false, closeUpstreamError},
+		{&closeError{reason: closeClientWriteError, err: io.ErrClosedPipe}, false, closeClientWriteError},
+	}
+	for _, tt := range tests {
+		if got := closeReasonOf(tt.err, tt.fromClient); got != tt.want {
+			t.Errorf("closeReasonOf(%v, %t) = %s, want %s", tt.err, tt.fromClient, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_HalfClose(t *testing.T) {
+	upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer upstreamListener.Close()
+	clientListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer clientListener.Close()
+
+	p := newTestProxy(&Config{DefaultBandwidth: 1 << 20})
+	p.SetDialer(func() (net.Conn, error) {
+		return net.Dial("tcp", upstreamListener.Addr().String())
+	})
+	done := make(chan struct{})
+	go func() {
+		conn, err := clientListener.Accept()
+		if err == nil {
+			p.HandleConnection(conn)
+		}
+		close(done)
+	}()
+
+	client, err := net.Dial("tcp", clientListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	upstream, err := upstreamListener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer upstream.Close()
+
+	// The client sends its last message and closes its write side
+	input := "PUB foo 5\r\nhello\r\n"
+	client.Write([]byte(input))
+	client.(*net.TCPConn).CloseWrite()
+
+	// The upstream receives everything followed by EOF
+	upstream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, err := io.ReadAll(upstream)
+	if err != nil || string(got) != input {
+		t.Fatalf("Expected %q then EOF upstream, got %q, %v", input, got, err)
+	}
+
+	// Server messages are still delivered until the upstream closes
+	output := "MSG foo 1 5\r\nworld\r\n"
+	upstream.Write([]byte(output))
+	upstream.Close()
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, err = io.ReadAll(client)
+	if err != nil || string(got) != output {
+		t.Errorf("Expected %q then EOF on the client, got %q, %v", output, got, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("HandleConnection didn't return after the upstream closed")
+	}
+}
+
+func TestProxy_DialSlots(t *testing.T) {
+	p := newTestProxy(&Config{DefaultBandwidth: 1 << 20, DialTimeout: 50 * time.Millisecond})
+	p.dialSlots = make(chan struct{}, 1)
+
+	release := make(chan struct{})
+	dialing := make(chan struct{})
+	p.SetDialer(func() (net.Conn, error) {
+		close(dialing)
+		<-release
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+
+	go p.dialUpstream()
+	<-dialing
+
+	// The only slot is taken by the blocked dial
+	before := metricUpstreamDialFailures.Get("slot_timeout")
+	if _, err := p.dialUpstream(); err != errDialSlotTimeout {
+		t.Errorf("Expected %v, got %v", errDialSlotTimeout, err)
+	}
+	if got := metricUpstreamDialFailures.Get("slot_timeout") - before; got != 1 {
+		t.Errorf("Expected 1 slot_timeout failure recorded, got %d", got)
+	}
+	close(release)
+}
+
+func TestProxy_DialFailureMetrics(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	p := newTestProxy(&Config{DefaultBandwidth: 1 << 20, DialTimeout: time.Second})
+	p.SetDialer(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, time.Second)
+	})
+	before := metricUpstreamDialFailures.Get("refused")
+
+	if _, err := p.dialUpstream(); err == nil {
+		t.Fatal("Expected dial to a closed port to fail")
+	}
+	if got := metricUpstreamDialFailures.Get("refused") - before; got != 1 {
+		t.Errorf("Expected 1 refused failure recorded, got %d", got)
+	}
+	if metricUpstreamUp.Get() != 0 {
+		t.Error("Expected upstream reported down after a failed dial")
+	}
+}
+
+func TestProxy_DialFailureSendsErr(t *testing.T) {
+	p := newTestProxy(&Config{DefaultBandwidth: 1 << 20})
+	p.SetDialer(func() (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: io.ErrClosedPipe}
+	})
+
+	client, proxySide := net.Pipe()
+	defer client.Close()
+	go p.HandleConnection(proxySide)
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if want := "-ERR 'Upstream Unavailable'\r\n"; string(got) != want {
+		t.Errorf("Expected %q before close, got %q", want, got)
+	}
+}
+
+func TestProxy_HoldClient(t *testing.T) {
+	p := newTestProxy(&Config{
+		DefaultBandwidth: 1 << 20,
+		UpstreamUnavailable: &UnavailableConfig{
+			Mode:          UnavailableHold,
+			RetryInterval: 10 * time.Millisecond,
+			HoldTimeout:   2 * time.Second,
+			Info:          map[string]interface{}{"server_name": "maintenance"},
+		},
+	})
+
+	// The upstream comes back on the third dial
+	dial, servers := pipeDialer()
+	dials := 0
+	p.SetDialer(func() (net.Conn, error) {
+		if dials++; dials < 3 {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: io.ErrClosedPipe}
+		}
+		return dial()
+	})
+
+	client, proxySide := net.Pipe()
+	defer client.Close()
+	go p.HandleConnection(proxySide)
+
+	// The client is sent a lame duck INFO instead of being closed
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(client)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	var info map[string]interface{}
+	if !strings.HasPrefix(line, "INFO ") || json.Unmarshal([]byte(line[5:]), &info) != nil {
+		t.Fatalf("Expected INFO line, got %q", line)
+	}
+	if info["ldm"] != true || info["server_name"] != "maintenance" {
+		t.Errorf("Unexpected INFO fields: %v", info)
+	}
+
+	// Once the upstream is reachable, the client's data, sent while held, is
+	// forwarded and the upstream's INFO delivered
+	input := "CONNECT {}\r\n"
+	client.Write([]byte(input))
+	var upstream net.Conn
+	select {
+	case upstream = <-servers:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the upstream redial")
+	}
+	defer upstream.Close()
+	go upstream.Write([]byte("INFO {\"server_id\":\"upstream\",\"nonce\":\"abc\"}\r\n"))
+	if got := readString(t, upstream, len(input)); got != input {
+		t.Errorf("Expected %q forwarded, got %q", input, got)
+	}
+	if line, err := r.ReadString('\n'); err != nil || !strings.Contains(line, `"nonce":"abc"`) {
+		t.Errorf("Expected the upstream's INFO delivered, got %q, %v", line, err)
+	}
+}
+
+func TestProxy_HoldClientLeaves(t *testing.T) {
+	for _, signed := range []bool{false, true} {
+		p := newTestProxy(&Config{
+			DefaultBandwidth: 1 << 20,
+			UpstreamUnavailable: &UnavailableConfig{
+				Mode:          UnavailableHold,
+				RetryInterval: 10 * time.Millisecond,
+				HoldTimeout:   time.Minute,
+			},
+		})
+		// The upstream comes back once the client sent its CONNECT
+		dial, servers := pipeDialer()
+		var up atomic.Bool
+		var dials atomic.Int32
+		p.SetDialer(func() (net.Conn, error) {
+			dials.Add(1)
+			if !up.Load() {
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: io.ErrClosedPipe}
+			}
+			return dial()
+		})
+
+		client, proxySide := net.Pipe()
+		defer client.Close()
+		done := make(chan struct{})
+		go func() {
+			p.HandleConnection(proxySide)
+			close(done)
+		}()
+		r := bufio.NewReader(client)
+		r.ReadString('\n')
+
+		if signed {
+			// Signed without a nonce: closed to reconnect once the upstream is back
+			go client.Write([]byte("CONNECT {\"jwt\":\"x\",\"sig\":\"y\"}\r\nPING\r\n"))
+			time.Sleep(50 * time.Millisecond)
+			up.Store(true)
+		} else {
+			client.Close()
+		}
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected the held client's connection ended (signed %t)", signed)
+		}
+		if !signed {
+			n := dials.Load()
+			time.Sleep(50 * time.Millisecond)
+			if dials.Load() != n {
+				t.Error("Expected no more dials once the held client left")
+			}
+			continue
+		}
+		upstream := <-servers
+		upstream.SetReadDeadline(time.Now().Add(time.Second))
+		if got, _ := io.ReadAll(upstream); len(got) != 0 {
+			t.Errorf("Expected the signed CONNECT not forwarded, got %q", got)
+		}
+	}
+}
+
+func TestUpstreamDialer_Bind(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn.RemoteAddr()
+			conn.Close()
+		}
+	}()
+
+	dialer, err := upstreamDialer(&Config{DialTimeout: time.Second, UpstreamBindAddress: "127.0.0.2"})
+	if err != nil {
+		t.Fatalf("upstreamDialer failed: %v", err)
+	}
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Skipf("127.0.0.2 not usable as a source address here: %v", err)
+	}
+	conn.Close()
+	if addr := (<-accepted).(*net.TCPAddr); !addr.IP.Equal(net.ParseIP("127.0.0.2")) {
+		t.Errorf("Expected the upstream to see 127.0.0.2, got %s", addr.IP)
+	}
+
+	if _, err := LoadConfig(writeTestConfig(t, "upstream_bind_address: eth0\n")); err == nil {
+		t.Error("Expected an error for a bind address that isn't an IP address")
+	}
+}
+
+func TestUpstreamDialer_FallbackDelay(t *testing.T) {
+	cfg, err := LoadConfig(writeTestConfig(t, "default_bandwidth: 1024\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	dialer, _ := upstreamDialer(cfg)
+	if dialer.FallbackDelay != 300*time.Millisecond {
+		t.Errorf("Expected a 300ms head start by default, got %v", dialer.FallbackDelay)
+	}
+	if dialer, _ := upstreamDialer(&Config{UpstreamFallbackDelay: -1}); dialer.FallbackDelay >= 0 {
+		t.Errorf("Expected serial dials kept for a negative delay, got %v", dialer.FallbackDelay)
+	}
+}
+
+func TestProxy_MaxConnectionAge(t *testing.T) {
+	p := newTestProxy(&Config{
+		DefaultBandwidth:      1 << 20,
+		MaxConnectionAge:      100 * time.Millisecond,
+		MaxConnectionAgeGrace: 100 * time.Millisecond,
+	})
+	before := metricConnectionsClosed.Get(string(closeMaxConnectionAge))
+	client, upstream, done := pipeConnection(t, p)
+
+	banner := "INFO {\"server_id\":\"upstream\",\"max_payload\":1048576}\r\n"
+	go upstream.Write([]byte(banner))
+	reader := bufio.NewReader(client)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if line, err := reader.ReadString('\n'); err != nil || line != banner {
+		t.Fatalf("Expected the upstream INFO, got %q (%v)", line, err)
+	}
+
+	// Once the connection is old enough, the upstream's INFO is resent in
+	// lame duck mode
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	var info map[string]interface{}
+	if !strings.HasPrefix(line, "INFO ") || json.Unmarshal([]byte(line[5:]), &info) != nil {
+		t.Fatalf("Expected INFO line, got %q", line)
+	}
+	if info["ldm"] != true || info["server_id"] != "upstream" || info["max_payload"] != float64(1048576) {
+		t.Errorf("Unexpected INFO fields: %v", info)
+	}
+
+	// And the connection is closed after the grace period
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("HandleConnection didn't return after the grace period")
+	}
+	if got := metricConnectionsClosed.Get(string(closeMaxConnectionAge)) - before; got != 1 {
+		t.Errorf("Expected 1 connection closed with reason %s, got %d", closeMaxConnectionAge, got)
+	}
+}
+
+func TestConnectionAge(t *testing.T) {
+	for range 100 {
+		if age := connectionAge(time.Hour); age < 54*time.Minute || age >= 66*time.Minute {
+			t.Fatalf("Expected an age within 10%% of 1h, got %v", age)
+		}
+	}
+}
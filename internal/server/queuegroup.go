@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+
+	"github.com/juju/ratelimit"
+)
+
+// queueSub is a client's subscription in a limited queue group.
+type queueSub struct {
+	queue   string
+	limiter *ratelimit.Bucket // shared by all members of the queue group
+}
+
+// queueSubs tracks a connection's subscriptions in limited queue groups by
+// sid, so the messages delivered to them are charged to their group.
+type queueSubs struct {
+	mu    sync.Mutex
+	bySid map[string]queueSub
+	n     atomic.Int32 // len(bySid), to skip the lookup without subscriptions
+}
+
+func (qs *queueSubs) add(sid string, sub queueSub) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if qs.bySid == nil {
+		qs.bySid = make(map[string]queueSub)
+	}
+	qs.bySid[sid] = sub
+	qs.n.Store(int32(len(qs.bySid)))
+}
+
+func (qs *queueSubs) remove(sid string) {
+	if qs.n.Load() == 0 {
+		return
+	}
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	delete(qs.bySid, sid)
+	qs.n.Store(int32(len(qs.bySid)))
+}
+
+// lookup returns the queue group subscription a MSG or HMSG line is
+// delivered to, if limited.
+func (qs *queueSubs) lookup(line []byte) (queueSub, bool) {
+	if qs.n.Load() == 0 {
+		return queueSub{}, false
+	}
+	fields := bytes.Fields(line)
+	if len(fields) < 4 {
+		return queueSub{}, false
+	}
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	sub, ok := qs.bySid[string(fields[2])]
+	return sub, ok
+}
+
+// queueKey identifies a user's queue group. Queue group names are scoped to
+// an account, so groups of the same name of different users are limited
+// separately.
+type queueKey struct {
+	user  string
+	queue string
+}
+
+// GetQueueLimiter returns the delivery limiter shared by all members of a
+// user's queue group, or nil if the group isn't limited.
+func (rlm *RateLimiterManager) GetQueueLimiter(username, queue string) *ratelimit.Bucket {
+	bandwidth, ok := rlm.config.Downstream.QueueGroups[queue]
+	if !ok {
+		return nil
+	}
+	key := queueKey{user: username, queue: queue}
+	rlm.mu.Lock()
+	defer rlm.mu.Unlock()
+	limiter, exists := rlm.queueLimiters[key]
+	if !exists {
+		limiter = rlm.newBucket(bandwidth)
+		rlm.queueLimiters[key] = limiter
+	}
+	return limiter
+}
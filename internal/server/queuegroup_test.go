@@ -0,0 +1,47 @@
+package server
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForwardDownstream_QueueGroupLimit(t *testing.T) {
+	rlm := NewRateLimiterManager(&Config{Downstream: DownstreamConfig{QueueGroups: map[string]int64{"workers": 1000}}})
+	clock := newFakeClock()
+	rlm.SetClock(clock)
+
+	subscribe := func(subs string) *clientWriter {
+		cw := newClientWriter(io.Discard)
+		parser := NewClientMessageParser(strings.NewReader(subs), io.Discard, rlm)
+		parser.SetClock(clock)
+		parser.SetClientWriter(cw)
+		if err := parser.ParseAndForward(); err != nil {
+			t.Fatalf("ParseAndForward failed: %v", err)
+		}
+		return cw
+	}
+	first := subscribe("CONNECT {\"user\":\"alice\"}\r\nSUB orders workers 1\r\nSUB audit 2\r\n")
+	second := subscribe("CONNECT {\"user\":\"alice\"}\r\nSUB orders workers 1\r\nSUB orders other 2\r\nSUB orders workers 3\r\nUNSUB 3\r\n")
+
+	msg := func(sid string) string {
+		return "MSG orders " + sid + " 500\r\n" + strings.Repeat("x", 500) + "\r\n"
+	}
+	// The group's members share its limit: about 2000 bytes at 1000 B/s, the
+	// first 1000 of them burst
+	forwardDownstream(strings.NewReader(msg("1")+msg("1")+msg("2")), first)
+	forwardDownstream(strings.NewReader(msg("1")+msg("1")), second)
+	if first.queues.n.Load() != 1 || second.queues.n.Load() != 1 {
+		t.Errorf("Expected unsubscribed and unlimited queue groups untracked, got %d and %d",
+			first.queues.n.Load(), second.queues.n.Load())
+	}
+	if slept := clock.Slept(); slept < 500*time.Millisecond || slept > 2*time.Second {
+		t.Errorf("Expected deliveries to the queue group throttled for about 1s, slept %v", slept)
+	}
+
+	// Another user's group of the same name is limited on its own
+	if rlm.GetQueueLimiter("bob", "workers") == rlm.GetQueueLimiter("alice", "workers") {
+		t.Error("Expected queue groups of different users limited separately")
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"math"
+
+	"github.com/juju/ratelimit"
+)
+
+// connQuota is a connection's guaranteed share of its user's bandwidth, an
+// equal split between the user's live connections. Bytes within the share
+// are forwarded without waiting for the user's bucket; beyond it the
+// connection borrows from the bucket, which the guaranteed bytes of the
+// user's other connections are charged to as well. A busy connection can
+// so use what idle ones leave, but can't starve them.
+type connQuota struct {
+	// bucket refills at the user's rate and is charged each byte times the
+	// number of shares, so it lets through the connection's share.
+	bucket *ratelimit.Bucket
+	shares func() int // the user's live connections
+}
+
+// take takes up to tokens of the connection's share, returning how many it
+// got.
+func (q *connQuota) take(tokens int64) int64 {
+	shares := int64(max(q.shares(), 1))
+	if tokens > math.MaxInt64/shares {
+		return 0
+	}
+	return q.bucket.TakeAvailable(tokens*shares) / shares
+}
+
+// available reports whether the connection has some of its share left.
+func (q *connQuota) available() bool {
+	return q.bucket.Available() >= int64(max(q.shares(), 1))
+}
+
+// NewConnectionQuota returns a connection's guaranteed share of limiter, the
+// user's bucket, or nil unless connection quotas are enabled.
+func (rlm *RateLimiterManager) NewConnectionQuota(username string, limiter *ratelimit.Bucket) *connQuota {
+	if !rlm.config.ConnectionQuotas || limiter == nil {
+		return nil
+	}
+	rlm.mu.Lock()
+	bucket := rlm.newBucket(max(int64(limiter.Rate()), 1))
+	rlm.mu.Unlock()
+	return &connQuota{bucket: bucket, shares: func() int { return rlm.Connections(username) }}
+}
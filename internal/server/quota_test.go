@@ -0,0 +1,44 @@
+package server
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestConnectionQuotas(t *testing.T) {
+	for _, quotas := range []bool{false, true} {
+		clock := newFakeClock()
+		rlm := NewRateLimiterManager(&Config{DefaultBandwidth: 1000, ConnectionQuotas: quotas})
+		rlm.SetClock(clock)
+		limiter := rlm.GetLimiter("alice")
+
+		writers := make([]*RateLimitedWriter, 2)
+		for i := range writers {
+			writers[i] = NewRateLimitedWriter(io.Discard)
+			writers[i].SetClock(clock)
+			writers[i].Rebind("alice", limiter, nil, nil, rlm.NewConnectionQuota("alice", limiter), nil, nil)
+			defer rlm.Bind("alice", func() {})()
+		}
+		if got := rlm.NewConnectionQuota("alice", limiter) != nil; got != quotas {
+			t.Fatalf("Expected a quota %v, got %v", quotas, got)
+		}
+
+		// A bulk upload on one connection, still held to the user's limit
+		writers[0].Write(make([]byte, 5000))
+		if slept := clock.Slept(); slept < 3*time.Second {
+			t.Errorf("quotas %v: expected the upload held to 1000B/s, took %v", quotas, slept)
+		}
+
+		// The other connection's share is left for it
+		before := clock.Slept()
+		writers[1].Write(make([]byte, 100))
+		waited := clock.Slept() - before
+		if quotas && waited > 0 {
+			t.Errorf("Expected the idle connection's share forwarded at once, waited %v", waited)
+		}
+		if !quotas && waited == 0 {
+			t.Error("Expected a wait behind the upload without quotas")
+		}
+	}
+}
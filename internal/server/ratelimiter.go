@@ -1,37 +1,320 @@
 package server
 
 import (
+	"fmt"
+	"maps"
+	"math"
+	"path"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/juju/ratelimit"
+	"github.com/rs/zerolog/log"
 )
 
+// limitClass is the kind of traffic a frame is charged to.
+type limitClass int
+
+const (
+	classBulk    limitClass = iota // regular messages, charged to the user's limit
+	classControl                   // protocol ops and control subjects
+	classObject                    // object store chunks
+)
+
+// Direction is the direction of traffic a limiter applies to.
+type Direction int
+
+const (
+	DirectionUpstream   Direction = iota // client -> upstream
+	DirectionDownstream                  // upstream -> client
+)
+
+// LimiterKey identifies a limiter shared by all connections it applies to.
+type LimiterKey struct {
+	User      string
+	Direction Direction
+	Class     limitClass
+	Client    string // CONNECT name, for applications limited on their own
+	Country   string // client country, for traffic limited by where it comes from
+	Region    string // client region, for traffic limited by where it comes from
+}
+
+// userLimitKey returns the key of a user's main upstream limit.
+func userLimitKey(username string) LimiterKey {
+	return LimiterKey{User: username, Direction: DirectionUpstream, Class: classBulk}
+}
+
+// isUserLimit reports whether key identifies a user's main upstream limit.
+func (key LimiterKey) isUserLimit() bool {
+	return key == userLimitKey(key.User)
+}
+
+// PolicyResolver returns the bandwidth in bytes per second of the limiter
+// identified by key, or false if that traffic isn't limited.
+type PolicyResolver func(key LimiterKey) (int64, bool)
+
 // RateLimiterManager manages rate limiters per user to ensure consistent
 // rate limiting across multiple connections from the same user.
 type RateLimiterManager struct {
-	mu       sync.RWMutex
-	limiters map[string]*ratelimit.Bucket
-	config   *Config
+	mu              sync.RWMutex
+	limiters        map[LimiterKey]*ratelimit.Bucket
+	policy          PolicyResolver // called with mu held
+	pendingTrackers map[string]*pendingTracker
+	streamLimiters  map[string]*ratelimit.Bucket
+	streams         []string // names of the configured streams, sorted
+	queueLimiters   map[queueKey]*ratelimit.Bucket
+	downstream      *ratelimit.Bucket // shared downstream limiter in global mode
+	overrides       map[string]int64  // bandwidth set at runtime via the admin API
+	hookLimits      map[string]int64  // bandwidth decided by the policy hook
+	clock           Clock             // time source of the limiters
+	freezes         *freezeList       // publish freezes
+	config          *Config
+
+	// bindings holds each user's live connections, which RebindUser moves to
+	// the user's current limiters.
+	bindMu   sync.Mutex
+	bindings map[string]map[*binding]struct{}
+
+	// scale holds the float64 bits of the factor applied to all users'
+	// effective rates, e.g. 0.5 halves every limit.
+	scale atomic.Uint64
+	// userScales holds per-user factors (*atomic.Uint64 float64 bits) applied
+	// on top of scale.
+	userScales sync.Map
+	// shares holds the per-user fraction (*atomic.Uint64 float64 bits) of
+	// the configured rate the uplink scheduler allots.
+	shares sync.Map
+	// stats holds each user's *userStats.
+	stats sync.Map
+	// boosts holds each user's *replayBoost.
+	boosts sync.Map
+	// ramps holds the *limitRamp of limiters created by a ramped reduction,
+	// until the ramp ends or the limiter is dropped.
+	ramps sync.Map
+	// credits holds each user's *burstCredit, if burst credit is enabled.
+	credits sync.Map
+}
+
+// limitRamp eases a limiter created by a limit reduction in: its effective
+// rate starts at the old limit, from times its own, and reaches its own
+// linearly by until.
+type limitRamp struct {
+	from         float64
+	start, until time.Time
+}
+
+// binding is a live connection bound to its user's limiters.
+type binding struct {
+	rebind func()
+}
+
+// replayBoost tracks a user's JetStream replay boost, as unix nanoseconds.
+type replayBoost struct {
+	started atomic.Int64
+	until   atomic.Int64
 }
 
 // NewRateLimiterManager creates a new rate limiter manager.
 func NewRateLimiterManager(config *Config) *RateLimiterManager {
-	return &RateLimiterManager{
-		limiters: make(map[string]*ratelimit.Bucket),
-		config:   config,
+	rlm := &RateLimiterManager{
+		limiters:        make(map[LimiterKey]*ratelimit.Bucket),
+		pendingTrackers: make(map[string]*pendingTracker),
+		streamLimiters:  make(map[string]*ratelimit.Bucket),
+		streams:         slices.Sorted(maps.Keys(config.Streams)),
+		queueLimiters:   make(map[queueKey]*ratelimit.Bucket),
+		overrides:       make(map[string]int64),
+		hookLimits:      make(map[string]int64),
+		bindings:        make(map[string]map[*binding]struct{}),
+		clock:           systemClock{},
+		freezes:         newFreezeList(config.Freezes),
+		config:          config,
+	}
+	rlm.policy = rlm.DefaultPolicy
+	rlm.SetScale(1)
+	return rlm
+}
+
+// GlobalScale returns the factor currently applied to all users' effective rates.
+func (rlm *RateLimiterManager) GlobalScale() float64 {
+	return math.Float64frombits(rlm.scale.Load())
+}
+
+// Scale returns the factor applied to a user's effective rate, combining the
+// global and per-user factors, the uplink share and any replay boost.
+func (rlm *RateLimiterManager) Scale(username string) float64 {
+	return rlm.GlobalScale() * rlm.UserScale(username) * rlm.UserShare(username) * rlm.boostFactor(username)
+}
+
+// boostFactor returns the replay boost multiplier if the user is boosted, or 1.
+func (rlm *RateLimiterManager) boostFactor(username string) float64 {
+	if v, ok := rlm.boosts.Load(username); ok && rlm.Clock().Now().UnixNano() < v.(*replayBoost).until.Load() {
+		return rlm.config.ReplayBoost.Multiplier
 	}
+	return 1
+}
+
+// ObservePublish starts a replay boost for a user publishing to a replay
+// boost subject, unless the user's last boost started within the cooldown.
+func (rlm *RateLimiterManager) ObservePublish(username, subject string) {
+	cfg := rlm.config.ReplayBoost
+	if cfg == nil || !matchesAny(cfg.Subjects, subject) {
+		return
+	}
+
+	v, _ := rlm.boosts.LoadOrStore(username, &replayBoost{})
+	boost := v.(*replayBoost)
+	now := rlm.Clock().Now().UnixNano()
+	started := boost.started.Load()
+	if started != 0 && now-started < cfg.Cooldown.Nanoseconds() {
+		return
+	}
+	if !boost.started.CompareAndSwap(started, now) {
+		return
+	}
+	boost.until.Store(now + cfg.Duration.Nanoseconds())
+	metricReplayBoosts.Add(1, username)
+	log.Info().Str("user", username).Float64("multiplier", cfg.Multiplier).
+		Dur("duration", cfg.Duration).Msg("JetStream replay detected, boosting rate")
+}
+
+// UserScale returns the per-user factor applied to a user's effective rate.
+func (rlm *RateLimiterManager) UserScale(username string) float64 {
+	if v, ok := rlm.userScales.Load(username); ok {
+		return math.Float64frombits(v.(*atomic.Uint64).Load())
+	}
+	return 1
+}
+
+// SetUserScale sets the per-user factor applied to a user's effective rate.
+// Unlike the global scale it may exceed 1 to grant more than the configured rate.
+func (rlm *RateLimiterManager) SetUserScale(username string, scale float64) {
+	if scale <= 0 {
+		scale = 1
+	}
+	v, _ := rlm.userScales.LoadOrStore(username, new(atomic.Uint64))
+	v.(*atomic.Uint64).Store(math.Float64bits(scale))
+}
+
+// UserShare returns the fraction of a user's configured rate the uplink
+// scheduler currently allots, 1 unless the uplink is congested.
+func (rlm *RateLimiterManager) UserShare(username string) float64 {
+	if v, ok := rlm.shares.Load(username); ok {
+		return math.Float64frombits(v.(*atomic.Uint64).Load())
+	}
+	return 1
+}
+
+// SetUserShare sets the fraction of a user's configured rate the uplink
+// scheduler allots. Values outside (0, 1] are clamped to 1.
+func (rlm *RateLimiterManager) SetUserShare(username string, share float64) {
+	if share <= 0 || share > 1 {
+		share = 1
+	}
+	v, _ := rlm.shares.LoadOrStore(username, new(atomic.Uint64))
+	v.(*atomic.Uint64).Store(math.Float64bits(share))
+}
+
+// SetScale sets the factor applied to all users' effective rates. Values
+// outside (0, 1] are clamped to 1, meaning limits apply as configured.
+func (rlm *RateLimiterManager) SetScale(scale float64) {
+	if scale <= 0 || scale > 1 {
+		scale = 1
+	}
+	rlm.scale.Store(math.Float64bits(scale))
 }
 
 // GetLimiter returns the rate limiter for a user, creating one if it doesn't exist.
 // This ensures all connections from the same user share the same rate limiter.
 func (rlm *RateLimiterManager) GetLimiter(username string) *ratelimit.Bucket {
-	if username == "" {
+	return rlm.GetLimiterFor(userLimitKey(username))
+}
+
+// GetClientLimiter returns the rate limiter for an application connecting as
+// a user with a CONNECT name, creating one if it doesn't exist. Its traffic
+// is charged to it on top of the user's limiter, so an application gets a
+// budget of its own within the user's. It returns nil for applications
+// without a configured bandwidth.
+func (rlm *RateLimiterManager) GetClientLimiter(username, client string) *ratelimit.Bucket {
+	if _, ok := rlm.config.Clients[client]; client == "" || !ok {
+		return nil
+	}
+	key := userLimitKey(username)
+	key.Client = client
+	return rlm.GetLimiterFor(key)
+}
+
+// GetConnectionLimiters returns the rate limiters a user's connection with
+// a CONNECT name from a country is charged to on top of the user's limiter,
+// creating those that don't exist: the named client's, and for users without
+// a bandwidth of their own, those of the country's and the region's GeoIP
+// bandwidth.
+func (rlm *RateLimiterManager) GetConnectionLimiters(username, client, country string) []*ratelimit.Bucket {
+	var limiters []*ratelimit.Bucket
+	if limiter := rlm.GetClientLimiter(username, client); limiter != nil {
+		limiters = append(limiters, limiter)
+	}
+	for _, key := range rlm.geoLimitKeys(username, country) {
+		if limiter := rlm.GetLimiterFor(key); limiter != nil {
+			limiters = append(limiters, limiter)
+		}
+	}
+	return limiters
+}
+
+// geoLimitKeys returns the keys of the limiters of a user's traffic from a
+// country with a GeoIP bandwidth, or of its region with one. Users with a
+// bandwidth of their own aren't limited by where they connect from.
+func (rlm *RateLimiterManager) geoLimitKeys(username, country string) []LimiterKey {
+	geo := rlm.config.GeoIP
+	if country == "" || geo == nil {
+		return nil
+	}
+	rlm.mu.RLock()
+	_, explicit := rlm.explicitBandwidth(username)
+	rlm.mu.RUnlock()
+	if explicit {
+		return nil
+	}
+	var keys []LimiterKey
+	if _, ok := geo.Countries[country]; ok {
+		key := userLimitKey(username)
+		key.Country = country
+		keys = append(keys, key)
+	}
+	if region := geo.regionOf(country); region != "" && geo.Regions[region].Bandwidth > 0 {
+		key := userLimitKey(username)
+		key.Region = region
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// GetControlLimiter returns the control lane rate limiter for a user, creating
+// one if it doesn't exist. It returns nil if the control lane is disabled.
+func (rlm *RateLimiterManager) GetControlLimiter(username string) *ratelimit.Bucket {
+	return rlm.GetLimiterFor(LimiterKey{User: username, Direction: DirectionUpstream, Class: classControl})
+}
+
+// GetObjectLimiter returns the object store rate limiter for a user, creating
+// one if it doesn't exist. It returns nil if the object store class is disabled.
+func (rlm *RateLimiterManager) GetObjectLimiter(username string) *ratelimit.Bucket {
+	return rlm.GetLimiterFor(LimiterKey{User: username, Direction: DirectionUpstream, Class: classObject})
+}
+
+// GetLimiterFor returns the limiter identified by key, creating one with the
+// bandwidth the policy resolves if it doesn't exist. It returns nil if the
+// policy doesn't limit that traffic.
+func (rlm *RateLimiterManager) GetLimiterFor(key LimiterKey) *ratelimit.Bucket {
+	if key.User == "" {
 		return nil
 	}
 
 	// Try read lock first for common case
 	rlm.mu.RLock()
-	limiter, exists := rlm.limiters[username]
+	limiter, exists := rlm.limiters[key]
 	rlm.mu.RUnlock()
 
 	if exists {
@@ -43,33 +326,690 @@ func (rlm *RateLimiterManager) GetLimiter(username string) *ratelimit.Bucket {
 	defer rlm.mu.Unlock()
 
 	// Double-check in case another goroutine created it while we were waiting
-	if limiter, exists := rlm.limiters[username]; exists {
+	if limiter, exists := rlm.limiters[key]; exists {
 		return limiter
 	}
 
-	// Create new rate limiter for this user
-	bandwidth := rlm.getBandwidthForUser(username)
-	limiter = ratelimit.NewBucketWithRate(float64(bandwidth), bandwidth)
-	rlm.limiters[username] = limiter
-
+	bandwidth, ok := rlm.policy(key)
+	if !ok || bandwidth <= 0 {
+		return nil
+	}
+	limiter = rlm.newBucketFor(key, bandwidth)
+	rlm.limiters[key] = limiter
 	return limiter
 }
 
-// getBandwidthForUser returns the bandwidth limit for a user.
+// DefaultPolicy resolves limiters from the configuration: users' configured
+// or overridden bandwidth, named clients', countries' and regions'
+// bandwidth, the control lane and object store classes, and users' delivery
+// limits.
+// Callers must hold rlm.mu.
+func (rlm *RateLimiterManager) DefaultPolicy(key LimiterKey) (int64, bool) {
+	if key.Direction == DirectionDownstream {
+		ds := rlm.config.Downstream
+		if ds.Mode != DownstreamUser || key.Class != classBulk || key.Client != "" || key.Country != "" || key.Region != "" {
+			return 0, false
+		}
+		if bw, ok := ds.Users[key.User]; ok {
+			return bw, true
+		}
+		return ds.Bandwidth, true
+	}
+	if key.Client != "" {
+		bw, ok := rlm.config.Clients[key.Client]
+		return bw, ok && key.Class == classBulk
+	}
+	if key.Country != "" && rlm.config.GeoIP != nil {
+		bw, ok := rlm.config.GeoIP.Countries[key.Country]
+		return bw, ok && key.Class == classBulk
+	}
+	if key.Region != "" && rlm.config.GeoIP != nil {
+		region, ok := rlm.config.GeoIP.Regions[key.Region]
+		return region.Bandwidth, ok && region.Bandwidth > 0 && key.Class == classBulk
+	}
+	switch key.Class {
+	case classControl:
+		if lane := rlm.config.ControlLane; lane != nil {
+			return lane.Bandwidth, true
+		}
+	case classObject:
+		if object := rlm.config.ObjectStore; object != nil {
+			return object.Bandwidth, true
+		}
+	default:
+		return rlm.getBandwidthForUser(key.User), true
+	}
+	return 0, false
+}
+
+// SetPolicy replaces the resolver limiters are created with, e.g. to wrap
+// DefaultPolicy. Existing limiters are dropped and live connections rebound,
+// so the new policy applies to all connections without the old limiters
+// still admitting traffic alongside. The resolver is called with rlm.mu held
+// and must not call back into the manager other than DefaultPolicy.
+func (rlm *RateLimiterManager) SetPolicy(policy PolicyResolver) {
+	rlm.mu.Lock()
+	rlm.policy = policy
+	clear(rlm.limiters)
+	rlm.ramps.Clear()
+	rlm.mu.Unlock()
+
+	rlm.bindMu.Lock()
+	users := slices.Collect(maps.Keys(rlm.bindings))
+	rlm.bindMu.Unlock()
+	for _, user := range users {
+		rlm.RebindUser(user)
+	}
+}
+
+// newBucket creates a limiter of bandwidth bytes per second shaped by the
+// bucket configuration. Callers must hold rlm.mu.
+func (rlm *RateLimiterManager) newBucket(bandwidth int64) *ratelimit.Bucket {
+	return rlm.newBucketWithBurst(bandwidth, rlm.config.Bucket.Burst)
+}
+
+// newBucketFor creates the bucket of key, holding its user's own burst, or
+// the default burst of users, if it's the user's main limit.
+func (rlm *RateLimiterManager) newBucketFor(key LimiterKey, bandwidth int64) *ratelimit.Bucket {
+	if !key.isUserLimit() {
+		return rlm.newBucket(bandwidth)
+	}
+	if burst, ok := rlm.config.UserBursts[key.User]; ok {
+		return rlm.newBucketWithBurst(bandwidth, burst)
+	}
+	if rlm.config.DefaultBurst > 0 {
+		return rlm.newBucketWithBurst(bandwidth, rlm.config.DefaultBurst)
+	}
+	return rlm.newBucket(bandwidth)
+}
+
+// newBucketWithBurst creates a bucket holding burst worth of traffic at
+// bandwidth, or a second's worth without a burst.
+func (rlm *RateLimiterManager) newBucketWithBurst(bandwidth int64, burst time.Duration) *ratelimit.Bucket {
+	cfg := rlm.config.Bucket
+	capacity := bandwidth
+	if burst > 0 {
+		capacity = max(1, int64(float64(bandwidth)*burst.Seconds()))
+	}
+	if cfg.RefillInterval <= 0 {
+		return ratelimit.NewBucketWithRateAndClock(float64(bandwidth), capacity, rlm.clock)
+	}
+	// Refill at least a byte per step, stretching the interval to keep the rate
+	quantum := max(1, int64(math.Round(float64(bandwidth)*cfg.RefillInterval.Seconds())))
+	interval := time.Duration(float64(quantum) / float64(bandwidth) * float64(time.Second))
+	return ratelimit.NewBucketWithQuantumAndClock(interval, max(capacity, quantum), quantum, rlm.clock)
+}
+
+// Clock returns the time source of the limiters, which writers charging them
+// must wait on.
+func (rlm *RateLimiterManager) Clock() Clock {
+	rlm.mu.RLock()
+	defer rlm.mu.RUnlock()
+	return rlm.clock
+}
+
+// SetClock replaces the time source of the limiters, e.g. with a fake clock
+// in tests. Existing limiters are dropped.
+func (rlm *RateLimiterManager) SetClock(clock Clock) {
+	rlm.mu.Lock()
+	defer rlm.mu.Unlock()
+	rlm.clock = clock
+	clear(rlm.limiters)
+	rlm.ramps.Clear()
+	clear(rlm.streamLimiters)
+	clear(rlm.queueLimiters)
+	rlm.downstream = nil
+}
+
+// GetPendingTracker returns the tracker bounding a user's pending bytes,
+// creating one if it doesn't exist. It returns nil if the cap is disabled.
+func (rlm *RateLimiterManager) GetPendingTracker(username string) *pendingTracker {
+	if username == "" || rlm.config.MaxPendingBytes <= 0 {
+		return nil
+	}
+
+	rlm.mu.Lock()
+	defer rlm.mu.Unlock()
+
+	tracker, exists := rlm.pendingTrackers[username]
+	if !exists {
+		tracker = newPendingTracker(rlm.config.MaxPendingBytes, rlm.config.PendingLimitAction == "close")
+		rlm.pendingTrackers[username] = tracker
+	}
+	return tracker
+}
+
+// GetStreamLimiter returns the name and shared ingest limiter of the stream
+// whose subjects match subject, the first by name if several do, or an empty
+// name and nil if no cap applies.
+func (rlm *RateLimiterManager) GetStreamLimiter(subject string) (string, *ratelimit.Bucket) {
+	for _, name := range rlm.streams {
+		stream := rlm.config.Streams[name]
+		if !matchesAny(stream.Subjects, subject) {
+			continue
+		}
+		rlm.mu.RLock()
+		limiter, exists := rlm.streamLimiters[name]
+		rlm.mu.RUnlock()
+		if exists {
+			return name, limiter
+		}
+
+		rlm.mu.Lock()
+		defer rlm.mu.Unlock()
+		if limiter, exists = rlm.streamLimiters[name]; !exists {
+			limiter = rlm.newBucket(stream.Bandwidth)
+			rlm.streamLimiters[name] = limiter
+		}
+		return name, limiter
+	}
+	return "", nil
+}
+
+// GetDeliveryLimiter returns the limiter shared by a user's connections for
+// the messages delivered to their subscriptions, creating one if it doesn't
+// exist: the user's own limiter in shared mode. It returns nil unless the
+// downstream is limited per user.
+func (rlm *RateLimiterManager) GetDeliveryLimiter(username string) *ratelimit.Bucket {
+	if rlm.config.Downstream.Mode == DownstreamShared {
+		return rlm.GetLimiter(username)
+	}
+	return rlm.GetLimiterFor(LimiterKey{User: username, Direction: DirectionDownstream, Class: classBulk})
+}
+
+// GetDownstreamLimiter returns the limiter for upstream->client traffic of a
+// new connection, or nil if the downstream direction isn't limited or is
+// limited per user, once the connection authenticated.
+func (rlm *RateLimiterManager) GetDownstreamLimiter() *ratelimit.Bucket {
+	ds := rlm.config.Downstream
+	if ds.Bandwidth <= 0 {
+		return nil
+	}
+
+	switch ds.Mode {
+	case DownstreamGlobal:
+		rlm.mu.Lock()
+		defer rlm.mu.Unlock()
+		if rlm.downstream == nil {
+			rlm.downstream = rlm.newBucket(ds.Bandwidth)
+		}
+		return rlm.downstream
+	case DownstreamConnection:
+		rlm.mu.RLock()
+		defer rlm.mu.RUnlock()
+		return rlm.newBucket(ds.Bandwidth)
+	default:
+		return nil
+	}
+}
+
+// IsBypassed reports whether a user bypasses rate limiting, either by name or
+// by the claims of their JWT.
+func (rlm *RateLimiterManager) IsBypassed(username string, claims map[string]interface{}) bool {
+	bypass := rlm.config.Bypass
+	for _, pattern := range bypass.Users {
+		if ok, _ := path.Match(pattern, username); ok {
+			return true
+		}
+	}
+	if claims == nil || len(bypass.JWTClaims) == 0 {
+		return false
+	}
+	for key, value := range bypass.JWTClaims {
+		if !claimMatches(lookupClaim(claims, key), value) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsKnownUser reports whether a user has a limit of their own, configured
+// or set at runtime.
+func (rlm *RateLimiterManager) IsKnownUser(username string) bool {
+	rlm.mu.RLock()
+	defer rlm.mu.RUnlock()
+	_, ok := rlm.explicitBandwidth(username)
+	return ok
+}
+
+// UsesClaims reports whether bypass rules match JWT claims, which
+// connections authenticating with a JWT then need decoded.
+func (rlm *RateLimiterManager) UsesClaims() bool {
+	return len(rlm.config.Bypass.JWTClaims) > 0
+}
+
+// lookupClaim returns the claim at a dotted path, e.g. "nats.tags".
+func lookupClaim(claims map[string]interface{}, key string) interface{} {
+	var v interface{} = claims
+	for _, part := range strings.Split(key, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[part]
+	}
+	return v
+}
+
+func claimMatches(claim interface{}, value string) bool {
+	switch c := claim.(type) {
+	case []interface{}:
+		for _, item := range c {
+			if claimMatches(item, value) {
+				return true
+			}
+		}
+		return false
+	case nil:
+		return false
+	default:
+		return fmt.Sprint(c) == value
+	}
+}
+
+// MessageClass returns the limit class a user's message is charged to, by
+// the first matching class rule or else by the subject. tag is the
+// connection's proxy_tag.
+func (rlm *RateLimiterManager) MessageClass(username, tag, subject string, size int) limitClass {
+	if class, ok := matchRules(rlm.config.ClassRules, username, tag, subject, size, time.Now()); ok {
+		return class
+	}
+	if lane := rlm.config.ControlLane; lane != nil && lane.Bandwidth > 0 && matchesAny(lane.Subjects, subject) {
+		return classControl
+	}
+	if object := rlm.config.ObjectStore; object != nil && object.Bandwidth > 0 && matchesAny(object.Subjects, subject) {
+		return classObject
+	}
+	return classBulk
+}
+
+// Bandwidth returns the bandwidth limit currently in effect for a user.
+func (rlm *RateLimiterManager) Bandwidth(username string) int64 {
+	rlm.mu.RLock()
+	defer rlm.mu.RUnlock()
+	return rlm.getBandwidthForUser(username)
+}
+
+// SetBandwidth overrides a user's bandwidth limit at runtime. The user's live
+// connections are rebound to the new limit, so the old limiter doesn't keep
+// admitting traffic alongside the new one. With a limit ramp configured, a
+// reduction takes effect gradually.
+func (rlm *RateLimiterManager) SetBandwidth(username string, bandwidth int64) {
+	rlm.setBandwidth(username, bandwidth)
+	rlm.RebindUser(username)
+}
+
+func (rlm *RateLimiterManager) setBandwidth(username string, bandwidth int64) {
+	rlm.mu.Lock()
+	defer rlm.mu.Unlock()
+	previous := rlm.getBandwidthForUser(username)
+	rlm.overrides[username] = bandwidth
+	key := userLimitKey(username)
+	rlm.dropLimiter(key)
+
+	ramp := rlm.config.LimitRamp
+	if ramp <= 0 || bandwidth >= previous {
+		return
+	}
+	resolved, ok := rlm.policy(key)
+	if !ok || resolved <= 0 {
+		return
+	}
+	limiter := rlm.newBucketFor(key, resolved)
+	rlm.limiters[key] = limiter
+	now := rlm.clock.Now()
+	rlm.ramps.Store(limiter, &limitRamp{from: float64(previous) / float64(resolved), start: now, until: now.Add(ramp)})
+	log.Info().Str("user", username).Int64("previous_bandwidth", previous).Int64("bandwidth", bandwidth).
+		Dur("ramp", ramp).Msg("Ramping down user bandwidth")
+}
+
+// SetHookBandwidth sets the bandwidth the policy hook decided for a user,
+// applying over the configuration but not over the admin API's overrides.
+// Unlike an override, it isn't listed or persisted as one, and the hook's
+// next decision replaces it. The user's live connections are rebound only if
+// their limit changes.
+func (rlm *RateLimiterManager) SetHookBandwidth(username string, bandwidth int64) {
+	rlm.mu.Lock()
+	previous := rlm.getBandwidthForUser(username)
+	rlm.hookLimits[username] = bandwidth
+	changed := rlm.getBandwidthForUser(username) != previous
+	if changed {
+		rlm.dropLimiter(userLimitKey(username))
+	}
+	rlm.mu.Unlock()
+	if changed {
+		rlm.RebindUser(username)
+	}
+}
+
+// ResetBandwidth drops a user's bandwidth set at runtime, returning the user
+// and, like SetBandwidth, their live connections to the configured limit. It
+// reports whether the user had a bandwidth set.
+func (rlm *RateLimiterManager) ResetBandwidth(username string) bool {
+	rlm.mu.Lock()
+	_, ok := rlm.overrides[username]
+	delete(rlm.overrides, username)
+	rlm.dropLimiter(userLimitKey(username))
+	rlm.mu.Unlock()
+	if ok {
+		rlm.RebindUser(username)
+	}
+	return ok
+}
+
+// Overrides returns the bandwidths set at runtime, by user.
+func (rlm *RateLimiterManager) Overrides() map[string]int64 {
+	rlm.mu.RLock()
+	defer rlm.mu.RUnlock()
+	return maps.Clone(rlm.overrides)
+}
+
+// RestoreOverrides replaces the bandwidths set at runtime, e.g. with those
+// persisted before a restart. Unlike SetBandwidth it never ramps.
+func (rlm *RateLimiterManager) RestoreOverrides(overrides map[string]int64) {
+	rlm.mu.Lock()
+	changed := rlm.overrides
+	rlm.overrides = maps.Clone(overrides)
+	if rlm.overrides == nil {
+		rlm.overrides = make(map[string]int64)
+	}
+	maps.Copy(changed, overrides)
+	for user := range changed {
+		rlm.dropLimiter(userLimitKey(user))
+	}
+	rlm.mu.Unlock()
+
+	for user := range changed {
+		rlm.RebindUser(user)
+	}
+}
+
+// Tokens returns the tokens available in the main limiter of each of users
+// that has one.
+func (rlm *RateLimiterManager) Tokens(users []string) map[string]int64 {
+	rlm.mu.RLock()
+	defer rlm.mu.RUnlock()
+	tokens := make(map[string]int64)
+	for _, user := range users {
+		if limiter, ok := rlm.limiters[userLimitKey(user)]; ok {
+			tokens[user] = limiter.Available()
+		}
+	}
+	return tokens
+}
+
+// RestoreTokens drains a user's main limiter to the tokens it had at
+// savedAt plus what it would have refilled since, so a restart doesn't
+// refill the user's burst.
+func (rlm *RateLimiterManager) RestoreTokens(username string, tokens int64, savedAt time.Time) {
+	limiter := rlm.GetLimiter(username)
+	if limiter == nil {
+		return
+	}
+	elapsed := max(0, rlm.Clock().Now().Sub(savedAt))
+	refilled := min(float64(limiter.Capacity()), limiter.Rate()*elapsed.Seconds())
+	tokens = min(limiter.Capacity(), tokens+int64(refilled))
+	if drain := limiter.Available() - tokens; drain > 0 {
+		limiter.Take(drain)
+	}
+}
+
+// dropLimiter drops the limiter identified by key and its ramp, if any.
+// Callers must hold rlm.mu.
+func (rlm *RateLimiterManager) dropLimiter(key LimiterKey) {
+	if limiter, ok := rlm.limiters[key]; ok {
+		rlm.ramps.Delete(limiter)
+		delete(rlm.limiters, key)
+	}
+}
+
+// RampFactor returns the factor applied to a limiter's rate while a ramped
+// limit reduction eases it in, or 1.
+func (rlm *RateLimiterManager) RampFactor(limiter *ratelimit.Bucket) float64 {
+	v, ok := rlm.ramps.Load(limiter)
+	if !ok {
+		return 1
+	}
+	ramp := v.(*limitRamp)
+	now := rlm.Clock().Now()
+	if !now.Before(ramp.until) {
+		rlm.ramps.Delete(limiter)
+		return 1
+	}
+	left := float64(ramp.until.Sub(now)) / float64(ramp.until.Sub(ramp.start))
+	return 1 + (ramp.from-1)*left
+}
+
+// Bind registers a live connection of a user. RebindUser calls rebind to
+// move it to the user's current limiters; the returned function unregisters
+// it once the connection ends.
+func (rlm *RateLimiterManager) Bind(username string, rebind func()) (unbind func()) {
+	b := &binding{rebind: rebind}
+	rlm.bindMu.Lock()
+	defer rlm.bindMu.Unlock()
+	if rlm.bindings[username] == nil {
+		rlm.bindings[username] = make(map[*binding]struct{})
+	}
+	rlm.bindings[username][b] = struct{}{}
+	return func() {
+		rlm.bindMu.Lock()
+		defer rlm.bindMu.Unlock()
+		delete(rlm.bindings[username], b)
+		if len(rlm.bindings[username]) == 0 {
+			delete(rlm.bindings, username)
+		}
+	}
+}
+
+// Connections returns the number of a user's live, rate limited connections.
+func (rlm *RateLimiterManager) Connections(username string) int {
+	rlm.bindMu.Lock()
+	defer rlm.bindMu.Unlock()
+	return len(rlm.bindings[username])
+}
+
+// RebindUser moves a user's live connections to the user's current limiters,
+// e.g. after the limiters were replaced, instead of only connections
+// established afterwards. It returns the number of connections rebound.
+func (rlm *RateLimiterManager) RebindUser(username string) int {
+	rlm.bindMu.Lock()
+	live := make([]*binding, 0, len(rlm.bindings[username]))
+	for b := range rlm.bindings[username] {
+		live = append(live, b)
+	}
+	rlm.bindMu.Unlock()
+
+	for _, b := range live {
+		b.rebind()
+	}
+	return len(live)
+}
+
+// getBandwidthForUser returns the bandwidth limit for a user. Callers must hold rlm.mu.
 func (rlm *RateLimiterManager) getBandwidthForUser(username string) int64 {
+	if bw, ok := rlm.explicitBandwidth(username); ok {
+		return bw
+	}
+	return rlm.config.DefaultBandwidth
+}
+
+// explicitBandwidth returns the bandwidth set for a user at runtime or in the
+// configuration, or false if the user gets the default. Callers must hold rlm.mu.
+func (rlm *RateLimiterManager) explicitBandwidth(username string) (int64, bool) {
+	if bw, ok := rlm.overrides[username]; ok {
+		return bw, true
+	}
+	if bw, ok := rlm.hookLimits[username]; ok {
+		return bw, true
+	}
 	if rlm.config.Users != nil {
 		if bw, ok := rlm.config.Users[username]; ok {
-			return bw
+			return bw, true
 		}
 	}
-	return rlm.config.DefaultBandwidth
+	for _, tenant := range rlm.config.Tenants {
+		if bw, ok := tenant.Users[username]; ok {
+			return bw, true
+		}
+	}
+	return 0, false
+}
+
+// RecordBytes records n bytes a user sent upstream, or received in shared
+// downstream mode.
+func (rlm *RateLimiterManager) RecordBytes(username string, n int) {
+	v, ok := rlm.stats.Load(username)
+	if !ok {
+		v, _ = rlm.stats.LoadOrStore(username, &userStats{})
+	}
+	v.(*userStats).add(int64(n), time.Now())
+	metricClientBytes.Add(int64(n), username)
+	if rlm.boostFactor(username) != 1 {
+		metricReplayBoostedBytes.Add(int64(n), username)
+	}
+}
+
+// Stats returns a user's throughput estimates, e.g. for policies reacting to
+// sustained rather than momentary throughput.
+func (rlm *RateLimiterManager) Stats(username string) ThroughputStats {
+	if v, ok := rlm.stats.Load(username); ok {
+		return v.(*userStats).snapshot(time.Now())
+	}
+	return ThroughputStats{}
+}
+
+// TotalBytes returns the bytes recorded for each user since startup.
+func (rlm *RateLimiterManager) TotalBytes() map[string]int64 {
+	totals := make(map[string]int64)
+	rlm.stats.Range(func(key, value interface{}) bool {
+		totals[key.(string)] = value.(*userStats).snapshot(time.Now()).Total
+		return true
+	})
+	return totals
+}
+
+// Usage describes a user's current limit and consumption.
+type Usage struct {
+	User               string  `json:"user"`
+	Bandwidth          int64   `json:"bandwidth"`
+	EffectiveBandwidth float64 `json:"effective_bandwidth"`
+	Available          int64   `json:"available"`
+	Throughput         float64 `json:"throughput"` // over the last 10s
+	TotalBytes         int64   `json:"total_bytes"`
+	BurstCredit        int64   `json:"burst_credit,omitempty"` // banked bytes, if enabled
+}
+
+// Usage returns a user's current limit, remaining budget and recent throughput.
+func (rlm *RateLimiterManager) Usage(username string) Usage {
+	rlm.mu.RLock()
+	bandwidth := rlm.getBandwidthForUser(username)
+	limiter := rlm.limiters[userLimitKey(username)]
+	rlm.mu.RUnlock()
+
+	usage := Usage{
+		User:               username,
+		Bandwidth:          bandwidth,
+		EffectiveBandwidth: float64(bandwidth) * rlm.Scale(username),
+		Available:          bandwidth,
+	}
+	if limiter != nil {
+		usage.Available = limiter.Available()
+		usage.EffectiveBandwidth *= rlm.RampFactor(limiter)
+	}
+	stats := rlm.Stats(username)
+	usage.Throughput = stats.Rate10s
+	usage.TotalBytes = stats.Total
+	if v, ok := rlm.credits.Load(username); ok {
+		usage.BurstCredit = v.(*burstCredit).Balance()
+	}
+	return usage
+}
+
+// BucketStatus is the state of the token bucket a connection is charged to.
+// Tokens are bytes at the configured rate; while the rate is scaled, each
+// byte costs 1/scale tokens.
+type BucketStatus struct {
+	User          string  `json:"user"`
+	Client        string  `json:"client,omitempty"`  // CONNECT name, if limited on its own
+	Country       string  `json:"country,omitempty"` // if traffic from there is limited
+	Region        string  `json:"region,omitempty"`  // if traffic from there is limited
+	Limited       bool    `json:"limited"`
+	Capacity      int64   `json:"capacity"`
+	Available     int64   `json:"available"` // negative while writes wait for a refill
+	Rate          float64 `json:"rate"`      // refill in tokens per second
+	Scale         float64 `json:"scale"`
+	EffectiveRate float64 `json:"effective_rate"` // bytes per second
+	WaitMs        int64   `json:"wait_ms"`        // until the bucket has tokens again
+
+	// Also are the buckets the connection is charged to on top of the
+	// user's, those of its CONNECT name and where it connects from.
+	Also []BucketStatus `json:"also,omitempty"`
+}
+
+// Status returns the state of the user's bucket a connection with a CONNECT
+// name from a country is charged to, and of those it's charged to on top,
+// without creating any.
+func (rlm *RateLimiterManager) Status(username, client, country string) BucketStatus {
+	status := rlm.bucketStatus(userLimitKey(username), rlm.Scale(username))
+	if _, ok := rlm.config.Clients[client]; client != "" && ok {
+		key := userLimitKey(username)
+		key.Client = client
+		status.Also = append(status.Also, rlm.bucketStatus(key, 1))
+	}
+	for _, key := range rlm.geoLimitKeys(username, country) {
+		status.Also = append(status.Also, rlm.bucketStatus(key, 1))
+	}
+	return status
+}
+
+// bucketStatus returns the state of the bucket identified by key, charged
+// at scale.
+func (rlm *RateLimiterManager) bucketStatus(key LimiterKey, scale float64) BucketStatus {
+	rlm.mu.RLock()
+	limiter := rlm.limiters[key]
+	rlm.mu.RUnlock()
+
+	status := BucketStatus{User: key.User, Client: key.Client, Country: key.Country, Region: key.Region}
+	if limiter == nil {
+		return status
+	}
+	status.Limited = true
+	status.Capacity = limiter.Capacity()
+	status.Available = limiter.Available()
+	status.Rate = limiter.Rate()
+	status.Scale = scale * rlm.RampFactor(limiter)
+	status.EffectiveRate = status.Rate * status.Scale
+	if status.Available < 0 {
+		status.WaitMs = int64(math.Ceil(float64(-status.Available) / status.Rate * 1000))
+	}
+	return status
 }
 
 // RemoveLimiter removes a rate limiter for a user (useful for cleanup).
 func (rlm *RateLimiterManager) RemoveLimiter(username string) {
 	rlm.mu.Lock()
 	defer rlm.mu.Unlock()
-	delete(rlm.limiters, username)
+	for key := range rlm.limiters {
+		if key.User == username {
+			rlm.dropLimiter(key)
+		}
+	}
+	rlm.userScales.Delete(username)
+	rlm.shares.Delete(username)
+}
+
+// ActiveUsers returns the users that currently have a rate limiter.
+func (rlm *RateLimiterManager) ActiveUsers() []string {
+	rlm.mu.RLock()
+	defer rlm.mu.RUnlock()
+
+	users := make([]string, 0, len(rlm.limiters))
+	for key := range rlm.limiters {
+		if key.isUserLimit() {
+			users = append(users, key.User)
+		}
+	}
+	return users
 }
 
 // GetStats returns statistics about active rate limiters.
@@ -78,8 +1018,10 @@ func (rlm *RateLimiterManager) GetStats() map[string]int64 {
 	defer rlm.mu.RUnlock()
 
 	stats := make(map[string]int64)
-	for username, limiter := range rlm.limiters {
-		stats[username] = limiter.Available()
+	for key, limiter := range rlm.limiters {
+		if key.isUserLimit() {
+			stats[key.User] = limiter.Available()
+		}
 	}
 	return stats
 }
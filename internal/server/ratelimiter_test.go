@@ -0,0 +1,638 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestRateLimiterManager_GetDownstreamLimiter(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       string
+		expectNil    bool
+		expectShared bool
+	}{
+		{
+			name:      "Off by default",
+			config:    "default_bandwidth: 1024\n",
+			expectNil: true,
+		},
+		{
+			name:      "Explicitly off",
+			config:    "default_bandwidth: 1024\ndownstream:\n  mode: off\n",
+			expectNil: true,
+		},
+		{
+			name:         "Global bucket shared by connections",
+			config:       "default_bandwidth: 1024\ndownstream:\n  mode: global\n",
+			expectShared: true,
+		},
+		{
+			name:   "Bucket per connection",
+			config: "default_bandwidth: 1024\ndownstream:\n  mode: connection\n  bandwidth: 2048\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeTestConfig(t, tt.config))
+			if err != nil {
+				t.Fatalf("LoadConfig failed: %v", err)
+			}
+			rlm := NewRateLimiterManager(cfg)
+
+			first, second := rlm.GetDownstreamLimiter(), rlm.GetDownstreamLimiter()
+			if tt.expectNil {
+				if first != nil {
+					t.Error("Expected no downstream limiter")
+				}
+				return
+			}
+			if first == nil || second == nil {
+				t.Fatal("Expected a downstream limiter")
+			}
+			if (first == second) != tt.expectShared {
+				t.Errorf("Expected shared limiter %v, got %v", tt.expectShared, first == second)
+			}
+			if first.Capacity() != cfg.Downstream.Bandwidth {
+				t.Errorf("Expected capacity %d, got %d", cfg.Downstream.Bandwidth, first.Capacity())
+			}
+		})
+	}
+}
+
+func TestRateLimiterManager_GetDeliveryLimiter(t *testing.T) {
+	cfg, err := LoadConfig(writeTestConfig(t, "default_bandwidth: 1024\n"+
+		"downstream:\n  mode: user\n  bandwidth: 2048\n  users:\n    analytics: 4096\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	rlm := NewRateLimiterManager(cfg)
+
+	if rlm.GetDownstreamLimiter() != nil {
+		t.Error("Expected no connection limiter before authentication in user mode")
+	}
+	alice := rlm.GetDeliveryLimiter("alice")
+	if alice == nil || alice != rlm.GetDeliveryLimiter("alice") {
+		t.Fatal("Expected one delivery limiter shared by alice's connections")
+	}
+	if alice.Capacity() != 2048 {
+		t.Errorf("Expected the downstream bandwidth, got %d", alice.Capacity())
+	}
+	if analytics := rlm.GetDeliveryLimiter("analytics"); analytics == nil || analytics.Capacity() != 4096 {
+		t.Error("Expected analytics' own delivery limit")
+	}
+	if rlm.GetLimiter("alice") == alice {
+		t.Error("Expected the delivery limiter apart from the publish limiter")
+	}
+
+	// Delivered messages charge the subscribing user once authenticated
+	downstream := NewRateLimitedWriter(io.Discard)
+	parser := NewClientMessageParser(strings.NewReader("CONNECT {\"user\":\"alice\"}\r\n"), io.Discard, rlm)
+	parser.SetClock(newFakeClock())
+	parser.SetDownstream(downstream)
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if downstream.limits.Load().rateLimiter != alice {
+		t.Error("Expected the connection's deliveries charged to alice's delivery limiter")
+	}
+	if downstream.limits.Load().record != nil {
+		t.Error("Expected deliveries to a separate limit not recorded as alice's throughput")
+	}
+
+	if rlm := NewRateLimiterManager(&Config{DefaultBandwidth: 1024}); rlm.GetDeliveryLimiter("alice") != nil {
+		t.Error("Expected no delivery limiter unless in user mode")
+	}
+}
+
+func TestRateLimiterManager_SharedDownstream(t *testing.T) {
+	cfg, err := LoadConfig(writeTestConfig(t, "default_bandwidth: 1024\nusers:\n  alice: 4096\ndownstream:\n  mode: shared\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	rlm := NewRateLimiterManager(cfg)
+	if rlm.GetDownstreamLimiter() != nil {
+		t.Error("Expected no connection limiter before authentication in shared mode")
+	}
+	if alice := rlm.GetDeliveryLimiter("alice"); alice == nil || alice != rlm.GetLimiter("alice") {
+		t.Error("Expected alice's deliveries charged to alice's own limiter")
+	}
+	if bob := rlm.GetDeliveryLimiter("bob"); bob == nil || bob.Capacity() != 1024 {
+		t.Error("Expected bob's deliveries charged to bob's default limit")
+	}
+
+	// Deliveries count towards alice's throughput like her publishes
+	downstream := NewRateLimitedWriter(io.Discard)
+	parser := NewClientMessageParser(strings.NewReader("CONNECT {\"user\":\"alice\"}\r\n"), io.Discard, rlm)
+	parser.SetClock(newFakeClock())
+	parser.SetDownstream(downstream)
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	before := rlm.Stats("alice").Total
+	downstream.Write([]byte("MSG orders 1 2\r\nok\r\n"))
+	if got := rlm.Stats("alice").Total - before; got != 20 {
+		t.Errorf("Expected the 20 bytes delivered recorded for alice, got %d", got)
+	}
+}
+
+func TestLoadConfig_InvalidDownstreamMode(t *testing.T) {
+	if _, err := LoadConfig(writeTestConfig(t, "downstream:\n  mode: sometimes\n")); err == nil {
+		t.Error("Expected error for invalid downstream mode")
+	}
+}
+
+func TestRateLimiterManager_IsBypassed(t *testing.T) {
+	rlm := NewRateLimiterManager(&Config{
+		DefaultBandwidth: 1024,
+		Bypass: BypassConfig{
+			Users:     []string{"monitoring-*", "registry"},
+			JWTClaims: map[string]string{"nats.tags": "bypass"},
+		},
+	})
+
+	tests := []struct {
+		name     string
+		user     string
+		claims   map[string]interface{}
+		expected bool
+	}{
+		{"Wildcard user", "monitoring-prometheus", nil, true},
+		{"Exact user", "registry", nil, true},
+		{"Regular user", "alice", nil, false},
+		{"JWT tag", "bob", map[string]interface{}{"nats": map[string]interface{}{"tags": []interface{}{"team-a", "bypass"}}}, true},
+		{"JWT without tag", "bob", map[string]interface{}{"nats": map[string]interface{}{"tags": []interface{}{"team-a"}}}, false},
+		{"JWT missing claim", "bob", map[string]interface{}{"name": "bob"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rlm.IsBypassed(tt.user, tt.claims); got != tt.expected {
+				t.Errorf("Expected bypassed %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestRateLimiterManager_ReplayBoost(t *testing.T) {
+	path := writeTestConfig(t, "replay_boost:\n  multiplier: 4\n  duration: 50ms\n  cooldown: 1h\ndownstream:\n  mode: user\n  bandwidth: 2048\n")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	rlm := NewRateLimiterManager(cfg)
+	clock := newFakeClock()
+	rlm.SetClock(clock)
+	downstream := NewRateLimitedWriter(io.Discard)
+	parser := NewClientMessageParser(strings.NewReader("CONNECT {\"user\":\"alice\"}\r\n"), io.Discard, rlm)
+	parser.SetClock(clock)
+	parser.SetDownstream(downstream)
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+
+	rlm.ObservePublish("alice", "orders.new")
+	if got := rlm.Scale("alice"); got != 1 {
+		t.Errorf("Expected no boost for a regular publish, got scale %v", got)
+	}
+
+	rlm.ObservePublish("alice", "$JS.API.CONSUMER.MSG.NEXT.ORDERS.worker")
+	if got := rlm.Scale("alice"); got != 4 {
+		t.Errorf("Expected boosted scale 4, got %v", got)
+	}
+	if got := downstream.limits.Load().scale(); got != 4 {
+		t.Errorf("Expected the replayed deliveries boosted too, got scale %v", got)
+	}
+	if got := rlm.Scale("bob"); got != 1 {
+		t.Errorf("Expected other users unaffected, got scale %v", got)
+	}
+
+	clock.Sleep(60 * time.Millisecond)
+	if got := rlm.Scale("alice"); got != 1 {
+		t.Errorf("Expected boost to expire, got scale %v", got)
+	}
+
+	// Steady-state pulling within the cooldown isn't boosted again
+	rlm.ObservePublish("alice", "$JS.API.CONSUMER.MSG.NEXT.ORDERS.worker")
+	if got := rlm.Scale("alice"); got != 1 {
+		t.Errorf("Expected no boost within the cooldown, got scale %v", got)
+	}
+}
+
+func TestRateLimiterManager_GetStreamLimiter(t *testing.T) {
+	cfg, err := LoadConfig(writeTestConfig(t, "streams:\n  ORDERS:\n    subjects: [\"orders.>\"]\n    bandwidth: 2048\n"+
+		"  ALL:\n    subjects: [\">\"]\n    bandwidth: 4096\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	rlm := NewRateLimiterManager(cfg)
+
+	// Overlapping streams: the first by name applies, every time
+	name, limiter := rlm.GetStreamLimiter("orders.new")
+	if name != "ALL" || limiter == nil || limiter.Capacity() != 4096 {
+		t.Fatalf("Expected the ALL stream's cap, got %q", name)
+	}
+	for range 20 {
+		if n, l := rlm.GetStreamLimiter("orders.new"); n != name || l != limiter {
+			t.Fatalf("Expected the same stream's limiter on every publish, got %q", n)
+		}
+	}
+	if name, _ := NewRateLimiterManager(&Config{}).GetStreamLimiter("orders.new"); name != "" {
+		t.Errorf("Expected no cap without streams, got %q", name)
+	}
+}
+
+func TestRateLimiterManager_GetLimiterFor(t *testing.T) {
+	cfg, err := LoadConfig(writeTestConfig(t, "default_bandwidth: 1024\nusers:\n  alice: 4096\ncontrol_lane:\n  bandwidth: 512\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	rlm := NewRateLimiterManager(cfg)
+
+	bulk := rlm.GetLimiterFor(LimiterKey{User: "alice", Direction: DirectionUpstream, Class: classBulk})
+	if bulk != rlm.GetLimiter("alice") {
+		t.Error("Expected GetLimiter to return the bulk limiter of the key")
+	}
+	if bulk.Capacity() != 4096 {
+		t.Errorf("Expected alice's bulk capacity 4096, got %d", bulk.Capacity())
+	}
+	control := rlm.GetLimiterFor(LimiterKey{User: "alice", Direction: DirectionUpstream, Class: classControl})
+	if control == bulk || control.Capacity() != 512 {
+		t.Errorf("Expected a separate control limiter of capacity 512")
+	}
+	if rlm.GetObjectLimiter("alice") != nil {
+		t.Error("Expected no object limiter without object_store")
+	}
+	if rlm.GetLimiterFor(LimiterKey{User: "alice", Direction: DirectionDownstream}) != nil {
+		t.Error("Expected no downstream limiter from the default policy")
+	}
+
+	// A custom policy wrapping the default one applies to new limiters, and
+	// live connections are rebound to them
+	rebound := 0
+	unbind := rlm.Bind("alice", func() { rebound++ })
+	defer unbind()
+	rlm.SetPolicy(func(key LimiterKey) (int64, bool) {
+		if key.Direction == DirectionDownstream {
+			return 2048, true
+		}
+		return rlm.DefaultPolicy(key)
+	})
+	downstream := rlm.GetLimiterFor(LimiterKey{User: "alice", Direction: DirectionDownstream})
+	if downstream == nil || downstream.Capacity() != 2048 {
+		t.Error("Expected a downstream limiter of capacity 2048 from the custom policy")
+	}
+	if rlm.GetLimiter("alice") == bulk {
+		t.Error("Expected limiters recreated after the policy changed")
+	}
+	if rebound != 1 {
+		t.Errorf("Expected alice's live connection rebound, %d rebinds", rebound)
+	}
+	if users := rlm.ActiveUsers(); len(users) != 1 || users[0] != "alice" {
+		t.Errorf("Expected alice as the only active user, got %v", users)
+	}
+
+	rlm.RemoveLimiter("alice")
+	if len(rlm.GetStats()) != 0 {
+		t.Error("Expected RemoveLimiter to drop all of alice's limiters")
+	}
+}
+
+func TestRateLimiterManager_GetClientLimiter(t *testing.T) {
+	cfg, err := LoadConfig(writeTestConfig(t, "default_bandwidth: 1024\nclients:\n  billing: 8192\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	rlm := NewRateLimiterManager(cfg)
+
+	user := rlm.GetLimiter("svc")
+	if rlm.GetClientLimiter("svc", "") != nil || rlm.GetClientLimiter("svc", "reports") != nil {
+		t.Error("Expected no limiter of their own for clients without a configured bandwidth")
+	}
+	billing := rlm.GetClientLimiter("svc", "billing")
+	if billing == user || billing.Capacity() != 8192 {
+		t.Errorf("Expected a separate billing limiter of capacity 8192")
+	}
+	if rlm.GetClientLimiter("svc", "billing") != billing {
+		t.Error("Expected billing connections to share their limiter")
+	}
+	if rlm.GetClientLimiter("other", "billing") == billing {
+		t.Error("Expected billing limited separately per user")
+	}
+
+	// Billing's publishes are charged to its bucket and the user's
+	input := "CONNECT {\"user\":\"svc\",\"name\":\"billing\"}\r\nPUB orders 100\r\n" + strings.Repeat("x", 100) + "\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), io.Discard, rlm)
+	parser.SetClock(newFakeClock())
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if billing.Available() >= 8192 || user.Available() >= 1024 {
+		t.Errorf("Expected the publish charged to both buckets, got billing %d and svc %d available", billing.Available(), user.Available())
+	}
+	if users := rlm.ActiveUsers(); len(users) != 1 || users[0] != "svc" {
+		t.Errorf("Expected svc as the only active user, got %v", users)
+	}
+}
+
+func TestRateLimiterManager_BucketShape(t *testing.T) {
+	cfg, err := LoadConfig(writeTestConfig(t, "default_bandwidth: 1000\nusers:\n  iot: 500\nbucket:\n  burst: 100ms\n  refill_interval: 10ms\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	clock := newFakeClock()
+	rlm := NewRateLimiterManager(cfg)
+	rlm.SetClock(clock)
+
+	alice := rlm.GetLimiter("alice")
+	if alice.Capacity() != 100 {
+		t.Errorf("Expected a burst of 100 bytes, got %d", alice.Capacity())
+	}
+	alice.TakeAvailable(100)
+	clock.Sleep(15 * time.Millisecond)
+	if available := alice.Available(); available != 10 {
+		t.Errorf("Expected a single 10 byte refill after 15ms, got %d", available)
+	}
+
+	// 500 bytes/s refills 5 bytes per 10ms step
+	iot := rlm.GetLimiter("iot")
+	iot.TakeAvailable(iot.Capacity())
+	clock.Sleep(10 * time.Millisecond)
+	if available := iot.Available(); available != 5 || iot.Rate() != 500 {
+		t.Errorf("Expected 500 bytes/s refilling 5 bytes per step, got rate %v and %d available", iot.Rate(), available)
+	}
+}
+
+func TestRateLimiterManager_UserBursts(t *testing.T) {
+	cfg, err := LoadConfig(writeTestConfig(t, "default_bandwidth: 1000\nbucket:\n  burst: 100ms\nuser_bursts:\n  batch: 3s\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	rlm := NewRateLimiterManager(cfg)
+
+	if capacity := rlm.GetLimiter("batch").Capacity(); capacity != 3000 {
+		t.Errorf("Expected batch's own burst of 3000 bytes, got %d", capacity)
+	}
+	if capacity := rlm.GetLimiter("alice").Capacity(); capacity != 100 {
+		t.Errorf("Expected the default burst of 100 bytes, got %d", capacity)
+	}
+	// The burst holds across runtime limit changes
+	rlm.SetBandwidth("batch", 2000)
+	if capacity := rlm.GetLimiter("batch").Capacity(); capacity != 6000 {
+		t.Errorf("Expected batch's burst at the new limit, got %d", capacity)
+	}
+}
+
+func TestRateLimiterManager_DefaultBurst(t *testing.T) {
+	cfg, err := LoadConfig(writeTestConfig(t, "default_bandwidth: 1000\nbucket:\n  burst: 100ms\ndefault_burst: 2s\n"+
+		"users:\n  batch: {bandwidth: 1000, burst: 3s}\n  bob: 500\n"+
+		"streams:\n  ORDERS:\n    subjects: [\"orders.>\"]\n    bandwidth: 1000\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.Users["batch"] != 1000 || cfg.UserBursts["batch"] != 3*time.Second {
+		t.Fatalf("Expected batch's bandwidth and burst from the long form, got %v and %v", cfg.Users, cfg.UserBursts)
+	}
+	rlm := NewRateLimiterManager(cfg)
+
+	for user, expected := range map[string]int64{"batch": 3000, "bob": 1000, "alice": 2000} {
+		if capacity := rlm.GetLimiter(user).Capacity(); capacity != expected {
+			t.Errorf("Expected %s's bucket to hold %d bytes, got %d", user, expected, capacity)
+		}
+	}
+	// Limits other than users' own keep the burst of bucket
+	if _, limiter := rlm.GetStreamLimiter("orders.new"); limiter.Capacity() != 100 {
+		t.Errorf("Expected the stream's bucket to hold 100 bytes, got %d", limiter.Capacity())
+	}
+}
+
+func TestLoadConfig_InvalidBucket(t *testing.T) {
+	if _, err := LoadConfig(writeTestConfig(t, "bucket:\n  burst: -1s\n")); err == nil {
+		t.Error("Expected an error for a negative burst")
+	}
+	if _, err := LoadConfig(writeTestConfig(t, "user_bursts:\n  alice: 0s\n")); err == nil {
+		t.Error("Expected an error for a user burst that isn't positive")
+	}
+	if _, err := LoadConfig(writeTestConfig(t, "users:\n  alice: {bandwidth: 1024, burst: -1s}\n")); err == nil {
+		t.Error("Expected an error for a user burst that isn't positive")
+	}
+	if _, err := LoadConfig(writeTestConfig(t, "default_burst: -1s\n")); err == nil {
+		t.Error("Expected an error for a negative default burst")
+	}
+	if _, err := LoadConfig(writeTestConfig(t, "limit_ramp: -1s\n")); err == nil {
+		t.Error("Expected an error for a negative limit ramp")
+	}
+}
+
+func TestRateLimiterManager_TinyLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		bandwidth int64
+		writes    []int
+		scale     float64
+		expect    time.Duration
+	}{
+		{"8KB/s", 8192, []int{8192, 4096}, 1, 500 * time.Millisecond},
+		{"500B/s message larger than the bucket", 500, []int{2000}, 1, 3 * time.Second},
+		{"1B/s", 1, []int{1, 1, 1}, 1, 2 * time.Second},
+		{"Scaled small writes are charged", 10, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}, 1.5, 200 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			rlm := NewRateLimiterManager(&Config{DefaultBandwidth: tt.bandwidth})
+			rlm.SetClock(clock)
+
+			var output bytes.Buffer
+			w := NewRateLimitedWriter(&output)
+			w.SetClock(clock)
+			w.Rebind("tiny", rlm.GetLimiter("tiny"), nil, nil, nil, nil, func() float64 { return tt.scale })
+			total := 0
+			for _, n := range tt.writes {
+				if _, err := w.Write(make([]byte, n)); err != nil {
+					t.Fatalf("Write failed: %v", err)
+				}
+				total += n
+			}
+
+			if output.Len() != total {
+				t.Errorf("Expected %d bytes written, got %d", total, output.Len())
+			}
+			// Buckets approximate rates in whole tokens per refill step
+			if slept := clock.Slept(); (slept - tt.expect).Abs() > time.Millisecond {
+				t.Errorf("Expected %v of throttling, got %v", tt.expect, slept)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Example(t *testing.T) {
+	// The config.yaml shipped with the proxy, which it loads by default
+	cfg, err := LoadConfig("../../config.yaml")
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.MaxPendingBytes != 1048576 {
+		t.Errorf("Expected max_pending_bytes 1048576, got %d", cfg.MaxPendingBytes)
+	}
+}
+
+func TestLoadConfig_InvalidBandwidth(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"Negative default", "default_bandwidth: -1\n"},
+		{"Zero user", "users:\n  alice: 0\n"},
+		{"Negative client", "clients:\n  billing: -100\n"},
+		{"Zero tenant user", "tenants:\n  acme:\n    users:\n      acme-alice: 0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadConfig(writeTestConfig(t, tt.config)); err == nil {
+				t.Error("Expected an error for a bandwidth that isn't positive")
+			}
+		})
+	}
+}
+
+func TestRateLimiterManager_LimitRamp(t *testing.T) {
+	cfg, err := LoadConfig(writeTestConfig(t, "default_bandwidth: 1000\nusers:\n  alice: 10000\nlimit_ramp: 10s\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	rlm := NewRateLimiterManager(cfg)
+	clock := newFakeClock()
+	rlm.SetClock(clock)
+
+	old := rlm.GetLimiter("alice")
+	rlm.SetBandwidth("alice", 1000)
+	limiter := rlm.GetLimiter("alice")
+	if limiter == old || limiter.Rate() != 1000 {
+		t.Fatalf("Expected a new limiter at the reduced rate, got rate %v", limiter.Rate())
+	}
+	if f := rlm.RampFactor(limiter); f != 10 {
+		t.Errorf("Expected the ramp to start at the old limit, got factor %v", f)
+	}
+	clock.Sleep(5 * time.Second)
+	if f := rlm.RampFactor(limiter); f != 5.5 {
+		t.Errorf("Expected the rate halfway down the ramp, got factor %v", f)
+	}
+	if usage := rlm.Usage("alice"); usage.EffectiveBandwidth != 5500 {
+		t.Errorf("Expected usage to report the ramped rate, got %v", usage.EffectiveBandwidth)
+	}
+	clock.Sleep(5 * time.Second)
+	if f := rlm.RampFactor(limiter); f != 1 {
+		t.Errorf("Expected the reduced limit in full effect after the ramp, got factor %v", f)
+	}
+
+	rlm.SetBandwidth("alice", 4000)
+	if f := rlm.RampFactor(rlm.GetLimiter("alice")); f != 1 {
+		t.Errorf("Expected raised limits applied at once, got factor %v", f)
+	}
+
+	// A ramping limiter replaced before its ramp ends doesn't keep the ramp
+	rlm.SetBandwidth("alice", 1000)
+	ramped := rlm.GetLimiter("alice")
+	rlm.ResetBandwidth("alice")
+	if _, ok := rlm.ramps.Load(ramped); ok {
+		t.Error("Expected the ramp of a replaced limiter dropped")
+	}
+}
+
+func TestRateLimiterManager_Status(t *testing.T) {
+	cfg, err := LoadConfig(writeTestConfig(t, "default_bandwidth: 1000\nclients:\n  billing: 4000\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	rlm := NewRateLimiterManager(cfg)
+	rlm.SetClock(newFakeClock())
+
+	if status := rlm.Status("alice", "", ""); status.Limited {
+		t.Errorf("Expected no bucket before alice connects, got %+v", status)
+	}
+	if len(rlm.ActiveUsers()) != 0 {
+		t.Error("Expected the status not to create a bucket")
+	}
+
+	rlm.GetLimiter("alice").Take(1500)
+	rlm.SetUserScale("alice", 0.5)
+	status := rlm.Status("alice", "reports", "")
+	want := BucketStatus{User: "alice", Limited: true, Capacity: 1000, Available: -500, Rate: 1000, Scale: 0.5, EffectiveRate: 500, WaitMs: 500}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("Expected %+v, got %+v", want, status)
+	}
+
+	rlm.GetClientLimiter("alice", "billing")
+	status = rlm.Status("alice", "billing", "")
+	if len(status.Also) != 1 || status.Also[0].Client != "billing" || status.Also[0].Capacity != 4000 || status.Also[0].Available != 4000 {
+		t.Errorf("Expected the billing bucket's state along with alice's, got %+v", status)
+	}
+	if status.Capacity != 1000 {
+		t.Errorf("Expected alice's own bucket's state, got %+v", status)
+	}
+}
+
+func TestRateLimiterManager_CountryLimits(t *testing.T) {
+	cfg, err := LoadConfig(writeTestConfig(t, "default_bandwidth: 4096\nusers:\n  vip: 8192\n"+
+		"geoip:\n  database: /dev/null\n  countries:\n    BR: 1024\n    AU: 16384\n"+
+		"  regions:\n    latam:\n      countries: [BR, AR]\n      bandwidth: 2048\n    eu:\n      countries: [DE]\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	rlm := NewRateLimiterManager(cfg)
+
+	if limiters := rlm.GetConnectionLimiters("svc", "", "US"); len(limiters) != 0 {
+		t.Error("Expected traffic from countries without a bandwidth limited by the user's limiter alone")
+	}
+	if limiters := rlm.GetConnectionLimiters("svc", "", "DE"); len(limiters) != 0 {
+		t.Error("Expected traffic from regions without a bandwidth limited by the user's limiter alone")
+	}
+	remote := rlm.GetConnectionLimiters("svc", "", "BR")
+	if len(remote) != 2 || remote[0].Capacity() != 1024 || remote[1].Capacity() != 2048 {
+		t.Fatalf("Expected traffic from BR limited to 1024 for BR and 2048 for latam, got %d limiters", len(remote))
+	}
+	if again := rlm.GetConnectionLimiters("svc", "", "BR"); again[0] != remote[0] || again[1] != remote[1] {
+		t.Error("Expected the user's connections from BR to share their limiters")
+	}
+	if argentina := rlm.GetConnectionLimiters("svc", "", "AR"); len(argentina) != 1 || argentina[0] != remote[1] {
+		t.Error("Expected the user's connections from latam to share the region's limiter")
+	}
+	if limiters := rlm.GetConnectionLimiters("vip", "", "BR"); len(limiters) != 0 {
+		t.Error("Expected users with a bandwidth of their own to keep it in every country")
+	}
+
+	// A country's bandwidth never raises the user's limit
+	if au := rlm.GetConnectionLimiters("svc", "", "AU"); len(au) != 1 || rlm.GetLimiter("svc").Capacity() != 4096 {
+		t.Error("Expected traffic from AU charged to its bucket on top of the user's")
+	}
+
+	status := rlm.Status("svc", "", "BR")
+	if status.Capacity != 4096 || len(status.Also) != 2 || status.Also[0].Country != "BR" || status.Also[1].Region != "latam" {
+		t.Errorf("Expected the status of svc's bucket and its BR and latam buckets, got %+v", status)
+	}
+
+	if _, err := LoadConfig(writeTestConfig(t, "geoip:\n  countries:\n    BR: 1024\n")); err == nil {
+		t.Error("Expected an error for geoip without a database")
+	}
+	overlapping := "geoip:\n  database: /dev/null\n  regions:\n    a:\n      countries: [BR]\n    b:\n      countries: [BR]\n"
+	if _, err := LoadConfig(writeTestConfig(t, overlapping)); err == nil {
+		t.Error("Expected an error for a country in two regions")
+	}
+}
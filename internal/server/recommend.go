@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RecommendationConfig configures sampling users' throughput to recommend
+// limits from what they actually use.
+type RecommendationConfig struct {
+	// Window of throughput history recommendations are based on. Defaults
+	// to 24h.
+	Window time.Duration `yaml:"window"`
+	// Interval between throughput samples. Defaults to 10s.
+	Interval time.Duration `yaml:"interval"`
+	// Percentile of the sampled throughput limits are derived from.
+	// Defaults to 95.
+	Percentile float64 `yaml:"percentile"`
+	// Headroom multiplies the percentile into the recommended limit.
+	// Defaults to 1.5.
+	Headroom float64 `yaml:"headroom"`
+}
+
+// normalize applies defaults and validates the configuration.
+func (c *RecommendationConfig) normalize() error {
+	if c.Window <= 0 {
+		c.Window = 24 * time.Hour
+	}
+	if c.Interval <= 0 {
+		c.Interval = 10 * time.Second
+	}
+	if c.Interval > c.Window {
+		return fmt.Errorf("recommendations interval must not exceed the window")
+	}
+	if c.Percentile == 0 {
+		c.Percentile = 95
+	}
+	if c.Percentile < 0 || c.Percentile > 100 {
+		return fmt.Errorf("recommendations percentile must be in (0, 100]")
+	}
+	if c.Headroom == 0 {
+		c.Headroom = 1.5
+	}
+	if c.Headroom < 1 {
+		return fmt.Errorf("recommendations headroom must be at least 1")
+	}
+	return nil
+}
+
+// throughputHistory keeps each user's throughput sampled over a window.
+type throughputHistory struct {
+	mu    sync.Mutex
+	size  int // samples per window
+	users map[string]*userHistory
+}
+
+// userHistory is a ring of a user's throughput samples in bytes per second.
+type userHistory struct {
+	last  int64 // total bytes as of the previous sample
+	rates []float32
+	next  int
+}
+
+func newThroughputHistory(cfg *RecommendationConfig) *throughputHistory {
+	return &throughputHistory{size: int(cfg.Window / cfg.Interval), users: make(map[string]*userHistory)}
+}
+
+// sample records the throughput of each user since the previous sample,
+// interval ago, from their total bytes sent.
+func (h *throughputHistory) sample(totals map[string]int64, interval time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for user, total := range totals {
+		u, ok := h.users[user]
+		if !ok {
+			u = &userHistory{}
+			h.users[user] = u
+		}
+		rate := float32(float64(total-u.last) / interval.Seconds())
+		u.last = total
+		if len(u.rates) < h.size {
+			u.rates = append(u.rates, rate)
+		} else {
+			u.rates[u.next] = rate
+		}
+		u.next = (u.next + 1) % h.size
+	}
+}
+
+// percentile returns the p-th percentile and the peak of a user's sampled
+// throughput, and how many samples they're based on.
+func (h *throughputHistory) percentile(user string, p float64) (value, peak float64, samples int) {
+	h.mu.Lock()
+	var rates []float32
+	if u, ok := h.users[user]; ok {
+		rates = slices.Clone(u.rates)
+	}
+	h.mu.Unlock()
+	if len(rates) == 0 {
+		return 0, 0, 0
+	}
+	slices.Sort(rates)
+	rank := max(int(math.Ceil(p/100*float64(len(rates))))-1, 0)
+	return float64(rates[rank]), float64(rates[len(rates)-1]), len(rates)
+}
+
+// sampledUsers returns the users with throughput samples.
+func (h *throughputHistory) sampledUsers() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	users := make([]string, 0, len(h.users))
+	for user := range h.users {
+		users = append(users, user)
+	}
+	return users
+}
+
+// runThroughputSampler samples users' throughput until ctx is cancelled.
+func (p *Proxy) runThroughputSampler(ctx context.Context) {
+	interval := p.currentConfig().Recommendations.Interval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.history.sample(p.rateLimiterMgr.TotalBytes(), interval)
+		}
+	}
+}
+
+// Recommendation is a suggested limit for a user, as served by the admin
+// API.
+type Recommendation struct {
+	User        string  `json:"user"`
+	Bandwidth   int64   `json:"bandwidth"`   // current limit
+	Percentile  float64 `json:"percentile"`  // sampled throughput at the percentile, bytes/s
+	Peak        float64 `json:"peak"`        // highest sampled throughput, bytes/s
+	Samples     int     `json:"samples"`     // throughput samples in the window
+	Recommended int64   `json:"recommended"` // percentile times headroom, in whole KiB/s
+	// Limited is set when the percentile is near the current limit: the
+	// user may need more than they were able to use.
+	Limited bool `json:"limited,omitempty"`
+}
+
+// recommendationStep rounds recommended limits up to whole KiB/s.
+const recommendationStep = 1024
+
+// limitedRatio is the share of the limit above which throughput is likely
+// capped by it.
+const limitedRatio = 0.9
+
+func (p *Proxy) handleRecommendations(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizeAdmin(w, r, scopeRead) {
+		return
+	}
+	if p.history == nil {
+		writeError(w, http.StatusNotFound, "recommendations are not enabled")
+		return
+	}
+	cfg := p.currentConfig().Recommendations
+	headroom := cfg.Headroom
+	if s := r.URL.Query().Get("headroom"); s != "" {
+		h, err := strconv.ParseFloat(s, 64)
+		if err != nil || h < 1 {
+			writeError(w, http.StatusBadRequest, "invalid headroom")
+			return
+		}
+		headroom = h
+	}
+
+	recs := []Recommendation{}
+	for _, user := range p.history.sampledUsers() {
+		value, peak, samples := p.history.percentile(user, cfg.Percentile)
+		usage := p.rateLimiterMgr.Usage(user)
+		steps := math.Ceil(value * headroom / recommendationStep)
+		recs = append(recs, Recommendation{
+			User:        user,
+			Bandwidth:   usage.Bandwidth,
+			Percentile:  value,
+			Peak:        peak,
+			Samples:     samples,
+			Recommended: int64(max(steps, 1)) * recommendationStep,
+			Limited:     value >= limitedRatio*usage.EffectiveBandwidth,
+		})
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].User < recs[j].User })
+	writeJSON(w, http.StatusOK, recs)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestThroughputHistory_Percentile(t *testing.T) {
+	h := newThroughputHistory(&RecommendationConfig{Window: 100 * time.Second, Interval: time.Second})
+	total := int64(0)
+	// 120 samples: the first 20 fall out of the window
+	for i := range 120 {
+		rate := int64(1000)
+		if i < 20 || i%20 == 0 {
+			rate = 50000 // spikes
+		}
+		total += rate
+		h.sample(map[string]int64{"alice": total}, time.Second)
+	}
+	// 5% of the window are spikes, which p95 ignores
+	value, peak, samples := h.percentile("alice", 95)
+	if samples != 100 || value != 1000 || peak != 50000 {
+		t.Errorf("Expected p95 at the steady rate over 100 samples, got %v, peak %v over %d", value, peak, samples)
+	}
+	if value, _, _ := h.percentile("alice", 99); value != 50000 {
+		t.Errorf("Expected p99 at the spikes, got %v", value)
+	}
+}
+
+func TestAdmin_Recommendations(t *testing.T) {
+	cfg := &Config{DefaultBandwidth: 10240, AdminReadToken: "view", Recommendations: &RecommendationConfig{}}
+	cfg.Recommendations.normalize()
+	p := newTestProxy(cfg)
+	p.history = newThroughputHistory(cfg.Recommendations)
+	p.history.sample(map[string]int64{"alice": 30000, "bob": 99000}, 10*time.Second)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/recommendations", nil)
+	req.Header.Set("Authorization", "Bearer view")
+	rec := httptest.NewRecorder()
+	p.AdminHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var recs []Recommendation
+	json.Unmarshal(rec.Body.Bytes(), &recs)
+	if len(recs) != 2 || recs[0].User != "alice" {
+		t.Fatalf("Expected recommendations for both users, got %+v", recs)
+	}
+	// 3000 B/s with 1.5 headroom, rounded up to whole KiB/s
+	if recs[0].Percentile != 3000 || recs[0].Recommended != 5120 || recs[0].Limited {
+		t.Errorf("Expected 5KiB/s recommended for alice, got %+v", recs[0])
+	}
+	if !recs[1].Limited {
+		t.Errorf("Expected bob flagged as limited by his current limit, got %+v", recs[1])
+	}
+}
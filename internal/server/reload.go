@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// adminSecrets are the global admin tokens read from token files.
+type adminSecrets struct {
+	write string
+	read  string
+}
+
+// adminTokens returns the global admin tokens: read from the token files if
+// configured, or else inline in the config.
+func (p *Proxy) adminTokens() (write, read string) {
+	if s := p.secrets.Load(); s != nil {
+		return s.write, s.read
+	}
+	return p.currentConfig().AdminToken, p.currentConfig().AdminReadToken
+}
+
+// loadSecrets reads the admin token files, if configured.
+func (p *Proxy) loadSecrets() error {
+	if p.currentConfig().AdminTokenFile == "" && p.currentConfig().AdminReadTokenFile == "" {
+		return nil
+	}
+	s := &adminSecrets{write: p.currentConfig().AdminToken, read: p.currentConfig().AdminReadToken}
+	var err error
+	if s.write, err = readSecret(p.currentConfig().AdminTokenFile, s.write); err != nil {
+		return err
+	}
+	if s.read, err = readSecret(p.currentConfig().AdminReadTokenFile, s.read); err != nil {
+		return err
+	}
+	p.secrets.Store(s)
+	return nil
+}
+
+// readSecret returns the trimmed contents of path, or fallback if path is
+// empty.
+func readSecret(path, fallback string) (string, error) {
+	if path == "" {
+		return fallback, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// loadTLS (re)loads the certificates served to clients.
+func (p *Proxy) loadTLS() error {
+	config, err := newTLSConfig(p.currentConfig().TLS, p.acme)
+	if err != nil {
+		return err
+	}
+	p.tls.Store(config)
+	return nil
+}
+
+// fileStamp identifies a version of a watched file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// fileWatcher reports changes of files by polling their stamps, as mounted
+// secrets are often replaced through symlink swaps that inotify misses.
+type fileWatcher struct {
+	stamps map[string]fileStamp
+}
+
+func newFileWatcher(paths []string) *fileWatcher {
+	w := &fileWatcher{stamps: make(map[string]fileStamp, len(paths))}
+	for _, path := range paths {
+		w.stamps[path] = stampOf(path)
+	}
+	return w
+}
+
+func stampOf(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// changed reports whether any of paths changed since the last call.
+func (w *fileWatcher) changed(paths []string) bool {
+	changed := false
+	for _, path := range paths {
+		if stamp := stampOf(path); stamp != w.stamps[path] {
+			w.stamps[path] = stamp
+			changed = true
+		}
+	}
+	return changed
+}
+
+// certFiles returns the certificate and key files served to clients, and the
+// authorities their certificates are verified against.
+func (p *Proxy) certFiles() []string {
+	t := p.currentConfig().TLS
+	if t == nil || p.tls.Load() == nil {
+		// Route proxies ignore their config's TLS settings
+		return nil
+	}
+	var files []string
+	if t.Cert != "" {
+		files = append(files, t.Cert, t.Key)
+	}
+	if t.CA != "" {
+		files = append(files, t.CA)
+	}
+	for _, route := range t.Routes {
+		if route.Cert != "" {
+			files = append(files, route.Cert, route.Key)
+		}
+	}
+	return files
+}
+
+// secretFiles returns the configured admin token files.
+func (p *Proxy) secretFiles() []string {
+	var files []string
+	for _, path := range []string{p.currentConfig().AdminTokenFile, p.currentConfig().AdminReadTokenFile} {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// credentialFiles returns the upstream credentials file, if configured.
+func (p *Proxy) credentialFiles() []string {
+	if a := p.currentConfig().UpstreamAuth; a != nil && a.Credentials != "" {
+		return []string{a.Credentials}
+	}
+	return nil
+}
+
+// startReloader starts reloading certificates, secrets and upstream
+// credentials whose files change from now on, until ctx is cancelled. Connections keep the certificate they were established
+// with; new ones get the reloaded certificate. A file that fails to load,
+// e.g. a certificate written before its key, keeps the previous version in
+// use until the next change.
+func (p *Proxy) startReloader(ctx context.Context) {
+	certs, secrets, creds := p.certFiles(), p.secretFiles(), p.credentialFiles()
+	if len(certs) == 0 && len(secrets) == 0 && len(creds) == 0 {
+		return
+	}
+	watcher := newFileWatcher(append(append(certs, secrets...), creds...))
+	go p.runReloader(ctx, watcher, certs, secrets, creds)
+}
+
+func (p *Proxy) runReloader(ctx context.Context, watcher *fileWatcher, certs, secrets, creds []string) {
+	ticker := time.NewTicker(p.currentConfig().ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if watcher.changed(certs) {
+			p.reload("certificates", p.loadTLS)
+		}
+		if watcher.changed(secrets) {
+			p.reload("secrets", p.loadSecrets)
+		}
+		if watcher.changed(creds) {
+			p.reload("upstream_credentials", p.loadUpstreamAuth)
+		}
+	}
+}
+
+func (p *Proxy) reload(kind string, load func() error) {
+	if err := load(); err != nil {
+		log.Error().Err(err).Str("kind", kind).Msg("Reload failed, keeping the previous version")
+		metricReloads.Add(1, kind, "error")
+		return
+	}
+	log.Info().Str("kind", kind).Msg("Reloaded")
+	metricReloads.Add(1, kind, "ok")
+}
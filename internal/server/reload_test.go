@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// servedName returns the first DNS name of the certificate p serves.
+func servedName(t *testing.T, p *Proxy) string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go tls.Server(server, p.tls.Load()).Handshake()
+	conn := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	return conn.ConnectionState().PeerCertificates[0].DNSNames[0]
+}
+
+// eventually polls cond until it holds or a second passed.
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestProxy_ReloadsCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "old.example.com")
+	config := writeTestConfig(t, "reload_interval: 10ms\ntls:\n  cert: "+certFile+"\n  key: "+keyFile+"\n")
+	p, err := NewProxy("127.0.0.1", 4222, config)
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.startReloader(ctx)
+
+	// Rotate the files in place, with a later mtime than the originals
+	newCert, newKey := writeTestCert(t, t.TempDir(), "new.example.com")
+	for src, dst := range map[string]string{newCert: certFile, newKey: keyFile} {
+		data, _ := os.ReadFile(src)
+		os.WriteFile(dst, data, 0o600)
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(dst, later, later)
+	}
+	if !eventually(func() bool { return servedName(t, p) == "new.example.com" }) {
+		t.Error("Expected the rotated certificate served")
+	}
+}
+
+func TestProxy_ReloadsAdminTokenFile(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "admin-token")
+	os.WriteFile(tokenFile, []byte("first\n"), 0o600)
+	config := writeTestConfig(t, "reload_interval: 10ms\nadmin_token_file: "+tokenFile+"\n")
+	p, err := NewProxy("127.0.0.1", 4222, config)
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	status := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/freezes", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		p.AdminHandler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := status("first"); code != http.StatusOK {
+		t.Fatalf("Expected the file's token accepted, got status %d", code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.startReloader(ctx)
+	os.WriteFile(tokenFile, []byte("second-token\n"), 0o600)
+	if !eventually(func() bool { return status("second-token") == http.StatusOK }) {
+		t.Error("Expected the rotated token accepted")
+	}
+	if code := status("first"); code != http.StatusUnauthorized {
+		t.Errorf("Expected the old token rejected, got status %d", code)
+	}
+}
+
+func TestLoadConfig_AdminTokenAndFile(t *testing.T) {
+	if _, err := LoadConfig(writeTestConfig(t, "admin_token: x\nadmin_token_file: /run/secrets/admin\n")); err == nil {
+		t.Error("Expected an error for both an inline and a file token")
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Republish guard actions.
+const (
+	RepublishAlert    = "alert"    // log and count repeated payloads
+	RepublishThrottle = "throttle" // also charge repeated payloads extra
+)
+
+// RepublishGuardConfig configures detection of users republishing identical
+// payloads at high frequency, a common bug pattern where a service consumes
+// and republishes its own messages in a loop.
+type RepublishGuardConfig struct {
+	// Window over which identical payloads are counted. Defaults to 10s.
+	Window time.Duration `yaml:"window"`
+	// Threshold is the number of identical payloads per user and window
+	// above which the user is flagged. Defaults to 1000.
+	Threshold uint32 `yaml:"threshold"`
+	// Action is "alert" (default) or "throttle".
+	Action string `yaml:"action"`
+	// Penalty is how many times its size a repeated payload is charged in
+	// throttle mode. Defaults to 10.
+	Penalty int64 `yaml:"penalty"`
+}
+
+// Count-min sketch dimensions: 4 rows of 16K counters keep memory at 256KB
+// regardless of the number of users and payloads.
+const (
+	sketchDepth = 4
+	sketchWidth = 1 << 14
+)
+
+// countMinSketch estimates how often keys were seen, never underestimating.
+type countMinSketch struct {
+	counters [sketchDepth][sketchWidth]atomic.Uint32
+}
+
+// add counts a key by its hash and returns its estimated count.
+func (s *countMinSketch) add(h uint64) uint32 {
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	estimate := ^uint32(0)
+	for i := range s.counters {
+		n := s.counters[i][(h1+uint32(i)*h2)%sketchWidth].Add(1)
+		estimate = min(estimate, n)
+	}
+	return estimate
+}
+
+// republishGuard flags users republishing identical payloads. It is shared by
+// all connections.
+type republishGuard struct {
+	cfg  RepublishGuardConfig
+	seed maphash.Seed
+
+	sketch    atomic.Pointer[countMinSketch]
+	windowEnd atomic.Int64 // unix nanoseconds
+
+	mu      sync.Mutex
+	flagged map[string]bool // users already logged in this window
+}
+
+func newRepublishGuard(cfg RepublishGuardConfig) *republishGuard {
+	if cfg.Window <= 0 {
+		cfg.Window = 10 * time.Second
+	}
+	if cfg.Threshold == 0 {
+		cfg.Threshold = 1000
+	}
+	if cfg.Action == "" {
+		cfg.Action = RepublishAlert
+	}
+	if cfg.Penalty <= 0 {
+		cfg.Penalty = 10
+	}
+	g := &republishGuard{
+		cfg:     cfg,
+		seed:    maphash.MakeSeed(),
+		flagged: make(map[string]bool),
+	}
+	g.sketch.Store(&countMinSketch{})
+	g.windowEnd.Store(time.Now().Add(cfg.Window).UnixNano())
+	return g
+}
+
+// observe counts a user's payload and returns the extra multiple of its size
+// it should be charged, 0 unless the payload is repeated too often in throttle mode.
+func (g *republishGuard) observe(user string, payload []byte, now time.Time) int64 {
+	g.rotate(now)
+
+	var h maphash.Hash
+	h.SetSeed(g.seed)
+	h.WriteString(user)
+	h.WriteByte(0)
+	h.Write(payload)
+	if g.sketch.Load().add(h.Sum64()) <= g.cfg.Threshold {
+		return 0
+	}
+
+	metricRepublishRepeats.Add(1, user)
+	g.mu.Lock()
+	first := !g.flagged[user]
+	g.flagged[user] = true
+	g.mu.Unlock()
+	if first {
+		log.Warn().Str("user", user).Uint32("threshold", g.cfg.Threshold).Dur("window", g.cfg.Window).
+			Str("action", g.cfg.Action).Msg("User is republishing identical payloads, possible publish loop")
+	}
+	if g.cfg.Action == RepublishThrottle {
+		return g.cfg.Penalty - 1
+	}
+	return 0
+}
+
+// rotate starts a new window with an empty sketch once the current one ended.
+func (g *republishGuard) rotate(now time.Time) {
+	if now.UnixNano() < g.windowEnd.Load() {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now.UnixNano() < g.windowEnd.Load() {
+		return
+	}
+	g.sketch.Store(&countMinSketch{})
+	g.windowEnd.Store(now.Add(g.cfg.Window).UnixNano())
+	clear(g.flagged)
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRepublishGuard_Observe(t *testing.T) {
+	g := newRepublishGuard(RepublishGuardConfig{Window: time.Minute, Threshold: 3, Action: RepublishThrottle, Penalty: 5})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if extra := g.observe("alice", []byte("same"), now); extra != 0 {
+			t.Fatalf("Expected no penalty up to the threshold, got %d on message %d", extra, i+1)
+		}
+	}
+	if extra := g.observe("alice", []byte("same"), now); extra != 4 {
+		t.Errorf("Expected a penalty of 4 extra over the threshold, got %d", extra)
+	}
+	if metricRepublishRepeats.Get("alice") == 0 {
+		t.Error("Expected repeats to be counted")
+	}
+
+	// Other payloads and users are counted separately
+	if extra := g.observe("alice", []byte("different"), now); extra != 0 {
+		t.Errorf("Expected no penalty for another payload, got %d", extra)
+	}
+	if extra := g.observe("bob", []byte("same"), now); extra != 0 {
+		t.Errorf("Expected no penalty for another user, got %d", extra)
+	}
+
+	// A new window starts from zero
+	if extra := g.observe("alice", []byte("same"), now.Add(time.Minute)); extra != 0 {
+		t.Errorf("Expected no penalty in a new window, got %d", extra)
+	}
+}
+
+func TestRepublishGuard_Alert(t *testing.T) {
+	g := newRepublishGuard(RepublishGuardConfig{Threshold: 1})
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if extra := g.observe("carol", []byte("loop"), now); extra != 0 {
+			t.Fatalf("Expected alert mode never to penalize, got %d", extra)
+		}
+	}
+	if got := metricRepublishRepeats.Get("carol"); got != 4 {
+		t.Errorf("Expected 4 repeats counted, got %d", got)
+	}
+}
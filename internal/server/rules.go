@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/rs/zerolog/log"
+)
+
+// ClassRule routes messages matching an expression to a limit class. Rules
+// are CEL expressions over the message, e.g.
+//
+//	user.startsWith("batch-") && hour >= 22
+//
+// with the variables user, tag (the proxy_tag the client sent in CONNECT, or
+// empty), subject and size (payload bytes, including headers), and hour
+// (0-23) and weekday (0 is Sunday) in the proxy's local time. They are
+// compiled when the config is loaded.
+type ClassRule struct {
+	When string `yaml:"when"`
+	// Class is "bulk", "control" or "object".
+	Class string `yaml:"class"`
+
+	program cel.Program
+	class   limitClass
+}
+
+// limitClasses maps class names used in the config to limit classes.
+var limitClasses = map[string]limitClass{
+	"bulk":    classBulk,
+	"control": classControl,
+	"object":  classObject,
+}
+
+// ruleEnv declares the variables rules are evaluated with.
+var ruleEnv, _ = cel.NewEnv(
+	cel.Variable("user", cel.StringType),
+	cel.Variable("tag", cel.StringType),
+	cel.Variable("subject", cel.StringType),
+	cel.Variable("size", cel.IntType),
+	cel.Variable("hour", cel.IntType),
+	cel.Variable("weekday", cel.IntType),
+)
+
+// compile checks the rule and prepares it for evaluation.
+func (r *ClassRule) compile() error {
+	class, ok := limitClasses[r.Class]
+	if !ok {
+		return fmt.Errorf("invalid class %q", r.Class)
+	}
+	ast, issues := ruleEnv.Compile(r.When)
+	if issues.Err() != nil {
+		return issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return fmt.Errorf("expression returns %s, not bool", ast.OutputType())
+	}
+	program, err := ruleEnv.Program(ast)
+	if err != nil {
+		return err
+	}
+	r.program, r.class = program, class
+	return nil
+}
+
+// matchRules returns the class of the first rule matching the message.
+func matchRules(rules []*ClassRule, user, tag, subject string, size int, now time.Time) (limitClass, bool) {
+	if len(rules) == 0 {
+		return classBulk, false
+	}
+	vars := map[string]any{
+		"user":    user,
+		"tag":     tag,
+		"subject": subject,
+		"size":    size,
+		"hour":    now.Hour(),
+		"weekday": int(now.Weekday()),
+	}
+	for _, r := range rules {
+		out, _, err := r.program.Eval(vars)
+		if err != nil {
+			log.Debug().Err(err).Str("rule", r.When).Msg("Failed to evaluate class rule")
+			continue
+		}
+		if matched, ok := out.Value().(bool); ok && matched {
+			return r.class, true
+		}
+	}
+	return classBulk, false
+}
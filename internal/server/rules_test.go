@@ -0,0 +1,70 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchRules(t *testing.T) {
+	cfg, err := LoadConfig(writeTestConfig(t, `
+class_rules:
+  - when: 'user.startsWith("batch-") && hour >= 22'
+    class: object
+  - when: 'subject.startsWith("$KV.") && size < 1024'
+    class: control
+  - when: 'tag == "telemetry"'
+    class: object
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	night := time.Date(2025, 1, 1, 23, 0, 0, 0, time.Local)
+	noon := time.Date(2025, 1, 1, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		name    string
+		user    string
+		tag     string
+		subject string
+		size    int
+		now     time.Time
+		class   limitClass
+		matched bool
+	}{
+		{"Batch user at night", "batch-etl", "", "orders", 100, night, classObject, true},
+		{"Batch user at noon", "batch-etl", "", "orders", 100, noon, classBulk, false},
+		{"Small KV update", "alice", "", "$KV.config.a", 100, noon, classControl, true},
+		{"Large KV update", "alice", "", "$KV.config.a", 4096, noon, classBulk, false},
+		{"Tagged telemetry", "alice", "telemetry", "metrics", 100, noon, classObject, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class, matched := matchRules(cfg.ClassRules, tt.user, tt.tag, tt.subject, tt.size, tt.now)
+			if class != tt.class || matched != tt.matched {
+				t.Errorf("Expected class %d (matched %t), got %d (matched %t)", tt.class, tt.matched, class, matched)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_InvalidClassRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   string
+		expect string
+	}{
+		{"Syntax error", "when: 'user ==='\n    class: bulk", "invalid class rule"},
+		{"Unknown variable", "when: 'account == \"a\"'\n    class: bulk", "undeclared reference"},
+		{"Not a condition", "when: 'size + 1'\n    class: bulk", "not bool"},
+		{"Unknown class", "when: 'size > 1'\n    class: urgent", "invalid class"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeTestConfig(t, "class_rules:\n  - "+tt.rule+"\n"))
+			if err == nil || !strings.Contains(err.Error(), tt.expect) {
+				t.Errorf("Expected error containing %q, got %v", tt.expect, err)
+			}
+		})
+	}
+}
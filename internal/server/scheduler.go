@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// UplinkConfig configures the uplink scheduler, which shares a
+// bandwidth-constrained egress link between users once their total demand
+// exceeds its capacity.
+type UplinkConfig struct {
+	// Capacity of the uplink in bytes per second.
+	Capacity int64 `yaml:"capacity"`
+	// DetectCapacity sets Capacity, if not configured, from the pod's
+	// kubernetes.io/egress-bandwidth annotation or else the link speed of
+	// Interface. Linux only.
+	DetectCapacity bool `yaml:"detect_capacity"`
+	// Interface whose link speed is detected. Defaults to the interface of
+	// the default route.
+	Interface string `yaml:"interface"`
+	// AnnotationsFile is the pod's annotations mounted with the downward
+	// API. Defaults to /etc/podinfo/annotations.
+	AnnotationsFile string `yaml:"annotations_file"`
+	// Interval between scheduling rounds. Defaults to 1s.
+	Interval time.Duration `yaml:"interval"`
+	// Guarantees are per-user minimum rates in bytes per second, honored
+	// before the remaining capacity is shared.
+	Guarantees map[string]int64 `yaml:"guarantees"`
+	// DefaultGuarantee applies to users without an entry in Guarantees.
+	DefaultGuarantee int64 `yaml:"default_guarantee"`
+}
+
+// saturatedThreshold is the fraction of its effective rate above which a user
+// is considered to want more than it currently gets.
+const saturatedThreshold = 0.9
+
+// minUplinkShare bounds how far the scheduler scales a user down, so idle
+// users can still start sending and be seen as demanding.
+const minUplinkShare = 0.01
+
+// uplinkDemand is a user's input to a scheduling round, in bytes per second.
+type uplinkDemand struct {
+	demand    float64
+	guarantee float64
+	weight    float64
+}
+
+// UplinkScheduler periodically divides the uplink capacity between users:
+// guarantees first, then the remainder in proportion to configured rates.
+// While total demand fits the uplink, users get their configured rates.
+type UplinkScheduler struct {
+	cfg UplinkConfig
+	rlm *RateLimiterManager
+
+	congested bool
+}
+
+// NewUplinkScheduler creates a scheduler adjusting rlm's per-user shares.
+func NewUplinkScheduler(cfg UplinkConfig, rlm *RateLimiterManager) *UplinkScheduler {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	return &UplinkScheduler{cfg: cfg, rlm: rlm}
+}
+
+// Run schedules until ctx is cancelled.
+func (s *UplinkScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.schedule()
+	}
+}
+
+// schedule runs one round, estimating each active user's demand from its
+// recent throughput: a user sending close to its effective rate wants its
+// configured rate, any other user wants what it currently sends.
+func (s *UplinkScheduler) schedule() {
+	demands := make(map[string]uplinkDemand)
+	var total float64
+	for _, user := range s.rlm.ActiveUsers() {
+		usage := s.rlm.Usage(user)
+		d := uplinkDemand{
+			demand:    usage.Throughput,
+			guarantee: float64(s.guarantee(user)),
+			weight:    float64(usage.Bandwidth),
+		}
+		if usage.Throughput >= saturatedThreshold*usage.EffectiveBandwidth {
+			d.demand = float64(usage.Bandwidth)
+		}
+		demands[user] = d
+		total += d.demand
+	}
+	metricUplinkDemand.Set(int64(total))
+
+	congested := total > float64(s.cfg.Capacity)
+	if congested != s.congested {
+		log.Info().Bool("congested", congested).Float64("demand", total).
+			Int64("capacity", s.cfg.Capacity).Msg("Uplink congestion changed")
+		s.congested = congested
+	}
+	if !congested {
+		for user, d := range demands {
+			s.rlm.SetUserShare(user, 1)
+			metricUplinkAllocated.Set(int64(d.weight), user)
+		}
+		return
+	}
+
+	for user, alloc := range allocateUplink(float64(s.cfg.Capacity), demands) {
+		d := demands[user]
+		share := 1.0
+		if d.weight > 0 {
+			share = max(minUplinkShare, alloc/d.weight)
+		}
+		s.rlm.SetUserShare(user, share)
+		metricUplinkAllocated.Set(int64(alloc), user)
+	}
+}
+
+// guarantee returns a user's minimum rate.
+func (s *UplinkScheduler) guarantee(user string) int64 {
+	if g, ok := s.cfg.Guarantees[user]; ok {
+		return g
+	}
+	return s.cfg.DefaultGuarantee
+}
+
+// allocateUplink divides capacity between users. Guarantees are granted first,
+// even to idle users so they can ramp up, and scaled down if they alone exceed
+// capacity. The remainder is shared in proportion to weight, never granting a
+// user more than it demands, with what satisfied users don't need going to
+// the others.
+func allocateUplink(capacity float64, demands map[string]uplinkDemand) map[string]float64 {
+	alloc := make(map[string]float64, len(demands))
+	var guaranteed float64
+	for user, d := range demands {
+		alloc[user] = min(d.guarantee, d.weight)
+		guaranteed += alloc[user]
+	}
+	if guaranteed >= capacity {
+		for user := range alloc {
+			alloc[user] *= capacity / guaranteed
+		}
+		return alloc
+	}
+
+	// Each round either hands out all that remains or satisfies a user
+	remaining := capacity - guaranteed
+	for remaining > 0 {
+		var weights float64
+		for user, d := range demands {
+			if alloc[user] < d.demand {
+				weights += d.weight
+			}
+		}
+		if weights == 0 {
+			break
+		}
+		satisfied := false
+		next := remaining
+		for user, d := range demands {
+			if alloc[user] >= d.demand {
+				continue
+			}
+			share := remaining * d.weight / weights
+			if alloc[user]+share >= d.demand {
+				share = d.demand - alloc[user]
+				satisfied = true
+			}
+			alloc[user] += share
+			next -= share
+		}
+		remaining = next
+		if !satisfied {
+			break
+		}
+	}
+	return alloc
+}
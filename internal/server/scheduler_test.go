@@ -0,0 +1,109 @@
+package server
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAllocateUplink(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity float64
+		demands  map[string]uplinkDemand
+		expect   map[string]float64
+	}{
+		{
+			name:     "Proportional to weight",
+			capacity: 3000,
+			demands: map[string]uplinkDemand{
+				"alice": {demand: 4000, weight: 4000},
+				"bob":   {demand: 2000, weight: 2000},
+			},
+			expect: map[string]float64{"alice": 2000, "bob": 1000},
+		},
+		{
+			name:     "Guarantee honored first",
+			capacity: 3000,
+			demands: map[string]uplinkDemand{
+				"alice": {demand: 4000, weight: 4000},
+				"bob":   {demand: 2000, weight: 2000, guarantee: 1500},
+			},
+			expect: map[string]float64{"alice": 1500 * 4000 / 6000.0, "bob": 1500 + 1500*2000/6000.0},
+		},
+		{
+			name:     "Unused share redistributed",
+			capacity: 3000,
+			demands: map[string]uplinkDemand{
+				"alice": {demand: 4000, weight: 4000},
+				"bob":   {demand: 200, weight: 4000},
+			},
+			expect: map[string]float64{"alice": 2800, "bob": 200},
+		},
+		{
+			name:     "Idle user keeps its guarantee",
+			capacity: 3000,
+			demands: map[string]uplinkDemand{
+				"alice": {demand: 4000, weight: 4000},
+				"bob":   {demand: 0, weight: 2000, guarantee: 500},
+			},
+			expect: map[string]float64{"alice": 2500, "bob": 500},
+		},
+		{
+			name:     "Oversubscribed guarantees scaled down",
+			capacity: 1000,
+			demands: map[string]uplinkDemand{
+				"alice": {demand: 4000, weight: 4000, guarantee: 1500},
+				"bob":   {demand: 2000, weight: 2000, guarantee: 500},
+			},
+			expect: map[string]float64{"alice": 750, "bob": 250},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alloc := allocateUplink(tt.capacity, tt.demands)
+			for user, expect := range tt.expect {
+				if math.Abs(alloc[user]-expect) > 0.001 {
+					t.Errorf("Expected %s allotted %v, got %v", user, expect, alloc[user])
+				}
+			}
+		})
+	}
+}
+
+func TestUplinkScheduler_Schedule(t *testing.T) {
+	rlm := NewRateLimiterManager(&Config{
+		DefaultBandwidth: 1000,
+		Users:            map[string]int64{"alice": 2000},
+	})
+	rlm.GetLimiter("alice")
+	rlm.GetLimiter("bob")
+
+	s := NewUplinkScheduler(UplinkConfig{
+		Capacity:   2000,
+		Guarantees: map[string]int64{"bob": 500},
+	}, rlm)
+
+	// Both users idle: demand fits and nobody is restricted
+	s.schedule()
+	if rlm.UserShare("alice") != 1 || rlm.UserShare("bob") != 1 {
+		t.Errorf("Expected full shares while uncongested, got %v and %v", rlm.UserShare("alice"), rlm.UserShare("bob"))
+	}
+
+	// Both users send at their full rates, demanding 3000 of 2000. A burst
+	// of 10s worth of bytes raises the 10s estimate to the rate.
+	rlm.RecordBytes("alice", 2000*10)
+	rlm.RecordBytes("bob", 1000*10)
+	s.schedule()
+
+	// bob gets 500 guaranteed plus a third of the remaining 1500
+	if share := rlm.UserShare("bob"); math.Abs(share-1) > 0.001 {
+		t.Errorf("Expected bob's share 1, got %v", share)
+	}
+	if share := rlm.UserShare("alice"); math.Abs(share-0.5) > 0.001 {
+		t.Errorf("Expected alice's share 0.5, got %v", share)
+	}
+	if got := metricUplinkAllocated.Get("alice"); got != 1000 {
+		t.Errorf("Expected alice allotted 1000 bytes/s, got %d", got)
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxAcceptBackoff bounds the delay between retries of a failing Accept.
+const maxAcceptBackoff = time.Second
+
+// Server accepts client connections on a listener and hands them to a Proxy.
+// Run serves until its context is cancelled or Stop is called; Stop then
+// drains the open connections.
+type Server struct {
+	proxy    *Proxy
+	listener net.Listener
+
+	mu      sync.Mutex
+	http    []*http.Server // admin, metrics and health endpoints
+	conns   map[net.Conn]struct{}
+	stopped bool
+	stop    chan struct{}  // closed by Stop
+	wg      sync.WaitGroup // connection handlers
+}
+
+// NewServer listens on addr (e.g. ":4223") for clients of p.
+func NewServer(p *Proxy, addr string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return NewServerWithListener(p, listener), nil
+}
+
+// NewServerWithListener serves clients of p accepted on listener, e.g. one
+// passed by systemd socket activation.
+func NewServerWithListener(p *Proxy, listener net.Listener) *Server {
+	return &Server{proxy: p, listener: listener, conns: make(map[net.Conn]struct{}), stop: make(chan struct{})}
+}
+
+// Addr returns the address clients connect to.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Run starts the admin endpoint and the proxy's background loops, and
+// accepts clients until ctx is cancelled or Stop is called. Open connections
+// keep being served after Run returns, until Stop. In lame duck mode, Run
+// stops accepting clients and returns once their connections are closed.
+func (s *Server) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := s.proxy.checkMiddleware(); err != nil {
+		s.listener.Close()
+		return err
+	}
+	log.Info().Str("addr", s.Addr().String()).Msg("NATS proxy listening")
+
+	for _, e := range s.proxy.endpoints() {
+		srv, err := s.proxy.startEndpoint(e)
+		if err != nil {
+			s.listener.Close()
+			s.closeEndpoints()
+			return err
+		}
+		s.mu.Lock()
+		s.http = append(s.http, srv)
+		s.mu.Unlock()
+	}
+	s.proxy.runBackground(ctx)
+
+	if err := sdNotify("READY=1"); err != nil {
+		log.Warn().Err(err).Msg("Failed to notify systemd of readiness")
+	}
+	if interval := systemdWatchdogInterval(); interval > 0 {
+		go runSystemdWatchdog(ctx, interval)
+	}
+
+	lameDuck, lameDuckDone := s.proxy.lameDuck.channels()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-lameDuck:
+			log.Info().Str("addr", s.Addr().String()).Msg("Lame duck mode, no longer accepting clients")
+		}
+		s.listener.Close()
+	}()
+
+	var backoff time.Duration
+	for {
+		if cleared := s.proxy.budget.overBudget(); cleared != nil {
+			// Leave clients in the listen backlog until back within budget
+			select {
+			case <-cleared:
+			case <-ctx.Done():
+			case <-s.stop:
+			case <-lameDuck:
+			}
+		}
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				select {
+				case <-lameDuck:
+					// Once lame duck mode closed its connections
+					select {
+					case <-lameDuckDone:
+					case <-ctx.Done():
+					case <-s.stop:
+					}
+				default:
+				}
+				return nil
+			}
+			// E.g. out of file descriptors: retry with backoff, as spinning
+			// doesn't free any
+			backoff = min(max(2*backoff, 5*time.Millisecond), maxAcceptBackoff)
+			log.Error().Err(err).Dur("backoff", backoff).Msg("Accept error")
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		backoff = 0
+		if !s.track(conn) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.untrack(conn)
+			s.proxy.HandleConnection(conn)
+		}()
+	}
+}
+
+// closeEndpoints closes the HTTP endpoints started.
+func (s *Server) closeEndpoints() {
+	s.mu.Lock()
+	endpoints := s.http
+	s.http = nil
+	s.mu.Unlock()
+	for _, srv := range endpoints {
+		srv.Close()
+	}
+}
+
+// Stop stops accepting clients and the HTTP endpoints, and waits up to
+// timeout for open connections to end before closing them and saving the
+// state file. It returns an error if connections had to be closed.
+func (s *Server) Stop(timeout time.Duration) error {
+	sdNotify("STOPPING=1")
+	defer func() {
+		s.proxy.persistState()
+		for _, route := range s.proxy.routes {
+			route.persistState()
+		}
+	}()
+	s.listener.Close()
+	s.mu.Lock()
+	if !s.stopped {
+		close(s.stop)
+	}
+	s.stopped = true
+	s.mu.Unlock()
+	s.closeEndpoints()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	s.mu.Lock()
+	open := len(s.conns)
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	<-done
+	return fmt.Errorf("closed %d connections still open after %s", open, timeout)
+}
+
+// track registers a connection being served, unless the server is stopped.
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.wg.Done()
+}
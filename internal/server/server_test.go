@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// runTestServer runs a server for p on a local port until ctx is cancelled,
+// returning it and a channel receiving the result of Run.
+func runTestServer(ctx context.Context, t *testing.T, p *Proxy) (*Server, chan error) {
+	t.Helper()
+	srv, err := NewServer(p, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- srv.Run(ctx)
+	}()
+	return srv, result
+}
+
+func TestServer_StopDrainsConnections(t *testing.T) {
+	p := newTestProxy(&Config{DefaultBandwidth: 1 << 20})
+	dial, servers := pipeDialer()
+	p.SetDialer(dial)
+	srv, result := runTestServer(context.Background(), t, p)
+
+	client, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	var upstream net.Conn
+	select {
+	case upstream = <-servers:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for upstream dial")
+	}
+	defer upstream.Close()
+
+	input := "PING\r\n"
+	go client.Write([]byte(input))
+	if got := readString(t, upstream, len(input)); got != input {
+		t.Errorf("Expected %q forwarded, got %q", input, got)
+	}
+
+	// The client stays connected past the timeout and gets closed
+	if err := srv.Stop(50 * time.Millisecond); err == nil {
+		t.Error("Expected an error for the connection closed on stop")
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Expected Run to return nil after Stop, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run didn't return after Stop")
+	}
+	if _, err := net.Dial("tcp", srv.Addr().String()); err == nil {
+		t.Error("Expected the listener closed after Stop")
+	}
+}
+
+func TestServer_RunStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	srv, result := runTestServer(ctx, t, newTestProxy(&Config{DefaultBandwidth: 1 << 20}))
+
+	cancel()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Expected Run to return nil once cancelled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run didn't return after its context was cancelled")
+	}
+	if err := srv.Stop(time.Second); err != nil {
+		t.Errorf("Expected a clean stop without connections, got %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ShadowConfig configures mirroring clients' publishes to a second
+// upstream, e.g. a staging cluster being validated for a migration.
+type ShadowConfig struct {
+	// Upstream is the host:port of the shadow cluster.
+	Upstream string `yaml:"upstream"`
+	// Buffer is how many bytes of publishes may be queued per connection
+	// for the shadow. A connection whose shadow falls further behind stops
+	// being mirrored. Defaults to 1MB.
+	Buffer int `yaml:"buffer"`
+}
+
+// maxShadowLine bounds a protocol line buffered by the shadow framer.
+const maxShadowLine = 1 << 20
+
+var (
+	errShadowBehind = errors.New("shadow fell behind")
+	errShadowLine   = errors.New("protocol line too long")
+)
+
+// shadowConn mirrors a client's CONNECT and publishes, as flushed to the
+// upstream after rate limiting, to a shadow upstream. It never blocks or
+// fails the client: a shadow that can't be dialed, errors or falls behind
+// is dropped, and the client keeps being served by the upstream.
+//
+// Subscriptions aren't mirrored, and the shadow's PINGs are answered by the
+// proxy. The client's CONNECT is replayed as is, so clients authenticating
+// with a nonce signature (JWT/nkey) are rejected by the shadow.
+type shadowConn struct {
+	queue  chan []byte
+	queued atomic.Int64 // bytes in queue
+	limit  int64
+	pings  chan struct{} // PINGs from the shadow to answer
+	stop   chan struct{}
+	failed atomic.Bool
+	remote string // of the client, for logging
+}
+
+// newShadowConn dials the shadow in the background and starts mirroring to
+// it.
+func newShadowConn(dial DialFunc, buffer int, remote string) *shadowConn {
+	s := &shadowConn{
+		queue:  make(chan []byte, 1024),
+		limit:  int64(buffer),
+		pings:  make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		remote: remote,
+	}
+	go func() {
+		conn, err := dial()
+		if err != nil {
+			s.fail("dial", err)
+			return
+		}
+		go s.readShadow(conn)
+		s.run(conn)
+	}()
+	return s
+}
+
+// mirror queues data the client sent upstream.
+func (s *shadowConn) mirror(data []byte) {
+	if s.failed.Load() {
+		return
+	}
+	if s.queued.Add(int64(len(data))) > s.limit {
+		s.fail("behind", errShadowBehind)
+		return
+	}
+	select {
+	case s.queue <- bytes.Clone(data):
+	default:
+		s.fail("behind", errShadowBehind)
+	}
+}
+
+// close stops mirroring once the queued publishes are written.
+func (s *shadowConn) close() {
+	close(s.stop)
+}
+
+func (s *shadowConn) fail(reason string, err error) {
+	if s.failed.CompareAndSwap(false, true) {
+		log.Warn().Err(err).Str("remote", s.remote).Msg("Shadow upstream dropped")
+		metricShadowFailures.Add(1, reason)
+	}
+}
+
+// run writes the publishes and PONGs to the shadow until stopped.
+func (s *shadowConn) run(conn net.Conn) {
+	defer conn.Close()
+	var framer shadowFramer
+	write := func(data []byte) bool {
+		s.queued.Add(-int64(len(data)))
+		frames, err := framer.feed(data)
+		if err != nil {
+			s.fail("protocol", err)
+			return false
+		}
+		if len(frames) == 0 {
+			return true
+		}
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write(frames); err != nil {
+			s.fail("write", err)
+			return false
+		}
+		metricShadowBytes.Add(int64(len(frames)))
+		return true
+	}
+	for !s.failed.Load() {
+		select {
+		case data := <-s.queue:
+			if !write(data) {
+				return
+			}
+		case <-s.pings:
+			// Between frames, as the framer only returns complete ones
+			conn.Write([]byte("PONG\r\n"))
+		case <-s.stop:
+			for {
+				select {
+				case data := <-s.queue:
+					if !write(data) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// readShadow discards what the shadow sends, except for PINGs to answer and
+// errors.
+func (s *shadowConn) readShadow(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return
+		}
+		switch {
+		case bytes.HasPrefix(line, []byte("PING")):
+			select {
+			case s.pings <- struct{}{}:
+			default:
+			}
+		case bytes.HasPrefix(line, []byte("-ERR")):
+			s.fail("error", errors.New(strings.TrimSpace(string(line))))
+			conn.Close()
+			return
+		}
+	}
+}
+
+// shadowFramer splits the client's protocol stream into frames, keeping
+// CONNECT, PUB and HPUB frames. Frames are returned once complete, so other
+// frames can be written between them.
+type shadowFramer struct {
+	line    []byte // control line read so far
+	payload int    // payload bytes, with CRLF, left of the current frame
+	keep    bool   // whether the current frame is kept
+	out     []byte // kept bytes, complete frames first
+	done    int    // length of the complete frames in out
+}
+
+// feed consumes data, returning the kept frames it completed.
+func (f *shadowFramer) feed(data []byte) ([]byte, error) {
+	f.out = f.out[f.done:]
+	f.done = 0
+	for len(data) > 0 {
+		if f.payload > 0 {
+			n := min(f.payload, len(data))
+			if f.keep {
+				f.out = append(f.out, data[:n]...)
+			}
+			f.payload -= n
+			data = data[n:]
+			if f.payload == 0 && f.keep {
+				f.done = len(f.out)
+			}
+			continue
+		}
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			if len(f.line)+len(data) > maxShadowLine {
+				return nil, errShadowLine
+			}
+			f.line = append(f.line, data...)
+			break
+		}
+		f.line = append(f.line, data[:i+1]...)
+		data = data[i+1:]
+		f.frame()
+		f.line = f.line[:0]
+	}
+	return bytes.Clone(f.out[:f.done]), nil
+}
+
+// frame starts the frame of a complete control line.
+func (f *shadowFramer) frame() {
+	fields := bytes.Fields(f.line)
+	if len(fields) == 0 {
+		return
+	}
+	f.keep = false
+	switch strings.ToUpper(string(fields[0])) {
+	case "CONNECT":
+		f.keep = true
+	case "PUB", "HPUB":
+		if size := parseSize(fields[len(fields)-1]); size >= 0 && len(fields) >= 3 {
+			f.keep = true
+			f.payload = size + 2
+		}
+	}
+	if f.keep {
+		f.out = append(f.out, f.line...)
+		if f.payload == 0 {
+			f.done = len(f.out)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShadowFramer(t *testing.T) {
+	var f shadowFramer
+	stream := "CONNECT {\"user\":\"alice\"}\r\nSUB foo 1\r\nPUB foo 5\r\nhello\r\nPING\r\nHPUB bar 12 14\r\nNATS/1.0\r\n\r\nhi\r\nUNSUB 1\r\n"
+	var got string
+	// Fed in small chunks, frames split across them come out whole
+	for i := 0; i < len(stream); i += 7 {
+		frames, err := f.feed([]byte(stream[i:min(i+7, len(stream))]))
+		if err != nil {
+			t.Fatalf("feed failed: %v", err)
+		}
+		if len(frames) > 0 && frames[len(frames)-1] != '\n' {
+			t.Errorf("Expected whole frames, got %q", frames)
+		}
+		got += string(frames)
+	}
+	expected := "CONNECT {\"user\":\"alice\"}\r\nPUB foo 5\r\nhello\r\nHPUB bar 12 14\r\nNATS/1.0\r\n\r\nhi\r\n"
+	if got != expected {
+		t.Errorf("Expected CONNECT and publishes only, got %q", got)
+	}
+}
+
+func TestShadowConn_MirrorsAndAnswersPings(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	shadow := newShadowConn(func() (net.Conn, error) { return client, nil }, 1<<20, "test")
+
+	shadow.mirror([]byte("CONNECT {}\r\nSUB foo 1\r\nPUB foo 2\r\n"))
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(server)
+	if line, _ := r.ReadString('\n'); line != "CONNECT {}\r\n" {
+		t.Fatalf("Expected the CONNECT first, got %q", line)
+	}
+	// A PING between frames is answered once the publish is complete
+	go server.Write([]byte("PING\r\n"))
+	time.Sleep(10 * time.Millisecond)
+	shadow.mirror([]byte("hi\r\n"))
+	for _, expected := range []string{"PUB foo 2\r\n", "hi\r\n"} {
+		line, _ := r.ReadString('\n')
+		if line == "PONG\r\n" {
+			line, _ = r.ReadString('\n')
+		}
+		if line != expected {
+			t.Fatalf("Expected %q, got %q", expected, line)
+		}
+	}
+
+	go server.Write([]byte("-ERR 'Authorization Violation'\r\n"))
+	deadline := time.Now().Add(time.Second)
+	for !shadow.failed.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !shadow.failed.Load() {
+		t.Error("Expected the shadow dropped on -ERR")
+	}
+	shadow.close()
+}
+
+func TestShadowConn_DropsWhenBehind(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	shadow := newShadowConn(func() (net.Conn, error) { <-block; return nil, net.ErrClosed }, 8, "test")
+	shadow.mirror([]byte("PUB foo 2\r\nhi\r\n"))
+	if !shadow.failed.Load() {
+		t.Error("Expected the shadow dropped once over its buffer")
+	}
+	shadow.close()
+}
+
+func TestProxy_ShadowDial(t *testing.T) {
+	dir := t.TempDir()
+	upstreamCert, upstreamKey := writeTestCert(t, dir, "localhost")
+	shadow := startFakeTLSNATS(t, "shadow", upstreamCert, upstreamKey)
+	_, port, _ := net.SplitHostPort(shadow.Addr())
+	p, err := NewProxy("127.0.0.1", 4222, writeTestConfig(t, "max_concurrent_dials: 1\ndial_timeout: 100ms\n"+
+		"upstream_tls:\n  ca: "+upstreamCert+"\n  server_name: nats.example.com\n"+
+		"shadow:\n  upstream: localhost:"+port+"\n"))
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+
+	// The shadow is dialed over TLS, verified as its own host
+	conn, err := p.shadowDial()
+	if err != nil {
+		t.Fatalf("shadowDial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") || !strings.Contains(line, `"shadow"`) {
+		t.Errorf("Expected the shadow's INFO, got %q, %v", line, err)
+	}
+
+	// and waits for a dial slot like the upstream
+	p.dialSlots <- struct{}{}
+	if _, err := p.shadowDial(); !errors.Is(err, errDialSlotTimeout) {
+		t.Errorf("Expected %v with no dial slot free, got %v", errDialSlotTimeout, err)
+	}
+}
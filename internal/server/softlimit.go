@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SoftLimitConfig configures a warning tier below users' limits: users
+// whose throughput crosses their soft limit are warned about, and can be
+// told themselves, before throttling at the limit changes their behavior.
+type SoftLimitConfig struct {
+	// Ratio of the limit soft limits are at. Defaults to 0.8.
+	Ratio float64 `yaml:"ratio"`
+	// Users have soft limits of their own, in bytes per second.
+	Users map[string]int64 `yaml:"users"`
+	// Cooldown between warnings about a user, and advisories to a
+	// connection, while over the soft limit. Defaults to 1m.
+	Cooldown time.Duration `yaml:"cooldown"`
+	// AdvisorySubject is delivered advisories of clients crossing their soft
+	// limit, if they subscribed to it. Empty sends none.
+	AdvisorySubject string `yaml:"advisory_subject"`
+}
+
+// normalize applies defaults and validates the configuration.
+func (c *SoftLimitConfig) normalize() error {
+	if c.Ratio == 0 {
+		c.Ratio = 0.8
+	}
+	if c.Ratio <= 0 || c.Ratio >= 1 {
+		return fmt.Errorf("soft_limit ratio must be between 0 and 1")
+	}
+	if err := checkBandwidths("soft_limit user", c.Users); err != nil {
+		return err
+	}
+	if c.Cooldown <= 0 {
+		c.Cooldown = time.Minute
+	}
+	return nil
+}
+
+// softLimitCheckInterval is how often a connection checks its user's
+// throughput against the soft limit.
+const softLimitCheckInterval = time.Second
+
+// SoftLimitAdvisory is the payload of advisories sent to clients over their
+// soft limit.
+type SoftLimitAdvisory struct {
+	User       string  `json:"user"`
+	Throughput float64 `json:"throughput"` // over the last 10s, bytes/s
+	SoftLimit  float64 `json:"soft_limit"`
+	Limit      float64 `json:"limit"` // throttled at, bytes/s
+}
+
+// softLimits tracks users over their soft limit, warning about each at most
+// once per cooldown.
+type softLimits struct {
+	cfg    *SoftLimitConfig
+	rlm    *RateLimiterManager
+	mu     sync.Mutex
+	warned map[string]time.Time // last warning by user
+}
+
+func newSoftLimits(cfg *SoftLimitConfig, rlm *RateLimiterManager) *softLimits {
+	return &softLimits{cfg: cfg, rlm: rlm, warned: make(map[string]time.Time)}
+}
+
+// check reports whether user is over their soft limit, warning about it if
+// the cooldown passed since the previous warning.
+func (s *softLimits) check(user string, now time.Time) (SoftLimitAdvisory, bool) {
+	usage := s.rlm.Usage(user)
+	advisory := SoftLimitAdvisory{
+		User:       user,
+		Throughput: usage.Throughput,
+		SoftLimit:  usage.EffectiveBandwidth * s.cfg.Ratio,
+		Limit:      usage.EffectiveBandwidth,
+	}
+	soft, explicit := s.cfg.Users[user]
+	switch {
+	case explicit:
+		advisory.SoftLimit = float64(soft)
+	case advisory.Limit <= 0:
+		// Unlimited users have no soft limit unless given one
+		return advisory, false
+	}
+	if advisory.Throughput <= advisory.SoftLimit {
+		return advisory, false
+	}
+
+	s.mu.Lock()
+	warn := now.Sub(s.warned[user]) >= s.cfg.Cooldown
+	if warn {
+		s.warned[user] = now
+	}
+	s.mu.Unlock()
+	if warn {
+		log.Warn().Str("user", user).Float64("throughput", advisory.Throughput).
+			Float64("soft_limit", advisory.SoftLimit).Float64("limit", advisory.Limit).
+			Msg("User over soft limit")
+		metricSoftLimitWarnings.Add(1, user)
+	}
+	return advisory, true
+}
+
+// checkSoftLimit checks the user's throughput against their soft limit,
+// at most once per check interval, and sends the client an advisory if it
+// subscribed to them. A failed write is left to the downstream direction,
+// which closes the connection.
+func (c *ClientMessageParser) checkSoftLimit(now time.Time) {
+	if now.Sub(c.softChecked) < softLimitCheckInterval {
+		return
+	}
+	c.softChecked = now
+	advisory, over := c.soft.check(c.user, now)
+	subject := c.soft.cfg.AdvisorySubject
+	if !over || subject == "" || c.clientWriter == nil || now.Sub(c.softAdvised) < c.soft.cfg.Cooldown {
+		return
+	}
+	for sid, pattern := range c.subs {
+		if !subjectMatches(pattern, subject) {
+			continue
+		}
+		c.softAdvised = now
+		payload, _ := json.Marshal(advisory)
+		frame := fmt.Appendf(nil, "MSG %s %s %d\r\n", subject, sid, len(payload))
+		frame = append(frame, payload...)
+		frame = append(frame, '\r', '\n')
+		c.clientWriter.WriteFrame(frame)
+		return
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSoftLimits_Check(t *testing.T) {
+	rlm := NewRateLimiterManager(&Config{DefaultBandwidth: 1000})
+	cfg := &SoftLimitConfig{Users: map[string]int64{"bob": 5000}}
+	cfg.normalize()
+	soft := newSoftLimits(cfg, rlm)
+	now := time.Now()
+
+	rlm.RecordBytes("alice", 5000) // ~500 B/s over 10s, under 80% of 1000
+	if _, over := soft.check("alice", now); over {
+		t.Error("Expected alice under her soft limit")
+	}
+	rlm.RecordBytes("alice", 5000)
+	warnings := metricSoftLimitWarnings.Get("alice")
+	advisory, over := soft.check("alice", now)
+	if !over || advisory.SoftLimit != 800 || advisory.Limit != 1000 {
+		t.Errorf("Expected alice over a soft limit of 800, got %+v", advisory)
+	}
+	soft.check("alice", now.Add(time.Second))
+	if got := metricSoftLimitWarnings.Get("alice") - warnings; got != 1 {
+		t.Errorf("Expected one warning per cooldown, got %d", got)
+	}
+
+	rlm.RecordBytes("bob", 10000)
+	if advisory, over := soft.check("bob", now); over || advisory.SoftLimit != 5000 {
+		t.Errorf("Expected bob under his own soft limit, got %+v", advisory)
+	}
+
+	// Unlimited users are only checked against soft limits of their own
+	unlimited := newSoftLimits(cfg, NewRateLimiterManager(&Config{}))
+	unlimited.rlm.RecordBytes("carol", 10000)
+	if _, over := unlimited.check("carol", now); over {
+		t.Error("Expected an unlimited user never over a soft limit")
+	}
+	unlimited.rlm.RecordBytes("bob", 100000)
+	if advisory, over := unlimited.check("bob", now); !over || advisory.SoftLimit != 5000 {
+		t.Errorf("Expected an unlimited user over their own soft limit, got %+v", advisory)
+	}
+}
+
+func TestClientMessageParser_SoftLimitAdvisory(t *testing.T) {
+	rlm := NewRateLimiterManager(&Config{DefaultBandwidth: 1000})
+	cfg := &SoftLimitConfig{AdvisorySubject: "$PROXY.ADVISORY.SOFT_LIMIT"}
+	cfg.normalize()
+
+	var client bytes.Buffer
+	parser := NewClientMessageParser(strings.NewReader(""), &bytes.Buffer{}, rlm)
+	parser.SetClientWriter(newClientWriter(&client))
+	parser.SetSoftLimits(newSoftLimits(cfg, rlm))
+	parser.user = "alice"
+	parser.subs["4"] = "$PROXY.ADVISORY.>"
+
+	rlm.RecordBytes("alice", 20000)
+	now := time.Now()
+	parser.checkSoftLimit(now)
+	parser.checkSoftLimit(now.Add(2 * time.Second)) // within the cooldown
+
+	header, payload, ok := strings.Cut(client.String(), "\r\n")
+	if !ok || !strings.HasPrefix(header, "MSG $PROXY.ADVISORY.SOFT_LIMIT 4 ") || strings.Count(client.String(), "MSG") != 1 {
+		t.Fatalf("Expected one advisory to the subscription, got %q", client.String())
+	}
+	var advisory SoftLimitAdvisory
+	if err := json.Unmarshal([]byte(strings.TrimSpace(payload)), &advisory); err != nil || advisory.User != "alice" {
+		t.Errorf("Expected alice's advisory, got %q", payload)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// persistedState is the runtime state kept in the state file across
+// restarts, so an operator's mitigations don't vanish with the process.
+type persistedState struct {
+	// Overrides are the bandwidths set via the admin API, by user.
+	Overrides map[string]int64 `json:"overrides"`
+	// Buckets are the bucket states of strict users, by user.
+	Buckets map[string]persistedBucket `json:"buckets,omitempty"`
+	// Freezes are the publish freezes added via the admin API.
+	Freezes []Freeze `json:"freezes,omitempty"`
+}
+
+// persistedBucket is the state of a user's main limiter when it was saved.
+type persistedBucket struct {
+	Tokens  int64     `json:"tokens"`
+	SavedAt time.Time `json:"saved_at"`
+}
+
+// loadState reads the state file. A missing file is an empty state.
+func loadState(path string) (*persistedState, error) {
+	st := &persistedState{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", path, err)
+	}
+	return st, nil
+}
+
+// saveState replaces the state file, atomically so a crash never leaves a
+// truncated file behind.
+func saveState(path string, st *persistedState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// restoreState reapplies the persisted limit overrides, dropping invalid
+// ones.
+func (p *Proxy) restoreState() error {
+	st, err := loadState(p.currentConfig().StateFile)
+	if err != nil {
+		return err
+	}
+	restored := make(map[string]int64, len(st.Overrides))
+	for user, bw := range st.Overrides {
+		if bw <= 0 {
+			log.Warn().Str("user", user).Int64("bandwidth", bw).Msg("Dropping invalid persisted limit override")
+			continue
+		}
+		restored[user] = bw
+	}
+	p.rateLimiterMgr.RestoreOverrides(restored)
+
+	buckets := 0
+	for user, bucket := range st.Buckets {
+		if !slices.Contains(p.currentConfig().StrictUsers, user) {
+			continue
+		}
+		p.rateLimiterMgr.RestoreTokens(user, bucket.Tokens, bucket.SavedAt)
+		buckets++
+	}
+	p.rateLimiterMgr.freezes.restore(st.Freezes)
+	log.Info().Str("file", p.currentConfig().StateFile).Int("overrides", len(restored)).Int("buckets", buckets).
+		Int("freezes", len(st.Freezes)).Msg("Restored persisted state")
+	return nil
+}
+
+// persistState writes the current limit overrides and strict users' buckets
+// to the state file, if one is configured. Concurrent calls write one after
+// the other, so an older snapshot never replaces a newer one.
+func (p *Proxy) persistState() {
+	if p.currentConfig().StateFile == "" {
+		return
+	}
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+	now := p.rateLimiterMgr.Clock().Now()
+	st := &persistedState{Overrides: p.rateLimiterMgr.Overrides(), Freezes: p.rateLimiterMgr.freezes.created(now)}
+	if tokens := p.rateLimiterMgr.Tokens(p.currentConfig().StrictUsers); len(tokens) > 0 {
+		st.Buckets = make(map[string]persistedBucket, len(tokens))
+		for user, n := range tokens {
+			st.Buckets[user] = persistedBucket{Tokens: n, SavedAt: now}
+		}
+	}
+	if err := saveState(p.currentConfig().StateFile, st); err != nil {
+		log.Error().Err(err).Str("file", p.currentConfig().StateFile).Msg("Failed to persist state")
+	}
+}
+
+// runStatePersister saves the state file every state interval, keeping the
+// persisted buckets of strict users current, until ctx is cancelled.
+func (p *Proxy) runStatePersister(ctx context.Context) {
+	ticker := time.NewTicker(p.currentConfig().StateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.persistState()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
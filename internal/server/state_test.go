@@ -0,0 +1,104 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxy_PersistedOverrides(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	config := writeTestConfig(t, "default_bandwidth: 1024\nadmin_token: root-token\nstate_file: "+stateFile+"\n"+
+		"tenants:\n  acme:\n    users:\n      acme-alice: 2048\n      acme-bob: 2048\n")
+
+	p, err := NewProxy("localhost", 4222, config)
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	for _, path := range []string{"/api/v1/tenants/acme/users/acme-alice", "/api/v1/tenants/acme/users/acme-bob", "/api/v1/users/carol"} {
+		req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(`{"bandwidth": 512}`))
+		req.Header.Set("Authorization", "Bearer root-token")
+		rec := httptest.NewRecorder()
+		p.AdminHandler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	restarted, err := NewProxy("localhost", 4222, config)
+	if err != nil {
+		t.Fatalf("NewProxy failed after restart: %v", err)
+	}
+	for _, user := range []string{"acme-alice", "carol"} {
+		if bw := restarted.rateLimiterMgr.Bandwidth(user); bw != 512 {
+			t.Errorf("Expected %s's override restored after restart, got %d", user, bw)
+		}
+	}
+
+	// acme-bob's override outlives the tenant that managed it, like any user's
+	os.WriteFile(config, []byte("default_bandwidth: 1024\nstate_file: "+stateFile+"\n"+
+		"tenants:\n  acme:\n    users:\n      acme-alice: 2048\n"), 0o644)
+	reconfigured, err := NewProxy("localhost", 4222, config)
+	if err != nil {
+		t.Fatalf("NewProxy failed after reconfiguration: %v", err)
+	}
+	if overrides := reconfigured.rateLimiterMgr.Overrides(); len(overrides) != 3 || overrides["acme-bob"] != 512 {
+		t.Errorf("Expected all overrides restored, got %v", overrides)
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	dir := t.TempDir()
+	if st, err := loadState(filepath.Join(dir, "missing.json")); err != nil || len(st.Overrides) != 0 {
+		t.Errorf("Expected a missing state file to be empty, got %+v, %v", st, err)
+	}
+	corrupt := filepath.Join(dir, "corrupt.json")
+	os.WriteFile(corrupt, []byte("{"), 0o644)
+	if _, err := loadState(corrupt); err == nil {
+		t.Error("Expected an error for a corrupt state file")
+	}
+}
+
+func TestProxy_PersistedStrictBuckets(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	config := writeTestConfig(t, "default_bandwidth: 1024\nstate_file: "+stateFile+"\nstrict_users: [metered]\n")
+
+	p, err := NewProxy("localhost", 4222, config)
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	p.rateLimiterMgr.GetLimiter("metered").TakeAvailable(1024)
+	p.rateLimiterMgr.GetLimiter("unmetered").TakeAvailable(1024)
+	p.persistState()
+
+	restarted, err := NewProxy("localhost", 4222, config)
+	if err != nil {
+		t.Fatalf("NewProxy failed after restart: %v", err)
+	}
+	if available := restarted.rateLimiterMgr.GetLimiter("metered").Available(); available > 512 {
+		t.Errorf("Expected the strict user's bucket to stay drained after restart, got %d tokens", available)
+	}
+	if available := restarted.rateLimiterMgr.GetLimiter("unmetered").Available(); available != 1024 {
+		t.Errorf("Expected other users' buckets to start full, got %d tokens", available)
+	}
+
+	// Tokens refill for the time the proxy was down
+	st, _ := loadState(stateFile)
+	st.Buckets["metered"] = persistedBucket{Tokens: 0, SavedAt: time.Now().Add(-time.Hour)}
+	saveState(stateFile, st)
+	refilled, err := NewProxy("localhost", 4222, config)
+	if err != nil {
+		t.Fatalf("NewProxy failed after a long downtime: %v", err)
+	}
+	if available := refilled.rateLimiterMgr.GetLimiter("metered").Available(); available != 1024 {
+		t.Errorf("Expected the bucket refilled after a long downtime, got %d tokens", available)
+	}
+
+	if _, err := LoadConfig(writeTestConfig(t, "strict_users: [metered]\n")); err == nil {
+		t.Error("Expected an error for strict_users without state_file")
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// statsWindows are the time constants of the decayed throughput estimates.
+var statsWindows = [...]time.Duration{time.Second, 10 * time.Second, time.Minute}
+
+// ThroughputStats are a user's exponentially decayed throughput estimates in
+// bytes per second.
+type ThroughputStats struct {
+	Rate1s  float64 `json:"rate_1s"`
+	Rate10s float64 `json:"rate_10s"`
+	Rate60s float64 `json:"rate_60s"`
+	Total   int64   `json:"total_bytes"`
+}
+
+// userStats tracks a user's throughput. Each estimate decays by e^(-dt/window),
+// so a steady rate r converges to r in every window while a burst fades after
+// a few windows.
+type userStats struct {
+	mu    sync.Mutex
+	rates [len(statsWindows)]float64 // as of last
+	last  time.Time
+	total int64
+}
+
+// add records n bytes sent at now.
+func (s *userStats) add(n int64, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.decay(now)
+	for i, window := range statsWindows {
+		s.rates[i] += float64(n) / window.Seconds()
+	}
+	s.total += n
+}
+
+// decay advances the estimates to now. Callers must hold s.mu.
+func (s *userStats) decay(now time.Time) {
+	if dt := now.Sub(s.last); dt > 0 && !s.last.IsZero() {
+		for i, window := range statsWindows {
+			s.rates[i] *= math.Exp(-dt.Seconds() / window.Seconds())
+		}
+	}
+	if now.After(s.last) {
+		s.last = now
+	}
+}
+
+// snapshot returns the estimates as of now.
+func (s *userStats) snapshot(now time.Time) ThroughputStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.decay(now)
+	return ThroughputStats{
+		Rate1s:  s.rates[0],
+		Rate10s: s.rates[1],
+		Rate60s: s.rates[2],
+		Total:   s.total,
+	}
+}
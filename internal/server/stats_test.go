@@ -0,0 +1,42 @@
+package server
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestUserStats(t *testing.T) {
+	var s userStats
+	start := time.Unix(1000, 0)
+
+	// A steady 1000 bytes/s converges to 1000 in every window
+	for i := 0; i < 600; i++ {
+		s.add(100, start.Add(time.Duration(i)*100*time.Millisecond))
+	}
+	now := start.Add(60 * time.Second)
+	steady := s.snapshot(now)
+	for name, rate := range map[string]float64{"1s": steady.Rate1s, "10s": steady.Rate10s} {
+		if math.Abs(rate-1000) > 100 {
+			t.Errorf("Expected %s rate about 1000, got %v", name, rate)
+		}
+	}
+	if steady.Rate60s < 500 || steady.Rate60s > 1000 {
+		t.Errorf("Expected 60s rate still converging towards 1000, got %v", steady.Rate60s)
+	}
+	if steady.Total != 60000 {
+		t.Errorf("Expected 60000 total bytes, got %d", steady.Total)
+	}
+
+	// After 10s of silence the short window has forgotten, the long one hasn't
+	idle := s.snapshot(now.Add(10 * time.Second))
+	if idle.Rate1s > 1 {
+		t.Errorf("Expected 1s rate decayed to 0, got %v", idle.Rate1s)
+	}
+	if idle.Rate10s > steady.Rate10s/2 {
+		t.Errorf("Expected 10s rate decayed, got %v", idle.Rate10s)
+	}
+	if idle.Rate60s < steady.Rate60s*0.8 {
+		t.Errorf("Expected 60s rate mostly retained, got %v", idle.Rate60s)
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+import "strings"
+
+// subjectMatches reports whether subject matches pattern, which may contain
+// the NATS wildcards '*' (one token) and '>' (one or more trailing tokens).
+func subjectMatches(pattern, subject string) bool {
+	for {
+		pt, prest, pmore := strings.Cut(pattern, ".")
+		st, srest, smore := strings.Cut(subject, ".")
+
+		switch {
+		case pt == ">":
+			return st != ""
+		case pt != "*" && pt != st:
+			return false
+		case !pmore || !smore:
+			return pmore == smore
+		}
+		pattern, subject = prest, srest
+	}
+}
+
+// matchesAny reports whether subject matches any of the patterns.
+func matchesAny(patterns []string, subject string) bool {
+	for _, pattern := range patterns {
+		if subjectMatches(pattern, subject) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package server
+
+import "testing"
+
+func TestSubjectMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		subject string
+		expect  bool
+	}{
+		{"foo.bar", "foo.bar", true},
+		{"foo.bar", "foo.baz", false},
+		{"foo.*", "foo.bar", true},
+		{"foo.*", "foo.bar.baz", false},
+		{"foo.*", "foo", false},
+		{"foo.>", "foo.bar.baz", true},
+		{"foo.>", "foo", false},
+		{"*.bar", "foo.bar", true},
+		{">", "foo", true},
+		{"$JS.ACK.>", "$JS.ACK.ORDERS.consumer.1.2.3", true},
+		{"foo", "foo.bar", false},
+	}
+
+	for _, tt := range tests {
+		if got := subjectMatches(tt.pattern, tt.subject); got != tt.expect {
+			t.Errorf("subjectMatches(%q, %q) = %v, expected %v", tt.pattern, tt.subject, got, tt.expect)
+		}
+	}
+}
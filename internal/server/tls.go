@@ -0,0 +1,199 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newTLSConfig loads the certificates served to clients: the proxy's own and
+// those of its SNI routes, picked by the server name clients connect to.
+// Names of ACME hosts are served the certificates m obtains.
+func newTLSConfig(cfg *TLSConfig, m *autocert.Manager) (*tls.Config, error) {
+	var certs []tls.Certificate
+	if cfg.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	for name, route := range cfg.Routes {
+		if route.Cert == "" {
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(route.Cert, route.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls certificate of route %s: %w", name, err)
+		}
+		// Prefer the route's certificate for its name
+		certs = append([]tls.Certificate{cert}, certs...)
+	}
+	config := &tls.Config{Certificates: certs, MinVersion: tls.VersionTLS12}
+	if cfg.CA != "" {
+		pool, err := loadCertPool(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls ca: %w", err)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if cfg.WebSocket {
+		config.NextProtos = []string{alpnHTTP}
+	}
+	if m != nil {
+		config.GetCertificate = acmeCertificate(m, cfg.ACME.Hosts)
+		if cfg.ACME.Challenge == challengeTLSALPN {
+			config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+		}
+	}
+	return config, nil
+}
+
+// newRoutes creates the proxies serving the clients of each SNI route, with
+// the route's own upstream and configuration.
+func newRoutes(routes map[string]*SNIRoute) (map[string]*Proxy, error) {
+	proxies := make(map[string]*Proxy, len(routes))
+	for name, route := range routes {
+		config, err := LoadConfig(route.Config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config of route %s: %w", name, err)
+		}
+		host, portStr, _ := net.SplitHostPort(route.Upstream)
+		port, _ := strconv.Atoi(portStr)
+		if proxies[name], err = newProxy(host, port, config); err != nil {
+			return nil, fmt.Errorf("route %s: %w", name, err)
+		}
+	}
+	return proxies, nil
+}
+
+// handshake terminates TLS of a client connection.
+func (p *Proxy) handshake(clientConn net.Conn) (*tls.Conn, error) {
+	conn := tls.Server(clientConn, p.tls.Load())
+	conn.SetDeadline(time.Now().Add(p.currentConfig().TLS.HandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// transportOf unwraps the TLS and WebSocket layers of a client connection,
+// reporting whether one of them was TLS.
+func transportOf(conn net.Conn) (raw net.Conn, secure bool) {
+	for {
+		if _, ok := conn.(*tls.Conn); ok {
+			secure = true
+		}
+		layered, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return conn, secure
+		}
+		conn = layered.NetConn()
+	}
+}
+
+// route returns the proxy serving clients that connected to serverName.
+func (p *Proxy) route(serverName string) *Proxy {
+	if route, ok := p.routes[strings.ToLower(serverName)]; ok {
+		metricSNIConnections.Add(1, strings.ToLower(serverName))
+		return route
+	}
+	return p
+}
+
+// tlsInfo returns an upstream INFO line telling the client whether TLS is
+// required: the NATS client libraries refuse a secure connection to a server
+// that doesn't announce it, and clients served without TLS mustn't upgrade
+// because the upstream requires it of the proxy. Other lines are returned
+// unchanged.
+func tlsInfo(line []byte, required bool) []byte {
+	secured, err := setInfoField(line, "tls_required", strconv.FormatBool(required))
+	if errors.Is(err, errNotInfo) {
+		return line
+	} else if err != nil {
+		log.Debug().Err(err).Msg("Failed to parse upstream INFO")
+		return line
+	}
+	return secured
+}
+
+// tlsFirstDelay is how long clients may take to start the TLS handshake
+// before they're taken to wait for INFO first, as in nats-server.
+const tlsFirstDelay = 50 * time.Millisecond
+
+// startsHandshake reports whether a client starts the TLS handshake within
+// tlsFirstDelay, returning the connection with the bytes read ahead still to
+// be read if so.
+func startsHandshake(clientConn net.Conn) (net.Conn, bool, error) {
+	b := make([]byte, 1)
+	clientConn.SetReadDeadline(time.Now().Add(tlsFirstDelay))
+	_, err := clientConn.Read(b)
+	clientConn.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return clientConn, false, nil
+	case err != nil:
+		return nil, false, err
+	}
+	return &prefixConn{Conn: clientConn, prefix: b}, true, nil
+}
+
+// serveInfoFirst serves a client waiting for INFO before upgrading to TLS,
+// sending it the INFO of a new upstream connection in plaintext first.
+func (p *Proxy) serveInfoFirst(clientConn net.Conn) {
+	remote := clientConn.RemoteAddr().String()
+	upstream, err := p.dialUpstream()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to connect to upstream")
+		metricConnectionsClosed.Add(1, string(closeDialError))
+		clientConn.SetWriteDeadline(time.Now().Add(time.Second))
+		clientConn.Write(clientErrorLine(closeDialError))
+		clientConn.Close()
+		return
+	}
+	deadline := time.Now().Add(p.currentConfig().TLS.HandshakeTimeout)
+	upstream.SetReadDeadline(deadline)
+	info, err := readInfo(upstream)
+	upstream.SetReadDeadline(time.Time{})
+	if err == nil {
+		info = tlsInfo(info, true)
+		clientConn.SetWriteDeadline(deadline)
+		_, err = clientConn.Write(info)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("remote", remote).Msg("Failed to send upstream INFO ahead of TLS handshake")
+		metricConnectionsClosed.Add(1, string(closeTLSHandshake))
+		upstream.Close()
+		clientConn.Close()
+		return
+	}
+
+	conn, err := p.handshake(clientConn)
+	if err != nil {
+		log.Warn().Err(err).Str("remote", remote).Msg("TLS handshake failed")
+		metricConnectionsClosed.Add(1, string(closeTLSHandshake))
+		upstream.Close()
+		clientConn.Close()
+		return
+	}
+	if name := conn.ConnectionState().ServerName; p.routes[strings.ToLower(name)] != nil {
+		log.Warn().Str("remote", remote).Str("server_name", name).
+			Msg("SNI routes are only served to clients that handshake first, closing client")
+		metricConnectionsClosed.Add(1, string(closeTLSHandshake))
+		upstream.Close()
+		conn.Close()
+		return
+	}
+	p.serve(conn, upstream, info)
+}
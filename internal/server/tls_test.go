@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// writeTestCert writes a self-signed certificate for names and its key to
+// dir, returning their paths.
+func writeTestCert(t *testing.T, dir string, names ...string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey failed: %v", err)
+	}
+	certFile = filepath.Join(dir, names[0]+".crt")
+	keyFile = filepath.Join(dir, names[0]+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestProxy_SNIRoutes(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "nats.example.com")
+	routeCert, routeKey := writeTestCert(t, dir, "tenant-b.nats.example.com")
+	routeConfig := filepath.Join(dir, "tenant-b.yaml")
+	os.WriteFile(routeConfig, []byte("default_bandwidth: 2048\n"), 0o644)
+
+	upstreamA := startFakeNATS(t, "cluster-a").Addr()
+	upstreamB := startFakeNATS(t, "cluster-b").Addr()
+	host, port, _ := net.SplitHostPort(upstreamA)
+	config := writeTestConfig(t, "default_bandwidth: 1024\ntls:\n  cert: "+certFile+"\n  key: "+keyFile+"\n"+
+		"  routes:\n    Tenant-B.nats.example.com:\n      upstream: "+upstreamB+"\n      config: "+routeConfig+"\n"+
+		"      cert: "+routeCert+"\n      key: "+routeKey+"\n")
+	portNum, _ := net.LookupPort("tcp", port)
+	p, err := NewProxy(host, portNum, config)
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	if bw := p.routes["tenant-b.nats.example.com"].currentConfig().DefaultBandwidth; bw != 2048 {
+		t.Errorf("Expected the route's own config, got default bandwidth %d", bw)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.HandleConnection(conn)
+		}
+	}()
+
+	for serverName, expected := range map[string]string{
+		"nats.example.com":          "cluster-a",
+		"tenant-b.nats.example.com": "cluster-b",
+	} {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("%s: TLS dial failed: %v", serverName, err)
+		}
+		if names := conn.ConnectionState().PeerCertificates[0].DNSNames; names[0] != serverName {
+			t.Errorf("%s: expected its certificate, got one for %v", serverName, names)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%s: reading INFO failed: %v", serverName, err)
+		}
+		var info struct {
+			ServerID    string `json:"server_id"`
+			TLSRequired bool   `json:"tls_required"`
+			MaxPayload  int64  `json:"max_payload"`
+		}
+		json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+		if info.ServerID != expected || !info.TLSRequired || info.MaxPayload != 1048576 {
+			t.Errorf("%s: expected INFO of %s announcing TLS, got %q", serverName, expected, line)
+		}
+	}
+}
+
+func TestLoadConfig_InvalidTLS(t *testing.T) {
+	for _, yaml := range []string{
+		"tls:\n  cert: server.crt\n",
+		"tls:\n  cert: server.crt\n  key: server.key\n  routes:\n    a.example.com:\n      config: a.yaml\n",
+		"tls:\n  cert: server.crt\n  key: server.key\n  routes:\n    a.example.com:\n      upstream: nats-a:4222\n",
+		"tls:\n  cert: server.crt\n  key: server.key\n  routes:\n    a.example.com:\n      upstream: nats-a:4222\n      config: a.yaml\n      cert: a.crt\n",
+		"tls:\n  acme:\n    cache_dir: /tmp/acme\n",
+		"tls:\n  acme:\n    hosts: [nats.example.com]\n",
+		"tls:\n  acme:\n    hosts: [nats.example.com]\n    cache_dir: /tmp/acme\n    challenge: dns-01\n",
+		"tls:\n  cert: server.crt\n  acme:\n    hosts: [nats.example.com]\n    cache_dir: /tmp/acme\n",
+		"tls:\n  cert: server.crt\n  key: server.key\n  info_first: true\ninfo_passthrough: true\n",
+		"upstream_tls:\n  cert: client.crt\n",
+		"upstream_tls:\n  server_name: nats.example.com\ninfo_passthrough: true\n",
+	} {
+		if _, err := LoadConfig(writeTestConfig(t, yaml)); err == nil {
+			t.Errorf("Expected an error for %q", yaml)
+		}
+	}
+}
+
+func TestLoadConfig_UpstreamTLSPassthrough(t *testing.T) {
+	// Clients of TLS terminated at the proxy handshake as the upstream's INFO asks
+	if _, err := LoadConfig(writeTestConfig(t, "tls:\n  cert: server.crt\n  key: server.key\n"+
+		"upstream_tls:\n  server_name: nats.example.com\ninfo_passthrough: true\n")); err != nil {
+		t.Errorf("Expected info_passthrough allowed with tls and upstream_tls, got %v", err)
+	}
+}
+
+func TestLoadConfig_ACME(t *testing.T) {
+	config, err := LoadConfig(writeTestConfig(t, "tls:\n  acme:\n    hosts: [NATS.example.com]\n    cache_dir: /tmp/acme\n    challenge: http-01\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	acme := config.TLS.ACME
+	if acme.Hosts[0] != "nats.example.com" || acme.HTTPAddr != ":80" {
+		t.Errorf("Expected lowercase hosts and the default http address, got %v and %q", acme.Hosts, acme.HTTPAddr)
+	}
+}
+
+func TestProxy_ACMEFallsBackToStaticCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "internal.example.com")
+	config := writeTestConfig(t, "tls:\n  cert: "+certFile+"\n  key: "+keyFile+"\n"+
+		"  acme:\n    hosts: [nats.example.com]\n    cache_dir: "+filepath.Join(dir, "acme")+"\n")
+	p, err := NewProxy("127.0.0.1", 4222, config)
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	if !slices.Contains(p.tls.Load().NextProtos, "acme-tls/1") {
+		t.Errorf("Expected tls-alpn-01 challenges accepted, got protocols %v", p.tls.Load().NextProtos)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go tls.Server(server, p.tls.Load()).Handshake()
+	conn := tls.Client(client, &tls.Config{ServerName: "internal.example.com", InsecureSkipVerify: true})
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if names := conn.ConnectionState().PeerCertificates[0].DNSNames; names[0] != "internal.example.com" {
+		t.Errorf("Expected the static certificate for a name ACME doesn't cover, got one for %v", names)
+	}
+}
+
+func TestProxy_TLSUpgradeAfterInfo(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "proxy.example.com")
+	upstreamCert, upstreamKey := writeTestCert(t, dir, "nats.example.com")
+	upstream := startFakeTLSNATS(t, "secure", upstreamCert, upstreamKey)
+	host, port, _ := net.SplitHostPort(upstream.Addr())
+	portNum, _ := strconv.Atoi(port)
+	p, err := NewProxy(host, portNum, writeTestConfig(t, "default_bandwidth: 1048576\n"+
+		"tls:\n  cert: "+certFile+"\n  key: "+keyFile+"\n  info_first: true\n"+
+		"upstream_tls:\n  ca: "+upstreamCert+"\n  server_name: nats.example.com\n"))
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, _ := runTestServer(ctx, t, p)
+	defer srv.Stop(time.Second)
+	roots, err := loadCertPool(certFile)
+	if err != nil {
+		t.Fatalf("loadCertPool failed: %v", err)
+	}
+
+	// Clients upgrading after the upstream's INFO, as nats.go does by
+	// default, and clients handshaking first are both served
+	for name, opt := range map[string]nats.Option{
+		"info first":      func(*nats.Options) error { return nil },
+		"handshake first": nats.TLSHandshakeFirst(),
+	} {
+		nc, err := nats.Connect("nats://"+srv.Addr().String(), opt, nats.UserInfo("alice", "secret"),
+			nats.Secure(&tls.Config{RootCAs: roots, ServerName: "proxy.example.com"}))
+		if err != nil {
+			t.Fatalf("%s: Connect failed: %v", name, err)
+		}
+		if id := nc.ConnectedServerId(); id != "secure" {
+			t.Errorf("%s: expected the upstream's INFO, got server %q", name, id)
+		}
+		sub, _ := nc.SubscribeSync("greetings")
+		nc.Publish("greetings", []byte("hello"))
+		if msg, err := sub.NextMsg(2 * time.Second); err != nil || string(msg.Data) != "hello" {
+			t.Errorf("%s: expected the message through TLS on both sides, got %v", name, err)
+		}
+		nc.Close()
+	}
+}
+
+func TestProxy_UpstreamTLSPlaintextClients(t *testing.T) {
+	dir := t.TempDir()
+	upstreamCert, upstreamKey := writeTestCert(t, dir, "nats.example.com")
+	upstream := startFakeTLSNATS(t, "secure", upstreamCert, upstreamKey)
+	host, port, _ := net.SplitHostPort(upstream.Addr())
+	portNum, _ := strconv.Atoi(port)
+	p, err := NewProxy(host, portNum, writeTestConfig(t, "default_bandwidth: 1048576\n"+
+		"upstream_tls:\n  ca: "+upstreamCert+"\n  server_name: nats.example.com\n"))
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, _ := runTestServer(ctx, t, p)
+	defer srv.Stop(time.Second)
+
+	// The upstream requires TLS of the proxy, not of its clients
+	nc, err := nats.Connect("nats://"+srv.Addr().String(), nats.UserInfo("alice", "secret"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer nc.Close()
+	if err := nc.Flush(); err != nil || nc.ConnectedServerId() != "secure" {
+		t.Errorf("Expected a plaintext client served through the TLS upstream, got %v", err)
+	}
+}
+
+func TestProxy_ClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "proxy.example.com")
+	clientCert, clientKey := writeTestCert(t, dir, "client.example.com")
+	p, err := NewProxy("127.0.0.1", 4222, writeTestConfig(t, "tls:\n  cert: "+certFile+"\n  key: "+keyFile+"\n  ca: "+clientCert+"\n"))
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	p.SetDialer(func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			server.Write([]byte("INFO {\"server_id\":\"fake\"}\r\n"))
+			io.Copy(io.Discard, server)
+		}()
+		return client, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, _ := runTestServer(ctx, t, p)
+	defer srv.Stop(time.Second)
+
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair failed: %v", err)
+	}
+	for _, certs := range [][]tls.Certificate{{cert}, nil} {
+		conn, err := tls.Dial("tcp", srv.Addr().String(), &tls.Config{InsecureSkipVerify: true, Certificates: certs})
+		if err == nil {
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, err = bufio.NewReader(conn).ReadString('\n')
+			conn.Close()
+		}
+		if verified := certs != nil; (err == nil) != verified {
+			t.Errorf("Expected clients served only with a certificate the CA issued, with one: %v, got %v", verified, err)
+		}
+	}
+}
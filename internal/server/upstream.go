@@ -0,0 +1,283 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var errUpstreamClosed = errors.New("upstream connection closed")
+
+// reconnectInfoTimeout bounds waiting for the INFO of a new upstream
+// connection.
+const reconnectInfoTimeout = 5 * time.Second
+
+// upstreamConn is the proxy's connection to the upstream NATS server.
+//
+// When retryBuffer is non-zero, it keeps the bytes of the frame currently in
+// flight (up to retryBuffer bytes) together with the client's CONNECT line and
+// active subscriptions. If the upstream connection fails, it redials once and
+// replays that state so a brief upstream blip doesn't force the client to
+// reconnect and replay everything itself. Replay is at-least-once: the frame in
+// flight may be delivered twice if the old connection did forward it, and an
+// auto-unsubscribing subscription may receive up to its max messages again.
+// The new connection's INFO isn't forwarded, the client has the upstream's.
+type upstreamConn struct {
+	dial        func() (net.Conn, error)
+	retryBuffer int
+
+	mu      sync.Mutex
+	conn    net.Conn
+	gen     int // incremented on every reconnect
+	retried bool
+	closed  bool
+
+	// Frame tracking for replay, guarded by mu.
+	connect   []byte            // client CONNECT line
+	subs      map[string][]byte // active SUB lines, and any UNSUB with a max, keyed by sid
+	line      []byte            // current, incomplete protocol line
+	payload   int               // payload bytes (including CRLF) still expected
+	pending   []byte            // bytes of the current frame
+	overflow  bool              // current frame exceeded retryBuffer
+	frameDone bool              // pending holds a complete frame
+
+	mem  *connMemory // accounts the frame tracking buffers, nil unless capped
+	held int         // bytes of the frame tracking buffers accounted to mem
+}
+
+func newUpstreamConn(conn net.Conn, dial func() (net.Conn, error), retryBuffer int) *upstreamConn {
+	return &upstreamConn{
+		dial:        dial,
+		retryBuffer: retryBuffer,
+		conn:        conn,
+		subs:        make(map[string][]byte),
+	}
+}
+
+// Write forwards client data to the upstream, reconnecting once on failure.
+func (u *upstreamConn) Write(p []byte) (int, error) {
+	u.mu.Lock()
+	if u.retryBuffer > 0 {
+		u.track(p)
+		held := cap(u.pending) + cap(u.line)
+		u.mem.grow(int64(held - u.held))
+		u.held = held
+	}
+	conn, gen := u.conn, u.gen
+	u.mu.Unlock()
+
+	_, err := conn.Write(p)
+	if err == nil {
+		return len(p), nil
+	}
+	// A stalled upstream isn't a blip a reconnect gets past
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return 0, err
+	}
+	if rerr := u.reconnect(gen, err); rerr != nil {
+		return 0, rerr
+	}
+	// The frame containing p was replayed on the new connection.
+	return len(p), nil
+}
+
+// Read reads upstream data, following the connection across a reconnect.
+func (u *upstreamConn) Read(p []byte) (int, error) {
+	for {
+		u.mu.Lock()
+		conn, gen := u.conn, u.gen
+		u.mu.Unlock()
+
+		n, err := conn.Read(p)
+		if n > 0 || err == nil {
+			return n, nil
+		}
+		// A clean close is deliberate, e.g. following the client's half-close,
+		// not a failure to recover from
+		if errors.Is(err, io.EOF) {
+			return 0, io.EOF
+		}
+		if rerr := u.reconnect(gen, err); rerr != nil {
+			return 0, rerr
+		}
+	}
+}
+
+// SetWriteDeadline sets the write deadline of the current connection.
+func (u *upstreamConn) SetWriteDeadline(t time.Time) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.conn.SetWriteDeadline(t)
+}
+
+// Close closes the upstream connection and disables any further reconnects.
+func (u *upstreamConn) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closed = true
+	return u.conn.Close()
+}
+
+// CloseWrite shuts down the writing side of the upstream connection, if the
+// connection supports half-close. The connection is no longer reconnected, as
+// the client is done with it.
+func (u *upstreamConn) CloseWrite() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closed = true
+	cw, ok := u.conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return cw.CloseWrite()
+}
+
+// reconnect replaces the connection of generation gen, returning cause if a
+// reconnect isn't possible. If another goroutine already reconnected, it
+// returns nil immediately.
+func (u *upstreamConn) reconnect(gen int, cause error) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.gen != gen {
+		return nil
+	}
+	if u.closed {
+		return errUpstreamClosed
+	}
+	if u.retryBuffer == 0 || u.retried || u.overflow || u.connect == nil || isSignedConnect(u.connect) {
+		return cause
+	}
+	u.retried = true
+	u.conn.Close()
+
+	log.Warn().Err(cause).Msg("Upstream connection failed, reconnecting")
+	conn, err := u.dial()
+	if err != nil {
+		log.Error().Err(err).Msg("Upstream reconnect failed")
+		return cause
+	}
+	conn.SetReadDeadline(time.Now().Add(reconnectInfoTimeout))
+	if _, err := readInfo(conn); err != nil {
+		conn.Close()
+		log.Error().Err(err).Msg("Upstream reconnect failed")
+		return cause
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var replay bytes.Buffer
+	if !bytes.HasPrefix(u.pending, u.connect) {
+		replay.Write(u.connect)
+	}
+	for _, sid := range slices.Sorted(maps.Keys(u.subs)) {
+		replay.Write(u.subs[sid])
+	}
+	replay.Write(u.pending)
+	if _, err := conn.Write(replay.Bytes()); err != nil {
+		conn.Close()
+		log.Error().Err(err).Msg("Upstream replay failed")
+		return cause
+	}
+
+	u.conn = conn
+	u.gen++
+	log.Info().Int("replayed", replay.Len()).Int("subs", len(u.subs)).Msg("Upstream reconnected")
+	return nil
+}
+
+// track records p as part of the current frame and updates the CONNECT and
+// subscription state from completed protocol lines.
+func (u *upstreamConn) track(p []byte) {
+	if u.frameDone {
+		u.pending = u.pending[:0]
+		u.overflow = false
+		u.frameDone = false
+	}
+	if !u.overflow {
+		if len(u.pending)+len(p) > u.retryBuffer {
+			u.overflow = true
+			u.pending = u.pending[:0]
+		} else {
+			u.pending = append(u.pending, p...)
+		}
+	}
+
+	for len(p) > 0 {
+		if u.payload > 0 {
+			k := min(u.payload, len(p))
+			u.payload -= k
+			p = p[k:]
+			if u.payload == 0 {
+				u.frameDone = true
+			}
+			continue
+		}
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			u.line = append(u.line, p...)
+			return
+		}
+		u.line = append(u.line, p[:i+1]...)
+		p = p[i+1:]
+		u.trackLine(u.line)
+		u.line = u.line[:0]
+	}
+}
+
+func (u *upstreamConn) trackLine(line []byte) {
+	fields := bytes.Fields(line)
+	if len(fields) == 0 {
+		u.frameDone = true
+		return
+	}
+
+	switch string(bytes.ToUpper(fields[0])) {
+	case "CONNECT":
+		u.connect = bytes.Clone(line)
+	case "SUB":
+		if len(fields) >= 3 {
+			u.subs[string(fields[len(fields)-1])] = bytes.Clone(line)
+		}
+	case "UNSUB":
+		switch {
+		case len(fields) == 2:
+			delete(u.subs, string(fields[1]))
+		case len(fields) > 2:
+			// Still subscribed until max messages are delivered, so
+			// replayed along with its auto-unsubscribe
+			sid := string(fields[1])
+			if sub, ok := u.subs[sid]; ok {
+				u.subs[sid] = append(bytes.Clone(sub[:bytes.IndexByte(sub, '\n')+1]), line...)
+			}
+		}
+	case "PUB", "HPUB":
+		size, err := strconv.Atoi(string(fields[len(fields)-1]))
+		if err == nil && size >= 0 {
+			u.payload = size + 2 // payload + CRLF
+			return
+		}
+	}
+	u.frameDone = true
+}
+
+// isSignedConnect reports whether a CONNECT line carries a nonce signature,
+// which can't be replayed on a new connection with a different nonce.
+func isSignedConnect(line []byte) bool {
+	arg := bytes.TrimSpace(line[len("CONNECT"):])
+	var obj map[string]interface{}
+	if json.Unmarshal(arg, &obj) != nil {
+		return false
+	}
+	_, ok := obj["sig"]
+	return ok
+}
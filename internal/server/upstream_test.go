@@ -0,0 +1,153 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pipeDialer returns a dial func backed by net.Pipe, delivering the server
+// side of every dialed connection on the returned channel.
+func pipeDialer() (func() (net.Conn, error), chan net.Conn) {
+	servers := make(chan net.Conn, 4)
+	return func() (net.Conn, error) {
+		client, server := net.Pipe()
+		servers <- server
+		return client, nil
+	}, servers
+}
+
+func TestUpstreamConn_ReconnectReplaysState(t *testing.T) {
+	dial, servers := pipeDialer()
+	conn, _ := dial()
+	first := <-servers
+	go io.Copy(io.Discard, first)
+
+	u := newUpstreamConn(conn, dial, 1024)
+	defer u.Close()
+
+	// bar is unsubscribed, baz auto-unsubscribes after 10 messages
+	connect := "CONNECT {\"user\":\"alice\"}\r\n"
+	for _, w := range []string{connect, "SUB foo 1\r\n", "SUB bar 2\r\n", "UNSUB 2\r\n", "SUB baz 3\r\n", "UNSUB 3 10\r\n", "PUB foo 5\r\n"} {
+		if _, err := u.Write([]byte(w)); err != nil {
+			t.Fatalf("Write %q failed: %v", w, err)
+		}
+	}
+	first.Close()
+
+	want := connect + "SUB foo 1\r\n" + "SUB baz 3\r\nUNSUB 3 10\r\n" + "PUB foo 5\r\nhello\r\n"
+	received := make(chan string, 1)
+	go func() {
+		second := <-servers
+		second.Write([]byte("INFO {\"server_id\":\"second\"}\r\n"))
+		buf := make([]byte, len(want))
+		io.ReadFull(second, buf)
+		received <- string(buf)
+		second.Write([]byte("MSG foo 1 5\r\nworld\r\n"))
+	}()
+
+	if _, err := u.Write([]byte("hello\r\n")); err != nil {
+		t.Fatalf("Write after upstream failure should reconnect, got: %v", err)
+	}
+
+	select {
+	case got := <-received:
+		if got != want {
+			t.Errorf("Unexpected replay.\nExpected: %q\nGot: %q", want, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for replay on new upstream connection")
+	}
+
+	// The client already has an INFO: the new connection's isn't forwarded
+	buf := make([]byte, len("MSG foo 1 5\r\nworld\r\n"))
+	if _, err := io.ReadFull(u, buf); err != nil || string(buf) != "MSG foo 1 5\r\nworld\r\n" {
+		t.Errorf("Expected the message delivered after the reconnect, got %q, %v", buf, err)
+	}
+}
+
+func TestUpstreamConn_NoReconnect(t *testing.T) {
+	tests := []struct {
+		name        string
+		retryBuffer int
+		connect     string
+	}{
+		{
+			name:        "Retry disabled",
+			retryBuffer: 0,
+			connect:     "CONNECT {\"user\":\"alice\"}\r\n",
+		},
+		{
+			name:        "Nonce-signed CONNECT",
+			retryBuffer: 1024,
+			connect:     "CONNECT {\"jwt\":\"x\",\"sig\":\"y\"}\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dial, servers := pipeDialer()
+			conn, _ := dial()
+			first := <-servers
+			go io.Copy(io.Discard, first)
+
+			u := newUpstreamConn(conn, dial, tt.retryBuffer)
+			defer u.Close()
+
+			if _, err := u.Write([]byte(tt.connect)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			first.Close()
+
+			if _, err := u.Write([]byte("PING\r\n")); err == nil {
+				t.Error("Expected write error without reconnect")
+			}
+			if len(servers) != 0 {
+				t.Error("Expected no reconnect attempt")
+			}
+		})
+	}
+}
+
+func TestUpstreamConn_HalfCloseNoReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	var dials atomic.Int32
+	dial := func() (net.Conn, error) {
+		if dials.Add(1) > 2 {
+			return nil, errors.New("unexpected reconnect")
+		}
+		return net.Dial("tcp", ln.Addr().String())
+	}
+
+	for _, halfClose := range []bool{true, false} {
+		conn, _ := dial()
+		upstream, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("Accept failed: %v", err)
+		}
+		u := newUpstreamConn(conn, dial, 1024)
+		state := "CONNECT {\"user\":\"alice\"}\r\nSUB foo 1\r\n"
+		u.Write([]byte(state))
+		upstream.SetReadDeadline(time.Now().Add(2 * time.Second))
+		io.ReadFull(upstream, make([]byte, len(state)))
+		if halfClose {
+			u.CloseWrite()
+			io.ReadAll(upstream)
+		}
+		upstream.Write([]byte("MSG foo 1 5\r\nworld\r\n"))
+		upstream.Close()
+
+		got, err := io.ReadAll(u)
+		if err != nil || string(got) != "MSG foo 1 5\r\nworld\r\n" {
+			t.Errorf("Expected the last message then EOF (half-close %t), got %q, %v", halfClose, got, err)
+		}
+		u.Close()
+	}
+}
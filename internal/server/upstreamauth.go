@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UpstreamAuthConfig configures the credentials the proxy authenticates
+// clients' connections to a secured upstream with, in place of those in
+// their CONNECT. Limits still apply to the identity clients connect with,
+// which the upstream no longer checks: the proxy verifies it against
+// Clients, or else clients must be trusted by other means, e.g. a private
+// network, and no user may be limited or bypassed by name. The main
+// listener and each SNI route use their own configuration's credentials.
+type UpstreamAuthConfig struct {
+	// Credentials is a creds file with a user JWT and nkey seed. The nonce
+	// of the upstream's INFO is signed with the seed. Rewritten files are
+	// picked up by new connections.
+	Credentials string `yaml:"credentials"`
+	// User and Password authenticate with a user name instead.
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// Token authenticates with a token instead.
+	Token string `yaml:"token"`
+	// Clients verifies the credentials clients connect with in place of the
+	// upstream. Nil admits any client as whoever it claims to be.
+	Clients *ClientAuthConfig `yaml:"clients"`
+}
+
+// ClientAuthConfig verifies clients' credentials in the proxy. Clients
+// without credentials it verifies are rejected.
+type ClientAuthConfig struct {
+	// Users maps user names to their passwords, plain or bcrypt hashed.
+	Users map[string]string `yaml:"users"`
+	// Issuers are the public keys of the accounts, or of their signing keys,
+	// whose user JWTs are trusted. Clients with a JWT must sign the nonce of
+	// the upstream's INFO with the user's key, as the upstream itself would
+	// require.
+	Issuers []string `yaml:"issuers"`
+}
+
+// normalize validates the configuration.
+func (c *UpstreamAuthConfig) normalize() error {
+	set := 0
+	for _, s := range []string{c.Credentials, c.User, c.Token} {
+		if s != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("upstream_auth requires exactly one of credentials, user or token")
+	}
+	if c.Password != "" && c.User == "" {
+		return fmt.Errorf("upstream_auth password requires a user")
+	}
+	if v := c.Clients; v != nil {
+		if len(v.Users) == 0 && len(v.Issuers) == 0 {
+			return fmt.Errorf("upstream_auth clients requires users or issuers")
+		}
+		for _, key := range v.Issuers {
+			if !nkeys.IsValidPublicAccountKey(key) {
+				return fmt.Errorf("upstream_auth clients issuer %q is not an account public key", key)
+			}
+		}
+	}
+	return nil
+}
+
+// clientAuthFields are the CONNECT options carrying a client's own
+// credentials, replaced by the proxy's.
+var clientAuthFields = []string{"user", "pass", "auth_token", "jwt", "nkey", "sig"}
+
+// upstreamAuth holds the loaded upstream credentials.
+type upstreamAuth struct {
+	cfg *UpstreamAuthConfig
+	jwt string
+	kp  nkeys.KeyPair // signs the INFO nonce, with a creds file
+}
+
+// readUpstreamAuth reads the credentials file, if configured.
+func readUpstreamAuth(cfg *UpstreamAuthConfig) (*upstreamAuth, error) {
+	a := &upstreamAuth{cfg: cfg}
+	if cfg.Credentials == "" {
+		return a, nil
+	}
+	data, err := os.ReadFile(cfg.Credentials)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upstream credentials: %w", err)
+	}
+	if a.jwt, err = nkeys.ParseDecoratedJWT(data); err != nil {
+		return nil, fmt.Errorf("invalid upstream credentials: %w", err)
+	}
+	if a.kp, err = nkeys.ParseDecoratedNKey(data); err != nil {
+		return nil, fmt.Errorf("invalid upstream credentials: %w", err)
+	}
+	return a, nil
+}
+
+var errNoNonce = errors.New("upstream INFO has no nonce to sign")
+
+// connect returns a CONNECT line with the client's options and the proxy's
+// credentials, signing the nonce of the upstream's INFO line with a creds
+// file.
+func (a *upstreamAuth) connect(obj map[string]interface{}, info []byte) ([]byte, error) {
+	opts := make(map[string]interface{}, len(obj)+2)
+	for k, v := range obj {
+		opts[k] = v
+	}
+	for _, k := range clientAuthFields {
+		delete(opts, k)
+	}
+	switch {
+	case a.kp != nil:
+		nonce := infoNonce(info)
+		if nonce == "" {
+			return nil, errNoNonce
+		}
+		sig, err := a.kp.Sign([]byte(nonce))
+		if err != nil {
+			return nil, err
+		}
+		opts["jwt"] = a.jwt
+		opts["sig"] = base64.RawURLEncoding.EncodeToString(sig)
+	case a.cfg.Token != "":
+		opts["auth_token"] = a.cfg.Token
+	default:
+		opts["user"] = a.cfg.User
+		opts["pass"] = a.cfg.Password
+	}
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte("CONNECT "), data...), '\r', '\n'), nil
+}
+
+// infoNonce returns the nonce of an INFO line, if any.
+func infoNonce(info []byte) string {
+	body, ok := bytes.CutPrefix(info, []byte("INFO "))
+	if !ok {
+		return ""
+	}
+	var fields struct {
+		Nonce string `json:"nonce"`
+	}
+	if json.Unmarshal(bytes.TrimSpace(body), &fields) != nil {
+		return ""
+	}
+	return fields.Nonce
+}
+
+var errClientAuth = errors.New("client credentials not verified")
+
+// verify checks the credentials in a client's CONNECT options against the
+// configured clients: the password of its user, or else its JWT and the
+// signature of the nonce in the upstream's INFO line.
+func (a *upstreamAuth) verify(obj map[string]interface{}, info []byte) error {
+	clients := a.cfg.Clients
+	if clients == nil {
+		return nil
+	}
+	if user, ok := obj["user"].(string); ok {
+		pass, _ := obj["pass"].(string)
+		want, ok := clients.Users[user]
+		if !ok || !passwordMatches(want, pass) {
+			return fmt.Errorf("%w: wrong password for %q", errClientAuth, user)
+		}
+		return nil
+	}
+	token, ok := obj["jwt"].(string)
+	if !ok {
+		return fmt.Errorf("%w: no user or JWT", errClientAuth)
+	}
+	claims, err := jwt.DecodeUserClaims(token)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errClientAuth, err)
+	}
+	vr := jwt.CreateValidationResults()
+	claims.Validate(vr)
+	if vr.IsBlocking(true) {
+		return fmt.Errorf("%w: invalid JWT: %v", errClientAuth, vr.Errors())
+	}
+	if !slices.Contains(clients.Issuers, claims.Issuer) {
+		return fmt.Errorf("%w: untrusted issuer %s", errClientAuth, claims.Issuer)
+	}
+	nonce := infoNonce(info)
+	encoded, _ := obj["sig"].(string)
+	sig, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		sig, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if nonce == "" || err != nil {
+		return fmt.Errorf("%w: no nonce signature", errClientAuth)
+	}
+	kp, err := nkeys.FromPublicKey(claims.Subject)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errClientAuth, err)
+	}
+	if err := kp.Verify([]byte(nonce), sig); err != nil {
+		return fmt.Errorf("%w: %w", errClientAuth, err)
+	}
+	return nil
+}
+
+// passwordMatches reports whether pass is the configured password want,
+// which may be bcrypt hashed.
+func passwordMatches(want, pass string) bool {
+	if strings.HasPrefix(want, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(want), []byte(pass)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(pass)) == 1
+}
+
+// verifyClient verifies the client's credentials before the proxy's replace
+// them, ending the connection if they aren't.
+func (c *ClientMessageParser) verifyClient(obj map[string]interface{}) error {
+	var info []byte
+	if c.clientWriter != nil {
+		info = c.clientWriter.lastInfo()
+	}
+	if err := c.upstreamAuth.verify(obj, info); err != nil {
+		log.Warn().Err(err).EmbedObject(c.client).Msg("Rejecting unverified client")
+		return &closeError{reason: closeClientAuth, err: err}
+	}
+	return nil
+}
+
+var errConnectNotRewritten = errors.New("CONNECT can't be rewritten with upstream credentials")
+
+// injectUpstreamAuth replaces the buffered CONNECT line with one carrying the
+// proxy's upstream credentials. A CONNECT that can't be parsed or rewritten
+// ends the connection rather than reach the upstream with the client's own
+// credentials.
+func (c *ClientMessageParser) injectUpstreamAuth(obj map[string]interface{}) error {
+	err := errConnectNotRewritten
+	if obj != nil {
+		var info []byte
+		if c.clientWriter != nil {
+			info = c.clientWriter.lastInfo()
+		}
+		var line []byte
+		if line, err = c.upstreamAuth.connect(obj, info); err == nil && !c.rewriteFrame(line) {
+			err = errConnectNotRewritten
+		}
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("user", c.user).EmbedObject(c.client).Msg("Failed to inject upstream credentials")
+		return &closeError{reason: closeUpstreamAuth, err: err}
+	}
+	return nil
+}
+
+// loadUpstreamAuth (re)loads the upstream credentials, if configured.
+func (p *Proxy) loadUpstreamAuth() error {
+	cfg := p.currentConfig().UpstreamAuth
+	if cfg == nil {
+		return nil
+	}
+	a, err := readUpstreamAuth(cfg)
+	if err != nil {
+		return err
+	}
+	p.upstreamAuth.Store(a)
+	return nil
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nkeys"
+	"golang.org/x/crypto/bcrypt"
+
+	"nats-limiter-proxy/internal/creds"
+)
+
+func TestUpstreamAuthConfig_Normalize(t *testing.T) {
+	tests := []struct {
+		cfg UpstreamAuthConfig
+		ok  bool
+	}{
+		{UpstreamAuthConfig{Token: "secret"}, true},
+		{UpstreamAuthConfig{User: "proxy", Password: "secret"}, true},
+		{UpstreamAuthConfig{Credentials: "proxy.creds"}, true},
+		{UpstreamAuthConfig{}, false},
+		{UpstreamAuthConfig{Token: "secret", User: "proxy"}, false},
+		{UpstreamAuthConfig{Token: "secret", Password: "secret"}, false},
+		{UpstreamAuthConfig{Token: "secret", Clients: &ClientAuthConfig{Users: map[string]string{"alice": "secret"}}}, true},
+		{UpstreamAuthConfig{Token: "secret", Clients: &ClientAuthConfig{}}, false},
+		{UpstreamAuthConfig{Token: "secret", Clients: &ClientAuthConfig{Issuers: []string{"UABC"}}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.normalize(); (err == nil) != tt.ok {
+			t.Errorf("normalize(%+v) = %v, expected ok %v", tt.cfg, err, tt.ok)
+		}
+	}
+}
+
+func TestUpstreamAuth_ConnectSignsNonce(t *testing.T) {
+	env, err := creds.NewEnvironment("root", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := env.UserCreds("proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "proxy.creds")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := readUpstreamAuth(&UpstreamAuthConfig{Credentials: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj := map[string]interface{}{"user": "alice", "pass": "secret", "verbose": false}
+	if _, err := auth.connect(obj, []byte("INFO {\"port\":4222}\r\n")); !errors.Is(err, errNoNonce) {
+		t.Errorf("Expected an INFO without nonce rejected, got %v", err)
+	}
+	line, err := auth.connect(obj, []byte("INFO {\"nonce\":\"abc123\"}\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opts map[string]interface{}
+	if err := json.Unmarshal(bytes.TrimSpace(bytes.TrimPrefix(line, []byte("CONNECT "))), &opts); err != nil {
+		t.Fatalf("Invalid CONNECT %q: %v", line, err)
+	}
+	if _, ok := opts["user"]; ok || opts["pass"] != nil {
+		t.Errorf("Expected the client's credentials removed, got %v", opts)
+	}
+	if opts["verbose"] != false {
+		t.Errorf("Expected other options kept, got %v", opts)
+	}
+	if opts["jwt"] != auth.jwt {
+		t.Errorf("Expected the proxy's JWT, got %v", opts["jwt"])
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(opts["sig"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := auth.kp.PublicKey()
+	verifier, err := nkeys.FromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify([]byte("abc123"), sig); err != nil {
+		t.Errorf("Expected the nonce signed by the proxy's key: %v", err)
+	}
+}
+
+func TestClientMessageParser_UpstreamAuth(t *testing.T) {
+	input := "CONNECT {\"user\":\"alice\",\"pass\":\"secret\"}\r\nPUB foo 2\r\nhi\r\n"
+	var out bytes.Buffer
+	mockRLM := &mockRateLimiterManager{}
+	parser := NewClientMessageParser(strings.NewReader(input), &out, mockRLM)
+	parser.SetUpstreamAuth(&upstreamAuth{cfg: &UpstreamAuthConfig{Token: "proxy-token"}})
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if parser.GetUser() != "alice" {
+		t.Errorf("Expected limits to apply to alice, got %q", parser.GetUser())
+	}
+	want := "CONNECT {\"auth_token\":\"proxy-token\"}\r\nPUB foo 2\r\nhi\r\n"
+	if out.String() != want {
+		t.Errorf("Expected %q upstream, got %q", want, out.String())
+	}
+
+	// A CONNECT that can't be rewritten isn't forwarded with the client's
+	// credentials
+	out.Reset()
+	parser = NewClientMessageParser(strings.NewReader("CONNECT {\"user\":\"alice\"\r\n"), &out, mockRLM)
+	parser.SetUpstreamAuth(&upstreamAuth{cfg: &UpstreamAuthConfig{Token: "proxy-token"}})
+	var ce *closeError
+	if err := parser.ParseAndForward(); !errors.As(err, &ce) || ce.reason != closeUpstreamAuth {
+		t.Fatalf("Expected an upstream_auth_error close, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Expected nothing forwarded, got %q", out.String())
+	}
+}
+
+func TestUpstreamAuth_VerifyClients(t *testing.T) {
+	env, err := creds.NewEnvironment("root", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := creds.NewEnvironment("root", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("hashed"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, _ := env.Account.PublicKey()
+	auth := &upstreamAuth{cfg: &UpstreamAuthConfig{Token: "proxy-token", Clients: &ClientAuthConfig{
+		Users:   map[string]string{"alice": "secret", "bob": string(hash)},
+		Issuers: []string{issuer},
+	}}}
+	info := []byte("INFO {\"nonce\":\"abc123\"}\r\n")
+	jwtConnect := func(env *creds.Environment, nonce string) map[string]interface{} {
+		token, kp, err := env.UserJWT("carol")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, _ := kp.Sign([]byte(nonce))
+		return map[string]interface{}{"jwt": token, "sig": base64.RawURLEncoding.EncodeToString(sig)}
+	}
+
+	tests := []struct {
+		name string
+		obj  map[string]interface{}
+		ok   bool
+	}{
+		{"password", map[string]interface{}{"user": "alice", "pass": "secret"}, true},
+		{"wrong password", map[string]interface{}{"user": "alice", "pass": "guess"}, false},
+		{"bcrypt password", map[string]interface{}{"user": "bob", "pass": "hashed"}, true},
+		{"unknown user", map[string]interface{}{"user": "mallory", "pass": "secret"}, false},
+		{"jwt", jwtConnect(env, "abc123"), true},
+		{"jwt signing another nonce", jwtConnect(env, "replayed"), false},
+		{"jwt of an untrusted issuer", jwtConnect(other, "abc123"), false},
+		{"jwt without a signature", map[string]interface{}{"jwt": jwtConnect(env, "abc123")["jwt"]}, false},
+		{"unsigned jwt", map[string]interface{}{"jwt": testJWT(`{"name":"carol"}`), "sig": "x"}, false},
+		{"token", map[string]interface{}{"auth_token": "secret"}, false},
+		{"anonymous", map[string]interface{}{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := auth.verify(tt.obj, info); (err == nil) != tt.ok {
+				t.Errorf("verify = %v, expected ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestClientMessageParser_UpstreamAuthVerifiesClients(t *testing.T) {
+	var out bytes.Buffer
+	input := "CONNECT {\"user\":\"alice\",\"pass\":\"guess\"}\r\nPUB foo 2\r\nhi\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &out, &mockRateLimiterManager{})
+	parser.SetUpstreamAuth(&upstreamAuth{cfg: &UpstreamAuthConfig{Token: "proxy-token",
+		Clients: &ClientAuthConfig{Users: map[string]string{"alice": "secret"}}}})
+	if err := parser.ParseAndForward(); closeReasonOf(err, true) != closeClientAuth {
+		t.Fatalf("Expected a client_auth_error close, got %v", err)
+	}
+	if out.Len() != 0 || parser.GetUser() != "" {
+		t.Errorf("Expected nothing forwarded for an unverified client, got %q as %q", out.String(), parser.GetUser())
+	}
+}
+
+func TestLoadConfig_UpstreamAuthTrust(t *testing.T) {
+	for _, tt := range []struct {
+		yaml string
+		ok   bool
+	}{
+		{"upstream_auth:\n  token: proxy\n", true},
+		{"users:\n  alice: 1024\nupstream_auth:\n  token: proxy\n", false},
+		{"bypass:\n  users: [\"monitoring-*\"]\nupstream_auth:\n  token: proxy\n", false},
+		{"users:\n  alice: 1024\nupstream_auth:\n  token: proxy\n  clients:\n    users:\n      alice: secret\n", true},
+	} {
+		if _, err := LoadConfig(writeTestConfig(t, tt.yaml)); (err == nil) != tt.ok {
+			t.Errorf("LoadConfig(%q) = %v, expected ok %v", tt.yaml, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+var errUpstreamTLS = errors.New("upstream TLS upgrade failed")
+
+// maxInfoLine bounds an INFO line read ahead of a TLS upgrade.
+const maxInfoLine = 64 * 1024
+
+// UpstreamTLSConfig configures TLS to the upstream, as NATS servers with
+// `tls: required` expect of their clients.
+type UpstreamTLSConfig struct {
+	// CA is the PEM file of the certificate authorities the upstream's
+	// certificate is verified against. Defaults to the system's.
+	CA string `yaml:"ca"`
+	// Cert and Key are the PEM files of the certificate presented to the
+	// upstream, if it verifies clients.
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ServerName is the name the upstream's certificate is verified for.
+	// Defaults to the upstream's host.
+	ServerName string `yaml:"server_name"`
+	// HandshakeFirst handshakes right away instead of upgrading after the
+	// upstream's INFO, for upstreams configured with handshake_first.
+	HandshakeFirst bool `yaml:"handshake_first"`
+}
+
+// normalize validates the configuration.
+func (c *UpstreamTLSConfig) normalize() error {
+	if (c.Cert == "") != (c.Key == "") {
+		return fmt.Errorf("upstream_tls requires both cert and key")
+	}
+	return nil
+}
+
+// newUpstreamTLSConfig loads the TLS configuration of connections to host.
+func newUpstreamTLSConfig(cfg *UpstreamTLSConfig, host string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if cfg.ServerName != "" {
+		config.ServerName = cfg.ServerName
+	}
+	if cfg.CA != "" {
+		pool, err := loadCertPool(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream_tls ca: %w", err)
+		}
+		config.RootCAs = pool
+	}
+	if cfg.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream_tls certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// loadCertPool loads the certificates of a PEM file into a pool.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// upgradeUpstream upgrades a new upstream connection to TLS with config.
+// Unless the upstream handshakes first, its INFO precedes the upgrade, and is
+// read first from the returned connection as it would have been without TLS.
+func (p *Proxy) upgradeUpstream(conn net.Conn, config *tls.Config) (net.Conn, error) {
+	cfg := p.currentConfig()
+	conn.SetDeadline(time.Now().Add(cfg.DialTimeout))
+	var info []byte
+	if !cfg.UpstreamTLS.HandshakeFirst {
+		var err error
+		if info, err = readInfo(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%w: %w", errUpstreamTLS, err)
+		}
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %w", errUpstreamTLS, err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	if info == nil {
+		return tlsConn, nil
+	}
+	return &prefixConn{Conn: tlsConn, prefix: info}, nil
+}
+
+// readInfo reads the INFO line a NATS server greets clients with, without
+// reading beyond it.
+func readInfo(conn net.Conn) ([]byte, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\n")) {
+		if len(line) >= maxInfoLine {
+			return nil, fmt.Errorf("INFO longer than %d bytes", maxInfoLine)
+		}
+		if _, err := conn.Read(b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	if !bytes.HasPrefix(line, []byte("INFO ")) {
+		return nil, fmt.Errorf("expected INFO, got %q", bytes.TrimSpace(line))
+	}
+	return line, nil
+}
+
+// prefixConn is a connection whose reads return bytes read from it ahead,
+// prefix, first.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// NetConn returns the underlying connection.
+func (c *prefixConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, if
+// it supports half-close.
+func (c *prefixConn) CloseWrite() error {
+	cw, ok := c.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return cw.CloseWrite()
+}
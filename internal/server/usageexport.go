@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+// UsageExportConfig configures writing per-user usage records into a
+// JetStream stream on the upstream cluster, for durable usage history.
+type UsageExportConfig struct {
+	// URL of the cluster. Defaults to the upstream.
+	URL string `yaml:"url"`
+	// Credentials is a creds file authenticating the proxy, if the cluster
+	// requires it.
+	Credentials string `yaml:"credentials"`
+	// Stream is the stream records are stored in, created or updated at
+	// startup. Defaults to "PROXY_USAGE".
+	Stream string `yaml:"stream"`
+	// Subject prefix of records, followed by the user. Defaults to
+	// "proxy.usage".
+	Subject string `yaml:"subject"`
+	// Interval each record covers. Defaults to 1m.
+	Interval time.Duration `yaml:"interval"`
+	// MaxAge is how long records are kept. Defaults to 90 days.
+	MaxAge time.Duration `yaml:"max_age"`
+	// MaxBytes caps the size of the stream, discarding the oldest records.
+	// Zero doesn't cap it.
+	MaxBytes int64 `yaml:"max_bytes"`
+	// Replicas of the stream. Defaults to 1.
+	Replicas int `yaml:"replicas"`
+}
+
+// normalize applies defaults and validates the configuration.
+func (c *UsageExportConfig) normalize() error {
+	if c.Stream == "" {
+		c.Stream = "PROXY_USAGE"
+	}
+	if c.Subject == "" {
+		c.Subject = "proxy.usage"
+	}
+	if strings.ContainsAny(c.Subject, "*> \t") || strings.HasSuffix(c.Subject, ".") {
+		return fmt.Errorf("invalid usage_export subject %q: must be a literal subject", c.Subject)
+	}
+	if c.Interval <= 0 {
+		c.Interval = time.Minute
+	}
+	if c.MaxAge <= 0 {
+		c.MaxAge = 90 * 24 * time.Hour
+	}
+	if c.MaxBytes < 0 {
+		return fmt.Errorf("usage_export max_bytes must not be negative")
+	}
+	if c.Replicas <= 0 {
+		c.Replicas = 1
+	}
+	return nil
+}
+
+// usageRecord is a user's usage over an interval.
+type usageRecord struct {
+	User               string    `json:"user"`
+	Start              time.Time `json:"start"`
+	End                time.Time `json:"end"`
+	Bytes              int64     `json:"bytes"`
+	Bandwidth          int64     `json:"bandwidth"`
+	EffectiveBandwidth float64   `json:"effective_bandwidth"`
+}
+
+// usageMark is where a user's next record starts.
+type usageMark struct {
+	total int64
+	since time.Time
+}
+
+// usageExporter turns users' byte counters into records of the bytes sent
+// since their previous record.
+type usageExporter struct {
+	cfg     *UsageExportConfig
+	rlm     *RateLimiterManager
+	publish func(ctx context.Context, subject string, data []byte, msgID string) error
+	marks   map[string]usageMark
+	start   time.Time // of the first record of users without a mark
+}
+
+func newUsageExporter(cfg *UsageExportConfig, rlm *RateLimiterManager, now time.Time) *usageExporter {
+	return &usageExporter{cfg: cfg, rlm: rlm, marks: make(map[string]usageMark), start: now}
+}
+
+// flush publishes the records of users who sent bytes since their previous
+// record. A record that fails to publish is retried at the next flush,
+// covering the longer interval.
+func (e *usageExporter) flush(ctx context.Context, now time.Time) {
+	for user, total := range e.rlm.TotalBytes() {
+		mark, ok := e.marks[user]
+		if !ok {
+			mark.since = e.start
+		}
+		if total <= mark.total {
+			continue
+		}
+		usage := e.rlm.Usage(user)
+		record := usageRecord{
+			User:               user,
+			Start:              mark.since,
+			End:                now,
+			Bytes:              total - mark.total,
+			Bandwidth:          usage.Bandwidth,
+			EffectiveBandwidth: usage.EffectiveBandwidth,
+		}
+		data, _ := json.Marshal(record)
+		// The ID deduplicates a record published again after a lost ack
+		msgID := user + "@" + strconv.FormatInt(record.End.UnixNano(), 10)
+		if err := e.publish(ctx, e.cfg.Subject+"."+subjectToken(user), data, msgID); err != nil {
+			log.Warn().Err(err).Str("user", user).Msg("Failed to export usage record")
+			metricUsageRecords.Add(1, "error")
+			continue
+		}
+		metricUsageRecords.Add(1, "ok")
+		e.marks[user] = usageMark{total: total, since: now}
+	}
+}
+
+// subjectToken returns user as a single subject token.
+func subjectToken(user string) string {
+	if user == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, user)
+}
+
+// runUsageExport writes usage records every interval until ctx is
+// cancelled. It connects to the cluster directly, so its records aren't
+// rate limited, and keeps retrying while the cluster is unavailable.
+func (p *Proxy) runUsageExport(ctx context.Context) {
+	cfg := p.currentConfig().UsageExport
+	url := cfg.URL
+	if url == "" {
+		url = "nats://" + net.JoinHostPort(p.upstreamHost, strconv.Itoa(p.upstreamPort))
+	}
+	opts := []nats.Option{nats.Name("nats-limiter-proxy usage export"), nats.MaxReconnects(-1), nats.RetryOnFailedConnect(true)}
+	if cfg.Credentials != "" {
+		opts = append(opts, nats.UserCredentials(cfg.Credentials))
+	}
+	nc, err := nats.Connect(url, opts...)
+	if err != nil {
+		log.Error().Err(err).Msg("Usage export disabled")
+		return
+	}
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		log.Error().Err(err).Msg("Usage export disabled")
+		return
+	}
+
+	maxBytes := cfg.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = -1 // unlimited
+	}
+	streamReady := false
+	exporter := newUsageExporter(cfg, p.rateLimiterMgr, time.Now())
+	exporter.publish = func(ctx context.Context, subject string, data []byte, msgID string) error {
+		if !streamReady {
+			if _, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+				Name:       cfg.Stream,
+				Subjects:   []string{cfg.Subject + ".>"},
+				MaxAge:     cfg.MaxAge,
+				MaxBytes:   maxBytes,
+				Replicas:   cfg.Replicas,
+				Storage:    jetstream.FileStorage,
+				Duplicates: cfg.Interval,
+			}); err != nil {
+				return fmt.Errorf("failed to create stream %s: %w", cfg.Stream, err)
+			}
+			streamReady = true
+		}
+		_, err := js.Publish(ctx, subject, data, jetstream.WithMsgID(msgID))
+		return err
+	}
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			flushCtx, cancel := context.WithTimeout(ctx, cfg.Interval)
+			exporter.flush(flushCtx, now)
+			cancel()
+		}
+	}
+}
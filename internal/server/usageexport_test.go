@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUsageExporter_Flush(t *testing.T) {
+	rlm := NewRateLimiterManager(&Config{DefaultBandwidth: 1024})
+	cfg := &UsageExportConfig{}
+	cfg.normalize()
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	exporter := newUsageExporter(cfg, rlm, start)
+
+	var records []usageRecord
+	var subjects []string
+	fail := false
+	exporter.publish = func(ctx context.Context, subject string, data []byte, msgID string) error {
+		if fail {
+			return errors.New("no responders")
+		}
+		var record usageRecord
+		json.Unmarshal(data, &record)
+		records = append(records, record)
+		subjects = append(subjects, subject)
+		return nil
+	}
+
+	rlm.RecordBytes("alice.smith", 100)
+	exporter.flush(context.Background(), start.Add(time.Minute))
+	if len(records) != 1 || records[0].Bytes != 100 || !records[0].Start.Equal(start) || records[0].Bandwidth != 1024 {
+		t.Fatalf("Expected one record of 100 bytes from the start, got %+v", records)
+	}
+	if subjects[0] != "proxy.usage.alice_smith" {
+		t.Errorf("Expected the user as one subject token, got %q", subjects[0])
+	}
+
+	// Idle users get no record, failed records are retried with a longer window
+	fail = true
+	rlm.RecordBytes("alice.smith", 50)
+	exporter.flush(context.Background(), start.Add(2*time.Minute))
+	fail = false
+	rlm.RecordBytes("alice.smith", 25)
+	exporter.flush(context.Background(), start.Add(3*time.Minute))
+	if len(records) != 2 {
+		t.Fatalf("Expected a second record, got %+v", records)
+	}
+	if r := records[1]; r.Bytes != 75 || !r.Start.Equal(start.Add(time.Minute)) || !r.End.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("Expected the failed interval included, got %+v", r)
+	}
+	exporter.flush(context.Background(), start.Add(4*time.Minute))
+	if len(records) != 2 {
+		t.Errorf("Expected no record without traffic, got %+v", records[2:])
+	}
+}
+
+func TestLoadConfig_UsageExport(t *testing.T) {
+	config, err := LoadConfig(writeTestConfig(t, "usage_export:\n  max_bytes: 1073741824\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if u := config.UsageExport; u.Stream != "PROXY_USAGE" || u.Interval != time.Minute || u.MaxAge != 90*24*time.Hour {
+		t.Errorf("Expected defaults applied, got %+v", u)
+	}
+	if _, err := LoadConfig(writeTestConfig(t, "usage_export:\n  subject: proxy.*\n")); err == nil {
+		t.Error("Expected an error for a wildcard subject")
+	}
+}
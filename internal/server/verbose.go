@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// verboseAckTimeout bounds how long a reply of the proxy's own to a verbose
+// client waits for the upstream to acknowledge the ops pipelined before it.
+const verboseAckTimeout = 2 * time.Second
+
+// verboseAcks counts the +OK and -ERR acknowledgments the upstream owes a
+// client in verbose mode, one per op forwarded but PING and PONG. Replies
+// the proxy sends in place of the upstream's, for messages it rejects or
+// answers itself, wait for them so the client can match acknowledgments to
+// its ops in order.
+type verboseAcks struct {
+	mu      sync.Mutex
+	owed    int64
+	settled chan struct{} // closed once none are owed, nil while none waits
+}
+
+// expect counts an op forwarded, before it's written to the upstream.
+func (a *verboseAcks) expect() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.owed++
+}
+
+// received counts an acknowledgment from the upstream.
+func (a *verboseAcks) received() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.owed > 0 {
+		a.owed--
+	}
+	if a.owed == 0 && a.settled != nil {
+		close(a.settled)
+		a.settled = nil
+	}
+}
+
+// wait waits until the upstream acknowledged every op forwarded, or timeout.
+func (a *verboseAcks) wait(timeout time.Duration) bool {
+	a.mu.Lock()
+	if a.owed == 0 {
+		a.mu.Unlock()
+		return true
+	}
+	if a.settled == nil {
+		a.settled = make(chan struct{})
+	}
+	settled := a.settled
+	a.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-settled:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// ackErrors prefix the -ERRs the upstream sends in place of a +OK, for an op
+// it refuses. Others, e.g. 'Slow Consumer' or 'Stale Connection', are
+// asynchronous and acknowledge nothing.
+var ackErrors = [][]byte{
+	[]byte("'Permissions Violation"),
+	[]byte("'Invalid Subject"),
+	[]byte("'Invalid Publish Subject"),
+	[]byte("'Maximum Subscriptions Exceeded"),
+}
+
+// isAck reports whether an upstream line acknowledges an op of a verbose
+// client.
+func isAck(line []byte) bool {
+	if bytes.HasPrefix(line, []byte("+OK")) {
+		return true
+	}
+	msg, ok := bytes.CutPrefix(line, []byte("-ERR "))
+	if !ok {
+		return false
+	}
+	for _, prefix := range ackErrors {
+		if bytes.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPing reports whether a client line is a PING or PONG, which the upstream
+// doesn't acknowledge.
+func isPing(line []byte) bool {
+	return len(line) >= 4 && (bytes.EqualFold(line[:4], []byte("PING")) || bytes.EqualFold(line[:4], []byte("PONG")))
+}
+
+// setVerbose makes the client writer track the acknowledgments the upstream
+// owes the client.
+func (cw *clientWriter) setVerbose() {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.verbose = true
+}
+
+// forwarded counts an op of the current frame forwarded to the upstream.
+func (c *ClientMessageParser) forwarded() {
+	if c.verbose && c.clientWriter != nil {
+		c.clientWriter.acks.expect()
+	}
+}
+
+// replyInOrder writes a reply of the proxy's own to the current frame, once
+// the upstream acknowledged the ops forwarded before it if verbose. ack is
+// the +OK the upstream would have sent for the frame.
+func (c *ClientMessageParser) replyInOrder(frame []byte, ack bool) error {
+	if !c.verbose {
+		return c.clientWriter.WriteFrame(frame)
+	}
+	c.idle()
+	if !c.clientWriter.acks.wait(verboseAckTimeout) {
+		log.Debug().Str("user", c.user).Msg("Upstream acknowledgments of verbose client overdue")
+	}
+	c.work()
+	if ack {
+		frame = append([]byte("+OK\r\n"), frame...)
+	}
+	return c.clientWriter.WriteFrame(frame)
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+func TestClientMessageParser_PipelinedHandshake(t *testing.T) {
+	clock := newFakeClock()
+	bucket := ratelimit.NewBucketWithRateAndClock(1, 10000, clock)
+	tracker := newPendingTracker(1<<20, false)
+	mockRLM := &mockRateLimiterManager{bucket: bucket, pendingTracker: tracker}
+
+	// CONNECT, PUB and PING arrive in a single read: the user's limiter is
+	// bound before the PUB is charged, and the PUB and PING are pending
+	// until forwarded
+	input := "CONNECT {\"user\":\"alice\"}\r\nPUB foo 500\r\n" + strings.Repeat("x", 500) + "\r\nPING\r\n"
+	output := &pendingWriter{tracker: tracker}
+	parser := NewClientMessageParser(strings.NewReader(input), output, mockRLM)
+	parser.SetClock(clock)
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if output.String() != input {
+		t.Errorf("Output doesn't match input")
+	}
+	if charged := 10000 - bucket.Available(); charged != int64(len(input)) {
+		t.Errorf("Expected all %d bytes charged to alice, got %d", len(input), charged)
+	}
+	if pipelined := int64(len(input) - len("CONNECT {\"user\":\"alice\"}\r\n")); output.peak < pipelined {
+		t.Errorf("Expected the %d bytes behind the CONNECT pending, peaked at %d", pipelined, output.peak)
+	}
+	if pending := tracker.Pending(); pending != 0 {
+		t.Errorf("Expected nothing pending once forwarded, got %d", pending)
+	}
+}
+
+// pendingWriter records the peak of a pending tracker at each write.
+type pendingWriter struct {
+	bytes.Buffer
+	tracker *pendingTracker
+	peak    int64
+}
+
+func (w *pendingWriter) Write(p []byte) (int, error) {
+	w.peak = max(w.peak, w.tracker.Pending())
+	return w.Buffer.Write(p)
+}
+
+func TestIsAck(t *testing.T) {
+	tests := map[string]bool{
+		"+OK\r\n": true,
+		"-ERR 'Permissions Violation for Publish to \"x\"'\r\n": true,
+		"-ERR 'Invalid Subject'\r\n":                            true,
+		"-ERR 'Maximum Subscriptions Exceeded'\r\n":             true,
+		"-ERR 'Slow Consumer'\r\n":                              false,
+		"-ERR 'Stale Connection'\r\n":                           false,
+		"PONG\r\n":                                              false,
+	}
+	for line, expected := range tests {
+		if got := isAck([]byte(line)); got != expected {
+			t.Errorf("isAck(%q) = %t, expected %t", line, got, expected)
+		}
+	}
+}
+
+// ackingUpstream acknowledges each frame written to it, late, as a NATS
+// server does for a verbose client.
+type ackingUpstream struct {
+	frames chan []byte
+}
+
+func (u ackingUpstream) Write(p []byte) (int, error) {
+	u.frames <- bytes.Clone(p)
+	return len(p), nil
+}
+
+func TestClientMessageParser_VerboseOrdering(t *testing.T) {
+	var client bytes.Buffer
+	cw := newClientWriter(&client)
+	acks, upstream := io.Pipe()
+	go forwardDownstream(acks, cw)
+
+	u := ackingUpstream{frames: make(chan []byte, 8)}
+	go func() {
+		for frame := range u.frames {
+			if !isPing(frame) {
+				time.Sleep(20 * time.Millisecond)
+				upstream.Write([]byte("+OK\r\n"))
+			}
+		}
+	}()
+	defer close(u.frames)
+
+	input := "CONNECT {\"user\":\"alice\",\"verbose\":true}\r\n" +
+		"PUB orders 2\r\nok\r\n" +
+		"PUB secret.keys 2\r\nno\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), u, &mockRateLimiterManager{})
+	parser.SetClientWriter(cw)
+	parser.SetMiddleware([]FrameMiddleware{func(f Frame) (Frame, error) {
+		if strings.HasPrefix(f.Subject, "secret.") {
+			return f, errors.New("no secrets")
+		}
+		return f, nil
+	}})
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+
+	// The rejection follows the upstream's acknowledgments of the CONNECT
+	// and the PUB pipelined before it
+	cw.mu.Lock()
+	got := client.String()
+	cw.mu.Unlock()
+	expected := "+OK\r\n+OK\r\n-ERR 'Permissions Violation for Publish to \"secret.keys\"'\r\n"
+	if got != expected {
+		t.Errorf("Expected acknowledgments in order.\nExpected: %q\nGot: %q", expected, got)
+	}
+}
+
+func TestClientMessageParser_PreAuthBytes(t *testing.T) {
+	clock := newFakeClock()
+	bucket := ratelimit.NewBucketWithRateAndClock(1000, 1000, clock)
+	mockRLM := &mockRateLimiterManager{bucket: bucket}
+
+	// Frames ahead of the CONNECT are forwarded before any limiter is
+	// bound, and charged to the user once it is
+	early := "PING\r\nPUB foo 3000\r\n" + strings.Repeat("x", 3000) + "\r\n"
+	input := early + "CONNECT {\"user\":\"alice\"}\r\n"
+	var output bytes.Buffer
+	parser := NewClientMessageParser(strings.NewReader(input), &output, mockRLM)
+	parser.SetClock(clock)
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if output.String() != input {
+		t.Errorf("Output doesn't match input")
+	}
+	if slept := clock.Slept(); slept < 2*time.Second {
+		t.Errorf("Expected the %d bytes ahead of the CONNECT charged to alice, waited %v", len(early), slept)
+	}
+	if mockRLM.recorded[len(mockRLM.recorded)-2] != len(early) {
+		t.Errorf("Expected the bytes ahead of the CONNECT recorded for alice, got %v", mockRLM.recorded)
+	}
+}
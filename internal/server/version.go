@@ -0,0 +1,19 @@
+package server
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Version and Commit are set at build time via -ldflags, e.g.
+//
+//	go build -ldflags "-X nats-limiter-proxy/internal/server.Version=v1.0.0"
+var (
+	Version = "dev"
+	Commit  = "unknown"
+)
+
+// VersionString returns a human-readable version line for --version output.
+func VersionString() string {
+	return fmt.Sprintf("nats-limiter-proxy %s (commit %s, %s)", Version, Commit, runtime.Version())
+}
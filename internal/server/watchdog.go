@@ -0,0 +1,78 @@
+package server
+
+import (
+	"hash/crc32"
+	"io"
+
+	"github.com/rs/zerolog/log"
+)
+
+// orderingWatchdog checksums the bytes of one direction of a connection on
+// both sides of its writer: as the proxy hands complete frames to the writer,
+// and as the writer passes them on to the connection. Wherever everything
+// handed over must have been written, e.g. after a flush, the two checksums
+// must match; if they don't, bytes were reordered, interleaved with another
+// writer's, or corrupted between the proxy's flush boundaries. It costs a
+// checksum of every byte twice, so it's meant for debugging. A nil watchdog
+// checks nothing.
+type orderingWatchdog struct {
+	sent, written           uint32 // running CRC-32 of the bytes on each side
+	sentBytes, writtenBytes int64
+}
+
+// send records bytes handed to the writer.
+func (w *orderingWatchdog) send(p []byte) {
+	if w == nil {
+		return
+	}
+	w.sent = crc32.Update(w.sent, crc32.IEEETable, p)
+	w.sentBytes += int64(len(p))
+}
+
+// wrote records bytes the writer passed on.
+func (w *orderingWatchdog) wrote(p []byte) {
+	if w == nil {
+		return
+	}
+	w.written = crc32.Update(w.written, crc32.IEEETable, p)
+	w.writtenBytes += int64(len(p))
+}
+
+// check logs and counts a violation if the bytes written differ from those
+// sent. Callers check once every byte sent must have been written.
+func (w *orderingWatchdog) check(direction string) bool {
+	if w == nil || (w.sent == w.written && w.sentBytes == w.writtenBytes) {
+		return true
+	}
+	metricOrderingViolations.Add(1, direction)
+	log.Error().Str("direction", direction).
+		Int64("bytes_sent", w.sentBytes).Int64("bytes_written", w.writtenBytes).
+		Msg("Bytes reordered, interleaved or corrupted between flushes")
+	// Resynchronize so one violation isn't reported at every later check
+	w.written, w.writtenBytes = w.sent, w.sentBytes
+	return false
+}
+
+// watchdogWriter records the bytes it writes on a watchdog.
+type watchdogWriter struct {
+	w        io.Writer
+	watchdog *orderingWatchdog
+}
+
+func (ww watchdogWriter) Write(p []byte) (int, error) {
+	n, err := ww.w.Write(p)
+	ww.watchdog.wrote(p[:n])
+	return n, err
+}
+
+// watchdogReader records the bytes read from it as sent on a watchdog.
+type watchdogReader struct {
+	r        io.Reader
+	watchdog *orderingWatchdog
+}
+
+func (wr watchdogReader) Read(p []byte) (int, error) {
+	n, err := wr.r.Read(p)
+	wr.watchdog.send(p[:n])
+	return n, err
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestOrderingWatchdog_Check(t *testing.T) {
+	var w orderingWatchdog
+	w.send([]byte("PUB a 1\r\nx\r\n"))
+	w.send([]byte("PUB b 1\r\ny\r\n"))
+	w.wrote([]byte("PUB a 1\r\nx\r\nPUB b"))
+	w.wrote([]byte(" 1\r\ny\r\n"))
+	if !w.check("upstream") {
+		t.Error("Expected bytes written in order, in other chunks, to match")
+	}
+
+	before := metricOrderingViolations.Get("upstream")
+	w.send([]byte("PUB a 1\r\nx\r\n"))
+	w.send([]byte("PUB b 1\r\ny\r\n"))
+	w.wrote([]byte("PUB b 1\r\ny\r\n"))
+	w.wrote([]byte("PUB a 1\r\nx\r\n"))
+	if w.check("upstream") {
+		t.Error("Expected reordered frames detected")
+	}
+	if got := metricOrderingViolations.Get("upstream") - before; got != 1 {
+		t.Errorf("Expected 1 violation counted, got %d", got)
+	}
+	if !w.check("upstream") {
+		t.Error("Expected the watchdog resynchronized after a violation")
+	}
+
+	var off *orderingWatchdog
+	off.send([]byte("lost"))
+	if !off.check("upstream") {
+		t.Error("Expected a nil watchdog to check nothing")
+	}
+}
+
+func TestClientMessageParser_OrderingWatchdog(t *testing.T) {
+	var output, client bytes.Buffer
+	input := "CONNECT {\"user\":\"alice\"}\r\n" +
+		"SUB _INBOX.abc.* 7\r\n" +
+		"PUB $PROXY.USAGE _INBOX.abc.1 3\r\nhi!\r\n" +
+		"PUB big 5000\r\n" + strings.Repeat("x", 5000) + "\r\n" +
+		"HPUB h 12 14\r\nNATS/1.0\r\n\r\nhi\r\n"
+	parser := NewClientMessageParser(strings.NewReader(input), &output, &mockRateLimiterManager{})
+	cw := newClientWriter(&client)
+	cw.setOrderingWatchdog()
+	parser.HandleService("$PROXY.USAGE", func(string, []byte) []byte { return []byte("ok") }, cw)
+	parser.SetOrderingWatchdog()
+	parser.SetClock(newFakeClock())
+
+	before := metricOrderingViolations.Get("upstream")
+	if err := parser.ParseAndForward(); err != nil {
+		t.Fatalf("ParseAndForward failed: %v", err)
+	}
+	if parser.watchdog.sentBytes != int64(output.Len()) || !parser.watchdog.check("upstream") {
+		t.Errorf("Expected every flushed byte checked, got %+v for %d bytes", *parser.watchdog, output.Len())
+	}
+	if got := metricOrderingViolations.Get("upstream") - before; got != 0 {
+		t.Errorf("Expected no violations, got %d", got)
+	}
+
+	upstream := "MSG foo 1 5\r\nhello\r\nPING\r\nMSG bar 2 3000\r\n" + strings.Repeat("y", 3000) + "\r\n"
+	if err := forwardDownstream(strings.NewReader(upstream), cw); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+	if cw.watchdog.writtenBytes != int64(client.Len()) || !cw.watchdog.check("downstream") {
+		t.Errorf("Expected every forwarded and injected byte checked, got %+v for %d bytes", *cw.watchdog, client.Len())
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// alpnHTTP is the ALPN protocol WebSocket clients negotiate; NATS clients
+// negotiate none.
+const alpnHTTP = "http/1.1"
+
+// wsGUID is the key suffix hashed into Sec-WebSocket-Accept (RFC 6455).
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// maxControlPayload is the largest payload of a control frame.
+const maxControlPayload = 125
+
+var errWebSocketProtocol = errors.New("websocket protocol error")
+
+// acceptWebSocket completes a client's WebSocket upgrade, returning a
+// connection carrying the NATS protocol in binary frames.
+func acceptWebSocket(conn net.Conn, timeout time.Duration) (*wsConn, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, err
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != http.MethodGet || !headerHasToken(req.Header, "Connection", "upgrade") ||
+		!strings.EqualFold(req.Header.Get("Upgrade"), "websocket") ||
+		req.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
+		return nil, fmt.Errorf("not a websocket upgrade: %s %s", req.Method, req.URL)
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &wsConn{Conn: conn, br: br}, nil
+}
+
+// headerHasToken reports whether a comma-separated header contains token.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is a server-side WebSocket connection whose reads return the
+// payloads of the client's data frames and whose writes are sent as binary
+// frames. Control frames are answered as they're read.
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	// Read side, used by one reader at a time
+	remaining int64 // payload bytes left in the current data frame
+	mask      [4]byte
+	maskPos   int
+
+	wmu    sync.Mutex // serializes frames written
+	closed bool       // a close frame was sent, with wmu held
+}
+
+// NetConn returns the connection the WebSocket runs over.
+func (c *wsConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers up to the next data frame, answering the
+// control frames before it.
+func (c *wsConn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return err
+	}
+	opcode := hdr[0] & 0x0F
+	length := int64(hdr[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+	}
+	if hdr[1]&0x80 == 0 {
+		// Clients must mask their frames
+		return errWebSocketProtocol
+	}
+	if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+		return err
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case wsContinuation, wsText, wsBinary:
+		c.remaining = length
+		return nil
+	case wsPing, wsPong, wsClose:
+		if length > maxControlPayload {
+			return errWebSocketProtocol
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		switch opcode {
+		case wsPing:
+			return c.writeFrame(wsPong, payload)
+		case wsClose:
+			// Echo the status code, then end the stream
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsClose, payload)
+			return io.EOF
+		}
+		return nil
+	default:
+		return errWebSocketProtocol
+	}
+}
+
+func (c *wsConn) unmask(p []byte) {
+	for i := range p {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame sends a frame, unmasked as servers must.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = opcode == wsClose
+
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch n := len(payload); {
+	case n <= maxControlPayload:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close sends the client a normal closure, unless a close frame was already
+// sent, and closes the connection.
+func (c *wsConn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrame(wsClose, []byte{0x03, 0xE8}) // 1000, normal closure
+	return c.Conn.Close()
+}
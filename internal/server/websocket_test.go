@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeClientFrame writes a masked client frame.
+func writeClientFrame(t *testing.T, w io.Writer, opcode byte, payload []byte) {
+	t.Helper()
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, 0x80|byte(n))
+	default:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i&3])
+	}
+	if _, err := w.Write(frame); err != nil {
+		t.Fatalf("Writing frame failed: %v", err)
+	}
+}
+
+// readServerFrame reads an unmasked server frame.
+func readServerFrame(t *testing.T, r io.Reader) (byte, []byte) {
+	t.Helper()
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatalf("Reading frame failed: %v", err)
+	}
+	if hdr[1]&0x80 != 0 {
+		t.Fatal("Expected an unmasked server frame")
+	}
+	n := int(hdr[1] & 0x7F)
+	if n == 126 {
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("Reading frame payload failed: %v", err)
+	}
+	return hdr[0] & 0x0F, payload
+}
+
+func TestWSConn_Frames(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	ws := &wsConn{Conn: server, br: bufio.NewReader(server)}
+
+	large := strings.Repeat("x", 300)
+	go func() {
+		writeClientFrame(t, client, wsBinary, []byte("PUB foo 3\r\n"))
+		writeClientFrame(t, client, wsPing, []byte("hi"))
+		writeClientFrame(t, client, wsBinary, []byte(large))
+		writeClientFrame(t, client, wsClose, []byte{0x03, 0xE8})
+	}()
+	replies := make(chan []byte, 2)
+	go func() {
+		for range 2 {
+			opcode, payload := readServerFrame(t, client)
+			replies <- append([]byte{opcode}, payload...)
+		}
+	}()
+
+	data, err := io.ReadAll(ws)
+	if err != nil {
+		t.Fatalf("Reading failed: %v", err)
+	}
+	if string(data) != "PUB foo 3\r\n"+large {
+		t.Errorf("Expected the data frames' payloads, got %q", data)
+	}
+	if pong := <-replies; pong[0] != wsPong || string(pong[1:]) != "hi" {
+		t.Errorf("Expected a pong echoing the ping, got %v", pong)
+	}
+	if closing := <-replies; closing[0] != wsClose {
+		t.Errorf("Expected the close echoed, got %v", closing)
+	}
+	if _, err := ws.Write([]byte("MSG")); err == nil {
+		t.Error("Expected writes to fail once closed")
+	}
+}
+
+func TestProxy_WebSocketOverALPN(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "nats.example.com")
+	host, port, _ := net.SplitHostPort(startFakeNATS(t, "cluster-a").Addr())
+	config := filepath.Join(dir, "config.yaml")
+	os.WriteFile(config, []byte("tls:\n  cert: "+certFile+"\n  key: "+keyFile+"\n  websocket: true\n"), 0o644)
+	portNum, _ := net.LookupPort("tcp", port)
+	p, err := NewProxy(host, portNum, config)
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.HandleConnection(conn)
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	if err != nil {
+		t.Fatalf("TLS dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: nats.example.com\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Reading upgrade response failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Expected the upgrade accepted, got %s %v", resp.Status, resp.Header)
+	}
+
+	opcode, payload := readServerFrame(t, br)
+	if opcode != wsBinary || !strings.HasPrefix(string(payload), "INFO ") || !strings.Contains(string(payload), `"tls_required":true`) {
+		t.Errorf("Expected the upstream INFO in a binary frame, got opcode %d: %q", opcode, payload)
+	}
+}
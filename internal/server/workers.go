@@ -0,0 +1,66 @@
+package server
+
+import (
+	"io"
+	"time"
+)
+
+// parseWorkers bounds how many connections parse client data at once, and
+// so the CPU parsing takes. A connection's parser holds a worker only while
+// it parses buffered bytes, handing it back whenever it waits for the
+// client, its limits or the upstream, so a fixed number of workers serve
+// any number of connections. The time workers are busy is measured, for
+// throughput per core to be derived from the bytes parsed.
+type parseWorkers struct {
+	slots chan struct{}
+}
+
+func newParseWorkers(n int) *parseWorkers {
+	return &parseWorkers{slots: make(chan struct{}, n)}
+}
+
+// acquire waits for a free worker, returning when it started working.
+func (w *parseWorkers) acquire() time.Time {
+	start := time.Now()
+	w.slots <- struct{}{}
+	now := time.Now()
+	metricParseWaitSeconds.Add(int64(now.Sub(start)))
+	metricParseWorkersBusy.Add(1)
+	return now
+}
+
+// release frees a worker acquired at start.
+func (w *parseWorkers) release(start time.Time) {
+	metricParseBusySeconds.Add(int64(time.Since(start)))
+	metricParseWorkersBusy.Add(-1)
+	<-w.slots
+}
+
+// work acquires a parse worker for the connection, if it parses with one and
+// doesn't hold it already.
+func (c *ClientMessageParser) work() {
+	if c.workers != nil && c.workStart.IsZero() {
+		c.workStart = c.workers.acquire()
+	}
+}
+
+// idle releases the connection's parse worker, if it holds one.
+func (c *ClientMessageParser) idle() {
+	if c.workers != nil && !c.workStart.IsZero() {
+		c.workers.release(c.workStart)
+		c.workStart = time.Time{}
+	}
+}
+
+// workerReader reads from the client without holding a parse worker.
+type workerReader struct {
+	reader io.Reader
+	parser *ClientMessageParser
+}
+
+func (r workerReader) Read(p []byte) (int, error) {
+	r.parser.idle()
+	n, err := r.reader.Read(p)
+	r.parser.work()
+	return n, err
+}
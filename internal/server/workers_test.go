@@ -0,0 +1,58 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProxy_ParseWorkers(t *testing.T) {
+	p := newTestProxy(&Config{DefaultBandwidth: 1 << 20})
+	p.workers = newParseWorkers(1)
+	before := metricParseBusySeconds.Get()
+
+	// One worker serves both connections: neither holds it while it waits
+	// for its client
+	input := "CONNECT {\"user\":\"alice\"}\r\nPUB foo 5\r\nhello\r\n"
+	client1, upstream1, _ := pipeConnection(t, p)
+	client2, upstream2, _ := pipeConnection(t, p)
+	for range 3 {
+		go client1.Write([]byte(input))
+		go client2.Write([]byte(input))
+		if got := readString(t, upstream1, len(input)); got != input {
+			t.Fatalf("Unexpected upstream data.\nExpected: %q\nGot: %q", input, got)
+		}
+		if got := readString(t, upstream2, len(input)); got != input {
+			t.Fatalf("Unexpected upstream data.\nExpected: %q\nGot: %q", input, got)
+		}
+	}
+
+	if !eventually(func() bool { return len(p.workers.slots) == 0 }) {
+		t.Error("Expected the worker released by connections waiting for their client")
+	}
+	if metricParseBusySeconds.Get() == before {
+		t.Error("Expected the time workers were busy recorded")
+	}
+}
+
+func TestParseWorkers_Bound(t *testing.T) {
+	w := newParseWorkers(1)
+	start := w.acquire()
+
+	acquired := make(chan struct{})
+	go func() {
+		w.release(w.acquire())
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Expected the second acquire to wait for a free worker")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	w.release(start)
+	select {
+	case <-acquired:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the second acquire once the worker was released")
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// UpstreamSchedulerConfig configures bounding how many connections write to
+// the upstream at once, handing free slots to the limit classes waiting in
+// weighted round-robin. Traffic of a heavier class, e.g. premium users'
+// traffic routed to the control class by class_rules, then waits less for
+// the upstream than other traffic, on top of any rate it is allowed. Each
+// client still has its own upstream connection: the slots are the only
+// thing the connections contend for, there's no shared pool of sockets.
+type UpstreamSchedulerConfig struct {
+	// Slots is how many connections write to the upstream at once.
+	Slots int `yaml:"slots"`
+	// WriteTimeout bounds how long a write may hold its slot. A write to an
+	// upstream connection stalled for longer fails, ending the client's
+	// connection, so stalled connections can't hold every slot. Defaults to
+	// 10s.
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	// Weights of the limit classes ("bulk", "control" or "object"), the
+	// share of slots each gets while several wait. Unlisted classes weigh 1.
+	Weights map[string]int `yaml:"weights"`
+}
+
+// normalize validates the configuration.
+func (c *UpstreamSchedulerConfig) normalize() error {
+	if c.Slots <= 0 {
+		return fmt.Errorf("upstream_scheduler slots must be positive")
+	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("upstream_scheduler write_timeout must not be negative")
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = 10 * time.Second
+	}
+	for name, weight := range c.Weights {
+		if _, ok := limitClasses[name]; !ok {
+			return fmt.Errorf("invalid upstream_scheduler class %q", name)
+		}
+		if weight <= 0 {
+			return fmt.Errorf("upstream_scheduler weight of %s must be positive", name)
+		}
+	}
+	return nil
+}
+
+// classNames are the names of limit classes, as in the config.
+var classNames = [...]string{classBulk: "bulk", classControl: "control", classObject: "object"}
+
+// writeScheduler hands out upstream write slots, in smooth weighted
+// round-robin across the limit classes of the connections waiting for one.
+type writeScheduler struct {
+	timeout time.Duration // bound on a write in a slot
+
+	mu      sync.Mutex
+	free    int
+	weights [len(classNames)]int
+	current [len(classNames)]int             // round-robin state
+	queues  [len(classNames)][]chan struct{} // waiting writers, by class
+}
+
+func newWriteScheduler(cfg *UpstreamSchedulerConfig) *writeScheduler {
+	s := &writeScheduler{timeout: cfg.WriteTimeout, free: cfg.Slots}
+	for class, name := range classNames {
+		s.weights[class] = 1
+		if weight, ok := cfg.Weights[name]; ok {
+			s.weights[class] = weight
+		}
+	}
+	return s
+}
+
+// acquire waits for a write slot for traffic of class.
+func (s *writeScheduler) acquire(class limitClass) {
+	s.mu.Lock()
+	if s.free > 0 {
+		s.free--
+		s.mu.Unlock()
+		return
+	}
+	start := time.Now()
+	ready := make(chan struct{})
+	s.queues[class] = append(s.queues[class], ready)
+	s.mu.Unlock()
+	<-ready
+	metricUpstreamWriteWaitSeconds.Add(int64(time.Since(start)), classNames[class])
+}
+
+// release hands a write slot to the next waiting writer, or frees it.
+func (s *writeScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	class, ok := s.next()
+	if !ok {
+		s.free++
+		return
+	}
+	close(s.queues[class][0])
+	s.queues[class] = s.queues[class][1:]
+}
+
+// next picks the class whose writer is served next, of those waiting: each
+// gains its weight per pick and the pick loses the total, so classes are
+// picked in proportion to their weights, interleaved. Callers must hold mu.
+func (s *writeScheduler) next() (limitClass, bool) {
+	best, total := -1, 0
+	for class, queue := range s.queues {
+		if len(queue) == 0 {
+			continue
+		}
+		s.current[class] += s.weights[class]
+		total += s.weights[class]
+		if best < 0 || s.current[class] > s.current[best] {
+			best = class
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+	s.current[best] -= total
+	return limitClass(best), true
+}
+
+// scheduledWriter writes to the upstream in a slot of the scheduler.
+type scheduledWriter struct {
+	writer io.Writer
+	sched  *writeScheduler
+	class  *limitClass // of the frame being written, set by the parser
+}
+
+func (w scheduledWriter) Write(p []byte) (int, error) {
+	w.sched.acquire(*w.class)
+	defer w.sched.release()
+	if conn, ok := w.writer.(interface{ SetWriteDeadline(time.Time) error }); ok && w.sched.timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(w.sched.timeout))
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	return w.writer.Write(p)
+}
+
+// SetUpstreamScheduler writes to the upstream in slots of sched, scheduled
+// by the class of the frame written.
+func (c *ClientMessageParser) SetUpstreamScheduler(sched *writeScheduler) {
+	c.serverWriter.writer = scheduledWriter{c.serverWriter.writer, sched, &c.class}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWriteScheduler_WeightedRoundRobin(t *testing.T) {
+	s := newWriteScheduler(&UpstreamSchedulerConfig{Slots: 1, Weights: map[string]int{"control": 3}})
+	for range 8 {
+		s.queues[classBulk] = append(s.queues[classBulk], make(chan struct{}))
+		s.queues[classControl] = append(s.queues[classControl], make(chan struct{}))
+	}
+	var picks string
+	for range 8 {
+		class, _ := s.next()
+		picks += classNames[class][:1]
+	}
+	// 3 of 4 picks control, interleaved rather than in runs
+	if picks != "cbcccbcc" {
+		t.Errorf("Expected control picked 3 times as often, interleaved, got %s", picks)
+	}
+}
+
+func TestWriteScheduler_Slots(t *testing.T) {
+	s := newWriteScheduler(&UpstreamSchedulerConfig{Slots: 1, Weights: map[string]int{"control": 100}})
+	s.acquire(classBulk)
+
+	order := make(chan limitClass, 2)
+	for _, class := range []limitClass{classBulk, classControl} {
+		go func() {
+			s.acquire(class)
+			order <- class
+			s.release()
+		}()
+		// Queue the bulk writer first
+		time.Sleep(20 * time.Millisecond)
+	}
+	select {
+	case class := <-order:
+		t.Fatalf("Expected writers to wait for the slot, %s got one", classNames[class])
+	default:
+	}
+
+	s.release()
+	for _, expected := range []limitClass{classControl, classBulk} {
+		select {
+		case class := <-order:
+			if class != expected {
+				t.Errorf("Expected %s served next, got %s", classNames[expected], classNames[class])
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for a write slot")
+		}
+	}
+	acquired := make(chan struct{})
+	go func() {
+		s.acquire(classBulk)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the slot free again")
+	}
+}
+
+func TestScheduledWriter_WriteTimeout(t *testing.T) {
+	s := newWriteScheduler(&UpstreamSchedulerConfig{Slots: 1, WriteTimeout: 50 * time.Millisecond})
+	conn, stalled := net.Pipe()
+	defer stalled.Close()
+	u := newUpstreamConn(conn, func() (net.Conn, error) {
+		t.Error("Expected no reconnect to a stalled upstream")
+		return nil, errors.New("unexpected reconnect")
+	}, 1024)
+	defer u.Close()
+	connect := "CONNECT {}\r\n"
+	go io.ReadFull(stalled, make([]byte, len(connect)))
+	if _, err := u.Write([]byte(connect)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// The upstream never reads: the write fails, handing the slot back
+	class := classBulk
+	w := scheduledWriter{u, s, &class}
+	start := time.Now()
+	if _, err := w.Write([]byte("PUB foo 2\r\nok\r\n")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected the write to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the write bounded by the timeout, took %v", elapsed)
+	}
+	if s.free != 1 {
+		t.Errorf("Expected the slot freed, %d free", s.free)
+	}
+}
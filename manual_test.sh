@@ -1,6 +1,8 @@
 #!/bin/bash
 
 # Manual verification of rate limiting
+# Requires alice's creds from `make init` or `make creds`
+CREDS=${CREDS:-local/nsc/nkeys/creds/root/app/alice.creds}
 echo "Manual Rate Limiting Test"
 echo "========================"
 
@@ -15,7 +17,7 @@ START_TIME=$(date +%s.%N)
 
 for i in {1..10}; do
     echo -n "Message $i... "
-    if nats --server=localhost:4223 --creds=local/alice.creds pub "test.manual" "$MESSAGE" 2>/dev/null; then
+    if nats --server=localhost:4223 --creds="$CREDS" pub "test.manual" "$MESSAGE" 2>/dev/null; then
         echo "sent"
     else
         echo "failed"